@@ -18,6 +18,15 @@ var (
 
 // Cache is a cache of all connection status.
 type Cache struct {
+	// Slim causes the cache to store slim copies of the records (see ArchivalRecord.Slim),
+	// rather than the records themselves.  This reduces the memory footprint on hosts
+	// with many connections, but changes in attributes other than DIAG_INFO are no
+	// longer detected by Compare.
+	Slim bool
+	// CompareOptions are the options that the records will be compared with, so
+	// that slim copies keep the attributes they need.
+	CompareOptions netlink.CompareOptions
+
 	// Map from inode to ArchivalRecord
 	current  map[uint64]*netlink.ArchivalRecord // Cache of most recent messages.
 	previous map[uint64]*netlink.ArchivalRecord // Cache of previous round of messages.
@@ -38,6 +47,9 @@ func (c *Cache) Update(msg *netlink.ArchivalRecord) (*netlink.ArchivalRecord, er
 		return nil, err
 	}
 	cookie := idm.ID.Cookie()
+	if c.Slim {
+		msg = msg.Slim(c.CompareOptions)
+	}
 	c.current[cookie] = msg
 	evicted, ok := c.previous[cookie]
 	if ok {
@@ -3,10 +3,14 @@ package cache_test
 import (
 	"encoding/json"
 	"log"
+	"runtime"
 	"testing"
+	"unsafe"
 
 	"github.com/m-lab/tcp-info/cache"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 func init() {
@@ -20,7 +24,7 @@ func testFatal(t *testing.T, err error) {
 	}
 }
 
-func fakeMsg(t *testing.T, cookie uint64, dport uint16) netlink.ArchivalRecord {
+func fakeMsg(t testing.TB, cookie uint64, dport uint16) netlink.ArchivalRecord {
 	var json1 = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
 	nm := netlink.NetlinkMessage{}
 	err := json.Unmarshal([]byte(json1), &nm)
@@ -98,3 +102,94 @@ func TestUpdateWithBadData(t *testing.T) {
 		t.Error("Should have had an error")
 	}
 }
+
+func TestSlimCache(t *testing.T) {
+	c := cache.NewCache()
+	c.Slim = true
+	pm1 := fakeMsg(t, 0x1234, 1)
+	_, err := c.Update(&pm1)
+	testFatal(t, err)
+	c.EndCycle()
+
+	// An identical record should not be considered a change, even though the slim
+	// copy lacks the other attributes.
+	pm2 := fakeMsg(t, 0x1234, 1)
+	old, err := c.Update(&pm2)
+	testFatal(t, err)
+	if old == nil || old == &pm1 {
+		t.Fatal("Expected a slim copy of pm1, got", old)
+	}
+	if len(old.Attributes) != inetdiag.INET_DIAG_INFO+1 {
+		t.Error("Slim record should only have DIAG_INFO attributes", len(old.Attributes))
+	}
+	change, err := pm2.Compare(old)
+	testFatal(t, err)
+	if change != netlink.NoMajorChange {
+		t.Error("Expected NoMajorChange, got", change)
+	}
+	c.EndCycle()
+
+	// A change in DIAG_INFO should still be detected.
+	pm3 := fakeMsg(t, 0x1234, 1)
+	pm3.Attributes[inetdiag.INET_DIAG_INFO][unsafe.Offsetof(tcp.LinuxTCPInfo{}.PMTU)] = 123
+	old, err = c.Update(&pm3)
+	testFatal(t, err)
+	change, err = pm3.Compare(old)
+	testFatal(t, err)
+	if change != netlink.StateOrCounterChange {
+		t.Error("Expected StateOrCounterChange, got", change)
+	}
+
+	// The slim copy must not share memory with the original.
+	pm3.Attributes[inetdiag.INET_DIAG_INFO][0] = 99
+	leftover := c.EndCycle()
+	if len(leftover) != 0 {
+		t.Error("Should be empty", len(leftover))
+	}
+	leftover = c.EndCycle()
+	if ar := leftover[0x1234]; ar == nil || ar.Attributes[inetdiag.INET_DIAG_INFO][0] == 99 {
+		t.Error("Slim record should be an independent copy", ar)
+	}
+}
+
+// benchmarkRetained reports the heap memory retained by the cache per connection.
+func benchmarkRetained(b *testing.B, slim bool) {
+	const conns = 1000
+	template := fakeMsg(b, 1, 1)
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		c := cache.NewCache()
+		c.Slim = slim
+		for j := uint64(1); j <= conns; j++ {
+			// Give each record its own backing buffer, as the netlink messages would.
+			pm := netlink.ArchivalRecord{RawIDM: append(inetdiag.RawInetDiagMsg(nil), template.RawIDM...)}
+			pm.Attributes = make([][]byte, len(template.Attributes))
+			buf := make([]byte, 0, 4096)
+			for k, a := range template.Attributes {
+				if a != nil {
+					buf = append(buf, a...)
+					pm.Attributes[k] = buf[len(buf)-len(a):]
+				}
+			}
+			idm, _ := pm.RawIDM.Parse()
+			idm.ID.IDiagCookie[0], idm.ID.IDiagCookie[1] = byte(j), byte(j>>8)
+			c.Update(&pm)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(c)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N*conns), "retained-B/conn")
+}
+
+func BenchmarkCacheRetained(b *testing.B) {
+	benchmarkRetained(b, false)
+}
+
+func BenchmarkSlimCacheRetained(b *testing.B) {
+	benchmarkRetained(b, true)
+}
@@ -3,10 +3,19 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gocarina/gocsv"
 	"github.com/m-lab/go/rtx"
@@ -23,39 +32,340 @@ func init() {
 var (
 	// A variable to enable mocking for testing.
 	logFatal = log.Fatal
+
+	format  = flag.String("format", "csv", "Output format: csv, otel for OpenTelemetry JSONL log records, or influx for InfluxDB line protocol.")
+	columns = flag.String("columns", "", "Comma separated list of CSV columns to output, e.g. Timestamp,IDM.SockID.Cookie.  Empty means all columns.")
+	entry   = flag.String("entry", "", "For a tar input, the name of the single file to convert.  Empty means all files, with a Filename column.")
+	lengths = flag.Bool("debug-lengths", false, "Instead of converting, print the payload length of each attribute of each snapshot, e.g. to find attributes that are larger than expected.")
 )
 
 func toCSV(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
 	return gocsv.Marshal(snapshots, wtr)
 }
 
-// openFile either opens a file, or opens and unzips a file that ends with .zst
-func openFile(fn string) (io.ReadCloser, error) {
-	if strings.HasSuffix(fn, ".zst") {
-		return zstd.NewReader(fn), nil
+// toCSVColumns writes only the named CSV columns, in the order given.  It
+// returns an error, without writing anything, if any name is not a column.
+func toCSVColumns(snapshots []*snapshot.Snapshot, wtr io.Writer, names []string) error {
+	buf := bytes.NewBuffer(nil)
+	if err := gocsv.Marshal(snapshots, buf); err != nil {
+		return err
+	}
+	rdr := csv.NewReader(buf)
+	header, err := rdr.Read()
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[name] = i
+	}
+	selected := make([]int, len(names))
+	for i, name := range names {
+		col, ok := index[name]
+		if !ok {
+			return fmt.Errorf("unknown CSV column %q", name)
+		}
+		selected[i] = col
+	}
+
+	out := csv.NewWriter(wtr)
+	row := make([]string, len(selected))
+	for record := header; record != nil; {
+		for i, col := range selected {
+			row[i] = record[col]
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+		record, err = rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// toOTel writes one OpenTelemetry log record per line for each snapshot that
+// contains connection data.
+func toOTel(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	enc := json.NewEncoder(wtr)
+	for _, snap := range snapshots {
+		if snap.InetDiagMsg == nil {
+			continue // Metadata only.
+		}
+		if err := enc.Encode(snap.OTelLogRecord()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toInflux writes the snapshots that contain TCPInfo as InfluxDB line protocol.
+func toInflux(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	for _, snap := range snapshots {
+		if err := snap.WriteLineProtocol(wtr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toLengths writes a line for each snapshot that contains connection data, with
+// its timestamp, cookie, and the payload length of each attribute, recorded
+// when snapshot.DecodeOptions.RecordAttributeLengths is set.
+func toLengths(snapshots []*snapshot.Snapshot, wtr io.Writer) error {
+	names := netlink.AttributeNames()
+	for _, snap := range snapshots {
+		if snap.InetDiagMsg == nil {
+			continue // Metadata only.
+		}
+		types := make([]int, 0, len(snap.AttributeLengths))
+		for t := range snap.AttributeLengths {
+			types = append(types, t)
+		}
+		sort.Ints(types)
+		line := fmt.Sprintf("%s %X", snap.Timestamp.Format(time.RFC3339Nano), snap.InetDiagMsg.ID.Cookie())
+		for _, t := range types {
+			name, ok := names[t]
+			if !ok {
+				name = fmt.Sprint(t)
+			}
+			line += fmt.Sprintf(" %s=%d", name, snap.AttributeLengths[t])
+		}
+		if _, err := fmt.Fprintln(wtr, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validReader skips, and counts, the records that fail ArchivalRecord.Validate.
+type validReader struct {
+	rdr     netlink.ArchiveReader
+	skipped int
+}
+
+func (v *validReader) Next() (*netlink.ArchivalRecord, error) {
+	for {
+		ar, err := v.rdr.Next()
+		if err != nil || ar.Validate() == nil {
+			return ar, err
+		}
+		v.skipped++
+	}
+}
+
+// loadSnapshots reads the snapshots from the JSONL read from src, skipping any
+// invalid records, and logging how many were skipped from name.
+func loadSnapshots(src io.Reader, name string) ([]*snapshot.Snapshot, error) {
+	rdr := &validReader{rdr: netlink.NewArchiveReader(src)}
+	// Ignore the metadata for now.
+	_, snaps, err := snapshot.LoadAllWith(rdr, snapshot.DecodeOptions{RecordAttributeLengths: *lengths})
+	if rdr.skipped > 0 {
+		log.Printf("Skipped %d invalid records in %s", rdr.skipped, name)
+	}
+	return snaps, err
+}
+
+// isTar returns whether fn names a tar archive, optionally gzip compressed.
+func isTar(fn string) bool {
+	return strings.HasSuffix(fn, ".tar") || strings.HasSuffix(fn, ".tar.gz") || strings.HasSuffix(fn, ".tgz")
+}
+
+// forEachTarEntry calls f with the snapshots from each .jsonl or .jsonl.zst file
+// in the tar archive read from rdr, one file at a time.  If name is not empty,
+// only the file with that name is read, and it is an error if there is none.
+func forEachTarEntry(rdr io.Reader, name string, f func(name string, snaps []*snapshot.Snapshot) error) error {
+	tr := tar.NewReader(rdr)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || (name != "" && hdr.Name != name) {
+			continue
+		}
+		var src io.Reader = tr
+		switch {
+		case strings.HasSuffix(hdr.Name, ".jsonl.zst"):
+			zr, err := zstd.NewStreamReader(tr)
+			if err != nil {
+				return err
+			}
+			src = zr
+		case strings.HasSuffix(hdr.Name, ".jsonl"):
+		default:
+			if name == "" {
+				continue // Not a connection file.
+			}
+			return fmt.Errorf("tar entry %q is not a .jsonl or .jsonl.zst file", name)
+		}
+		snaps, err := loadSnapshots(src, hdr.Name)
+		if c, ok := src.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("tar entry %q: %w", hdr.Name, err)
+		}
+		if err := f(hdr.Name, snaps); err != nil {
+			return err
+		}
+		found = true
+		if name != "" {
+			break
+		}
+	}
+	if name != "" && !found {
+		return fmt.Errorf("tar entry %q not found", name)
+	}
+	return nil
+}
+
+// filenameCSVWriter combines the CSV for several files, with a leading Filename
+// column, and a single header row.
+type filenameCSVWriter struct {
+	out    *csv.Writer
+	names  []string
+	header bool
+}
+
+func (w *filenameCSVWriter) write(filename string, snaps []*snapshot.Snapshot) error {
+	buf := bytes.NewBuffer(nil)
+	if err := writeCSV(snaps, buf, w.names); err != nil {
+		return err
+	}
+	rdr := csv.NewReader(buf)
+	header, err := rdr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !w.header {
+		if err := w.out.Write(append([]string{"Filename"}, header...)); err != nil {
+			return err
+		}
+		w.header = true
+	}
+	for {
+		record, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.out.Write(append([]string{filename}, record...)); err != nil {
+			return err
+		}
+	}
+	w.out.Flush()
+	return w.out.Error()
+}
+
+// writeCSV writes the snapshots as CSV, with only the named columns if names is
+// not empty.
+func writeCSV(snaps []*snapshot.Snapshot, wtr io.Writer, names []string) error {
+	if len(names) > 0 {
+		return toCSVColumns(snaps, wtr, names)
+	}
+	return toCSV(snaps, wtr)
+}
+
+// convert writes the snapshots in the requested format.
+func convert(snaps []*snapshot.Snapshot, wtr io.Writer, format string, names []string) error {
+	switch format {
+	case "csv":
+		return writeCSV(snaps, wtr, names)
+	case "otel":
+		return toOTel(snaps, wtr)
+	case "influx":
+		return toInflux(snaps, wtr)
+	case "lengths":
+		return toLengths(snaps, wtr)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
 	}
-	return os.Open(fn)
+}
+
+// convertTar converts the connection files in a tar archive read from rdr.  If
+// entry is empty, CSV output combines all the files, with a Filename column.
+func convertTar(rdr io.Reader, wtr io.Writer, entry string, format string, names []string) error {
+	if format == "csv" && entry == "" {
+		w := &filenameCSVWriter{out: csv.NewWriter(wtr), names: names}
+		return forEachTarEntry(rdr, "", w.write)
+	}
+	return forEachTarEntry(rdr, entry, func(_ string, snaps []*snapshot.Snapshot) error {
+		return convert(snaps, wtr, format, names)
+	})
+}
+
+// openTar opens a tar archive, decompressing it if the name ends with .gz or .tgz.
+func openTar(fn string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(fn, ".gz") && !strings.HasSuffix(fn, ".tgz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
 }
 
 // TODO handle gs: filenames.
-// TODO filter a single file from a tar file.
 func main() {
-	args := os.Args[1:]
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) > 1 {
+		logFatal("Too many command-line arguments.")
+		return
+	}
+	var names []string
+	if *columns != "" {
+		names = strings.Split(*columns, ",")
+	}
+	if *lengths {
+		*format = "lengths"
+	}
+
+	if len(args) == 1 && isTar(args[0]) {
+		source, err := openTar(args[0])
+		rtx.Must(err, "Could not open tar file %q", args[0])
+		defer source.Close()
+		rtx.Must(convertTar(source, os.Stdout, *entry, *format, names), "Could not convert %q", args[0])
+		return
+	}
 
 	var source io.ReadCloser
 	var err error
 	source = os.Stdin
+	name := "stdin"
 	if len(args) == 1 {
-		source, err = openFile(args[0])
+		source, err = zstd.Open(args[0])
 		rtx.Must(err, "Could not open file %q", args[0])
-	} else if len(args) > 1 {
-		logFatal("Too many command-line arguments.")
+		name = args[0]
 	}
 	defer source.Close()
 
-	arReader := netlink.NewArchiveReader(source)
-	// Ignore the metadata for now.
-	_, snaps, err := snapshot.LoadAll(arReader)
+	snaps, err := loadSnapshots(source, name)
 	rtx.Must(err, "Could not read snapshots")
-	rtx.Must(toCSV(snaps, os.Stdout), "Could not convert input to CSV")
+	rtx.Must(convert(snaps, os.Stdout, *format, names), "Could not convert input")
 }
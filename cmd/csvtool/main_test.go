@@ -1,7 +1,10 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
@@ -9,8 +12,10 @@ import (
 	"testing"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 func TestMainTooManyArgs(t *testing.T) {
@@ -49,7 +54,7 @@ func TestOpenFile(t *testing.T) {
 	rtx.Must(err, "Could not make tempdir")
 	defer os.RemoveAll(dir)
 	rtx.Must(ioutil.WriteFile(dir+"/test.txt", []byte("abcd"), 0666), "Could not write test.txt")
-	r, err := openFile(dir + "/test.txt")
+	r, err := zstd.Open(dir + "/test.txt")
 	rtx.Must(err, "Could not open file")
 	b, err := ioutil.ReadAll(r)
 	rtx.Must(err, "Could not read file")
@@ -58,8 +63,33 @@ func TestOpenFile(t *testing.T) {
 	}
 }
 
+// The CSV columns are checked in, one per line, so that any change in their
+// order, which breaks positional consumers, is deliberate.  New columns should
+// be added at the end.
+func TestCSVHeader(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/header.txt")
+	rtx.Must(err, "Could not read golden header")
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(toCSV(snaps, buf), "Could not convert to CSV")
+
+	header := strings.Split(strings.SplitN(buf.String(), "\n", 2)[0], ",")
+	want := strings.Split(strings.TrimSpace(string(golden)), "\n")
+	if len(header) != len(want) {
+		t.Errorf("CSV has %d columns, want %d", len(header), len(want))
+	}
+	for i := 0; i < len(header) && i < len(want); i++ {
+		if header[i] != want[i] {
+			t.Errorf("Column %d is %q, want %q", i, header[i], want[i])
+		}
+	}
+}
+
 func TestFileToCSV(t *testing.T) {
-	src, err := openFile("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
 	rtx.Must(err, "Could not open file")
 	buf := bytes.NewBuffer(nil)
 	_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
@@ -101,4 +131,234 @@ func TestFileToCSV(t *testing.T) {
 	if record[12] != "3E8" {
 		t.Error(record[12])
 	}
+	// The state is also written by name.
+	for i, name := range header {
+		if name == "IDM.StateName" && (record[4] != "1" || record[i] != "ESTABLISHED") {
+			t.Error("Wrong state", record[4], record[i])
+		}
+	}
+	// The test data was collected without CAP_NET_ADMIN, so there is no mark.
+	for i, name := range header {
+		if name == "MarkPresent" && record[i] != "false" {
+			t.Error("MarkPresent should be false, not", record[i])
+		}
+	}
+	// Options 7 is timestamps, SACK and window scaling.
+	found := 0
+	for i, name := range header {
+		want := ""
+		switch name {
+		case "TCP.Options":
+			want = "7"
+		case "TCP.Options.Timestamps", "TCP.Options.SACK", "TCP.Options.WScale":
+			want = "true"
+		case "TCP.Options.ECN", "TCP.Options.ECNSeen", "TCP.Options.FastOpen":
+			want = "false"
+		default:
+			continue
+		}
+		found++
+		if record[i] != want {
+			t.Errorf("%s = %q, want %q", name, record[i], want)
+		}
+	}
+	if found != 7 {
+		t.Error("Expected 7 TCP.Options columns, found", found)
+	}
+}
+
+func TestFileToOTel(t *testing.T) {
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	buf := bytes.NewBuffer(nil)
+	_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	rtx.Must(toOTel(snaps, buf), "Conversion problem")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// The header record contains only Metadata, and is skipped.
+	if len(lines) != 150 {
+		t.Errorf("Wrong number of records %d", len(lines))
+	}
+	if !strings.Contains(lines[0], `{"key":"IDM.SockID.Cookie","value":{"stringValue":"3E8"}}`) {
+		t.Error("Missing cookie attribute:", lines[0])
+	}
+}
+
+func TestFileToInflux(t *testing.T) {
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	buf := bytes.NewBuffer(nil)
+	_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	rtx.Must(convert(snaps, buf, "influx", nil), "Conversion problem")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// The header record contains only Metadata, and is skipped.
+	if len(lines) != 150 {
+		t.Errorf("Wrong number of lines %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], "tcp_info,IDM.SockID.Cookie=3E8,") || !strings.HasSuffix(lines[0], " 1554214357511000000") {
+		t.Error("Wrong line:", lines[0])
+	}
+}
+
+func TestFileToLengths(t *testing.T) {
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	opts := snapshot.DecodeOptions{RecordAttributeLengths: true}
+	_, snaps, err := snapshot.LoadAllWith(netlink.NewArchiveReader(src), opts)
+	rtx.Must(err, "Could not read test data")
+
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(toLengths(snaps, buf), "Conversion problem")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	// The header record contains only Metadata, and is skipped.
+	if len(lines) != 150 {
+		t.Errorf("Wrong number of lines %d", len(lines))
+	}
+	want := "2019-04-02T14:12:37.511Z 3E8 MemInfo=16 TCPInfo=224 Congestion=6 TOS=1 TClass=1 SKMemInfo=36 Shutdown=1"
+	if lines[0] != want {
+		t.Errorf("Got %q, want %q", lines[0], want)
+	}
+}
+
+func TestFileToCSVColumns(t *testing.T) {
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	_, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(toCSVColumns(snaps, buf, []string{"IDM.SockID.Cookie", "Timestamp", "TCP.RTT"}), "Conversion problem")
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 153 {
+		t.Errorf("Wrong number of lines %d", len(lines))
+	}
+	if lines[0] != "IDM.SockID.Cookie,Timestamp,TCP.RTT" {
+		t.Error("Incorrect header", lines[0])
+	}
+	record := strings.Split(lines[2], ",")
+	if len(record) != 3 || record[0] != "3E8" {
+		t.Error("Incorrect record", lines[2])
+	}
+
+	buf.Reset()
+	err = toCSVColumns(snaps, buf, []string{"Timestamp", "NoSuchColumn"})
+	if err == nil || !strings.Contains(err.Error(), "NoSuchColumn") {
+		t.Error("Expected an error naming the unknown column, got", err)
+	}
+	if buf.Len() != 0 {
+		t.Error("Nothing should be written on error:", buf.String())
+	}
+}
+
+// makeTar returns a gzipped tar archive containing the test data twice, once
+// compressed and once not, and a file that is not a connection file.
+func makeTar(t *testing.T) []byte {
+	zst, err := ioutil.ReadFile("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not read test data")
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	jsonl, err := ioutil.ReadAll(src)
+	rtx.Must(err, "Could not read test data")
+
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"2019/04/01/a.jsonl.zst", zst},
+		{"2019/04/01/README.txt", []byte("not a connection")},
+		{"2019/04/01/b.jsonl", jsonl},
+	} {
+		rtx.Must(tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data))}), "Could not write header")
+		_, err := tw.Write(f.data)
+		rtx.Must(err, "Could not write %q", f.name)
+	}
+	rtx.Must(tw.Close(), "Could not close tar")
+	rtx.Must(gz.Close(), "Could not close gzip")
+	return buf.Bytes()
+}
+
+func TestConvertTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConvertTar")
+	rtx.Must(err, "Could not make tempdir")
+	defer os.RemoveAll(dir)
+	fn := dir + "/test.tar.gz"
+	rtx.Must(ioutil.WriteFile(fn, makeTar(t), 0666), "Could not write tar")
+	if !isTar(fn) || isTar(dir+"/test.jsonl.zst") {
+		t.Error("isTar is wrong")
+	}
+
+	// All the connection files, with a Filename column.
+	src, err := openTar(fn)
+	rtx.Must(err, "Could not open tar")
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(convertTar(src, buf, "", "csv", []string{"IDM.SockID.Cookie", "TCP.RTT"}), "Could not convert tar")
+	src.Close()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1+2*151 {
+		t.Errorf("Wrong number of lines %d", len(lines))
+	}
+	if lines[0] != "Filename,IDM.SockID.Cookie,TCP.RTT" {
+		t.Error("Incorrect header", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], "2019/04/01/a.jsonl.zst,3E8,") ||
+		!strings.HasPrefix(lines[len(lines)-1], "2019/04/01/b.jsonl,3E8,") {
+		t.Error("Incorrect records", lines[2], lines[len(lines)-1])
+	}
+
+	// A single entry, without the Filename column.
+	src, err = openTar(fn)
+	rtx.Must(err, "Could not open tar")
+	buf.Reset()
+	rtx.Must(convertTar(src, buf, "2019/04/01/b.jsonl", "csv", nil), "Could not convert tar entry")
+	src.Close()
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 152 || strings.HasPrefix(lines[0], "Filename") {
+		t.Errorf("Wrong output for a single entry: %d lines, header %q", len(lines), lines[0])
+	}
+
+	for _, name := range []string{"no/such/file.jsonl", "2019/04/01/README.txt"} {
+		src, err = openTar(fn)
+		rtx.Must(err, "Could not open tar")
+		err = convertTar(src, ioutil.Discard, name, "csv", nil)
+		src.Close()
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("convertTar(%q) should fail, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadSnapshotsSkipsInvalid(t *testing.T) {
+	src, err := zstd.Open("testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst")
+	rtx.Must(err, "Could not open file")
+	records, err := netlink.LoadAllArchivalRecords(src)
+	rtx.Must(err, "Could not read test data")
+
+	// Follow each valid record with one that has an unknown address family.
+	buf := bytes.NewBuffer(nil)
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		rtx.Must(err, "Could not marshal record")
+		buf.Write(append(b, '\n'))
+		if r.RawIDM != nil {
+			bad := *r
+			bad.RawIDM = append(inetdiag.RawInetDiagMsg(nil), r.RawIDM...)
+			bad.RawIDM[0] = 0 // IDiagFamily
+			b, err := json.Marshal(&bad)
+			rtx.Must(err, "Could not marshal record")
+			buf.Write(append(b, '\n'))
+		}
+	}
+	snaps, err := loadSnapshots(buf, "test")
+	rtx.Must(err, "Could not load snapshots")
+	if len(snaps) != len(records) {
+		t.Errorf("loadSnapshots() returned %d snapshots, want %d", len(snaps), len(records))
+	}
 }
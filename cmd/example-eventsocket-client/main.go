@@ -45,11 +45,18 @@ func (h *handler) Open(ctx context.Context, timestamp time.Time, uuid string, id
 	}
 }
 
-// Close is called by tcp-info synchronously for every TCP close event.
+// Close is called by tcp-info synchronously for every TCP close event, unless
+// the handler implements eventsocket.CloseWithIDHandler, as this one does.
 func (h *handler) Close(ctx context.Context, timestamp time.Time, uuid string) {
 	log.Println("close", uuid, timestamp)
 }
 
+// CloseWithID is called instead of Close, with the flow's SockID if tcp-info
+// knows it.
+func (h *handler) CloseWithID(ctx context.Context, timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	log.Println("close", uuid, timestamp, id)
+}
+
 // ProcessOpenEvents reads and processes events received by the open handler.
 func (h *handler) ProcessOpenEvents(ctx context.Context) {
 	for {
@@ -69,8 +76,8 @@ func main() {
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "could not get args from environment variables")
 
-	if *eventsocket.Filename == "" {
-		log.Fatal("-tcpinfo.eventsocket path is required")
+	if *eventsocket.Filename == "" && *eventsocket.Address == "" {
+		log.Fatal("-tcpinfo.eventsocket path or -tcpinfo.eventsocket-tcp address is required")
 	}
 
 	h := &handler{events: make(chan event)}
@@ -81,7 +88,11 @@ func main() {
 
 	// Begin listening on the eventsocket for new events, and dispatch them to
 	// the given handler.
-	go eventsocket.MustRun(mainCtx, *eventsocket.Filename, h)
+	if *eventsocket.Filename != "" {
+		go eventsocket.MustRun(mainCtx, *eventsocket.Filename, h)
+	} else {
+		go eventsocket.MustRunTCP(mainCtx, *eventsocket.Address, h)
+	}
 
 	<-mainCtx.Done()
 }
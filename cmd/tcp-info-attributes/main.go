@@ -0,0 +1,43 @@
+// Main package in tcp-info-attributes implements a command line tool that lists
+// the INET_DIAG attribute types, and whether tcp-info decodes them.
+// See cmd/tcp-info-attributes/README.md for more information.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/snapshot"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+// writeTable writes the number, name and decode status of each attribute type.
+func writeTable(wtr io.Writer) error {
+	attrs := snapshot.SupportedAttributes()
+	types := make([]int, 0, len(attrs))
+	for t := range attrs {
+		types = append(types, t)
+	}
+	sort.Ints(types)
+
+	tw := tabwriter.NewWriter(wtr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Number\tName\tDecoded")
+	for _, t := range types {
+		fmt.Fprintf(tw, "%d\t%s\t%v\n", t, inetdiag.InetDiagType[int32(t)], attrs[t])
+	}
+	return tw.Flush()
+}
+
+func main() {
+	rtx.Must(writeTable(os.Stdout), "Could not write table")
+}
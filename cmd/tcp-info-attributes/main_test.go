@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestWriteTable(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(writeTable(buf), "Could not write table")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 19 {
+		t.Errorf("Wrong number of lines %d:\n%s", len(lines), buf.String())
+	}
+	for _, want := range []string{"Number  Name", "2       TCPInfo     true", "12      Locals      false", "18      MD5Sig      false"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Table missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestMain(t *testing.T) {
+	// Nothing crashes.
+	main()
+}
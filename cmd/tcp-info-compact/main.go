@@ -0,0 +1,116 @@
+// Main package in tcp-info-compact implements a command line tool for removing
+// redundant snapshots from existing ArchiveRecord files.
+// See cmd/tcp-info-compact/README.md for more information.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// compact returns the records that differ significantly, according to Compare,
+// from the last record kept for the same connection.  Comparing with the last
+// kept record, rather than the previous record, ensures that a series of small
+// changes is not lost.  Metadata records, and records that cannot be parsed,
+// are always kept.
+func compact(records []*netlink.ArchivalRecord) []*netlink.ArchivalRecord {
+	kept := make([]*netlink.ArchivalRecord, 0, len(records))
+	last := make(map[uint64]*netlink.ArchivalRecord)
+	for _, r := range records {
+		if r.Metadata != nil || r.RawIDM == nil {
+			kept = append(kept, r)
+			continue
+		}
+		idm, err := r.RawIDM.Parse()
+		if err != nil {
+			kept = append(kept, r)
+			continue
+		}
+		cookie := idm.ID.Cookie()
+		prev, ok := last[cookie]
+		if ok {
+			change, err := r.Compare(prev)
+			if err == nil && change == netlink.NoMajorChange {
+				continue
+			}
+		}
+		last[cookie] = r
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// write writes the records as JSONL.
+func write(records []*netlink.ArchivalRecord, wtr io.Writer) error {
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := wtr.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createFile either creates a file, or creates a zstd compressed file if the
+// name ends with .zst
+func createFile(fn string) (io.WriteCloser, error) {
+	if strings.HasSuffix(fn, ".zst") {
+		return zstd.NewWriter(fn)
+	}
+	return os.Create(fn)
+}
+
+func fileSize(fn string) int64 {
+	info, err := os.Stat(fn)
+	rtx.Must(err, "Could not stat %q", fn)
+	return info.Size()
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 2 {
+		logFatal("Usage: tcp-info-compact <input> <output>")
+		return
+	}
+	in, out := args[0], args[1]
+
+	source, err := zstd.Open(in)
+	rtx.Must(err, "Could not open file %q", in)
+	records, err := netlink.LoadAllArchivalRecords(source)
+	source.Close()
+	rtx.Must(err, "Could not read records from %q", in)
+
+	kept := compact(records)
+
+	dest, err := createFile(out)
+	rtx.Must(err, "Could not create file %q", out)
+	rtx.Must(write(kept, dest), "Could not write records to %q", out)
+	rtx.Must(dest.Close(), "Could not close %q", out)
+
+	inSize, outSize := fileSize(in), fileSize(out)
+	fmt.Printf("Records: %d -> %d\nBytes: %d -> %d (saved %d)\n",
+		len(records), len(kept), inSize, outSize, inSize-outSize)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func loadTestRecords(t *testing.T, fn string) []*netlink.ArchivalRecord {
+	src, err := zstd.Open(fn)
+	rtx.Must(err, "Could not open file")
+	defer src.Close()
+	records, err := netlink.LoadAllArchivalRecords(src)
+	rtx.Must(err, "Could not read test data")
+	return records
+}
+
+// withState returns a copy of r, with the given TCP state and timestamp.
+func withState(r *netlink.ArchivalRecord, state tcp.State, ts time.Time) *netlink.ArchivalRecord {
+	c := *r
+	c.Timestamp = ts
+	c.RawIDM = append(inetdiag.RawInetDiagMsg(nil), r.RawIDM...)
+	idm, err := c.RawIDM.Parse()
+	rtx.Must(err, "Could not parse RawIDM")
+	idm.IDiagState = uint8(state)
+	return &c
+}
+
+func states(records []*netlink.ArchivalRecord) []tcp.State {
+	var s []tcp.State
+	for _, r := range records {
+		if r.RawIDM == nil {
+			continue
+		}
+		idm, err := r.RawIDM.Parse()
+		rtx.Must(err, "Could not parse RawIDM")
+		state := tcp.State(idm.IDiagState)
+		if len(s) == 0 || s[len(s)-1] != state {
+			s = append(s, state)
+		}
+	}
+	return s
+}
+
+func TestCompact(t *testing.T) {
+	records := loadTestRecords(t, testFile)
+	if records[0].Metadata == nil {
+		t.Fatal("Test data should start with a metadata record")
+	}
+
+	// This file was written with an older, more sensitive, Compare.
+	n := len(compact(records))
+	if n != 37 {
+		t.Errorf("compact() kept %d of %d records, want 37", n, len(records))
+	}
+
+	// Duplicate each snapshot, and follow the last one with a state change, and
+	// a duplicate of that.
+	ts := records[len(records)-1].Timestamp
+	dup := []*netlink.ArchivalRecord{records[0]}
+	for _, r := range records[1:] {
+		dup = append(dup, r, withState(r, tcp.ESTABLISHED, r.Timestamp.Add(time.Millisecond)))
+	}
+	last := records[len(records)-1]
+	dup = append(dup,
+		withState(last, tcp.FIN_WAIT1, ts.Add(time.Second)),
+		withState(last, tcp.FIN_WAIT1, ts.Add(2*time.Second)),
+		withState(last, tcp.CLOSE_WAIT, ts.Add(3*time.Second)))
+
+	got := compact(dup)
+	if len(got) != n+2 {
+		t.Errorf("compact() kept %d of %d records, want %d", len(got), len(dup), n+2)
+	}
+	if got[0].Metadata == nil {
+		t.Error("compact() dropped the metadata record")
+	}
+	want := []tcp.State{tcp.ESTABLISHED, tcp.FIN_WAIT1, tcp.CLOSE_WAIT}
+	if s := states(got); len(s) != len(want) || s[0] != want[0] || s[1] != want[1] || s[2] != want[2] {
+		t.Errorf("States after compact() = %v, want %v", s, want)
+	}
+}
+
+func TestMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info-compact")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	// Write a file with redundant records.
+	records := loadTestRecords(t, testFile)
+	var dup []*netlink.ArchivalRecord
+	for _, r := range records {
+		dup = append(dup, r)
+		if r.Metadata == nil {
+			dup = append(dup, withState(r, tcp.ESTABLISHED, r.Timestamp))
+		}
+	}
+	in := filepath.Join(dir, "in.jsonl.zst")
+	out := filepath.Join(dir, "out.jsonl.zst")
+	w, err := createFile(in)
+	rtx.Must(err, "Could not create input")
+	rtx.Must(write(dup, w), "Could not write input")
+	rtx.Must(w.Close(), "Could not close input")
+
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+	os.Args = []string{"test_tcp-info-compact", in, out}
+	main()
+
+	got := loadTestRecords(t, out)
+	if want := len(compact(records)); len(got) != want {
+		t.Errorf("Output has %d records, want %d", len(got), want)
+	}
+	if fileSize(out) >= fileSize(in) {
+		t.Error("Output is not smaller", fileSize(out), fileSize(in))
+	}
+}
+
+func TestMainWrongArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_tcp-info-compact", "file1"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
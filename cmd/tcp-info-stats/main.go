@@ -0,0 +1,132 @@
+// Main package in tcp-info-stats implements a command line tool for summarizing the
+// connections in ArchiveRecord files.
+// See cmd/tcp-info-stats/README.md for more information.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+var (
+	// A variable to enable mocking for testing.
+	logFatal = log.Fatal
+)
+
+// connStats summarizes the snapshots of a single connection.
+type connStats struct {
+	UUID          string
+	Cookie        uint64
+	Snapshots     int
+	First, Last   time.Time
+	RTTs          []time.Duration // Every RTT sample, for the min, median and max.
+	BytesSent     int64
+	BytesReceived int64
+	FinalState    tcp.State
+}
+
+// summarize groups the snapshots by cookie, and returns the summaries in the
+// order the connections first appear.  Snapshots that contain only metadata are
+// ignored.
+func summarize(meta *netlink.Metadata, snaps []*snapshot.Snapshot) []*connStats {
+	var conns []*connStats
+	byCookie := make(map[uint64]*connStats)
+	for _, snap := range snaps {
+		if snap.InetDiagMsg == nil {
+			continue
+		}
+		cookie := snap.InetDiagMsg.ID.Cookie()
+		cs, ok := byCookie[cookie]
+		if !ok {
+			cs = &connStats{UUID: uuidFor(meta, cookie), Cookie: cookie, First: snap.Timestamp}
+			byCookie[cookie] = cs
+			conns = append(conns, cs)
+		}
+		cs.Snapshots++
+		cs.Last = snap.Timestamp
+		cs.FinalState = tcp.State(snap.InetDiagMsg.IDiagState)
+		if snap.TCPInfo != nil {
+			cs.RTTs = append(cs.RTTs, time.Duration(snap.TCPInfo.RTT)*time.Microsecond)
+			cs.BytesSent = snap.TCPInfo.BytesSent
+			cs.BytesReceived = snap.TCPInfo.BytesReceived
+		}
+	}
+	return conns
+}
+
+// uuidFor returns the UUID of the connection with the given cookie.  The metadata
+// only holds the UUID of the file's connection, so other connections use the same
+// host and boot time prefix, with their own cookie.
+func uuidFor(meta *netlink.Metadata, cookie uint64) string {
+	if meta == nil || meta.UUID == "" {
+		return ""
+	}
+	i := strings.LastIndex(meta.UUID, "_")
+	if i < 0 {
+		return meta.UUID
+	}
+	return fmt.Sprintf("%s_%016X", meta.UUID[:i], cookie)
+}
+
+// rttRange returns the min, median and max RTT.
+func (cs *connStats) rttRange() (min, median, max time.Duration) {
+	if len(cs.RTTs) == 0 {
+		return 0, 0, 0
+	}
+	rtts := append([]time.Duration(nil), cs.RTTs...)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[0], rtts[len(rtts)/2], rtts[len(rtts)-1]
+}
+
+func (cs *connStats) write(wtr io.Writer) error {
+	min, median, max := cs.rttRange()
+	_, err := fmt.Fprintf(wtr,
+		"UUID: %s\nCookie: %X\nSnapshots: %d\nStart: %s\nEnd: %s\nDuration: %s\nRTT min/median/max: %s / %s / %s\nBytesSent: %d\nBytesReceived: %d\nFinal state: %s\n",
+		cs.UUID, cs.Cookie, cs.Snapshots,
+		cs.First.Format(time.RFC3339Nano), cs.Last.Format(time.RFC3339Nano), cs.Last.Sub(cs.First),
+		min, median, max,
+		cs.BytesSent, cs.BytesReceived, cs.FinalState)
+	return err
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	var source io.ReadCloser
+	var err error
+	source = os.Stdin
+	if len(args) == 1 {
+		source, err = zstd.Open(args[0])
+		rtx.Must(err, "Could not open file %q", args[0])
+	} else if len(args) > 1 {
+		logFatal("Too many command-line arguments.")
+	}
+	defer source.Close()
+
+	meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(source))
+	rtx.Must(err, "Could not read snapshots")
+	for i, cs := range summarize(meta, snaps) {
+		if i > 0 {
+			fmt.Println()
+		}
+		rtx.Must(cs.write(os.Stdout), "Could not write summary")
+	}
+}
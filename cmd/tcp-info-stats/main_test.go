@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+const testFile = "../csvtool/testdata/ndt-jdczh_1553815964_00000000000003E8.00183.jsonl.zst"
+
+func TestMainTooManyArgs(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+		logFatal = log.Fatal
+	}(os.Args)
+
+	os.Args = []string{"test_tcp-info-stats", "file1", "file2"}
+	logFatal = func(...interface{}) {
+		panic("panic instead of log.Fatal")
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			t.Error("Should have panicked")
+		}
+	}()
+
+	main()
+}
+
+func TestMain(t *testing.T) {
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+
+	// Nothing crashes when we pass in a valid file.
+	os.Args = []string{"test_tcp-info-stats", testFile}
+	main()
+}
+
+func TestFileSummary(t *testing.T) {
+	src, err := zstd.Open(testFile)
+	rtx.Must(err, "Could not open file")
+	meta, snaps, err := snapshot.LoadAll(netlink.NewArchiveReader(src))
+	rtx.Must(err, "Could not read test data")
+
+	conns := summarize(meta, snaps)
+	if len(conns) != 1 {
+		t.Fatal("Expected one connection, got", len(conns))
+	}
+	cs := conns[0]
+	if cs.UUID != "ndt-jdczh_1553815964_00000000000003E8" || cs.Cookie != 0x3E8 {
+		t.Error("Wrong connection", cs.UUID, cs.Cookie)
+	}
+	// The header record contains only Metadata, and is not counted.
+	if cs.Snapshots != 150 {
+		t.Error("Wrong number of snapshots", cs.Snapshots)
+	}
+	if cs.FinalState != tcp.ESTABLISHED {
+		t.Error("Wrong final state", cs.FinalState)
+	}
+	min, median, max := cs.rttRange()
+	if min > median || median > max || min == 0 {
+		t.Error("Bad RTT range", min, median, max)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	rtx.Must(cs.write(buf), "Could not write summary")
+	for _, want := range []string{"Snapshots: 150\n", "BytesSent: 4934424\n", "Final state: ESTABLISHED\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Summary missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestSummarizeMultipleConnections(t *testing.T) {
+	start := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(cookie byte, offset time.Duration, state tcp.State, rtt uint32) *snapshot.Snapshot {
+		idm := &inetdiag.InetDiagMsg{IDiagState: uint8(state)}
+		idm.ID.IDiagCookie[0] = cookie
+		return &snapshot.Snapshot{
+			Timestamp:   start.Add(offset),
+			InetDiagMsg: idm,
+			TCPInfo:     &tcp.LinuxTCPInfo{RTT: rtt, BytesSent: int64(rtt)},
+		}
+	}
+	snaps := []*snapshot.Snapshot{
+		{}, // Metadata only.
+		snap(1, 0, tcp.ESTABLISHED, 3000),
+		snap(2, time.Second, tcp.ESTABLISHED, 100),
+		snap(1, 2*time.Second, tcp.ESTABLISHED, 1000),
+		snap(1, 3*time.Second, tcp.FIN_WAIT1, 2000),
+	}
+	conns := summarize(&netlink.Metadata{UUID: "host_1234_0000000000000001"}, snaps)
+	if len(conns) != 2 {
+		t.Fatal("Expected two connections, got", len(conns))
+	}
+	first, second := conns[0], conns[1]
+	if first.UUID != "host_1234_0000000000000001" || second.UUID != "host_1234_0000000000000002" {
+		t.Error("Wrong UUIDs", first.UUID, second.UUID)
+	}
+	if first.Snapshots != 3 || second.Snapshots != 1 {
+		t.Error("Wrong snapshot counts", first.Snapshots, second.Snapshots)
+	}
+	if first.Last.Sub(first.First) != 3*time.Second {
+		t.Error("Wrong duration", first.Last.Sub(first.First))
+	}
+	if first.FinalState != tcp.FIN_WAIT1 || first.BytesSent != 2000 {
+		t.Error("Wrong final values", first.FinalState, first.BytesSent)
+	}
+	min, median, max := first.rttRange()
+	if min != time.Millisecond || median != 2*time.Millisecond || max != 3*time.Millisecond {
+		t.Error("Wrong RTT range", min, median, max)
+	}
+}
@@ -3,12 +3,16 @@ package collector
 import (
 	"context"
 
+	"github.com/m-lab/tcp-info/logging"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
 )
 
+// Logger is unused on Darwin, but needed for compiling.
+var Logger logging.Logger
+
 // Run does nothing, but needed for compiling on Darwin.
-func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, skipLocal bool) (localCount, errCount int) {
+func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, ex *netlink.ExcludeConfig, opts Options) (localCount, errCount int) {
 	// Does notihg in Darwin
 	return 0, 0
 }
@@ -5,10 +5,13 @@ package collector
 
 import (
 	"context"
-	"log"
+	"io"
+	"math/rand"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/m-lab/tcp-info/metrics"
 
 	"github.com/m-lab/tcp-info/netlink"
@@ -21,71 +24,121 @@ var (
 )
 
 // collectDefaultNamespace collects all AF_INET6 and AF_INET connection stats, and sends them
-// to svr.
-func collectDefaultNamespace(svr chan<- netlink.MessageBlock, skipLocal bool) (int, int) {
+// to svr.  The connections that ex excludes as local are dropped, and not sent.  It returns the
+// number of connections, and the number that were not local.  Only the opts' families are
+// collected.  The timestamp of a family that is not collected is that of the other family.
+func collectDefaultNamespace(ctx context.Context, svr chan<- netlink.MessageBlock, ex *netlink.ExcludeConfig, opts *Options) (int, int) {
 	// Preallocate space for up to 500 connections.  We may want to adjust this upwards if profiling
 	// indicates a lot of reallocation.
 	buffer := netlink.MessageBlock{}
+	families := opts.families()
 
-	remoteCount := 0
-	res6, err := OneType(syscall.AF_INET6)
-	buffer.V6Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V6Messages = res6
+	if families&IPv6 != 0 {
+		res6, err := OneType(ctx, syscall.AF_INET6, opts.States)
+		buffer.V6Time = time.Now()
+		if err != nil {
+			// Properly handle errors
+			// TODO add metric
+			logger().Error(err)
+		} else {
+			buffer.V6Messages = res6
+		}
+	}
+	if families&IPv4 != 0 {
+		res4, err := OneType(ctx, syscall.AF_INET, opts.States)
+		buffer.V4Time = time.Now()
+		if err != nil {
+			// Properly handle errors
+			// TODO add metric
+			logger().Error(err)
+		} else {
+			buffer.V4Messages = res4
+		}
+	}
+	// The saver uses V4Time for its once a second reports, so it must be set.
+	switch families {
+	case IPv4:
+		buffer.V6Time = buffer.V4Time
+	case IPv6:
+		buffer.V4Time = buffer.V6Time
+	}
+	if opts.UnifiedTime && families == BothFamilies {
+		metrics.CollectionSkewHistogram.Observe(buffer.V4Time.Sub(buffer.V6Time).Seconds())
+		buffer.V6Time = buffer.V4Time
 	}
-	res4, err := OneType(syscall.AF_INET)
-	buffer.V4Time = time.Now()
-	if err != nil {
-		// Properly handle errors
-		// TODO add metric
-		log.Println(err)
-	} else {
-		buffer.V4Messages = res4
+
+	total := len(buffer.V4Messages) + len(buffer.V6Messages)
+	if opts.RawDump != nil {
+		writeRaw(opts.RawDump, buffer.V6Messages)
+		writeRaw(opts.RawDump, buffer.V4Messages)
 	}
+	buffer.V4Messages = ex.DropLocal(buffer.V4Messages)
+	buffer.V6Messages = ex.DropLocal(buffer.V6Messages)
 
 	// Submit full set of message to the marshalling service.
 	svr <- buffer
 
-	return len(res4) + len(res6), remoteCount
+	return total, len(buffer.V4Messages) + len(buffer.V6Messages)
+}
+
+// writeRaw writes the messages to wtr in the raw netlink format.  Errors are
+// logged and counted, but do not stop collection.
+func writeRaw(wtr io.Writer, msgs []*netlink.NetlinkMessage) {
+	for _, m := range msgs {
+		if err := netlink.WriteRawNetlinkMessage(wtr, m); err != nil {
+			logger().Error("Could not write raw netlink message:", err)
+			metrics.ErrorCount.With(prometheus.Labels{"type": "raw dump"}).Inc()
+			return
+		}
+	}
 }
 
 // Run the collector, either for the specified number of loops, or, if the
-// number specified is infinite, run forever.
-func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, skipLocal bool) (localCount, errCount int) {
+// number specified is infinite, run forever.  The connections that ex
+// excludes as local, if any, are dropped before they are sent to svrChan.  It
+// returns the number of local connections seen.  The collection is configured
+// by opts.
+func Run(ctx context.Context, reps int, svrChan chan<- netlink.MessageBlock, cl saver.CacheLogger, ex *netlink.ExcludeConfig, opts Options) (localCount, errCount int) {
 	totalCount := 0
 	remoteCount := 0
 	loops := 0
 
 	// TODO - make this interval programmable.
-	ticker := time.NewTicker(10 * time.Millisecond)
+	const interval = 10 * time.Millisecond
+	rng := opts.JitterSource
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	ticker := time.NewTicker(jitteredInterval(interval, opts.PollJitter, rng))
 	defer ticker.Stop()
 
 	lastCollectionTime := time.Now().Add(-10 * time.Millisecond)
 
 	for loops = 0; (reps == 0 || loops < reps) && (ctx.Err() == nil); loops++ {
-		total, remote := collectDefaultNamespace(svrChan, skipLocal)
+		total, remote := collectDefaultNamespace(ctx, svrChan, ex, &opts)
+		markCycle()
 		totalCount += total
 		remoteCount += remote
+		localCount += total - remote
 		// print stats roughly once per minute.
 		if loops%6000 == 0 {
 			cl.LogCacheStats(localCount, errCount)
 		}
 
 		now := time.Now()
-		interval := now.Sub(lastCollectionTime)
+		elapsed := now.Sub(lastCollectionTime)
 		lastCollectionTime = now
-		metrics.PollingHistogram.Observe(interval.Seconds())
+		metrics.PollingHistogram.Observe(elapsed.Seconds())
 
 		// Wait for next tick.
 		<-ticker.C
+		if opts.PollJitter > 0 {
+			ticker.Reset(jitteredInterval(interval, opts.PollJitter, rng))
+		}
 	}
 
 	if loops > 0 {
-		log.Println(totalCount, "sockets", remoteCount, "remotes", totalCount/loops, "per iteration")
+		logger().Info(totalCount, "sockets", remoteCount, "remotes", totalCount/loops, "per iteration")
 	}
 	return localCount, errCount
 }
@@ -1,10 +1,17 @@
 package collector_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -12,6 +19,7 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 func init() {
@@ -76,7 +84,7 @@ func TestRun(t *testing.T) {
 
 	go func() {
 		defer wg.Done()
-		collector.Run(ctx, 0, msgChan, &testCacheLogger{}, false)
+		collector.Run(ctx, 0, msgChan, &testCacheLogger{}, nil, collector.Options{})
 		t.Log("Run done.")
 	}()
 
@@ -153,4 +161,80 @@ func TestRun(t *testing.T) {
 
 	t.Log("Waiting for goroutines to exit")
 	wg.Wait()
+
+	cycle, dump := collector.LastCollection()
+	if cycle.IsZero() || dump.IsZero() {
+		t.Error("Run did not record the last collection", cycle, dump)
+	}
+}
+
+func TestRawDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRawDump")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	// Make sure there is at least one connection to collect.
+	listener, err := net.Listen("tcp", "localhost:0")
+	rtx.Must(err, "Could not listen")
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	rtx.Must(err, "Could not connect to myself")
+	defer conn.Close()
+
+	fn := filepath.Join(dir, "raw.zst")
+	w, err := zstd.NewWriter(fn)
+	rtx.Must(err, "Could not create raw dump")
+	msgChan := make(chan netlink.MessageBlock, 1)
+	collector.Run(context.Background(), 1, msgChan, &testCacheLogger{}, nil, collector.Options{RawDump: w})
+	rtx.Must(w.Close(), "Could not close raw dump")
+	block := <-msgChan
+	msgs := append(block.V6Messages, block.V4Messages...)
+	if len(msgs) == 0 {
+		t.Fatal("No messages collected")
+	}
+
+	r := zstd.NewReader(fn)
+	defer r.Close()
+	rdr := netlink.NewRawReader(r)
+	for i, m := range msgs {
+		want, err := netlink.MakeArchivalRecord(m, nil)
+		rtx.Must(err, "Could not make record")
+		got, err := rdr.Next()
+		if err != nil {
+			t.Fatal("Could not read record", i, err)
+		}
+		if !bytes.Equal(got.RawIDM, want.RawIDM) || !reflect.DeepEqual(got.Attributes, want.Attributes) {
+			t.Errorf("Record %d differs after the raw round trip", i)
+		}
+	}
+	if _, err := rdr.Next(); err != io.EOF {
+		t.Error("Expected EOF after the collected messages, got", err)
+	}
+}
+
+func TestRunWithJitter(t *testing.T) {
+	msgChan := make(chan netlink.MessageBlock, 100)
+	// The shortest and longest possible intervals, which must neither stop the
+	// ticker, nor grow from one cycle to the next.
+	for _, source := range []rand.Source{constSource(0), constSource(1<<63 - 1<<10)} {
+		opts := collector.Options{PollJitter: 1, JitterSource: rand.New(source)}
+		start := time.Now()
+		collector.Run(context.Background(), 20, msgChan, &testCacheLogger{}, nil, opts)
+		for len(msgChan) > 0 {
+			<-msgChan
+		}
+		// 20 intervals of at most 20ms, with plenty of slack for slow collection.
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("20 cycles took %v", elapsed)
+		}
+	}
+}
+
+func TestUnifiedTime(t *testing.T) {
+	msgChan := make(chan netlink.MessageBlock, 1)
+	collector.Run(context.Background(), 1, msgChan, &testCacheLogger{}, nil, collector.Options{UnifiedTime: true})
+	block := <-msgChan
+	if block.V4Time.IsZero() || !block.V4Time.Equal(block.V6Time) {
+		t.Errorf("V4Time %v and V6Time %v should be equal", block.V4Time, block.V6Time)
+	}
 }
@@ -1,3 +1,15 @@
 package collector
 
 var ProcessSingleMessage = processSingleMessage
+
+var MakeReq = makeReq
+
+type NetlinkSocket = netlinkSocket
+
+// SetSubscribe replaces the function used to open netlink sockets, and returns
+// a function that restores the original.
+func SetSubscribe(f func() (NetlinkSocket, error)) func() {
+	orig := subscribe
+	subscribe = f
+	return func() { subscribe = orig }
+}
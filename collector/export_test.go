@@ -0,0 +1,17 @@
+package collector
+
+import "time"
+
+var JitteredInterval = jitteredInterval
+
+// SetLastCollection sets the times reported by LastCollection.  A zero Time
+// means never.
+func SetLastCollection(cycle, dump time.Time) {
+	lastCycle, lastDump = 0, 0
+	if !cycle.IsZero() {
+		lastCycle = cycle.UnixNano()
+	}
+	if !dump.IsZero() {
+		lastDump = dump.UnixNano()
+	}
+}
@@ -0,0 +1,31 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Families is a set of the address families that the collector dumps.
+type Families uint8
+
+// The address families, and their combination, that may be collected.
+const (
+	IPv4 Families = 1 << iota
+	IPv6
+
+	BothFamilies = IPv4 | IPv6
+)
+
+// ParseFamilies converts "v4", "v6" or "both" into the corresponding Families.
+// Names are not case sensitive.
+func ParseFamilies(name string) (Families, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "v4":
+		return IPv4, nil
+	case "v6":
+		return IPv6, nil
+	case "both":
+		return BothFamilies, nil
+	}
+	return 0, fmt.Errorf("unknown address families %q, want v4, v6 or both", name)
+}
@@ -0,0 +1,32 @@
+package collector_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/tcp-info/collector"
+)
+
+func TestParseFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    collector.Families
+		wantErr bool
+	}{
+		{name: "v4", want: collector.IPv4},
+		{name: "V6", want: collector.IPv6},
+		{name: " both ", want: collector.BothFamilies},
+		{name: "", wantErr: true},
+		{name: "v5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := collector.ParseFamilies(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFamilies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseFamilies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The times, in UnixNano, of the end of the last collection cycle, and of the
+// last successful netlink dump.  Zero means never.
+var lastCycle, lastDump int64
+
+func markCycle() { atomic.StoreInt64(&lastCycle, time.Now().UnixNano()) }
+func markDump()  { atomic.StoreInt64(&lastDump, time.Now().UnixNano()) }
+
+func loadTime(t *int64) time.Time {
+	ns := atomic.LoadInt64(t)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// LastCollection returns the time the last collection cycle completed, and the
+// time of the last successful netlink dump.  Either is the zero Time if it has
+// not yet happened.
+func LastCollection() (cycle, dump time.Time) {
+	return loadTime(&lastCycle), loadTime(&lastDump)
+}
+
+// ReadyHandler returns a handler reporting the time since the last completed
+// collection cycle, and since the last successful netlink dump.  It responds
+// with 503 Service Unavailable if either is more than maxAge ago, or has not
+// happened yet, so that orchestrators can detect a wedged collector.
+func ReadyHandler(maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		cycle, dump := LastCollection()
+		now := time.Now()
+		status := http.StatusOK
+		body := ""
+		for _, last := range []struct {
+			name string
+			t    time.Time
+		}{{"cycle", cycle}, {"dump", dump}} {
+			if last.t.IsZero() {
+				status = http.StatusServiceUnavailable
+				body += fmt.Sprintf("last %s: never\n", last.name)
+				continue
+			}
+			age := now.Sub(last.t)
+			if age > maxAge {
+				status = http.StatusServiceUnavailable
+			}
+			body += fmt.Sprintf("last %s: %s ago\n", last.name, age)
+		}
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(status)
+		fmt.Fprint(rw, body)
+	})
+}
@@ -0,0 +1,42 @@
+package collector_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/collector"
+)
+
+func TestReadyHandler(t *testing.T) {
+	defer collector.SetLastCollection(collector.LastCollection())
+
+	now := time.Now()
+	tests := []struct {
+		name        string
+		cycle, dump time.Time
+		wantStatus  int
+		wantBody    string
+	}{
+		{name: "never", wantStatus: http.StatusServiceUnavailable, wantBody: "last cycle: never\nlast dump: never\n"},
+		{name: "recent", cycle: now, dump: now, wantStatus: http.StatusOK, wantBody: "last cycle: "},
+		{name: "stale-cycle", cycle: now.Add(-time.Minute), dump: now, wantStatus: http.StatusServiceUnavailable, wantBody: "last cycle: 1m"},
+		{name: "stale-dump", cycle: now, dump: now.Add(-time.Minute), wantStatus: http.StatusServiceUnavailable, wantBody: "last dump: 1m"},
+		{name: "no-dump", cycle: now, wantStatus: http.StatusServiceUnavailable, wantBody: "last dump: never\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector.SetLastCollection(tt.cycle, tt.dump)
+			rec := httptest.NewRecorder()
+			collector.ReadyHandler(10*time.Second).ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"math/rand"
+	"time"
+)
+
+// minJitteredInterval is the shortest interval returned by jitteredInterval,
+// since tickers require a positive interval.
+const minJitteredInterval = time.Millisecond
+
+// jitteredInterval returns interval, changed by a random amount of up to
+// fraction of it, in either direction.  Fractions above 1 are treated as 1, and
+// the result is at least minJitteredInterval.
+func jitteredInterval(interval time.Duration, fraction float64, rng *rand.Rand) time.Duration {
+	if fraction <= 0 {
+		return interval
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	offset := (2*rng.Float64() - 1) * fraction * float64(interval)
+	if d := interval + time.Duration(offset); d > minJitteredInterval {
+		return d
+	}
+	return minJitteredInterval
+}
@@ -0,0 +1,53 @@
+package collector_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/collector"
+)
+
+func TestJitteredInterval(t *testing.T) {
+	interval := 10 * time.Millisecond
+	rng := rand.New(rand.NewSource(1))
+	if got := collector.JitteredInterval(interval, 0, rng); got != interval {
+		t.Errorf("JitteredInterval() without jitter = %v, want %v", got, interval)
+	}
+
+	intervals := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		got := collector.JitteredInterval(interval, 0.2, rng)
+		if got < 8*time.Millisecond || got > 12*time.Millisecond {
+			t.Fatalf("JitteredInterval() = %v, want between 8ms and 12ms", got)
+		}
+		intervals[got] = true
+	}
+	if len(intervals) < 100 {
+		t.Error("Intervals should vary, but only", len(intervals), "were distinct")
+	}
+
+	// The same seed gives the same intervals.
+	a, b := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	for i := 0; i < 10; i++ {
+		if x, y := collector.JitteredInterval(interval, 0.5, a), collector.JitteredInterval(interval, 0.5, b); x != y {
+			t.Errorf("Intervals from the same seed differ: %v and %v", x, y)
+		}
+	}
+
+	// Intervals are always positive, even at the largest jitter.
+	for i := 0; i < 1000; i++ {
+		if got := collector.JitteredInterval(interval, 5, rng); got <= 0 || got > 2*interval {
+			t.Fatalf("JitteredInterval() = %v, want between 0 and %v", got, 2*interval)
+		}
+	}
+	if got := collector.JitteredInterval(interval, 1, rand.New(constSource(0))); got <= 0 {
+		t.Errorf("JitteredInterval() = %v, want a positive interval", got)
+	}
+}
+
+// constSource is a rand.Source that always returns the same value.
+type constSource int64
+
+func (s constSource) Int63() int64 { return int64(s) }
+func (s constSource) Seed(int64)   {}
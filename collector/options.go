@@ -0,0 +1,49 @@
+package collector
+
+import (
+	"io"
+	"math/rand"
+)
+
+// Options configures the collector.  The zero Options collects connections in
+// the default TCP states, of both address families, at regular intervals.
+type Options struct {
+	// States is the idiag_states bitmask of the TCP states that are collected,
+	// e.g. from tcp.ParseStateFlags.  If zero, tcp.DefaultFlags is used.
+	States uint32
+
+	// Families is the set of address families that are collected, e.g. only
+	// IPv4 on a single stack host, from ParseFamilies.  If zero, BothFamilies
+	// are collected.
+	Families Families
+
+	// RawDump, if not nil, receives every NetlinkMessage collected, in the form
+	// read by netlink.LoadRawNetlinkMessage, so that the exact kernel bytes can
+	// later be reprocessed with netlink.NewRawReader.
+	RawDump io.Writer
+
+	// UnifiedTime, if true, gives the AF_INET and AF_INET6 messages of each
+	// collection cycle the same timestamp, taken when both dumps are complete,
+	// so that MessageBlock.V4Time and V6Time are equal.  The gap between the
+	// dumps is then observed by the collector, rather than the saver.
+	UnifiedTime bool
+
+	// PollJitter, if non-zero, randomizes each polling interval by up to this
+	// fraction of the nominal interval, in either direction, so that the hosts
+	// in a fleet do not all poll in lockstep.  E.g. 0.2 makes each interval
+	// between 8ms and 12ms.  If zero, polling is deterministic.
+	PollJitter float64
+
+	// JitterSource provides the randomness for PollJitter, e.g. a seeded source,
+	// to make the intervals reproducible.  If nil, a source seeded with the
+	// current time is used.
+	JitterSource *rand.Rand
+}
+
+// families returns the set of address families to collect.
+func (opts *Options) families() Families {
+	if opts.Families == 0 {
+		return BothFamilies
+	}
+	return opts.Families
+}
@@ -3,7 +3,8 @@ package collector
 // This package is only meaningful in Linux.
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"syscall"
 	"time"
 
@@ -12,15 +13,51 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/logging"
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/tcp"
 )
 
+// receivePollInterval bounds how long a Receive blocks before OneType checks
+// whether its context has been canceled.
+const receivePollInterval = 100 * time.Millisecond
+
+// maxDumpAttempts is the number of times OneType will request a dump that the
+// kernel reported as overrun before giving up.
+const maxDumpAttempts = 3
+
+// Logger receives the collector's log messages.  If nil, logging.Default is used.
+var Logger logging.Logger
+
+func logger() logging.Logger {
+	if Logger != nil {
+		return Logger
+	}
+	return logging.Default
+}
+
+// netlinkSocket is the subset of nl.NetlinkSocket used by OneType.
+type netlinkSocket interface {
+	Send(request *nl.NetlinkRequest) error
+	Receive() ([]syscall.NetlinkMessage, *unix.SockaddrNetlink, error)
+	GetPid() (uint32, error)
+	SetReceiveTimeout(timeout *unix.Timeval) error
+	Close()
+}
+
+// subscribe opens the netlink socket.  It is a variable so that tests can replace it.
+var subscribe = func() (netlinkSocket, error) {
+	// Copied this from req.Execute in nl_linux.go
+	return nl.Subscribe(syscall.NETLINK_INET_DIAG)
+}
+
 // TODO - Figure out why we aren't seeing INET_DIAG_DCTCPINFO or INET_DIAG_BBRINFO messages.
-func makeReq(inetType uint8) *nl.NetlinkRequest {
+func makeReq(inetType uint8, states uint32) *nl.NetlinkRequest {
+	if states == 0 {
+		states = tcp.DefaultFlags
+	}
 	req := nl.NewNetlinkRequest(inetdiag.SOCK_DIAG_BY_FAMILY, syscall.NLM_F_DUMP|syscall.NLM_F_REQUEST)
-	msg := inetdiag.NewReqV2(inetType, syscall.IPPROTO_TCP,
-		tcp.AllFlags & ^((1<<uint(tcp.SYN_RECV))|(1<<uint(tcp.TIME_WAIT))|(1<<uint(tcp.CLOSE))))
+	msg := inetdiag.NewReqV2(inetType, syscall.IPPROTO_TCP, states)
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_MEMINFO - 1))
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_INFO - 1))
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_VEGASINFO - 1))
@@ -30,6 +67,9 @@ func makeReq(inetType uint8) *nl.NetlinkRequest {
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_TOS - 1))
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SKMEMINFO - 1))
 	msg.IDiagExt |= (1 << (inetdiag.INET_DIAG_SHUTDOWN - 1))
+	// INET_DIAG_MARK is beyond the 8 bits of IDiagExt, so it can't be requested.
+	// The kernel sends it anyway, but only if the collector has CAP_NET_ADMIN,
+	// e.g. when run as root.
 
 	req.AddData(msg)
 	req.NlMsghdr.Type = inetdiag.SOCK_DIAG_BY_FAMILY
@@ -39,18 +79,23 @@ func makeReq(inetType uint8) *nl.NetlinkRequest {
 
 func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*syscall.NetlinkMessage, bool, error) {
 	if m.Header.Seq != seq {
-		log.Printf("Wrong Seq nr %d, expected %d", m.Header.Seq, seq)
+		logger().Warn(fmt.Sprintf("Wrong Seq nr %d, expected %d", m.Header.Seq, seq))
 		metrics.ErrorCount.With(prometheus.Labels{"type": "wrong seq num"}).Inc()
 		return nil, false, inetdiag.ErrBadSequence
 	}
 	if m.Header.Pid != pid {
-		log.Printf("Wrong pid %d, expected %d", m.Header.Pid, pid)
+		logger().Warn(fmt.Sprintf("Wrong pid %d, expected %d", m.Header.Pid, pid))
 		metrics.ErrorCount.With(prometheus.Labels{"type": "wrong pid"}).Inc()
 		return nil, false, inetdiag.ErrBadPid
 	}
 	if m.Header.Type == unix.NLMSG_DONE {
 		return nil, false, nil
 	}
+	if m.Header.Type == unix.NLMSG_OVERRUN {
+		logger().Warn("Netlink dump overrun")
+		metrics.ErrorCount.With(prometheus.Labels{"type": "NLMSG_OVERRUN"}).Inc()
+		return nil, false, inetdiag.ErrDumpOverrun
+	}
 	if m.Header.Type == unix.NLMSG_ERROR {
 		native := nl.NativeEndian()
 		if len(m.Data) < 4 {
@@ -60,8 +105,12 @@ func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*s
 		if error == 0 {
 			return nil, false, nil
 		}
-		log.Println(syscall.Errno(-error))
+		logger().Error(syscall.Errno(-error))
 		metrics.ErrorCount.With(prometheus.Labels{"type": "NLMSG_ERROR"}).Inc()
+	} else if int(m.Header.Len) != unix.NLMSG_HDRLEN+len(m.Data) {
+		logger().Error(fmt.Sprintf("Netlink message length %d, but only %d bytes of data", m.Header.Len, len(m.Data)))
+		metrics.ErrorCount.With(prometheus.Labels{"type": "truncated message"}).Inc()
+		return nil, false, inetdiag.ErrTruncatedMsg
 	}
 	if m.Header.Flags&unix.NLM_F_MULTI == 0 {
 		return m, false, nil
@@ -69,10 +118,15 @@ func processSingleMessage(m *syscall.NetlinkMessage, seq uint32, pid uint32) (*s
 	return m, true, nil
 }
 
-// OneType handles the request and response for a single type, e.g. INET or INET6
+// OneType handles the request and response for a single type, e.g. INET or INET6,
+// for the connections in the TCP states in the states bitmask, or, if states is
+// zero, in tcp.DefaultFlags.  If ctx is canceled during the dump, OneType abandons it and returns an error
+// wrapping ctx.Err().  If the kernel reports that the dump overran, it is
+// retried, and ErrDumpOverrun is returned only if every attempt overran.
 // TODO maybe move this to top level?
-func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
+func OneType(ctx context.Context, inetType uint8, states uint32) ([]*syscall.NetlinkMessage, error) {
 	var res []*syscall.NetlinkMessage
+	var err error
 
 	start := time.Now()
 	defer func() {
@@ -87,34 +141,62 @@ func OneType(inetType uint8) ([]*syscall.NetlinkMessage, error) {
 		metrics.ConnectionCountHistogram.With(prometheus.Labels{"af": af}).Observe(float64(len(res)))
 	}()
 
-	req := makeReq(inetType)
+	for attempt := 0; attempt < maxDumpAttempts; attempt++ {
+		res, err = dump(ctx, inetType, states)
+		if err == nil {
+			markDump()
+		}
+		if err != inetdiag.ErrDumpOverrun {
+			return res, err
+		}
+	}
+	// Don't return the partial results of an overrun dump.
+	res = nil
+	return nil, err
+}
 
-	// Copied this from req.Execute in nl_linux.go
-	sockType := syscall.NETLINK_INET_DIAG
-	s, err := nl.Subscribe(sockType)
+// dump performs a single netlink dump request for inetType.
+func dump(ctx context.Context, inetType uint8, states uint32) ([]*syscall.NetlinkMessage, error) {
+	var res []*syscall.NetlinkMessage
+	req := makeReq(inetType, states)
+
+	s, err := subscribe()
 	if err != nil {
 		// TODO - all these logs should be metrics instead.
-		log.Println(err)
+		logger().Error(err)
 		return nil, err
 	}
 	defer s.Close()
 
+	// Wake up periodically from Receive, so that we can check for cancellation.
+	tv := unix.NsecToTimeval(receivePollInterval.Nanoseconds())
+	if err := s.SetReceiveTimeout(&tv); err != nil {
+		logger().Error(err)
+		return nil, err
+	}
+
 	if err := s.Send(req); err != nil {
-		log.Println(err)
+		logger().Error(err)
 		return nil, err
 	}
 
 	pid, err := s.GetPid()
 	if err != nil {
-		log.Println(err)
+		logger().Error(err)
 		return nil, err
 	}
 
 	// Adapted this from req.Execute in nl_linux.go
 	for {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("netlink dump abandoned: %w", ctx.Err())
+		}
 		msgs, _, err := s.Receive()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
 		if err != nil {
-			log.Println(err)
+			logger().Error(err)
 			return nil, err
 		}
 		// TODO avoid the copy.
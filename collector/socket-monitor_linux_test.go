@@ -1,19 +1,38 @@
 package collector_test
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/collector"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
 )
 
+func TestMakeReqStates(t *testing.T) {
+	states := func(states uint32) uint32 {
+		req := collector.MakeReq(syscall.AF_INET, states)
+		return req.Data[0].(*inetdiag.ReqV2).IDiagStates
+	}
+	if got := states(0); got != tcp.DefaultFlags {
+		t.Errorf("IDiagStates = %#x, want %#x", got, tcp.DefaultFlags)
+	}
+	if got := states(1 << tcp.ESTABLISHED); got != 1<<tcp.ESTABLISHED {
+		t.Errorf("IDiagStates = %#x, want %#x", got, 1<<tcp.ESTABLISHED)
+	}
+}
+
 func TestOneType(t *testing.T) {
 	// Open an AF_LOCAL socket connection.
 	// Get a safe name for the AF_LOCAL socket
@@ -55,7 +74,7 @@ func TestOneType(t *testing.T) {
 	defer fd.Close()
 
 	// Verify that OneType(AF_LOCAL) finds at least one connection.
-	res, err := collector.OneType(syscall.AF_LOCAL)
+	res, err := collector.OneType(context.Background(), syscall.AF_LOCAL, 0)
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,6 +83,39 @@ func TestOneType(t *testing.T) {
 	}
 }
 
+// slowSocket simulates a netlink dump that never completes.
+type slowSocket struct{}
+
+func (slowSocket) Send(*nl.NetlinkRequest) error            { return nil }
+func (slowSocket) GetPid() (uint32, error)                  { return 1, nil }
+func (slowSocket) SetReceiveTimeout(tv *unix.Timeval) error { return nil }
+func (slowSocket) Close()                                   {}
+func (slowSocket) Receive() ([]syscall.NetlinkMessage, *unix.SockaddrNetlink, error) {
+	time.Sleep(10 * time.Millisecond)
+	return nil, nil, unix.EAGAIN
+}
+
+func TestOneTypeCancel(t *testing.T) {
+	restore := collector.SetSubscribe(func() (collector.NetlinkSocket, error) {
+		return slowSocket{}, nil
+	})
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, err := collector.OneType(ctx, syscall.AF_INET, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected a wrapped DeadlineExceeded, got", err)
+	}
+	if res != nil {
+		t.Error("Expected no results, got", res)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("OneType took too long to notice cancellation", time.Since(start))
+	}
+}
+
 func TestProcessSingleMessageErrorPaths(t *testing.T) {
 	var m syscall.NetlinkMessage
 	m.Header.Seq = 1
@@ -100,3 +152,207 @@ func TestProcessSingleMessageErrorPaths(t *testing.T) {
 		t.Error("Should be ok but isn't")
 	}
 }
+
+func TestProcessSingleMessageOverrunAndTruncation(t *testing.T) {
+	var m syscall.NetlinkMessage
+	m.Header.Seq = 1
+	m.Header.Pid = 2
+	m.Header.Type = unix.NLMSG_OVERRUN
+	m.Header.Flags = unix.NLM_F_MULTI
+	msg, ok, err := collector.ProcessSingleMessage(&m, 1, 2)
+	if err != inetdiag.ErrDumpOverrun {
+		t.Error("Should have had ErrDumpOverrun not", err)
+	}
+	if msg != nil || ok {
+		t.Error("Overrun should not return a message or continue", msg, ok)
+	}
+
+	m.Header.Type = inetdiag.SOCK_DIAG_BY_FAMILY
+	m.Data = make([]byte, 100)
+	m.Header.Len = uint32(unix.NLMSG_HDRLEN + 72) // Less than the data we have.
+	_, _, err = collector.ProcessSingleMessage(&m, 1, 2)
+	if err != inetdiag.ErrTruncatedMsg {
+		t.Error("Should have had ErrTruncatedMsg not", err)
+	}
+	m.Header.Len = uint32(unix.NLMSG_HDRLEN + 200) // More than the data we have.
+	_, _, err = collector.ProcessSingleMessage(&m, 1, 2)
+	if err != inetdiag.ErrTruncatedMsg {
+		t.Error("Should have had ErrTruncatedMsg not", err)
+	}
+	m.Header.Len = uint32(unix.NLMSG_HDRLEN + 100)
+	msg, ok, err = collector.ProcessSingleMessage(&m, 1, 2)
+	rtx.Must(err, "A well formed message should be fine")
+	if msg != &m || !ok {
+		t.Error("Should have returned the message and continued", msg, ok)
+	}
+}
+
+// overrunSocket simulates netlink dumps, the first overruns of which are
+// reported as NLMSG_OVERRUN.
+type overrunSocket struct {
+	overruns *int
+	seq      uint32
+}
+
+func (s *overrunSocket) Send(req *nl.NetlinkRequest) error {
+	s.seq = req.Seq
+	return nil
+}
+func (*overrunSocket) GetPid() (uint32, error)                  { return 1, nil }
+func (*overrunSocket) SetReceiveTimeout(tv *unix.Timeval) error { return nil }
+func (*overrunSocket) Close()                                   {}
+func (s *overrunSocket) Receive() ([]syscall.NetlinkMessage, *unix.SockaddrNetlink, error) {
+	hdr := syscall.NlMsghdr{Seq: s.seq, Pid: 1, Flags: unix.NLM_F_MULTI}
+	data := syscall.NetlinkMessage{Header: hdr, Data: make([]byte, 8)}
+	data.Header.Type = inetdiag.SOCK_DIAG_BY_FAMILY
+	data.Header.Len = uint32(unix.NLMSG_HDRLEN + len(data.Data))
+	last := syscall.NetlinkMessage{Header: hdr}
+	last.Header.Type = unix.NLMSG_DONE
+	if *s.overruns > 0 {
+		*s.overruns--
+		last.Header.Type = unix.NLMSG_OVERRUN
+	}
+	return []syscall.NetlinkMessage{data, last}, nil, nil
+}
+
+func TestOneTypeOverrun(t *testing.T) {
+	overruns := 0
+	restore := collector.SetSubscribe(func() (collector.NetlinkSocket, error) {
+		return &overrunSocket{overruns: &overruns}, nil
+	})
+	defer restore()
+
+	// A single overrun is retried.
+	overruns = 1
+	res, err := collector.OneType(context.Background(), syscall.AF_INET, 0)
+	rtx.Must(err, "An overrun dump should have been retried")
+	if len(res) != 1 || overruns != 0 {
+		t.Errorf("Expected one message after one retry, got %d with %d overruns left", len(res), overruns)
+	}
+
+	// Persistent overruns are reported, without partial results.
+	overruns = 100
+	res, err = collector.OneType(context.Background(), syscall.AF_INET, 0)
+	if err != inetdiag.ErrDumpOverrun {
+		t.Error("Should have had ErrDumpOverrun not", err)
+	}
+	if res != nil {
+		t.Error("Should not return partial results", res)
+	}
+}
+
+func TestDropLocal(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	rtx.Must(err, "Could not listen on localhost")
+	defer l.Close()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	hasPort := func(msgs []*netlink.NetlinkMessage) bool {
+		for _, m := range msgs {
+			ar, err := netlink.MakeArchivalRecord(m, nil)
+			rtx.Must(err, "Could not parse message")
+			idm, err := ar.RawIDM.Parse()
+			rtx.Must(err, "Could not parse InetDiagMsg")
+			if idm.ID.SPort() == port {
+				return true
+			}
+		}
+		return false
+	}
+
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tt := range []struct {
+		name     string
+		ex       *netlink.ExcludeConfig
+		wantKept bool
+	}{
+		{"nil", nil, true},
+		{"include-local", &netlink.ExcludeConfig{Local: false}, true},
+		{"default", &netlink.ExcludeConfig{Local: true}, false},
+		// Replacing the definition of local keeps loopback connections.
+		{"private-only", &netlink.ExcludeConfig{Local: true, LocalCIDRs: []*net.IPNet{private}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := collector.OneType(context.Background(), syscall.AF_INET, 0)
+			rtx.Must(err, "Could not collect connections")
+			if !hasPort(msgs) {
+				t.Fatal("Local listener not found")
+			}
+			kept := tt.ex.DropLocal(msgs)
+			if hasPort(kept) != tt.wantKept {
+				t.Errorf("DropLocal kept the local listener = %v, want %v", hasPort(kept), tt.wantKept)
+			}
+			if tt.ex == nil {
+				return
+			}
+			for _, m := range kept {
+				ar, err := netlink.MakeArchivalRecord(m, nil)
+				rtx.Must(err, "Could not parse message")
+				idm, err := ar.RawIDM.Parse()
+				rtx.Must(err, "Could not parse InetDiagMsg")
+				if tt.ex.Local && tt.ex.IsLocalConnection(idm) {
+					t.Error("DropLocal kept a local connection", idm.ID.SrcIP(), idm.ID.DstIP())
+				}
+			}
+		})
+	}
+}
+
+// familySocket records the address family of each dump request, and returns
+// an empty dump.
+type familySocket struct {
+	families *[]uint8
+	seq      uint32
+}
+
+func (s *familySocket) Send(req *nl.NetlinkRequest) error {
+	s.seq = req.Seq
+	*s.families = append(*s.families, req.Data[0].(*inetdiag.ReqV2).SDiagFamily)
+	return nil
+}
+func (*familySocket) GetPid() (uint32, error)                  { return 1, nil }
+func (*familySocket) SetReceiveTimeout(tv *unix.Timeval) error { return nil }
+func (*familySocket) Close()                                   {}
+func (s *familySocket) Receive() ([]syscall.NetlinkMessage, *unix.SockaddrNetlink, error) {
+	done := syscall.NetlinkMessage{Header: syscall.NlMsghdr{Seq: s.seq, Pid: 1, Type: unix.NLMSG_DONE}}
+	return []syscall.NetlinkMessage{done}, nil, nil
+}
+
+func TestAddressFamilies(t *testing.T) {
+	var families []uint8
+	restore := collector.SetSubscribe(func() (collector.NetlinkSocket, error) {
+		return &familySocket{families: &families}, nil
+	})
+	defer restore()
+
+	tests := []struct {
+		name string
+		af   collector.Families
+		want []uint8
+	}{
+		{"v4", collector.IPv4, []uint8{syscall.AF_INET}},
+		{"v6", collector.IPv6, []uint8{syscall.AF_INET6}},
+		{"both", collector.BothFamilies, []uint8{syscall.AF_INET6, syscall.AF_INET}},
+		{"default", 0, []uint8{syscall.AF_INET6, syscall.AF_INET}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families = nil
+			msgChan := make(chan netlink.MessageBlock, 1)
+			collector.Run(context.Background(), 1, msgChan, &testCacheLogger{}, nil, collector.Options{Families: tt.af})
+			block := <-msgChan
+			if len(families) != len(tt.want) {
+				t.Fatalf("Requested families %v, want %v", families, tt.want)
+			}
+			for i := range families {
+				if families[i] != tt.want[i] {
+					t.Errorf("Requested families %v, want %v", families, tt.want)
+				}
+			}
+			// Both times are always set, so that the saver can use either.
+			if block.V4Time.IsZero() || block.V6Time.IsZero() {
+				t.Errorf("V4Time %v and V6Time %v should both be set", block.V4Time, block.V6Time)
+			}
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 var (
@@ -19,6 +20,11 @@ var (
 	// socket that should be used by the client and server. It is put here in an
 	// attempt to have just one standard flag name.
 	Filename = flag.String("tcpinfo.eventsocket", "", "The filename of the unix-domain socket on which events are served.")
+
+	// Address is a command-line flag holding the TCP address on which events
+	// are served, as an alternative to Filename.  The connection is not
+	// authenticated, so it should normally be a localhost address.
+	Address = flag.String("tcpinfo.eventsocket-tcp", "", "The TCP address (e.g. localhost:9990) on which events are served. There is no authentication, so avoid non-local addresses.")
 )
 
 // Handler is the interface that all interested users of the event socket
@@ -29,12 +35,37 @@ type Handler interface {
 	Close(ctx context.Context, timestamp time.Time, uuid string)
 }
 
+// StateChangeHandler may optionally be implemented by a Handler that wants to be
+// notified of StateChange events.  The server only sends these events if they
+// were enabled when tcp-info was started.
+type StateChangeHandler interface {
+	StateChange(ctx context.Context, timestamp time.Time, uuid string, oldState, newState tcp.State)
+}
+
+// CloseWithIDHandler may optionally be implemented by a Handler that wants the
+// SockID of closed flows, e.g. because it may have missed the Open event.  If
+// implemented, CloseWithID is called for Close events instead of Close.  The id
+// is nil if the server did not send one.
+type CloseWithIDHandler interface {
+	CloseWithID(ctx context.Context, timestamp time.Time, uuid string, id *inetdiag.SockID)
+}
+
 // MustRun will read from the passed-in socket filename until the context is
 // cancelled. Any errors are fatal.
 func MustRun(ctx context.Context, socket string, handler Handler) {
+	mustRun(ctx, "unix", socket, handler)
+}
+
+// MustRunTCP is like MustRun, but reads events from a server created with
+// NewTCP, at the passed-in TCP address.
+func MustRunTCP(ctx context.Context, addr string, handler Handler) {
+	mustRun(ctx, "tcp", addr, handler)
+}
+
+func mustRun(ctx context.Context, network, socket string, handler Handler) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	c, err := net.Dial("unix", socket)
+	c, err := net.Dial(network, socket)
 	rtx.Must(err, "Could not connect to %q", socket)
 	go func() {
 		// Close the connection when the context is done. Closing the underlying
@@ -45,6 +76,8 @@ func MustRun(ctx context.Context, socket string, handler Handler) {
 
 	// By default bufio.Scanner is based on newlines, which is perfect for our JSONL protocol.
 	s := bufio.NewScanner(c)
+	stateHandler, _ := handler.(StateChangeHandler)
+	closeHandler, _ := handler.(CloseWithIDHandler)
 	for s.Scan() {
 		var event FlowEvent
 		rtx.Must(json.Unmarshal(s.Bytes(), &event), "Could not unmarshall")
@@ -52,7 +85,15 @@ func MustRun(ctx context.Context, socket string, handler Handler) {
 		case Open:
 			handler.Open(ctx, event.Timestamp, event.UUID, event.ID)
 		case Close:
-			handler.Close(ctx, event.Timestamp, event.UUID)
+			if closeHandler != nil {
+				closeHandler.CloseWithID(ctx, event.Timestamp, event.UUID, event.ID)
+			} else {
+				handler.Close(ctx, event.Timestamp, event.UUID)
+			}
+		case StateChange:
+			if stateHandler != nil && event.State != nil && event.OldState != nil {
+				stateHandler.StateChange(ctx, event.Timestamp, event.UUID, *event.OldState, *event.State)
+			}
 		default:
 			log.Println("Unknown event type:", event.Event)
 		}
@@ -10,10 +10,12 @@ import (
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 type testHandler struct {
 	opens, closes int
+	states        int
 	wg            sync.WaitGroup
 }
 
@@ -27,6 +29,11 @@ func (t *testHandler) Close(ctx context.Context, timestamp time.Time, uuid strin
 	t.wg.Done()
 }
 
+func (t *testHandler) StateChange(ctx context.Context, timestamp time.Time, uuid string, oldState, newState tcp.State) {
+	t.states++
+	t.wg.Done()
+}
+
 func TestClient(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -47,7 +54,7 @@ func TestClient(t *testing.T) {
 		MustRun(ctx, dir+"/tcpevents.sock", th)
 		clientWg.Done()
 	}()
-	th.wg.Add(2)
+	th.wg.Add(3)
 
 	// Send an open event
 	srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
@@ -57,11 +64,114 @@ func TestClient(t *testing.T) {
 		Timestamp: time.Now(),
 		UUID:      "fakeuuid",
 	}
+	// Send a state change event
+	srv.FlowStateChanged(time.Now(), "fakeuuid", tcp.ESTABLISHED, tcp.CLOSE_WAIT)
 	// Send a deletion event
-	srv.FlowDeleted(time.Now(), "fakeuuid")
-	th.wg.Wait() // Wait until the handler gets two events!
+	srv.FlowDeleted(time.Now(), "fakeuuid", nil)
+	th.wg.Wait() // Wait until the handler gets three events!
 
 	// Cancel the context and wait until the client stops running.
 	cancel()
 	clientWg.Wait()
 }
+
+// openSignaler signals on opened, without blocking, for every Open event.
+type openSignaler struct {
+	opened chan struct{}
+}
+
+func (o *openSignaler) Open(ctx context.Context, timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	select {
+	case o.opened <- struct{}{}:
+	default:
+	}
+}
+
+func (o *openSignaler) Close(ctx context.Context, timestamp time.Time, uuid string) {}
+
+func TestClientTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := NewTCP("localhost:0").(*server)
+	rtx.Must(srv.Listen(), "Could not listen")
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+
+	h := &openSignaler{opened: make(chan struct{}, 1)}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRunTCP(ctx, srv.unixListener.Addr().String(), h)
+		clientWg.Done()
+	}()
+
+	// The client may not have connected yet, so keep sending events until one
+	// is received.
+	for received := false; !received; {
+		srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+		select {
+		case <-h.opened:
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	clientWg.Wait()
+}
+
+// closeRecorder records the SockIDs of Close events.
+type closeRecorder struct {
+	openSignaler
+	ids chan *inetdiag.SockID
+}
+
+func (c *closeRecorder) Close(ctx context.Context, timestamp time.Time, uuid string) {
+	panic("Close should not be called for a CloseWithIDHandler")
+}
+
+func (c *closeRecorder) CloseWithID(ctx context.Context, timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	c.ids <- id
+}
+
+func TestClientCloseWithID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := NewTCP("localhost:0").(*server)
+	rtx.Must(srv.Listen(), "Could not listen")
+	srvCtx, srvCancel := context.WithCancel(context.Background())
+	go srv.Serve(srvCtx)
+	defer srvCancel()
+
+	h := &closeRecorder{openSignaler{opened: make(chan struct{}, 1)}, make(chan *inetdiag.SockID, 2)}
+	clientWg := sync.WaitGroup{}
+	clientWg.Add(1)
+	go func() {
+		MustRunTCP(ctx, srv.unixListener.Addr().String(), h)
+		clientWg.Done()
+	}()
+	for received := false; !received; {
+		srv.FlowCreated(time.Now(), "fakeuuid", inetdiag.SockID{})
+		select {
+		case <-h.opened:
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	id := inetdiag.SockID{SrcIP: "127.0.0.1", SPort: 2, DstIP: "10.0.0.1", DPort: 3, Cookie: 1}
+	srv.FlowDeleted(time.Now(), "fakeuuid", &id)
+	srv.FlowDeleted(time.Now(), "fakeuuid", nil)
+	if got := <-h.ids; got == nil || *got != id {
+		t.Errorf("CloseWithID() got %+v, want %+v", got, id)
+	}
+	if got := <-h.ids; got != nil {
+		t.Errorf("CloseWithID() got %+v, want nil", got)
+	}
+
+	cancel()
+	clientWg.Wait()
+}
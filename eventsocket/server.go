@@ -7,18 +7,20 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 //go:generate stringer -type=TCPEvent
 
 // TCPEvent refers to the kind of socket event that has occurred. Right now, we
-// support Open and Close events, but it is not impossible to imagine future
-// versions that do more.
+// support Open, Close, and StateChange events, but it is not impossible to
+// imagine future versions that do more.
 type TCPEvent int
 
 const (
@@ -26,6 +28,10 @@ const (
 	Open = TCPEvent(iota)
 	// Close is sent when a TCP connection is closed.
 	Close
+	// StateChange is sent when a TCP connection moves to a new tcp.State.  It is
+	// only sent if the producer has opted in, as most clients only need Open and
+	// Close.
+	StateChange
 )
 
 // FlowEvent is the data that is sent down the socket in JSONL form to the
@@ -35,33 +41,98 @@ type FlowEvent struct {
 	Event     TCPEvent
 	Timestamp time.Time
 	UUID      string
-	ID        *inetdiag.SockID //`json:",omitempty"`
+	ID        *inetdiag.SockID `json:",omitempty"` // Set for Open, and for Close when known.
+	State     *tcp.State       `json:",omitempty"` // The new state, for StateChange events.
+	OldState  *tcp.State       `json:",omitempty"` // The previous state, for StateChange events.
 }
 
 // Server is the interface that has the methods that actually serve the events
-// over the unix domain socket. You should make new Server objects with
-// eventsocket.New or eventsocket.NullServer.
+// over the unix domain socket (or TCP). You should make new Server objects with
+// eventsocket.New, eventsocket.NewTCP, eventsocket.NewWithListener, or
+// eventsocket.NullServer.
 type Server interface {
 	Listen() error
 	Serve(context.Context) error
 	FlowCreated(timestamp time.Time, uuid string, sockid inetdiag.SockID)
-	FlowDeleted(timestamp time.Time, uuid string)
+	FlowDeleted(timestamp time.Time, uuid string, id *inetdiag.SockID)
+	FlowStateChanged(timestamp time.Time, uuid string, oldState, newState tcp.State)
+}
+
+// Option configures a Server made by New or NewTCP.
+type Option func(*server)
+
+// ReplayOpenFlows makes the server track the flows that are open, and send
+// each new client an Open event for each of them, with its original timestamp,
+// before any new events.  Without it, clients that connect mid-run only learn
+// about flows that open after they connect.
+func ReplayOpenFlows() Option {
+	return func(s *server) {
+		s.open = make(map[string]*FlowEvent)
+		s.inFlight = make(map[*FlowEvent]struct{})
+	}
 }
 
 type server struct {
 	eventC       chan *FlowEvent
-	filename     string
+	network      string
+	filename     string // The listening address, for non-unix networks.
 	clients      map[net.Conn]struct{}
 	unixListener net.Listener
 	mutex        sync.Mutex
 	servingWG    sync.WaitGroup
+
+	// If ReplayOpenFlows is set, open holds the Open events of live flows, by
+	// UUID, and inFlight the Open events that are queued, but not yet sent.
+	// They are updated as events are queued, even if they are dropped, so
+	// they are guarded by openMu, rather than mutex, which is held while
+	// writing to clients.  When both are held, mutex is acquired first.
+	open     map[string]*FlowEvent
+	inFlight map[*FlowEvent]struct{}
+	openMu   sync.Mutex
 }
 
 func (s *server) addClient(c net.Conn) {
 	log.Println("Adding new TCP event client", c)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	// Replay under the mutex, so that the client sees each flow's events in order.
+	if err := s.replayOpenFlows(c); err != nil {
+		log.Println("Replay to client", c, "failed with error", err, " - closing the client.")
+		c.Close()
+		return
+	}
 	s.clients[c] = struct{}{}
+	metrics.EventSocketClients.Inc()
+}
+
+// replayOpenFlows sends the Open events of the live flows to c, oldest first.
+// Open events that are still queued are skipped, since c receives them once it
+// has been added.  The caller must hold the mutex.
+func (s *server) replayOpenFlows(c net.Conn) error {
+	if s.open == nil {
+		return nil
+	}
+	s.openMu.Lock()
+	events := make([]*FlowEvent, 0, len(s.open))
+	for _, event := range s.open {
+		if _, queued := s.inFlight[event]; !queued {
+			events = append(events, event)
+		}
+	}
+	s.openMu.Unlock()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	for _, event := range events {
+		b, err := json.Marshal(*event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(c, string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *server) removeClient(c net.Conn) {
@@ -75,11 +146,18 @@ func (s *server) removeClient(c net.Conn) {
 		return
 	}
 	delete(s.clients, c)
+	metrics.EventSocketClients.Dec()
 }
 
-func (s *server) sendToAllListeners(data string) {
+// sendToAllListeners sends data, the encoded event, to every client.
+func (s *server) sendToAllListeners(event *FlowEvent, data string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.open != nil && event.Event == Open {
+		s.openMu.Lock()
+		delete(s.inFlight, event)
+		s.openMu.Unlock()
+	}
 	for c := range s.clients {
 		_, err := fmt.Fprintln(c, data)
 		if err != nil {
@@ -108,7 +186,7 @@ func (s *server) notifyClients(ctx context.Context) {
 			log.Printf("WARNING: Bad event received %v (err: %v)\n", event, err)
 			continue
 		}
-		s.sendToAllListeners(string(b))
+		s.sendToAllListeners(event, string(b))
 	}
 }
 
@@ -121,12 +199,17 @@ func (s *server) Listen() error {
 	// even if the Serve() goroutine is scheduled weirdly, servingWG.Wait() will
 	// definitely wait for Serve() to finish.
 	s.servingWG.Add(1)
+	if s.unixListener != nil {
+		return nil // Provided by NewWithListener.
+	}
 	var err error
-	// Delete any existing socket file before trying to listen on it. Unclean
-	// shutdowns can cause orphaned, stale socket files to hang around, causing
-	// this service to fail to start because it can't create the socket.
-	os.Remove(s.filename)
-	s.unixListener, err = net.Listen("unix", s.filename)
+	if s.network == "unix" {
+		// Delete any existing socket file before trying to listen on it. Unclean
+		// shutdowns can cause orphaned, stale socket files to hang around, causing
+		// this service to fail to start because it can't create the socket.
+		os.Remove(s.filename)
+	}
+	s.unixListener, err = net.Listen(s.network, s.filename)
 	return err
 }
 
@@ -165,43 +248,117 @@ func (s *server) Serve(ctx context.Context) error {
 	return err
 }
 
+// queue queues the event for the clients, without blocking, so that the
+// saver's throughput never depends on the clients.  If the queue is full, the
+// event is dropped and counted in EventSocketDroppedCounter.  Open flows are
+// tracked here, rather than as events are sent, so that dropped Close events
+// do not leave their flows open forever.
+func (s *server) queue(event *FlowEvent, kind string) {
+	metrics.FlowEventsCounter.WithLabelValues(kind).Inc()
+	if s.open != nil {
+		s.openMu.Lock()
+		defer s.openMu.Unlock()
+		switch event.Event {
+		case Open:
+			s.open[event.UUID] = event
+		case Close:
+			delete(s.open, event.UUID)
+		}
+	}
+	select {
+	case s.eventC <- event:
+		metrics.EventSocketEventsCounter.WithLabelValues(kind).Inc()
+		if s.open != nil && event.Event == Open {
+			s.inFlight[event] = struct{}{}
+		}
+	default:
+		metrics.EventSocketDroppedCounter.WithLabelValues(kind).Inc()
+	}
+}
+
 // FlowCreated should be called whenever tcpinfo notices a new flow is created.
 func (s *server) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID) {
-	s.eventC <- &FlowEvent{
+	s.queue(&FlowEvent{
 		Event:     Open,
 		Timestamp: timestamp,
 		ID:        &id,
 		UUID:      uuid,
-	}
-	metrics.FlowEventsCounter.WithLabelValues("open").Inc()
+	}, "open")
 }
 
 // FlowDeleted should be called whenever tcpinfo notices a flow has been retired.
-func (s *server) FlowDeleted(timestamp time.Time, uuid string) {
-	s.eventC <- &FlowEvent{
+// The id, if not nil, is the SockID the flow was created with, so that clients
+// that missed the Open event can still identify the flow.
+func (s *server) FlowDeleted(timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	s.queue(&FlowEvent{
 		Event:     Close,
 		Timestamp: timestamp,
+		ID:        id,
 		UUID:      uuid,
-	}
+	}, "close")
+}
+
+// FlowStateChanged should be called whenever tcpinfo notices a flow has changed
+// TCP state, if state change events are enabled.
+func (s *server) FlowStateChanged(timestamp time.Time, uuid string, oldState, newState tcp.State) {
+	s.queue(&FlowEvent{
+		Event:     StateChange,
+		Timestamp: timestamp,
+		UUID:      uuid,
+		State:     &newState,
+		OldState:  &oldState,
+	}, "state")
 }
 
 // New makes a new server that serves clients on the provided Unix domain socket.
-func New(filename string) Server {
+func New(filename string, opts ...Option) Server {
+	return newServer("unix", filename, opts)
+}
+
+// NewTCP makes a new server that serves clients on the provided TCP address,
+// for sidecars that do not share a filesystem with tcp-info.  The protocol is
+// identical to the one served by New.
+//
+// There is no authentication or encryption, and every client receives the
+// endpoints of every connection, so the address should normally be bound to
+// localhost (e.g. "localhost:9990"), and only exposed further on a trusted
+// network.
+func NewTCP(addr string, opts ...Option) Server {
+	return newServer("tcp", addr, opts)
+}
+
+// NewWithListener makes a new server that serves clients on l, e.g. a socket
+// passed in by systemd socket activation.  Listen does nothing but prepare for
+// Serve, which still must be called after it, and the server closes l when its
+// context is canceled.
+func NewWithListener(l net.Listener, opts ...Option) Server {
+	s := newServer(l.Addr().Network(), l.Addr().String(), opts)
+	s.unixListener = l
+	return s
+}
+
+func newServer(network, address string, opts []Option) *server {
 	c := make(chan *FlowEvent, 100)
-	return &server{
-		filename: filename,
+	s := &server{
+		network:  network,
+		filename: address,
 		eventC:   c,
 		clients:  make(map[net.Conn]struct{}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 type nullServer struct{}
 
 // Empty implementations that do no harm.
-func (nullServer) Listen() error                                                    { return nil }
-func (nullServer) Serve(context.Context) error                                      { return nil }
-func (nullServer) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID) {}
-func (nullServer) FlowDeleted(timestamp time.Time, uuid string)                     {}
+func (nullServer) Listen() error                                                                   { return nil }
+func (nullServer) Serve(context.Context) error                                                     { return nil }
+func (nullServer) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID)                {}
+func (nullServer) FlowDeleted(timestamp time.Time, uuid string, id *inetdiag.SockID)               {}
+func (nullServer) FlowStateChanged(timestamp time.Time, uuid string, oldState, newState tcp.State) {}
 
 // NullServer returns a Server that does nothing. It is made so that code that
 // may or may not want to use a eventsocket can receive a Server interface and
@@ -209,3 +366,67 @@ func (nullServer) FlowDeleted(timestamp time.Time, uuid string)
 func NullServer() Server {
 	return nullServer{}
 }
+
+// RecordingServer is a Server that records every flow event it is given,
+// instead of sending it to clients.  It is intended for use in tests.
+type RecordingServer struct {
+	mu     sync.Mutex
+	events []FlowEvent
+}
+
+// Listen does nothing.
+func (*RecordingServer) Listen() error { return nil }
+
+// Serve does nothing.
+func (*RecordingServer) Serve(context.Context) error { return nil }
+
+// FlowCreated records an Open event.
+func (r *RecordingServer) FlowCreated(timestamp time.Time, uuid string, id inetdiag.SockID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, FlowEvent{
+		Event:     Open,
+		Timestamp: timestamp,
+		ID:        &id,
+		UUID:      uuid,
+	})
+}
+
+// FlowDeleted records a Close event.
+func (r *RecordingServer) FlowDeleted(timestamp time.Time, uuid string, id *inetdiag.SockID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, FlowEvent{
+		Event:     Close,
+		Timestamp: timestamp,
+		ID:        id,
+		UUID:      uuid,
+	})
+}
+
+// FlowStateChanged records a StateChange event.
+func (r *RecordingServer) FlowStateChanged(timestamp time.Time, uuid string, oldState, newState tcp.State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, FlowEvent{
+		Event:     StateChange,
+		Timestamp: timestamp,
+		UUID:      uuid,
+		State:     &newState,
+		OldState:  &oldState,
+	})
+}
+
+// Events returns a copy of all the events recorded so far, in the order they
+// were received.
+func (r *RecordingServer) Events() []FlowEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]FlowEvent(nil), r.events...)
+}
+
+// NewRecordingServer returns a Server that saves all flow events, so that tests
+// can verify the events generated by the code under test.
+func NewRecordingServer() *RecordingServer {
+	return &RecordingServer{}
+}
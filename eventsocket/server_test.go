@@ -8,13 +8,17 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 func TestServer(t *testing.T) {
@@ -24,6 +28,10 @@ func TestServer(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(dir)
 
+	clientsBefore := testutil.ToFloat64(metrics.EventSocketClients)
+	opensBefore := testutil.ToFloat64(metrics.EventSocketEventsCounter.WithLabelValues("open"))
+	closesBefore := testutil.ToFloat64(metrics.FlowEventsCounter.WithLabelValues("close"))
+
 	srv := New(dir + "/tcpevents.sock").(*server)
 	srv.Listen()
 	go srv.Serve(ctx)
@@ -40,9 +48,12 @@ func TestServer(t *testing.T) {
 			break
 		}
 	}
+	if clients := testutil.ToFloat64(metrics.EventSocketClients); clients != clientsBefore+1 {
+		t.Errorf("EventSocketClients = %v, want %v", clients, clientsBefore+1)
+	}
 
 	// Send an event on the server, to cause the client to be notified by the server.
-	srv.FlowDeleted(time.Now(), "fakeuuid")
+	srv.FlowDeleted(time.Now(), "fakeuuid", nil)
 	r := bufio.NewScanner(c)
 	if !r.Scan() {
 		t.Error("Should have been able to scan until the next newline, but couldn't")
@@ -52,6 +63,9 @@ func TestServer(t *testing.T) {
 	if event.Event != Close || event.UUID != "fakeuuid" {
 		t.Error("Event was supposed to be {Close, 'fakeuuid'}, not", event)
 	}
+	if strings.Contains(r.Text(), `"ID"`) {
+		t.Error("A Close event without an ID should omit it:", r.Text())
+	}
 
 	// Send another event on the server, to cause the client to be notified by the server.
 	before := time.Now()
@@ -66,10 +80,22 @@ func TestServer(t *testing.T) {
 		t.Error("It should be true that", before, "<", event.Timestamp, "<", after)
 	}
 	event.Timestamp = time.Time{}
-	if diff := deep.Equal(event, FlowEvent{Open, time.Time{}, "fakeuuid2", &emptyID}); diff != nil {
+	if diff := deep.Equal(event, FlowEvent{Open, time.Time{}, "fakeuuid2", &emptyID, nil, nil}); diff != nil {
 		t.Error("Event differed from expected:", diff)
 	}
 
+	// State changes carry both the old and new states.
+	srv.FlowStateChanged(time.Now(), "fakeuuid2", tcp.ESTABLISHED, tcp.FIN_WAIT1)
+	if !r.Scan() {
+		t.Error("Should have been able to scan until the next newline, but couldn't")
+	}
+	event = FlowEvent{}
+	rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshall")
+	if event.Event != StateChange || event.OldState == nil || *event.OldState != tcp.ESTABLISHED ||
+		event.State == nil || *event.State != tcp.FIN_WAIT1 {
+		t.Error("Event was supposed to be {StateChange, ESTABLISHED -> FIN_WAIT1}, not", event)
+	}
+
 	// Close down things on the client side. When the server next tries to send
 	// something to the client, the client should get removed from the set of
 	// active clients.
@@ -81,7 +107,7 @@ func TestServer(t *testing.T) {
 	// No SIGSEGV == success!
 
 	// Send an event to ensure that cleanup should occur.
-	srv.FlowDeleted(time.Now(), "fakeuuid")
+	srv.FlowDeleted(time.Now(), "fakeuuid", nil)
 
 	// Busy wait until the server has unregistered the client
 	for {
@@ -92,6 +118,15 @@ func TestServer(t *testing.T) {
 			break
 		}
 	}
+	if clients := testutil.ToFloat64(metrics.EventSocketClients); clients != clientsBefore {
+		t.Errorf("EventSocketClients = %v, want %v", clients, clientsBefore)
+	}
+	if opens := testutil.ToFloat64(metrics.EventSocketEventsCounter.WithLabelValues("open")); opens != opensBefore+1 {
+		t.Errorf("EventSocketEventsCounter{open} = %v, want %v", opens, opensBefore+1)
+	}
+	if closes := testutil.ToFloat64(metrics.FlowEventsCounter.WithLabelValues("close")); closes != closesBefore+2 {
+		t.Errorf("FlowEventsCounter{close} = %v, want %v", closes, closesBefore+2)
+	}
 	// Cancel the context to shutdown the server.
 	cancel()
 	// Wait for every component goroutine of the server to complete.
@@ -99,6 +134,156 @@ func TestServer(t *testing.T) {
 	// No timeout == success!
 }
 
+func TestServerReplayOpenFlows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "TestServerReplayOpenFlows")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	srv := New(dir+"/tcpevents.sock", ReplayOpenFlows()).(*server)
+	rtx.Must(srv.Listen(), "Could not listen")
+	go srv.Serve(ctx)
+
+	dial := func() (net.Conn, func() FlowEvent) {
+		c, err := net.Dial("unix", dir+"/tcpevents.sock")
+		rtx.Must(err, "Could not open UNIX domain socket")
+		r := bufio.NewScanner(c)
+		return c, func() FlowEvent {
+			if !r.Scan() {
+				t.Fatal("Should have been able to scan until the next newline, but couldn't")
+			}
+			var event FlowEvent
+			rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshal")
+			return event
+		}
+	}
+	// The first client sees every event, so that once it has read them, the
+	// server has sent them all.
+	observer, observe := dial()
+	defer observer.Close()
+	for {
+		srv.mutex.Lock()
+		length := len(srv.clients)
+		srv.mutex.Unlock()
+		if length == 1 {
+			break
+		}
+	}
+
+	// Open three flows, and close one, before the second client connects.
+	start := time.Date(2019, 4, 2, 14, 12, 37, 0, time.UTC)
+	srv.FlowCreated(start, "flow1", inetdiag.SockID{SPort: 1})
+	srv.FlowCreated(start.Add(time.Second), "flow2", inetdiag.SockID{SPort: 2})
+	srv.FlowCreated(start.Add(2*time.Second), "flow3", inetdiag.SockID{SPort: 3})
+	srv.FlowDeleted(start.Add(3*time.Second), "flow2", nil)
+	for i := 0; i < 4; i++ {
+		observe()
+	}
+
+	c, next := dial()
+	defer c.Close()
+
+	// The live flows are replayed, oldest first, and then new events follow.
+	for _, want := range []struct {
+		uuid  string
+		sport uint16
+	}{{"flow1", 1}, {"flow3", 3}} {
+		event := next()
+		if event.Event != Open || event.UUID != want.uuid || event.ID == nil || event.ID.SPort != want.sport {
+			t.Errorf("Got %+v, want an Open event for %s", event, want.uuid)
+		}
+	}
+	srv.FlowDeleted(start.Add(4*time.Second), "flow1", nil)
+	if event := next(); event.Event != Close || event.UUID != "flow1" {
+		t.Errorf("Got %+v, want a Close event for flow1", event)
+	}
+}
+
+func TestNewWithListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := net.Listen("tcp", "localhost:0")
+	rtx.Must(err, "Could not listen")
+
+	srv := NewWithListener(l).(*server)
+	rtx.Must(srv.Listen(), "Listen should not fail with a provided listener")
+	go srv.Serve(ctx)
+	c, err := net.Dial("tcp", l.Addr().String())
+	rtx.Must(err, "Could not connect to the provided listener")
+	defer c.Close()
+	// Busy wait until the server has registered the client
+	for {
+		srv.mutex.Lock()
+		length := len(srv.clients)
+		srv.mutex.Unlock()
+		if length > 0 {
+			break
+		}
+	}
+
+	srv.FlowCreated(time.Now(), "flow1", inetdiag.SockID{SPort: 1})
+	r := bufio.NewScanner(c)
+	if !r.Scan() {
+		t.Fatal("Should have been able to scan until the next newline, but couldn't")
+	}
+	var event FlowEvent
+	rtx.Must(json.Unmarshal(r.Bytes(), &event), "Could not unmarshal")
+	if event.Event != Open || event.UUID != "flow1" {
+		t.Errorf("Got %+v, want an Open event for flow1", event)
+	}
+
+	// Canceling the context closes the provided listener.
+	cancel()
+	srv.servingWG.Wait()
+	if _, err := l.Accept(); err == nil {
+		t.Error("The listener should have been closed")
+	}
+}
+
+func TestServerDropsWhenFull(t *testing.T) {
+	// Nothing serves the queue, so it fills, and later events must be dropped
+	// rather than block the caller.
+	srv := New("/nonexistent/tcpevents.sock").(*server)
+	for i := 0; i < cap(srv.eventC); i++ {
+		srv.FlowCreated(time.Now(), "fill", inetdiag.SockID{})
+	}
+	before := testutil.ToFloat64(metrics.EventSocketDroppedCounter.WithLabelValues("open"))
+	done := make(chan struct{})
+	go func() {
+		srv.FlowCreated(time.Now(), "flow1", inetdiag.SockID{})
+		srv.FlowDeleted(time.Now(), "flow1", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FlowCreated and FlowDeleted blocked on a full queue")
+	}
+	if got := testutil.ToFloat64(metrics.EventSocketDroppedCounter.WithLabelValues("open")) - before; got != 1 {
+		t.Error("Expected one dropped open event, got", got)
+	}
+	if len(srv.eventC) != cap(srv.eventC) {
+		t.Error("The queue should still be full, but has", len(srv.eventC))
+	}
+}
+
+func TestServerDroppedCloseEndsOpenFlow(t *testing.T) {
+	// Nothing serves the queue, so both events for flow1 are dropped.
+	srv := New("/nonexistent/tcpevents.sock", ReplayOpenFlows()).(*server)
+	for i := 0; i < cap(srv.eventC); i++ {
+		srv.FlowCreated(time.Now(), "fill", inetdiag.SockID{})
+	}
+	srv.FlowCreated(time.Now(), "flow1", inetdiag.SockID{})
+	srv.FlowDeleted(time.Now(), "flow1", nil)
+	if _, ok := srv.open["flow1"]; ok {
+		t.Error("flow1 should not be open after its Close event was dropped")
+	}
+	if len(srv.open) != 1 || len(srv.inFlight) != cap(srv.eventC) {
+		t.Errorf("Expected 1 open flow, and %d queued Open events, got %d and %d", cap(srv.eventC), len(srv.open), len(srv.inFlight))
+	}
+}
+
 func TestTCPEvent_String(t *testing.T) {
 	tests := []struct {
 		want string
@@ -106,6 +291,7 @@ func TestTCPEvent_String(t *testing.T) {
 	}{
 		{"Open", Open},
 		{"Close", Close},
+		{"StateChange", StateChange},
 		{"TCPEvent(3)", TCPEvent(3)},
 	}
 	for _, tt := range tests {
@@ -125,6 +311,36 @@ func TestNullServer(t *testing.T) {
 	rtx.Must(srv.Listen(), "Could not listen")
 	rtx.Must(srv.Serve(ctx), "Could not serve")
 	srv.FlowCreated(time.Now(), "", inetdiag.SockID{})
-	srv.FlowDeleted(time.Now(), "")
+	srv.FlowDeleted(time.Now(), "", nil)
+	srv.FlowStateChanged(time.Now(), "", tcp.ESTABLISHED, tcp.CLOSE_WAIT)
 	// No crash == success
 }
+
+func TestRecordingServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := NewRecordingServer()
+	rtx.Must(srv.Listen(), "Could not listen")
+	rtx.Must(srv.Serve(ctx), "Could not serve")
+	if len(srv.Events()) != 0 {
+		t.Error("New server should have no events", srv.Events())
+	}
+
+	ts := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	id := inetdiag.SockID{SrcIP: "127.0.0.1", SPort: 2, DstIP: "10.0.0.1", DPort: 3, Cookie: 1}
+	srv.FlowCreated(ts, "fake-uuid", id)
+	// Modifying the returned slice must not affect the recorded events.
+	srv.Events()[0].UUID = "modified"
+	srv.FlowStateChanged(ts, "fake-uuid", tcp.SYN_SENT, tcp.ESTABLISHED)
+	srv.FlowDeleted(ts.Add(time.Second), "fake-uuid", &id)
+
+	oldState, newState := tcp.SYN_SENT, tcp.ESTABLISHED
+	want := []FlowEvent{
+		{Event: Open, Timestamp: ts, UUID: "fake-uuid", ID: &id},
+		{Event: StateChange, Timestamp: ts, UUID: "fake-uuid", State: &newState, OldState: &oldState},
+		{Event: Close, Timestamp: ts.Add(time.Second), UUID: "fake-uuid", ID: &id},
+	}
+	if diff := deep.Equal(srv.Events(), want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,61 @@
+package inetdiag
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// EphemeralPortStart is the start of the default Linux ephemeral port range
+// (net.ipv4.ip_local_port_range).
+const EphemeralPortStart = 32768
+
+// SockIDAnonymizer anonymizes the parts of a LinuxSockID that the IP anonymizer
+// leaves alone.  Cookies are replaced with a keyed hash, so that each cookie
+// still maps to a single, unique value for as long as the key is unchanged, but
+// cannot be correlated with the original.  Optionally, ports in the ephemeral
+// range are zeroed, while well known service ports are preserved.
+type SockIDAnonymizer struct {
+	key       []byte
+	zeroPorts bool
+}
+
+// NewSockIDAnonymizer creates a SockIDAnonymizer that hashes cookies with key.
+// Use a random key, generated once per run, so that anonymized cookies can not
+// be linked across runs.  If zeroPorts is true, ephemeral ports are also zeroed.
+func NewSockIDAnonymizer(key []byte, zeroPorts bool) *SockIDAnonymizer {
+	return &SockIDAnonymizer{key: append([]byte(nil), key...), zeroPorts: zeroPorts}
+}
+
+// Cookie returns the anonymized value of cookie.  It is never zero.
+func (a *SockIDAnonymizer) Cookie(cookie uint64) uint64 {
+	mac := hmac.New(sha256.New, a.key)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], cookie)
+	mac.Write(b[:])
+	anon := binary.LittleEndian.Uint64(mac.Sum(nil))
+	if anon == 0 {
+		// Zero is treated as a missing cookie.
+		anon = 1
+	}
+	return anon
+}
+
+// Anonymize replaces the cookie, and if configured, the ephemeral ports, of the
+// InetDiagMsg in place.
+func (a *SockIDAnonymizer) Anonymize(raw RawInetDiagMsg) error {
+	msg, err := raw.Parse()
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(msg.ID.IDiagCookie[:], a.Cookie(msg.ID.Cookie()))
+	if a.zeroPorts {
+		if msg.ID.SPort() >= EphemeralPortStart {
+			msg.ID.IDiagSPort = [2]byte{}
+		}
+		if msg.ID.DPort() >= EphemeralPortStart {
+			msg.ID.IDiagDPort = [2]byte{}
+		}
+	}
+	return nil
+}
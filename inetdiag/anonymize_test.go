@@ -0,0 +1,59 @@
+package inetdiag
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func makeRawMsg(cookie uint64, sport, dport uint16) RawInetDiagMsg {
+	data := make([]byte, unsafe.Sizeof(InetDiagMsg{}))
+	raw, _ := SplitInetDiagMsg(data)
+	msg, err := raw.Parse()
+	rtx.Must(err, "Failed to parse InetDiagMsg")
+	for i := 0; i < 8; i++ {
+		msg.ID.IDiagCookie[i] = byte(cookie >> (8 * i))
+	}
+	msg.ID.IDiagSPort = [2]byte{byte(sport >> 8), byte(sport)}
+	msg.ID.IDiagDPort = [2]byte{byte(dport >> 8), byte(dport)}
+	return raw
+}
+
+func TestSockIDAnonymizer(t *testing.T) {
+	a := NewSockIDAnonymizer([]byte("key"), true)
+	raw := makeRawMsg(0x3E8, 443, 50000)
+	rtx.Must(a.Anonymize(raw), "Could not anonymize")
+	msg, _ := raw.Parse()
+	if msg.ID.Cookie() == 0x3E8 || msg.ID.Cookie() != a.Cookie(0x3E8) {
+		t.Errorf("Cookie = %X, want %X", msg.ID.Cookie(), a.Cookie(0x3E8))
+	}
+	if msg.ID.SPort() != 443 || msg.ID.DPort() != 0 {
+		t.Error("Only the ephemeral port should be zeroed", msg.ID.SPort(), msg.ID.DPort())
+	}
+
+	// The same cookie always maps to the same value, and different cookies and
+	// keys map to different values.
+	if a.Cookie(0x3E8) != NewSockIDAnonymizer([]byte("key"), false).Cookie(0x3E8) {
+		t.Error("Anonymized cookies should be deterministic for a given key")
+	}
+	if a.Cookie(0x3E8) == a.Cookie(0x3E9) {
+		t.Error("Different cookies should not collide")
+	}
+	if a.Cookie(0x3E8) == NewSockIDAnonymizer([]byte("other"), false).Cookie(0x3E8) {
+		t.Error("Different keys should give different cookies")
+	}
+
+	// Ports are preserved unless zeroPorts is set.
+	raw = makeRawMsg(0x3E8, 50000, 50001)
+	rtx.Must(NewSockIDAnonymizer([]byte("key"), false).Anonymize(raw), "Could not anonymize")
+	msg, _ = raw.Parse()
+	if msg.ID.SPort() != 50000 || msg.ID.DPort() != 50001 {
+		t.Error("Ports should not have changed", msg.ID.SPort(), msg.ID.DPort())
+	}
+
+	if err := a.Anonymize(RawInetDiagMsg(bytes.Repeat([]byte{0}, 10))); err == nil {
+		t.Error("Short message should fail")
+	}
+}
@@ -34,6 +34,8 @@ import (
 	"unsafe"
 
 	"github.com/m-lab/go/anonymize"
+
+	"github.com/m-lab/tcp-info/tcp"
 )
 
 // Constants from linux.
@@ -50,6 +52,12 @@ var (
 
 	// ErrBadMsgData is used when the NHetlink response has bad or missing data.
 	ErrBadMsgData = errors.New("bad message data from netlink message")
+
+	// ErrDumpOverrun is used when the kernel reports NLMSG_OVERRUN, meaning some of the dump was lost.
+	ErrDumpOverrun = errors.New("netlink dump overrun, response is incomplete")
+
+	// ErrTruncatedMsg is used when a Netlink message's length does not match the data received.
+	ErrTruncatedMsg = errors.New("netlink message length does not match its data")
 )
 
 // ReqV2 is the Netlink request struct, as in linux/inet_diag.h
@@ -256,6 +264,11 @@ type InetDiagMsg struct {
 	IDiagInode   uint32      `csv:"IDM.Inode"`
 }
 
+// StateString returns the name of the TCP state, e.g. "ESTABLISHED".
+func (msg *InetDiagMsg) StateString() string {
+	return tcp.State(msg.IDiagState).String()
+}
+
 const (
 	// RTA_ALIGNTO previously came from syscall, but explicit here to work on Darwin.
 	RTA_ALIGNTO = 4
@@ -380,6 +393,26 @@ type BBRInfo struct {
 	CwndGain   uint32 `csv:"BBR.CwndGain"`   // Cwnd gain shifted left 8 bits
 }
 
+// bbrUnit is a gain of 1.0, in the fixed point units of BBRInfo.
+const bbrUnit = 1 << 8
+
+// Phase returns the BBR mode implied by the gains: STARTUP and DRAIN pace well
+// above and below the estimated bandwidth, PROBE_RTT paces at it with a cwnd
+// gain of at most 1, and PROBE_BW cycles through gains near 1, e.g. 1.25, 0.75
+// and 1 in BBRv1.
+func (b *BBRInfo) Phase() string {
+	switch {
+	case b.PacingGain > bbrUnit*5/4:
+		return "STARTUP"
+	case b.PacingGain < bbrUnit*3/4:
+		return "DRAIN"
+	case b.PacingGain == bbrUnit && b.CwndGain <= bbrUnit:
+		return "PROBE_RTT"
+	default:
+		return "PROBE_BW"
+	}
+}
+
 // LOCALS and PEERS contain an array of sockaddr_storage elements.
 /* ss.c parses these elements like this:
 static const char *format_host_sa(struct sockaddr_storage *sa)
@@ -82,6 +82,27 @@ func toString(id LinuxSockID) string {
 	return fmt.Sprintf("%s:%d -> %s:%d", id.SrcIP().String(), id.SPort(), id.DstIP().String(), id.DPort())
 }
 
+func TestBBRInfoPhase(t *testing.T) {
+	tests := []struct {
+		pacingGain, cwndGain uint32
+		want                 string
+	}{
+		{739, 739, "STARTUP"},
+		{88, 739, "DRAIN"},
+		{320, 512, "PROBE_BW"},
+		{192, 512, "PROBE_BW"},
+		{256, 512, "PROBE_BW"},
+		{256, 256, "PROBE_RTT"},
+		{256, 128, "PROBE_RTT"},
+	}
+	for _, tt := range tests {
+		b := BBRInfo{PacingGain: tt.pacingGain, CwndGain: tt.cwndGain}
+		if got := b.Phase(); got != tt.want {
+			t.Errorf("Phase() with gains %d, %d = %s, want %s", tt.pacingGain, tt.cwndGain, got, tt.want)
+		}
+	}
+}
+
 func TestParseInetDiagMsg(t *testing.T) {
 	var data [100]byte
 	for i := range data {
@@ -100,6 +121,9 @@ func TestParseInetDiagMsg(t *testing.T) {
 	if tcp.State(hdr.IDiagState) != tcp.SYN_RECV {
 		t.Errorf("Failed %+v\n", hdr)
 	}
+	if hdr.StateString() != "SYN_RECV" {
+		t.Error("Wrong StateString", hdr.StateString())
+	}
 
 	if len(value) != 28 {
 		t.Error("Len", len(value))
@@ -0,0 +1,103 @@
+// Package logging provides a minimal leveled logging interface, so that the
+// saver and collector can be connected to structured logging backends.  The
+// default implementation writes to the standard log package.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// The supported log levels, in increasing order of severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelName = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	if s, ok := levelName[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel converts a level name, e.g. "warn", into a Level.  Names are not
+// case sensitive.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for l, s := range levelName {
+		if s == name {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger is the interface used for logging by the saver and collector.  The
+// arguments are handled in the manner of fmt.Println.
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+// StdLogger is a Logger that writes to a standard log.Logger, dropping messages
+// below Level.  Messages other than Info are prefixed with their level, so that
+// Info output is unchanged from plain log.Println.
+type StdLogger struct {
+	Logger *log.Logger // If nil, the standard logger is used.
+	Level  Level
+}
+
+// NewStdLogger returns a StdLogger writing messages at or above level to l.  If
+// l is nil, messages are written to the standard logger.
+func NewStdLogger(l *log.Logger, level Level) *StdLogger {
+	return &StdLogger{Logger: l, Level: level}
+}
+
+// output is always called from one of the Logger methods, so the caller of
+// that method is at depth 3, as needed for Lshortfile.
+func (sl *StdLogger) output(level Level, v []interface{}) {
+	if level < sl.Level {
+		return
+	}
+	msg := fmt.Sprintln(v...)
+	if level != LevelInfo {
+		msg = level.String() + ": " + msg
+	}
+	l := sl.Logger
+	if l == nil {
+		l = log.Default()
+	}
+	l.Output(3, msg)
+}
+
+// Debug logs a message at LevelDebug.
+func (sl *StdLogger) Debug(v ...interface{}) { sl.output(LevelDebug, v) }
+
+// Info logs a message at LevelInfo.
+func (sl *StdLogger) Info(v ...interface{}) { sl.output(LevelInfo, v) }
+
+// Warn logs a message at LevelWarn.
+func (sl *StdLogger) Warn(v ...interface{}) { sl.output(LevelWarn, v) }
+
+// Error logs a message at LevelError.
+func (sl *StdLogger) Error(v ...interface{}) { sl.output(LevelError, v) }
+
+// Default is the Logger used when none is configured.  It may be replaced,
+// e.g. to change the level, before logging starts.
+var Default Logger = NewStdLogger(nil, LevelInfo)
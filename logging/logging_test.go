@@ -0,0 +1,83 @@
+package logging_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/tcp-info/logging"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := logging.NewStdLogger(log.New(&buf, "", log.Lshortfile), logging.LevelInfo)
+
+	l.Debug("dropped")
+	l.Info("info", 1)
+	l.Warn("warn", 2)
+	l.Error("error", 3)
+
+	want := "logging_test.go:17: info 1\n" +
+		"logging_test.go:18: WARN: warn 2\n" +
+		"logging_test.go:19: ERROR: error 3\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	l.Level = logging.LevelError
+	l.Warn("dropped")
+	if buf.Len() != 0 {
+		t.Error("Warn should be dropped at LevelError:", buf.String())
+	}
+	l.Level = logging.LevelDebug
+	l.Debug("debug")
+	if !strings.HasSuffix(buf.String(), "DEBUG: debug\n") {
+		t.Error("Wrong debug output:", buf.String())
+	}
+}
+
+func TestStdLoggerDefault(t *testing.T) {
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}()
+
+	logging.NewStdLogger(nil, logging.LevelInfo).Info("to std log")
+	if buf.String() != "to std log\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    logging.Level
+		wantErr bool
+	}{
+		{name: "debug", want: logging.LevelDebug},
+		{name: "INFO", want: logging.LevelInfo},
+		{name: " Warn ", want: logging.LevelWarn},
+		{name: "error", want: logging.LevelError},
+		{name: "fatal", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := logging.ParseLevel(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if logging.Level(7).String() != "Level(7)" {
+		t.Error("Wrong string for unknown level:", logging.Level(7))
+	}
+}
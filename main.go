@@ -5,11 +5,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"runtime"
 	"runtime/trace"
+	"time"
 
 	"github.com/m-lab/tcp-info/eventsocket"
 
@@ -22,8 +25,12 @@ import (
 	_ "net/http/pprof" // Support profiling
 
 	"github.com/m-lab/tcp-info/collector"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/logging"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
 )
 
 /*
@@ -55,8 +62,41 @@ var (
 	reps            int
 	enableTrace     bool
 	outputDir       string
+	fileAge         time.Duration
+	idleTimeout     time.Duration
+	binaryOutput    bool
+	slimCache       bool
+	minInterval     time.Duration
+	stateEvents     bool
+	replayFlows     bool
+	handshakes      bool
+	unifiedTime     bool
+	deliveryRates   bool
+	dropOnFull      bool
+	states          string
+	families        string
+	pollJitter      float64
+	logLevel        string
+	readyMaxAge     time.Duration
+	includeLocal    bool
+	maxFileBytes    int64
+	rawDump         string
+	retention       time.Duration
+	resume          bool
+	fsyncFiles      bool
+	cgroupMatch     string
+	bbrChanges      bool
+	fileName        string
+	saverBuffer     int
+	marshallers     int
+	marshalBuffer   int
+	anonCookies     bool
+	anonPorts       bool
+	attributeNames  bool
+	labels          netlink.Labels
 	excludeSrcPorts = flagx.StringArray{}
 	excludeDstIPs   = flagx.StringArray{}
+	localCIDRs      = flagx.StringArray{}
 )
 
 func init() {
@@ -66,8 +106,44 @@ func init() {
 	flag.IntVar(&reps, "reps", 0, "How many cycles should be recorded, 0 means continuous")
 	flag.BoolVar(&enableTrace, "trace", false, "Enable trace")
 	flag.StringVar(&outputDir, "output", "", "Directory in which to put the resulting tree of data. Default is the current directory.")
+	flag.DurationVar(&fileAge, "file-age", saver.DefaultFileAgeLimit, "How long to write each connection file before starting the next one.")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "If non-zero, close the file of a connection with no snapshot saved for this long.  Its next snapshot starts a new file.")
+	flag.BoolVar(&fsyncFiles, "fsync", false, "Fsync each connection file when it is closed, e.g. on rotation, so that closed files survive a crash, at the cost of some IO.")
+	flag.StringVar(&fileName, "filename-template", saver.DefaultFileNameTemplate, "A Go text/template for connection file names, relative to -output, with fields Date, UUID, Sequence, StartTime, Host, Pod, and Ext.  -resume and -retention only find files in the default layout.")
+	flag.Int64Var(&maxFileBytes, "max-file-bytes", 0, "If non-zero, also start the next connection file after about this many uncompressed bytes.")
+	flag.StringVar(&rawDump, "raw-dump", "", "If set, also write every raw netlink message collected to this zstd file, for later reprocessing with netlink.NewRawReader.")
+	flag.DurationVar(&retention, "retention", 0, "If non-zero, delete connection files in date directories older than this, e.g. 720h for 30 days, and then the directories if empty.")
+	flag.BoolVar(&resume, "resume", false, "On startup, continue the file sequence numbers of connections that already have files from yesterday or today, e.g. from before a restart.")
+	flag.BoolVar(&binaryOutput, "binary-output", false, "Write connection files with the compact binary record encoding, instead of JSONL.")
+	flag.DurationVar(&minInterval, "min-snapshot-interval", 0, "If non-zero, save at most one snapshot per connection in this interval, unless the TCP state changes.")
+	flag.BoolVar(&handshakes, "save-handshakes", false, "Save every changed snapshot of connections in SYN_SENT or SYN_RECV, to capture handshake timing, even if it would otherwise be suppressed.")
+	flag.BoolVar(&deliveryRates, "delivery-rates", false, "Observe the kernel's DeliveryRate of each saved snapshot that is not app-limited in tcpinfo_delivery_rate_histogram.")
+	flag.BoolVar(&bbrChanges, "bbr-changes", false, "Distinguish changes to the BBR pacing and cwnd gains, which mark BBR mode transitions, from other attribute changes, and count the transitions in tcpinfo_bbr_phase_transition_total.")
+	flag.BoolVar(&unifiedTime, "unified-timestamp", false, "Give the IPv4 and IPv6 snapshots of each collection cycle the same timestamp, taken once both dumps are complete, instead of separate timestamps.")
+	flag.StringVar(&states, "states", "default", "Comma separated TCP states to collect (e.g. ESTABLISHED,TIME_WAIT), \"all\", or \"default\", which is all except SYN_RECV, TIME_WAIT, and CLOSE.  Sockets only ever seen in TIME_WAIT are counted, but not saved.")
+	flag.StringVar(&families, "families", "both", "Which address families to collect: v4, v6, or both.  Single stack hosts can skip the unused family.")
+	flag.Float64Var(&pollJitter, "poll-jitter", 0, "If non-zero, randomize each polling interval by up to this fraction of it (e.g. 0.2), so that hosts in a fleet do not poll in lockstep.")
+	flag.DurationVar(&readyMaxAge, "ready-max-age", 30*time.Second, "The /ready handler on the metrics port fails if the last collection cycle, or successful netlink dump, is older than this.")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of log messages from the collector and saver: debug, info, warn, or error.")
+	flag.BoolVar(&stateEvents, "eventsocket.state-changes", false, "Also send StateChange events to eventsocket clients whenever a connection changes TCP state.")
+	flag.BoolVar(&replayFlows, "eventsocket.replay-open-flows", false, "Send each new eventsocket client an Open event for every flow that is already open, before any new events.")
+	flag.IntVar(&saverBuffer, "saver-buffer", 2, "How many complete netlink dumps may be queued for the saver.  Each holds every connection's snapshot, so this trades memory for tolerance of saver stalls.")
+	flag.IntVar(&marshallers, "marshallers", 3, "How many goroutines marshal and write snapshots.  More may help on hosts with many cores and connections.  Must be at least 1.")
+	flag.IntVar(&marshalBuffer, "marshal-buffer", saver.DefaultMarshalBufferSize, "How many snapshots each marshaller may queue.  Larger values absorb longer bursts of changes, at the cost of memory.")
+	flag.BoolVar(&dropOnFull, "marshal-drop", false, "Drop snapshots, and count them in tcpinfo_marshaller_overflow_total, when a marshaller queue is full, instead of stalling collection.")
+	flag.BoolVar(&anonCookies, "anonymize.cookie", false, "Replace socket cookies, and the UUIDs derived from them, with a hash keyed randomly on each run.")
+	flag.BoolVar(&anonPorts, "anonymize.ports", false, "Also zero ephemeral (>= 32768) ports.  Requires -anonymize.cookie.")
+	flag.BoolVar(&slimCache, "slim-cache", false, "Cache only the fields needed to detect changes in DIAG_INFO, reducing memory use on hosts with many connections.  Changes in any other attribute are no longer detected, so snapshots that differ only in those are not saved.")
+	flag.BoolVar(&attributeNames, "header-attribute-names", false, "Include the map of attribute names in the header of each connection file.")
+	flag.StringVar(&labels.Host, "metadata.host", "", "The host name to record in the header of each connection file.  Defaults to the name reported by the kernel.")
+	flag.StringVar(&labels.Pod, "metadata.pod", "", "The pod name to record in the header of each connection file.  Defaults to the POD_NAME environment variable, e.g. from the Kubernetes downward API.")
+	flag.StringVar(&labels.Site, "metadata.site", "", "If set, the site name to record in the header of each connection file.")
+	flag.StringVar(&labels.Experiment, "metadata.experiment", "", "If set, the experiment name to record in the header of each connection file.")
+	flag.StringVar(&cgroupMatch, "cgroup", "", "If set, only save connections owned by a process with a cgroup path containing this string, e.g. a container ID.  Finding the owners scans /proc, once per cycle with new connections.")
 	flag.Var(&excludeSrcPorts, "exclude-srcport", "Exclude snapshots with these local ports from saved archives.")
 	flag.Var(&excludeDstIPs, "exclude-dstip", "Exclude snapshots with these remote IPs from saved archives.")
+	flag.BoolVar(&includeLocal, "include-local", false, "Also collect and save local connections, e.g. over loopback.  On hosts with busy local services, this may greatly increase the volume of data.")
+	flag.Var(&localCIDRs, "exclude-local-cidr", "Also treat these CIDR blocks (e.g. 10.0.0.0/8) as local, and exclude them, along with loopback, link-local, multicast, and unspecified addresses.")
 }
 
 // NOTES:
@@ -84,6 +160,43 @@ func main() {
 	flagx.ArgsFromEnv(flag.CommandLine)
 	defer cancel()
 
+	if fileAge <= 0 {
+		log.Fatalf("-file-age must be positive, not %v", fileAge)
+	}
+
+	if marshallers < 1 {
+		log.Fatalf("-marshallers must be at least 1, not %d", marshallers)
+	}
+
+	var collectorOpts collector.Options
+	if states != "default" {
+		mask, err := tcp.ParseStateFlags(states)
+		rtx.Must(err, "Invalid -states flag %q", states)
+		collectorOpts.States = mask
+	}
+	collectorOpts.UnifiedTime = unifiedTime
+	af, err := collector.ParseFamilies(families)
+	rtx.Must(err, "Invalid -families flag")
+	collectorOpts.Families = af
+	if pollJitter < 0 || pollJitter > 1 {
+		log.Fatalf("-poll-jitter must be between 0 and 1, not %v", pollJitter)
+	}
+	collectorOpts.PollJitter = pollJitter
+	fileNameTemplate, err := saver.ParseFileNameTemplate(fileName)
+	rtx.Must(err, "Invalid -filename-template %q", fileName)
+
+	level, err := logging.ParseLevel(logLevel)
+	rtx.Must(err, "Invalid -log-level flag %q", logLevel)
+	logging.Default = logging.NewStdLogger(nil, level)
+
+	// The raw dump path is relative to the working directory, not -output.
+	if rawDump != "" {
+		w, err := zstd.NewWriter(rawDump)
+		rtx.Must(err, "Could not create raw dump file %q", rawDump)
+		defer w.Close()
+		collectorOpts.RawDump = w
+	}
+
 	if outputDir != "" {
 		rtx.PanicOnError(os.MkdirAll(outputDir, 0755), "Could not create the output dir %s", outputDir)
 		rtx.Must(os.Chdir(outputDir), "Could not change to the directory %s", outputDir)
@@ -96,6 +209,9 @@ func main() {
 	// Expose prometheus and pprof metrics on a separate port.
 	promSrv := prometheusx.MustServeMetrics()
 	defer promSrv.Shutdown(ctx)
+	if mux, ok := promSrv.Handler.(*http.ServeMux); ok {
+		mux.Handle("/ready", collector.ReadyHandler(readyMaxAge))
+	}
 
 	if enableTrace {
 		traceFile, err := os.Create("trace")
@@ -106,14 +222,25 @@ func main() {
 
 	// Make and start the event server.
 	eventSrv := eventsocket.NullServer()
-	if *eventsocket.Filename != "" {
-		eventSrv = eventsocket.New(*eventsocket.Filename)
+	eventAddr := *eventsocket.Filename
+	var eventOpts []eventsocket.Option
+	if replayFlows {
+		eventOpts = append(eventOpts, eventsocket.ReplayOpenFlows())
 	}
-	rtx.Must(eventSrv.Listen(), "Could not listen on", *eventsocket.Filename)
+	switch {
+	case *eventsocket.Filename != "" && *eventsocket.Address != "":
+		log.Fatal("Only one of -tcpinfo.eventsocket and -tcpinfo.eventsocket-tcp may be specified")
+	case *eventsocket.Filename != "":
+		eventSrv = eventsocket.New(*eventsocket.Filename, eventOpts...)
+	case *eventsocket.Address != "":
+		eventAddr = *eventsocket.Address
+		eventSrv = eventsocket.NewTCP(eventAddr, eventOpts...)
+	}
+	rtx.Must(eventSrv.Listen(), "Could not listen on", eventAddr)
 	go eventSrv.Serve(ctx)
 
 	ex := &netlink.ExcludeConfig{
-		Local: true,
+		Local: !includeLocal,
 	}
 
 	if len(excludeDstIPs) != 0 {
@@ -134,17 +261,71 @@ func main() {
 			}
 		}
 	}
+	for _, cidr := range localCIDRs {
+		rtx.Must(ex.AddLocalCIDR(cidr), "Invalid -exclude-local-cidr %q", cidr)
+	}
 
-	// Make the saver and construct the message channel, buffering up to 2 batches
-	// of messages without stalling producer. We may want to increase the buffer if
-	// we observe main() stalling.
-	svrChan := make(chan netlink.MessageBlock, 2)
+	// Make the saver and construct the message channel, buffering up to saverBuffer
+	// (by default 2) batches of messages without stalling producer. We may want to
+	// increase the buffer if we observe main() stalling, which shows up in the
+	// tcpinfo_queue_occupancy metric.
+	if saverBuffer < 0 || marshalBuffer < 0 {
+		log.Fatal("-saver-buffer and -marshal-buffer must not be negative")
+	}
+	svrChan := make(chan netlink.MessageBlock, saverBuffer)
 	anon := anonymize.New(anonymize.IPAnonymizationFlag)
-	svr := saver.NewSaver("host", "pod", 3, eventSrv, anon, ex)
+	if labels.Host == "" {
+		host, err := os.Hostname()
+		rtx.Must(err, "Could not get the host name")
+		labels.Host = host
+	}
+	if labels.Pod == "" {
+		labels.Pod = os.Getenv("POD_NAME")
+	}
+	svr := saver.NewSaverWithBuffer(labels.Host, labels.Pod, marshallers, marshalBuffer, eventSrv, anon, ex)
+	svr.FileAgeLimit = fileAge
+	svr.MaxFileBytes = maxFileBytes
+	svr.FileName = fileNameTemplate
+	svr.IdleTimeout = idleTimeout
+	svr.BinaryOutput = binaryOutput
+	svr.SlimCache = slimCache
+	svr.BBRChanges = bbrChanges
+	svr.MinInterval = minInterval
+	svr.StateEvents = stateEvents
+	svr.Handshakes = handshakes
+	svr.DeliveryRates = deliveryRates
+	svr.DropOnFull = dropOnFull
+	svr.AttrNames = attributeNames
+	svr.Labels = labels
+	if fsyncFiles {
+		svr.WriterFactory = saver.LocalWriterFactory{Sync: true}
+	}
+	if cgroupMatch != "" {
+		svr.Cgroups = saver.NewCgroupFilter("/proc", cgroupMatch)
+	}
+	if anonPorts && !anonCookies {
+		log.Fatal("-anonymize.ports requires -anonymize.cookie")
+	}
+	if anonCookies {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		rtx.Must(err, "Could not generate the cookie anonymization key")
+		svr.SockIDAnon = inetdiag.NewSockIDAnonymizer(key, anonPorts)
+	}
+	if resume {
+		// main has already changed to the output directory.
+		n, err := svr.ResumeSequences(".")
+		rtx.Must(err, "Could not scan for files to resume")
+		log.Println("Found files of", n, "connections to resume")
+	}
 	go svr.MessageSaverLoop(svrChan)
+	if retention > 0 {
+		// main has already changed to the output directory.
+		go svr.RetentionLoop(ctx, ".", retention)
+	}
 
 	// Run the collector, possibly forever.
-	totalSeen, totalErr := collector.Run(ctx, reps, svrChan, svr, true)
+	totalSeen, totalErr := collector.Run(ctx, reps, svrChan, svr, ex, collectorOpts)
 
 	// Shut down and clean up after the collector terminates.
 	close(svrChan)
@@ -39,6 +39,63 @@ var (
 		},
 	)
 
+	// CollectionSkewHistogram tracks the wall clock gap between the AF_INET6
+	// and AF_INET dumps in each polling cycle.  Large values indicate that the
+	// collector stalled between the two dumps.
+	CollectionSkewHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_collection_skew_histogram",
+			Help:    "time between the IPv6 and IPv4 netlink dumps in each cycle (seconds)",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+	)
+
+	// SaverBlockHistogram tracks the time the saver spends processing each
+	// MessageBlock.  If this is often longer than the polling interval, the
+	// saver is falling behind, and will eventually stall the collector.
+	SaverBlockHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_saver_block_processing_histogram",
+			Help:    "time the saver spent processing each netlink dump (seconds)",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+	)
+
+	// OutputFileBytesHistogram tracks the uncompressed size of each connection
+	// file, when it is closed, for capacity planning.
+	OutputFileBytesHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_output_file_bytes",
+			Help:    "uncompressed size of each connection file, when it is closed (bytes)",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 12),
+		},
+	)
+
+	// WriteLatencyHistogram tracks the time the marshallers spend writing each
+	// snapshot to its connection file.  Large values indicate a slow disk, or a
+	// saturated compressor.
+	WriteLatencyHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_write_latency_seconds",
+			Help:    "time spent writing each snapshot to its connection file (seconds)",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 12),
+		},
+	)
+
+	// SlowSaverBlockCount counts the MessageBlocks that took the saver longer
+	// than Saver.SlowBlock to process.
+	//
+	// Provides metrics:
+	//   tcpinfo_saver_slow_block_total
+	// Example usage:
+	//   metrics.SlowSaverBlockCount.Inc()
+	SlowSaverBlockCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_saver_slow_block_total",
+			Help: "Number of netlink dumps that took the saver longer than the polling interval to process.",
+		},
+	)
+
 	// ConnectionCountHistogram tracks the number of connections returned by
 	// each syscall.  This ??? includes local connections that are NOT recorded
 	// in the cache or output.
@@ -85,6 +142,102 @@ var (
 			Help: "The total number of errors encountered.",
 		}, []string{"type"})
 
+	// ParseErrorCount counts malformed netlink data, by reason.
+	//
+	// Provides metrics:
+	//   tcpinfo_parse_error_total
+	// Example usage:
+	//   metrics.ParseErrorCount.WithLabelValues("malformed route attribute").Inc()
+	ParseErrorCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_parse_error_total",
+			Help: "The total number of netlink parse errors, by reason.",
+		}, []string{"reason"})
+
+	// CookieCollisionCount counts the times a socket cookie was seen for a
+	// connection with different endpoints than the one already using it.
+	//
+	// Provides metrics:
+	//   tcpinfo_cookie_collision_total
+	// Example usage:
+	//   metrics.CookieCollisionCount.Inc()
+	CookieCollisionCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_cookie_collision_total",
+			Help: "Number of socket cookies reused by a different connection.",
+		},
+	)
+
+	// CounterRegressionCount counts the times a connection's cumulative byte
+	// counter decreased between snapshots, which should never happen.
+	//
+	// Provides metrics:
+	//   tcpinfo_counter_regression_total
+	// Example usage:
+	//   metrics.CounterRegressionCount.WithLabelValues("BytesSent").Inc()
+	CounterRegressionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_counter_regression_total",
+			Help: "Number of decreases in a connection's cumulative byte counters, by counter.",
+		}, []string{"counter"})
+
+	// CAStateTransitionCount counts congestion avoidance state transitions
+	// between successive snapshots.
+	//
+	// Provides metrics:
+	//   tcpinfo_ca_state_transition_total
+	// Example usage:
+	//   metrics.CAStateTransitionCount.WithLabelValues("Open", "Recovery").Inc()
+	CAStateTransitionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_ca_state_transition_total",
+			Help: "The total number of TCP congestion avoidance state transitions.",
+		}, []string{"from", "to"})
+
+	// BBRPhaseTransitionCount counts BBR mode transitions, as implied by the
+	// gains in the BBRInfo of successive snapshots.  Only counted if
+	// saver.Saver.BBRChanges is set.
+	//
+	// Provides metrics:
+	//   tcpinfo_bbr_phase_transition_total
+	// Example usage:
+	//   metrics.BBRPhaseTransitionCount.WithLabelValues("STARTUP", "DRAIN").Inc()
+	BBRPhaseTransitionCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_bbr_phase_transition_total",
+			Help: "The total number of BBR mode transitions.",
+		}, []string{"from", "to"})
+
+	// ConnectionCloseCount counts the connections that disappeared from the
+	// collection, classified by how they appear to have ended: "normal" if the
+	// last snapshot was in a FIN or TIME_WAIT state, "timeout" if the last
+	// TCPInfo showed repeated retransmission timeouts or the Loss state, "reset"
+	// otherwise, and "unknown" if the last snapshot could not be parsed.
+	//
+	// Provides metrics:
+	//   tcpinfo_connection_close_total
+	// Example usage:
+	//   metrics.ConnectionCloseCount.WithLabelValues("normal").Inc()
+	ConnectionCloseCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_connection_close_total",
+			Help: "The total number of connections that disappeared, by the apparent kind of close.",
+		}, []string{"kind"})
+
+	// IdleFileCloseCount counts the connection files closed because the
+	// connection had no snapshots saved for the saver's IdleTimeout.
+	//
+	// Provides metrics:
+	//   tcpinfo_idle_file_close_total
+	// Example usage:
+	//   metrics.IdleFileCloseCount.Inc()
+	IdleFileCloseCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_idle_file_close_total",
+			Help: "Number of connection files closed because the connection was idle.",
+		},
+	)
+
 	// NewFileCount counts the number of connection files written.
 	//
 	// Provides metrics:
@@ -98,6 +251,34 @@ var (
 		},
 	)
 
+	// RetentionFilesRemoved counts the connection files removed because they
+	// were older than the retention period.
+	//
+	// Provides metrics:
+	//   tcpinfo_retention_files_removed_total
+	// Example usage:
+	//   metrics.RetentionFilesRemoved.Inc()
+	RetentionFilesRemoved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_retention_files_removed_total",
+			Help: "Number of expired connection files removed.",
+		},
+	)
+
+	// RetentionBytesRemoved counts the bytes in the connection files removed
+	// because they were older than the retention period.
+	//
+	// Provides metrics:
+	//   tcpinfo_retention_bytes_removed_total
+	// Example usage:
+	//   metrics.RetentionBytesRemoved.Add(float64(size))
+	RetentionBytesRemoved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_retention_bytes_removed_total",
+			Help: "Number of bytes in expired connection files removed.",
+		},
+	)
+
 	// SendRateHistogram tracks the 1 second average TCP send rate from a namespace.
 	// The count field should increment at 60 counts per minute.
 	// The sum field will show the total bits sent over time from this namespace.
@@ -145,6 +326,117 @@ var (
 			},
 		})
 
+	// DeliveryRateHistogram tracks the kernel's DeliveryRate, in bits per second,
+	// of each saved snapshot that was not app-limited, if enabled with
+	// Saver.DeliveryRates.  Unlike the send rate, it estimates the capacity of
+	// each connection's path, rather than the total traffic.
+	DeliveryRateHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "tcpinfo_delivery_rate_histogram",
+			Help: "delivery rate histogram, for snapshots that are not app-limited",
+			Buckets: []float64{
+				0, // We don't really care about small rates, so we use courser measurement below 1Kbps.
+				1, 10, 100,
+				1000, 1580, 2510, 3980, 6310,
+				10000, 15800, 25100, 39800, 63100,
+				100000, 158000, 251000, 398000, 631000,
+				1000000, 1580000, 2510000, 3980000, 6310000,
+				10000000, 15800000, 25100000, 39800000, 63100000,
+				100000000, 158000000, 251000000, 398000000, 631000000,
+				// over 1Gb/sec, we want finer grained accounting.
+				1000000000, 1260000000, 1580000000, 2000000000, 2510000000, 3160000000, 3980000000, 5010000000, 6310000000, 7940000000,
+				10000000000, math.Inf(+1),
+			},
+		})
+
+	// RWndLimitedHistogram tracks the fraction of busy time that each connection
+	// spent limited by the peer's receive window, observed when the connection ends.
+	RWndLimitedHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_rwnd_limited_fraction_histogram",
+			Help:    "fraction of busy time limited by the receive window, per connection",
+			Buckets: []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+		})
+
+	// SndBufLimitedHistogram tracks the fraction of busy time that each connection
+	// spent limited by the local send buffer, observed when the connection ends.
+	SndBufLimitedHistogram = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tcpinfo_sndbuf_limited_fraction_histogram",
+			Help:    "fraction of busy time limited by the send buffer, per connection",
+			Buckets: []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+		})
+
+	// QueueOccupancy tracks the number of items waiting in the saver's input
+	// queue, and in the fullest marshaller queue, sampled once per collection
+	// cycle.  Values near the queue capacity mean the buffer should be larger.
+	//
+	// Provides metrics:
+	//   tcpinfo_queue_occupancy
+	// Example usage:
+	//   metrics.QueueOccupancy.WithLabelValues("saver").Set(2)
+	QueueOccupancy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_queue_occupancy",
+			Help: "Number of items waiting in internal queues, by queue.",
+		}, []string{"queue"})
+
+	// TimeWaitOnlyCount counts the sockets first seen in TIME_WAIT, which are
+	// not saved, since they would each need a file for a single snapshot.
+	//
+	// Provides metrics:
+	//   tcpinfo_time_wait_only_total
+	// Example usage:
+	//   metrics.TimeWaitOnlyCount.Inc()
+	TimeWaitOnlyCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_time_wait_only_total",
+			Help: "Number of sockets first seen in TIME_WAIT, which are not saved.",
+		},
+	)
+
+	// CgroupUnmatchedCount counts the connections that are not saved, because
+	// the process that owns them is not in a matching cgroup.
+	//
+	// Provides metrics:
+	//   tcpinfo_cgroup_unmatched_total
+	// Example usage:
+	//   metrics.CgroupUnmatchedCount.Inc()
+	CgroupUnmatchedCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_cgroup_unmatched_total",
+			Help: "Number of connections not saved because their owner's cgroup did not match.",
+		},
+	)
+
+	// SuppressedSnapshotCount counts the changed snapshots that were not saved
+	// because the connection had been saved too recently.
+	//
+	// Provides metrics:
+	//   tcpinfo_suppressed_snapshot_total
+	// Example usage:
+	//   metrics.SuppressedSnapshotCount.Inc()
+	SuppressedSnapshotCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_suppressed_snapshot_total",
+			Help: "Number of changed snapshots not saved due to the minimum snapshot interval.",
+		},
+	)
+
+	// MarshallerOverflowCount counts the snapshots that were dropped, instead of
+	// saved, because their marshaller queue was full.
+	//
+	// Provides metrics:
+	//   tcpinfo_marshaller_overflow_total
+	// Example usage:
+	//   metrics.MarshallerOverflowCount.Inc()
+	MarshallerOverflowCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_marshaller_overflow_total",
+			Help: "Number of snapshots dropped because the marshaller queue was full.",
+		},
+	)
+
 	// SnapshotCount counts the total number of snapshots collected across all connections.
 	SnapshotCount = promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -169,12 +461,105 @@ var (
 		}, []string{"type"},
 	)
 
+	// NonTCPInfoCount counts the INET_DIAG_INFO attributes of sockets that
+	// are not TCP, which are not decoded as a tcp_info, by protocol.
+	//
+	// Provides metrics:
+	//   tcpinfo_non_tcp_info_total
+	// Example usage:
+	//   metrics.NonTCPInfoCount.WithLabelValues("IPPROTO_UDP").Inc()
+	NonTCPInfoCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_non_tcp_info_total",
+			Help: "Number of INET_DIAG_INFO attributes of non-TCP sockets, by protocol.",
+		}, []string{"protocol"},
+	)
+
+	// BadHeaderLenCount counts the raw netlink messages whose header Len is too
+	// small or too large to be valid, which usually means a corrupt file.
+	//
+	// Provides metrics:
+	//   tcpinfo_bad_header_len_total
+	// Example usage:
+	//   metrics.BadHeaderLenCount.Inc()
+	BadHeaderLenCount = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_bad_header_len_total",
+			Help: "Number of raw netlink messages with an invalid header Len.",
+		},
+	)
+
+	// AttributeCountLimitTotal counts the netlink messages that were truncated because they
+	// contained more than the maximum allowed number of route attributes.
+	AttributeCountLimitTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_attribute_count_limit_total",
+			Help: "Number of netlink messages truncated due to excessive attribute count.",
+		},
+	)
+
+	// AttributeTypeClampedCount counts the route attributes dropped because their
+	// type exceeded netlink.MaxAttributeType, by attribute type.
+	//
+	// Provides metrics:
+	//   tcpinfo_attr_type_clamped_total
+	// Example usage:
+	//   metrics.AttributeTypeClampedCount.WithLabelValues("40").Inc()
+	AttributeTypeClampedCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_attr_type_clamped_total",
+			Help: "Number of route attributes dropped because their type was too large, by type.",
+		}, []string{"type"})
+
+	// FlowEventsCounter counts the flow events generated, by event type.
 	FlowEventsCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "tcpinfo_flow_events_total",
 			Help: "Number of flow events by event type.",
 		}, []string{"event"},
 	)
+
+	// EventSocketClients tracks the number of clients connected to the eventsocket
+	// server.
+	//
+	// Provides metrics:
+	//   tcpinfo_eventsocket_clients
+	// Example usage:
+	//   metrics.EventSocketClients.Inc()
+	EventSocketClients = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tcpinfo_eventsocket_clients",
+			Help: "Number of clients connected to the eventsocket server.",
+		},
+	)
+
+	// EventSocketEventsCounter counts the events queued by the eventsocket server
+	// for its clients, by event type.
+	//
+	// Provides metrics:
+	//   tcpinfo_eventsocket_events_total
+	// Example usage:
+	//   metrics.EventSocketEventsCounter.WithLabelValues("open").Inc()
+	EventSocketEventsCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_eventsocket_events_total",
+			Help: "Number of events queued for eventsocket clients, by event type.",
+		}, []string{"event"},
+	)
+
+	// EventSocketDroppedCounter counts the events dropped by the eventsocket
+	// server because its queue was full, by event type.
+	//
+	// Provides metrics:
+	//   tcpinfo_eventsocket_dropped_total
+	// Example usage:
+	//   metrics.EventSocketDroppedCounter.WithLabelValues("open").Inc()
+	EventSocketDroppedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpinfo_eventsocket_dropped_total",
+			Help: "Number of events dropped because the eventsocket queue was full, by event type.",
+		}, []string{"event"},
+	)
 )
 
 // init() prints a log message to let the user know that the package has been
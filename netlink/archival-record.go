@@ -8,8 +8,10 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"strconv"
 	"time"
@@ -18,18 +20,64 @@ import (
 	"github.com/m-lab/go/logx"
 
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/tcp"
 )
 
+// MaxAttributeCount limits the number of route attributes ParseRouteAttr will
+// parse from a single message.  Normal messages contain well under 20
+// attributes, so this only guards against malformed or malicious messages.
+var MaxAttributeCount = 100
+
+// MaxAttributeType is the largest route attribute type that MakeArchivalRecord
+// will store.  ArchivalRecord.Attributes is sized to the largest type present,
+// so this bounds its size.  The default leaves room for attributes added by
+// kernels newer than inetdiag.INET_DIAG_MAX; larger types are dropped, and
+// counted in metrics.AttributeTypeClampedCount.
+var MaxAttributeType uint16 = 2 * inetdiag.INET_DIAG_MAX
+
+var attrLimitLog = logx.NewLogEvery(nil, time.Second)
+var attrTypeLog = logx.NewLogEvery(nil, time.Second)
+
 /*********************************************************************************************
 *          Internal representation of NetlinkJSONL messages
 *********************************************************************************************/
 
+// SchemaVersion identifies the layout of ArchivalRecords written by this package.
+// It should be incremented whenever the meaning of the Attributes indices changes.
+const SchemaVersion = 1
+
+// Labels identify where a TCP stream was collected, so that consumers need not
+// rely on file names or paths.  They are configured statically, and each is
+// absent if it was not configured.
+type Labels struct {
+	Host       string `json:",omitempty"` // e.g. mlab1
+	Pod        string `json:",omitempty"`
+	Site       string `json:",omitempty"` // e.g. lga03
+	Experiment string `json:",omitempty"` // e.g. ndt
+}
+
 // Metadata contains the metadata for a particular TCP stream.
 type Metadata struct {
 	UUID      string
 	Sequence  int
 	StartTime time.Time
+
+	// SchemaVersion and AttributeNames allow consumers to detect version skew, and
+	// to map Attributes indices to names.  They are absent in older files.
+	SchemaVersion  int            `json:",omitempty"`
+	AttributeNames map[int]string `json:",omitempty"`
+
+	Labels // Encoded as fields of Metadata.
+}
+
+// AttributeNames returns a map from Attributes index to the attribute name.
+func AttributeNames() map[int]string {
+	names := make(map[int]string, len(inetdiag.InetDiagType))
+	for t, name := range inetdiag.InetDiagType {
+		names[int(t)] = name
+	}
+	return names
 }
 
 // ArchivalRecord is a container for parsed InetDiag messages and attributes.
@@ -47,12 +95,18 @@ type ArchivalRecord struct {
 	// Metadata contains connection level metadata.  It is typically included in the very first record
 	// in a file.
 	Metadata *Metadata `json:",omitempty"`
+
+	// slim is true for records produced by Slim, which lack all attributes other than DIAG_INFO.
+	slim bool
 }
 
 // ExcludeConfig provides options for excluding some measurements from archival messages.
 type ExcludeConfig struct {
 	// Local excludes connections from loopback, local unicast, multicast, or unspecified connections.
 	Local bool
+	// LocalCIDRs, if non-nil, replaces the definition of local used by Local, e.g. to
+	// also exclude private ranges, or to keep link-local connections.
+	LocalCIDRs []*net.IPNet
 	// SrcPorts excludes connections from specific source ports.
 	SrcPorts map[uint16]bool
 	DstIPs   map[[16]byte]bool
@@ -93,11 +147,61 @@ func (ex *ExcludeConfig) AddDstIP(dst string) error {
 	return nil
 }
 
+// DefaultLocalCIDRs returns the address ranges that Local excludes by default:
+// loopback, link-local unicast, multicast, and unspecified addresses.
+func DefaultLocalCIDRs() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"127.0.0.0/8", "::1/128", // loopback
+		"169.254.0.0/16", "fe80::/10", // link-local unicast
+		"224.0.0.0/4", "ff00::/8", // multicast
+		"0.0.0.0/32", "::/128", // unspecified
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// AddLocalCIDR adds the given CIDR block, e.g. "10.0.0.0/8", to the ranges that
+// Local excludes.  If LocalCIDRs is nil, it first starts from DefaultLocalCIDRs.
+func (ex *ExcludeConfig) AddLocalCIDR(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if ex.LocalCIDRs == nil {
+		ex.LocalCIDRs = DefaultLocalCIDRs()
+	}
+	ex.LocalCIDRs = append(ex.LocalCIDRs, n)
+	return nil
+}
+
+// isLocal returns true if addr is in LocalCIDRs or, if LocalCIDRs is nil, the
+// default local ranges.
+func (ex *ExcludeConfig) isLocal(addr net.IP) bool {
+	if ex.LocalCIDRs == nil {
+		return isLocal(addr)
+	}
+	for _, n := range ex.LocalCIDRs {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseRouteAttr parses a byte array into slice of NetlinkRouteAttr struct.
 // Derived from "github.com/vishvananda/netlink/nl/nl_linux.go"
+// At most MaxAttributeCount attributes are returned, and any others are dropped.
 func ParseRouteAttr(b []byte) ([]NetlinkRouteAttr, error) {
 	var attrs []NetlinkRouteAttr
 	for len(b) >= SizeofRtAttr {
+		if len(attrs) >= MaxAttributeCount {
+			metrics.AttributeCountLimitTotal.Inc()
+			attrLimitLog.Println("Too many RouteAttrs, dropping all after", MaxAttributeCount)
+			break
+		}
 		a, vbuf, alen, err := netlinkRouteAttrAndValue(b)
 		if err != nil {
 			return nil, err
@@ -113,23 +217,25 @@ func ParseRouteAttr(b []byte) ([]NetlinkRouteAttr, error) {
 // exclude is not nil, MakeArchivalRecord will return nil for any condition
 // matching the exclude config options, e.g. localhost, or source ports. Note
 // that Parse does not populate the Timestamp field, so caller should do so.
+// Malformed messages result in ErrShortInetDiagMsg or ErrBadRouteAttr, and
+// are counted in the tcpinfo_parse_error_total metric.
 func MakeArchivalRecord(msg *NetlinkMessage, exclude *ExcludeConfig) (*ArchivalRecord, error) {
 	if msg.Header.Type != 20 {
 		return nil, ErrNotType20
 	}
 	raw, attrBytes := inetdiag.SplitInetDiagMsg(msg.Data)
 	if raw == nil {
-		return nil, ErrParseFailed
+		return nil, countParseError(ErrShortInetDiagMsg)
 	}
 	if exclude != nil {
 		idm, err := raw.Parse()
 		if err != nil {
-			return nil, err
+			return nil, countParseError(ErrShortInetDiagMsg)
 		}
 		if exclude.SrcPorts != nil && exclude.SrcPorts[idm.ID.SPort()] {
 			return nil, nil
 		}
-		if exclude.Local && (isLocal(idm.ID.SrcIP()) || isLocal(idm.ID.DstIP())) {
+		if exclude.Local && exclude.IsLocalConnection(idm) {
 			return nil, nil
 		}
 		if exclude.DstIPs != nil && exclude.DstIPs[idm.ID.IDiagDst] {
@@ -144,7 +250,7 @@ func MakeArchivalRecord(msg *NetlinkMessage, exclude *ExcludeConfig) (*ArchivalR
 
 	attrs, err := ParseRouteAttr(attrBytes)
 	if err != nil {
-		return nil, err
+		return nil, countParseError(ErrBadRouteAttr)
 	}
 	maxAttrType := uint16(0)
 	for _, a := range attrs {
@@ -153,18 +259,19 @@ func MakeArchivalRecord(msg *NetlinkMessage, exclude *ExcludeConfig) (*ArchivalR
 			maxAttrType = t
 		}
 	}
-	if maxAttrType > 2*inetdiag.INET_DIAG_MAX {
-		maxAttrType = 2 * inetdiag.INET_DIAG_MAX
+	if maxAttrType > MaxAttributeType {
+		maxAttrType = MaxAttributeType
 	}
 	record.Attributes = make([][]byte, maxAttrType+1, maxAttrType+1)
 	for _, a := range attrs {
 		t := a.Attr.Type
 		if t > maxAttrType {
-			log.Println("Error!! Received RouteAttr with very large Type:", t)
+			metrics.AttributeTypeClampedCount.WithLabelValues(strconv.Itoa(int(t))).Inc()
+			attrTypeLog.Println("Dropping RouteAttr with very large Type:", t)
 			continue
 		}
 		if record.Attributes[t] != nil {
-			// TODO - add metric so we can alert on these.
+			countParseError(ErrDuplicateAttr)
 			log.Println("Parse error - Attribute appears more than once:", t)
 		}
 		record.Attributes[t] = a.Value
@@ -172,6 +279,12 @@ func MakeArchivalRecord(msg *NetlinkMessage, exclude *ExcludeConfig) (*ArchivalR
 	return &record, nil
 }
 
+// countParseError increments the parse error metric, using err as the reason, and returns err.
+func countParseError(err error) error {
+	metrics.ParseErrorCount.WithLabelValues(err.Error()).Inc()
+	return err
+}
+
 // ChangeType indicates why a new record is worthwhile saving.
 type ChangeType int
 
@@ -187,21 +300,68 @@ const (
 	PacketCountChange               // One of the packet/byte/segment counts (or other late field) changed
 	PreviousWasNil                  // The previous message was nil
 	Other                           // Some other attribute changed
+	CAStateChange                   // The congestion avoidance state in DIAG_INFO changed.
+	BBRChange                       // The BBR pacing or cwnd gain changed.  Only reported if CompareOptions.BBR is set.
 )
 
 // Useful offsets for Compare
 const (
+	caStateOffset       = unsafe.Offsetof(tcp.LinuxTCPInfo{}.CAState)
+	retransmitsOffset   = unsafe.Offsetof(tcp.LinuxTCPInfo{}.Retransmits)
+	appLimitedOffset    = unsafe.Offsetof(tcp.LinuxTCPInfo{}.AppLimited)
 	lastDataSentOffset  = unsafe.Offsetof(tcp.LinuxTCPInfo{}.LastDataSent)
 	pmtuOffset          = unsafe.Offsetof(tcp.LinuxTCPInfo{}.PMTU)
 	busytimeOffset      = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BusyTime)
 	bytesReceivedOffset = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesReceived) // 128
 	bytesSentOffset     = unsafe.Offsetof(tcp.LinuxTCPInfo{}.BytesSent)     // 200
+	deliveryRateOffset  = unsafe.Offsetof(tcp.LinuxTCPInfo{}.DeliveryRate)  // 160
+	minTCPInfoSize      = unsafe.Offsetof(tcp.LinuxTCPInfo{}.PacingRate)    // 104, the oldest tcp_info
+	pacingGainOffset    = unsafe.Offsetof(inetdiag.BBRInfo{}.PacingGain)
+	bbrInfoSize         = unsafe.Offsetof(inetdiag.BBRInfo{}.CwndGain) + 4 // 20, the size of tcp_bbr_info
 )
 
+// span returns b[lo:hi], truncated to the length of b.
+func span(b []byte, lo, hi uintptr) []byte {
+	if hi > uintptr(len(b)) {
+		hi = uintptr(len(b))
+	}
+	if lo > hi {
+		return nil
+	}
+	return b[lo:hi]
+}
+
 func isLocal(addr net.IP) bool {
 	return addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsMulticast() || addr.IsUnspecified()
 }
 
+// IsLocalConnection returns true if either endpoint of the connection is in
+// LocalCIDRs or, if LocalCIDRs is nil, is a loopback, link-local unicast,
+// multicast, or unspecified address.  It does not depend on Local.
+func (ex *ExcludeConfig) IsLocalConnection(idm *inetdiag.InetDiagMsg) bool {
+	return ex.isLocal(idm.ID.SrcIP()) || ex.isLocal(idm.ID.DstIP())
+}
+
+// DropLocal removes the messages for the connections that Local excludes, in
+// place, so that a collector need not pass them on.  Messages that cannot be
+// parsed are kept, so that MakeArchivalRecord counts them.  If ex is nil, or
+// Local is false, msgs is returned unchanged.
+func (ex *ExcludeConfig) DropLocal(msgs []*NetlinkMessage) []*NetlinkMessage {
+	if ex == nil || !ex.Local {
+		return msgs
+	}
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if raw, _ := inetdiag.SplitInetDiagMsg(m.Data); raw != nil {
+			if idm, err := raw.Parse(); err == nil && ex.IsLocalConnection(idm) {
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
 // Compare compares important fields to determine whether significant updates have occurred.
 // We ignore a bunch of fields:
 //   - The TCPInfo fields matching last_* are rapidly changing, but don't have much significance.
@@ -218,6 +378,18 @@ func isLocal(addr net.IP) bool {
 // and CAState fields, these are probably adequate, but we also check for new or missing attributes
 // and any attribute difference outside of the TCPInfo (INET_DIAG_INFO) attribute.
 func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error) {
+	return pm.CompareWith(previous, CompareOptions{})
+}
+
+// CompareOptions selects the optional changes reported by CompareWith.
+type CompareOptions struct {
+	// BBR reports changes to the pacing or cwnd gain in the INET_DIAG_BBRINFO
+	// attribute, which mark BBR mode transitions, as BBRChange, instead of Other.
+	BBR bool
+}
+
+// CompareWith is like Compare, but also reports the changes selected by opts.
+func (pm *ArchivalRecord) CompareWith(previous *ArchivalRecord, opts CompareOptions) (ChangeType, error) {
 	if previous == nil {
 		return PreviousWasNil, nil
 	}
@@ -236,29 +408,45 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 
 	// TODO - should we validate that ID matches?  Otherwise, we shouldn't even be comparing the rest.
 
-	// We now allocate only the size
-	if len(previous.Attributes) <= inetdiag.INET_DIAG_INFO || len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return NoTCPInfo, nil
-	}
-	a := previous.Attributes[inetdiag.INET_DIAG_INFO]
-	b := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	a := previous.attribute(inetdiag.INET_DIAG_INFO)
+	b := pm.attribute(inetdiag.INET_DIAG_INFO)
 	if a == nil || b == nil {
 		return NoTCPInfo, nil
 	}
 
+	// Congestion state transitions are analytically important, so report them explicitly.
+	if len(a) > int(caStateOffset) && len(b) > int(caStateOffset) && a[caStateOffset] != b[caStateOffset] {
+		return CAStateChange, nil
+	}
+
+	// The size of the TCPInfo depends on the kernel version, so it should never change
+	// within a connection, and may be shorter than the offsets used below.
+	if len(a) != len(b) {
+		return AttributeLength, nil
+	}
+
 	// If any of the byte/segment/package counters have changed, that is what we are most
 	// interested in.
 	// NOTE: There are more fields beyond BusyTime, but for now we are ignoring them for diffing purposes.
-	if 0 != bytes.Compare(a[pmtuOffset:busytimeOffset], b[pmtuOffset:busytimeOffset]) {
+	if 0 != bytes.Compare(span(a, pmtuOffset, busytimeOffset), span(b, pmtuOffset, busytimeOffset)) {
 		return StateOrCounterChange, nil
 	}
 
 	// Check all the earlier fields, too.  Usually these won't change unless the counters above
 	// change, but this way we won't miss something subtle.
-	if 0 != bytes.Compare(a[:lastDataSentOffset], b[:lastDataSentOffset]) {
+	if 0 != bytes.Compare(span(a, 0, lastDataSentOffset), span(b, 0, lastDataSentOffset)) {
 		return StateOrCounterChange, nil
 	}
 
+	// A slim record has no other attributes to compare, except for INET_DIAG_BBRINFO,
+	// which is kept if opts.BBR is set.
+	if previous.slim {
+		if opts.BBR && bbrGainChanged(previous.attribute(inetdiag.INET_DIAG_BBRINFO), pm.attribute(inetdiag.INET_DIAG_BBRINFO)) {
+			return BBRChange, nil
+		}
+		return NoMajorChange, nil
+	}
+
 	// If any attributes have been added or removed, that is likely significant.
 	if len(previous.Attributes) < len(pm.Attributes) {
 		return NewAttribute, nil
@@ -292,6 +480,9 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 			}
 			// All others we want to be identical
 			if 0 != bytes.Compare(a, b) {
+				if tp == inetdiag.INET_DIAG_BBRINFO && opts.BBR && bbrGainChanged(a, b) {
+					return BBRChange, nil
+				}
 				return Other, nil
 			}
 		}
@@ -304,9 +495,27 @@ func (pm *ArchivalRecord) Compare(previous *ArchivalRecord) (ChangeType, error)
 /*                            Utilities for loading data                                     */
 /*********************************************************************************************/
 
+// MaxRawMessageSize is the largest header Len accepted by LoadRawNetlinkMessage.
+// The message for a single socket is a few hundred bytes, so anything near this
+// size is the result of corruption.
+const MaxRawMessageSize = 1 << 20
+
+// HeaderLenError is returned by LoadRawNetlinkMessage if a header's Len is too
+// small to include the header, or larger than MaxRawMessageSize, e.g. because
+// of a bit error.  Nothing after the header can be read reliably.
+type HeaderLenError struct {
+	Len uint32 // The Len from the header.
+}
+
+func (e *HeaderLenError) Error() string {
+	return fmt.Sprintf("netlink header Len %d is outside [%d, %d]", e.Len, SizeofNlMsghdr, MaxRawMessageSize)
+}
+
 // LoadRawNetlinkMessage is a simple utility to read the next NetlinkMessage from a source reader,
 // e.g. from a file of naked binary netlink messages.
-// NOTE: This is a bit fragile if there are any bit errors in the message headers.
+// NOTE: This is a bit fragile if there are any bit errors in the message headers.  A
+// header Len that cannot be right returns a *HeaderLenError, and is counted in
+// BadHeaderLenCount, but other bit errors are not detected.
 func LoadRawNetlinkMessage(rdr io.Reader) (*NetlinkMessage, error) {
 	var header NlMsghdr
 	// TODO - should we pass in LittleEndian as a parameter?
@@ -315,6 +524,10 @@ func LoadRawNetlinkMessage(rdr io.Reader) (*NetlinkMessage, error) {
 		// Note that this may be EOF
 		return nil, err
 	}
+	if header.Len < uint32(binary.Size(header)) || header.Len > MaxRawMessageSize {
+		metrics.BadHeaderLenCount.Inc()
+		return nil, &HeaderLenError{Len: header.Len}
+	}
 	data := make([]byte, header.Len-uint32(binary.Size(header)))
 	err = binary.Read(rdr, binary.LittleEndian, data)
 	if err != nil {
@@ -324,6 +537,60 @@ func LoadRawNetlinkMessage(rdr io.Reader) (*NetlinkMessage, error) {
 	return &NetlinkMessage{Header: header, Data: data}, nil
 }
 
+// WriteRawNetlinkMessage writes msg as a naked binary netlink message, header
+// followed by data, in the form read by LoadRawNetlinkMessage.  The header Len
+// is set from the data, so that the message can always be read back.
+func WriteRawNetlinkMessage(wtr io.Writer, msg *NetlinkMessage) error {
+	header := msg.Header
+	header.Len = uint32(binary.Size(header) + len(msg.Data))
+	if err := binary.Write(wtr, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	_, err := wtr.Write(msg.Data)
+	return err
+}
+
+// ToNetlinkMessage reassembles a SOCK_DIAG_BY_FAMILY NetlinkMessage from the RawIDM and
+// Attributes, so that recorded data can be replayed through code that consumes
+// NetlinkMessages.  The attributes are emitted in type order, with the usual
+// alignment padding.  Returns ErrShortInetDiagMsg if there is no RawIDM, e.g. for
+// a Metadata record.
+func (pm *ArchivalRecord) ToNetlinkMessage() (*NetlinkMessage, error) {
+	if len(pm.RawIDM) == 0 {
+		return nil, ErrShortInetDiagMsg
+	}
+	size := len(pm.RawIDM)
+	for _, a := range pm.Attributes {
+		if a != nil {
+			size += rtaAlignOf(SizeofRtAttr + len(a))
+		}
+	}
+	data := make([]byte, 0, size)
+	data = append(data, pm.RawIDM...)
+	for t, a := range pm.Attributes {
+		if a == nil {
+			continue
+		}
+		if SizeofRtAttr+len(a) > math.MaxUint16 {
+			return nil, ErrBadRouteAttr
+		}
+		var hdr [SizeofRtAttr]byte
+		binary.LittleEndian.PutUint16(hdr[0:2], uint16(SizeofRtAttr+len(a)))
+		binary.LittleEndian.PutUint16(hdr[2:4], uint16(t))
+		data = append(data, hdr[:]...)
+		data = append(data, a...)
+		// Pad the value to the next attribute boundary.
+		for len(data)%RTA_ALIGNTO != 0 {
+			data = append(data, 0)
+		}
+	}
+	msg := &NetlinkMessage{
+		Header: NlMsghdr{Len: uint32(SizeofNlMsghdr + len(data)), Type: inetdiag.SOCK_DIAG_BY_FAMILY},
+		Data:   data,
+	}
+	return msg, nil
+}
+
 // ArchiveReader produces ArchivedRecord structs from some source.
 type ArchiveReader interface {
 	// Next returns the next ArchivalRecord.  Returns nil, EOF if no more records, or other error if there is a problem.
@@ -348,19 +615,37 @@ func (raw *rawReader) Next() (*ArchivalRecord, error) {
 	return MakeArchivalRecord(msg, nil)
 }
 
+// DefaultMaxRecordSize is the longest JSONL line NewArchiveReader will read.  It
+// is much larger than any normal record, which is a few KB.
+const DefaultMaxRecordSize = 1 << 20
+
 type archiveReader struct {
 	scanner *bufio.Scanner
+	failed  bool // Whether the scanner error has been returned.
 }
 
 // NewArchiveReader wraps a source of JSONL ArchiveRecords to create ArchiveReader
 func NewArchiveReader(rdr io.Reader) ArchiveReader {
+	return NewArchiveReaderWithBuffer(rdr, DefaultMaxRecordSize)
+}
+
+// NewArchiveReaderWithBuffer is like NewArchiveReader, but reads lines of up to
+// maxRecordSize bytes.  A longer line causes Next to return bufio.ErrTooLong,
+// and then io.EOF.
+func NewArchiveReaderWithBuffer(rdr io.Reader, maxRecordSize int) ArchiveReader {
 	sc := bufio.NewScanner(rdr)
+	sc.Buffer(nil, maxRecordSize)
 	return &archiveReader{scanner: sc}
 }
 
 // Next decodes and returns the next ArchivalRecord.
 func (ar *archiveReader) Next() (*ArchivalRecord, error) {
-	if !ar.scanner.Scan() {
+	// After an error, the Scanner may still return the partial line.
+	if ar.failed || !ar.scanner.Scan() {
+		if err := ar.scanner.Err(); err != nil && !ar.failed {
+			ar.failed = true
+			return nil, err
+		}
 		return nil, io.EOF
 	}
 	buf := ar.scanner.Bytes()
@@ -373,6 +658,49 @@ func (ar *archiveReader) Next() (*ArchivalRecord, error) {
 	return &record, nil
 }
 
+type sliceReader struct {
+	records []*ArchivalRecord
+}
+
+// NewSliceReader creates an ArchiveReader that yields the provided records, and then io.EOF.
+func NewSliceReader(records []*ArchivalRecord) ArchiveReader {
+	return &sliceReader{records: records}
+}
+
+// Next returns the next ArchivalRecord from the slice.
+func (sr *sliceReader) Next() (*ArchivalRecord, error) {
+	if len(sr.records) == 0 {
+		return nil, io.EOF
+	}
+	record := sr.records[0]
+	sr.records = sr.records[1:]
+	return record, nil
+}
+
+type sinceReader struct {
+	rdr   ArchiveReader
+	since time.Time
+}
+
+// NewArchiveReaderSince wraps an ArchiveReader, skipping any records with a
+// Timestamp before since.  Metadata records are always returned.
+func NewArchiveReaderSince(rdr ArchiveReader, since time.Time) ArchiveReader {
+	return &sinceReader{rdr: rdr, since: since}
+}
+
+// Next returns the next ArchivalRecord that is not before the cutoff time.
+func (sr *sinceReader) Next() (*ArchivalRecord, error) {
+	for {
+		record, err := sr.rdr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if record.Metadata != nil || !record.Timestamp.Before(sr.since) {
+			return record, nil
+		}
+	}
+}
+
 // LoadAllArchivalRecords reads all PMs from a jsonl stream.
 func LoadAllArchivalRecords(rdr io.Reader) ([]*ArchivalRecord, error) {
 	msgs := make([]*ArchivalRecord, 0, 2000) // We typically read a large number of records
@@ -391,9 +719,95 @@ func LoadAllArchivalRecords(rdr io.Reader) ([]*ArchivalRecord, error) {
 	}
 }
 
+// SkippedRecordsError summarizes the records that were skipped by a lenient load.
+type SkippedRecordsError struct {
+	Count int   // Number of records skipped.
+	First error // The error from the first skipped record.
+}
+
+func (e *SkippedRecordsError) Error() string {
+	return fmt.Sprintf("skipped %d malformed records, first: %v", e.Count, e.First)
+}
+
+// Unwrap returns the error from the first skipped record.
+func (e *SkippedRecordsError) Unwrap() error {
+	return e.First
+}
+
+// LoadAllArchivalRecordsLenient reads all PMs from a jsonl stream, skipping any
+// lines that cannot be parsed.  This allows best effort loading of partially
+// corrupt files, such as those truncated mid-write by a crash.  It returns the
+// good records, and a *SkippedRecordsError if any records were skipped.
+func LoadAllArchivalRecordsLenient(rdr io.Reader) ([]*ArchivalRecord, error) {
+	msgs := make([]*ArchivalRecord, 0, 2000) // We typically read a large number of records
+
+	pmr := NewArchiveReader(rdr)
+
+	var skipped *SkippedRecordsError
+	for {
+		pm, err := pmr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if skipped == nil {
+				skipped = &SkippedRecordsError{First: err}
+			}
+			skipped.Count++
+			continue
+		}
+		msgs = append(msgs, pm)
+	}
+	if skipped != nil {
+		return msgs, skipped
+	}
+	return msgs, nil
+}
+
+// ErrShortTCPInfo is returned by Validate if INET_DIAG_INFO is shorter than the
+// tcp_info of any kernel.
+var ErrShortTCPInfo = errors.New("INET_DIAG_INFO too short")
+
+// Validate checks the internal consistency of the record: that RawIDM parses,
+// that the address family is AF_INET or AF_INET6, and that INET_DIAG_INFO, if
+// present, is at least as long as the oldest tcp_info.  A metadata record
+// without RawIDM is valid.  Attributes holds a single value for each type, so
+// duplicate attributes are instead detected, and counted, by MakeArchivalRecord.
+func (pm *ArchivalRecord) Validate() error {
+	if pm.RawIDM == nil && pm.Metadata != nil {
+		return nil
+	}
+	idm, err := pm.RawIDM.Parse()
+	if err != nil {
+		return ErrShortInetDiagMsg
+	}
+	if idm.IDiagFamily != inetdiag.AF_INET && idm.IDiagFamily != inetdiag.AF_INET6 {
+		return inetdiag.ErrUnknownAF
+	}
+	if pm.HasDiagInfo() && len(pm.attribute(inetdiag.INET_DIAG_INFO)) < int(minTCPInfoSize) {
+		return ErrShortTCPInfo
+	}
+	return nil
+}
+
+// HasAttribute returns true if the record contains an attribute of type t.
+func (pm *ArchivalRecord) HasAttribute(t int) bool {
+	return pm.attribute(t) != nil
+}
+
 // HasDiagInfo returns true if there is a DIAG_INFO message.
 func (pm *ArchivalRecord) HasDiagInfo() bool {
-	return len(pm.Attributes) > inetdiag.INET_DIAG_INFO
+	return pm.HasAttribute(inetdiag.INET_DIAG_INFO)
+}
+
+// attribute returns the attribute of type t, or nil if there is none.  Attributes
+// is indexed by type, and only as long as the largest type present, so it must
+// not be indexed directly.
+func (pm *ArchivalRecord) attribute(t int) []byte {
+	if t < 0 || t >= len(pm.Attributes) {
+		return nil
+	}
+	return pm.Attributes[t]
 }
 
 var sendLogger = logx.NewLogEvery(nil, time.Second)
@@ -401,18 +815,129 @@ var rcvLogger = logx.NewLogEvery(nil, time.Second)
 
 // GetStats returns basic stats from the TCPInfo snapshot.
 func (pm *ArchivalRecord) GetStats() (uint64, uint64) {
-	if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return 0, 0
-	}
-	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	s, r, _ := pm.stats()
+	return s, r
+}
+
+// stats returns the BytesSent and BytesReceived, and whether the record contains them.
+func (pm *ArchivalRecord) stats() (uint64, uint64, bool) {
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
 	// Ensure the array contains both uint64 fields.
 	if len(raw) < int(bytesSentOffset+8) || len(raw) < int(bytesReceivedOffset+8) {
-		return 0, 0
+		return 0, 0, false
 	}
 	// The linux fields are actually uint64, though the LinuxTCPInfo struct uses int64 for bigquery compatibility.
 	s := *(*uint64)(unsafe.Pointer(&raw[bytesSentOffset]))
 	r := *(*uint64)(unsafe.Pointer(&raw[bytesReceivedOffset]))
-	return s, r
+	return s, r, true
+}
+
+// ErrCounterRegression is returned by CheckCounters when a cumulative counter decreased.
+var ErrCounterRegression = errors.New("cumulative byte counter decreased")
+
+// CheckCounters verifies that the cumulative BytesSent and BytesReceived have not
+// decreased since prev, an earlier record for the same connection, which should be
+// impossible for a single flow.  Each decrease is counted in CounterRegressionCount,
+// and results in ErrCounterRegression.  Records without both counters are not checked.
+func (pm *ArchivalRecord) CheckCounters(prev *ArchivalRecord) error {
+	if prev == nil {
+		return nil
+	}
+	s, r, ok := pm.stats()
+	prevS, prevR, prevOK := prev.stats()
+	if !ok || !prevOK {
+		return nil
+	}
+	var err error
+	if s < prevS {
+		sendLogger.Println("BytesSent decreased from", prevS, "to", s)
+		metrics.CounterRegressionCount.WithLabelValues("BytesSent").Inc()
+		err = ErrCounterRegression
+	}
+	if r < prevR {
+		rcvLogger.Println("BytesReceived decreased from", prevR, "to", r)
+		metrics.CounterRegressionCount.WithLabelValues("BytesReceived").Inc()
+		err = ErrCounterRegression
+	}
+	return err
+}
+
+// bbrGainChanged returns true if the pacing or cwnd gain differs between two
+// INET_DIAG_BBRINFO attributes.
+func bbrGainChanged(a, b []byte) bool {
+	return 0 != bytes.Compare(span(a, pacingGainOffset, bbrInfoSize), span(b, pacingGainOffset, bbrInfoSize))
+}
+
+// Slim returns a copy of the record containing only the Timestamp, RawIDM, and
+// DIAG_INFO attribute, which are all that Compare needs from the previous record,
+// and the BBRINFO attribute if opts.BBR is set, for CompareWith.  The copy does
+// not share memory with the original, so it does not keep the original netlink
+// message buffer alive.  When a slim record is passed to Compare as the previous
+// record, changes to other attributes are not detected.
+func (pm *ArchivalRecord) Slim(opts CompareOptions) *ArchivalRecord {
+	slim := &ArchivalRecord{
+		Timestamp: pm.Timestamp,
+		RawIDM:    append(inetdiag.RawInetDiagMsg(nil), pm.RawIDM...),
+		slim:      true,
+	}
+	if pm.HasDiagInfo() {
+		slim.Attributes = make([][]byte, inetdiag.INET_DIAG_INFO+1)
+		slim.Attributes[inetdiag.INET_DIAG_INFO] = append([]byte(nil), pm.attribute(inetdiag.INET_DIAG_INFO)...)
+	}
+	if bbr := pm.attribute(inetdiag.INET_DIAG_BBRINFO); opts.BBR && bbr != nil {
+		attrs := make([][]byte, inetdiag.INET_DIAG_BBRINFO+1)
+		copy(attrs, slim.Attributes)
+		attrs[inetdiag.INET_DIAG_BBRINFO] = append([]byte(nil), bbr...)
+		slim.Attributes = attrs
+	}
+	return slim
+}
+
+// CAState returns the congestion avoidance state from the DIAG_INFO attribute, and
+// false if there is no DIAG_INFO.
+func (pm *ArchivalRecord) CAState() (tcp.CAState, bool) {
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
+	if len(raw) <= int(caStateOffset) {
+		return 0, false
+	}
+	return tcp.CAState(raw[caStateOffset]), true
+}
+
+// BBRInfo returns the INET_DIAG_BBRINFO attribute, and false if there is none.
+func (pm *ArchivalRecord) BBRInfo() (*inetdiag.BBRInfo, bool) {
+	raw := pm.attribute(inetdiag.INET_DIAG_BBRINFO)
+	if len(raw) < int(bbrInfoSize) {
+		return nil, false
+	}
+	info := &inetdiag.BBRInfo{}
+	// The fields are decoded individually, since BBRInfo is padded to 24 bytes.
+	info.BW = int64(binary.LittleEndian.Uint64(raw[unsafe.Offsetof(info.BW):]))
+	info.MinRTT = binary.LittleEndian.Uint32(raw[unsafe.Offsetof(info.MinRTT):])
+	info.PacingGain = binary.LittleEndian.Uint32(raw[unsafe.Offsetof(info.PacingGain):])
+	info.CwndGain = binary.LittleEndian.Uint32(raw[unsafe.Offsetof(info.CwndGain):])
+	return info, true
+}
+
+// Retransmits returns the number of consecutive unrecovered retransmission
+// timeouts from the DIAG_INFO attribute, and whether it was present.
+func (pm *ArchivalRecord) Retransmits() (uint8, bool) {
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
+	if len(raw) <= int(retransmitsOffset) {
+		return 0, false
+	}
+	return raw[retransmitsOffset], true
+}
+
+// DeliveryRate returns the DeliveryRate, in bytes per second, and the
+// delivery_rate_app_limited bit, from the DIAG_INFO attribute, and whether they
+// were present.  Kernels before 4.9 do not report them.
+func (pm *ArchivalRecord) DeliveryRate() (uint64, bool, bool) {
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
+	if len(raw) < int(deliveryRateOffset+8) {
+		return 0, false, false
+	}
+	rate := *(*uint64)(unsafe.Pointer(&raw[deliveryRateOffset]))
+	return rate, raw[appLimitedOffset]&0x01 != 0, true
 }
 
 // SetBytesReceived sets the field for hacking unit tests.
@@ -420,10 +945,7 @@ func (pm *ArchivalRecord) SetBytesReceived(value uint64) uint64 {
 	if flag.Lookup("test.v") == nil {
 		panic("Allowed only in tests.")
 	}
-	if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return 0
-	}
-	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
 	if len(raw) < int(bytesReceivedOffset+8) {
 		return 0
 	}
@@ -438,10 +960,7 @@ func (pm *ArchivalRecord) SetBytesSent(value uint64) uint64 {
 	if flag.Lookup("test.v") == nil {
 		panic("Allowed only in tests.")
 	}
-	if len(pm.Attributes) <= inetdiag.INET_DIAG_INFO {
-		return 0
-	}
-	raw := pm.Attributes[inetdiag.INET_DIAG_INFO]
+	raw := pm.attribute(inetdiag.INET_DIAG_INFO)
 	// Ensure that the full field exists.
 	if len(raw) < int(bytesSentOffset+8) {
 		return 0
@@ -2,11 +2,24 @@
 package netlink
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 	"unsafe"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
 )
 
 func inet2bytes(inet *inetdiag.InetDiagMsg) []byte {
@@ -145,3 +158,493 @@ func TestExcludeConfig_AddDstIP(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRouteAttrCountLimit(t *testing.T) {
+	// Each attribute is just an RtAttr header with an empty value.
+	b := make([]byte, 0, (MaxAttributeCount+50)*SizeofRtAttr)
+	for i := 0; i < MaxAttributeCount+50; i++ {
+		b = append(b, SizeofRtAttr, 0, byte(inetdiag.INET_DIAG_MARK), 0)
+	}
+	before := testutil.ToFloat64(metrics.AttributeCountLimitTotal)
+	attrs, err := ParseRouteAttr(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != MaxAttributeCount {
+		t.Errorf("ParseRouteAttr() returned %d attributes, want %d", len(attrs), MaxAttributeCount)
+	}
+	if testutil.ToFloat64(metrics.AttributeCountLimitTotal) != before+1 {
+		t.Error("AttributeCountLimitTotal should have been incremented")
+	}
+
+	// A message within the limit should be untouched.
+	attrs, err = ParseRouteAttr(b[:10*SizeofRtAttr])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 10 {
+		t.Errorf("ParseRouteAttr() returned %d attributes, want 10", len(attrs))
+	}
+	if testutil.ToFloat64(metrics.AttributeCountLimitTotal) != before+1 {
+		t.Error("AttributeCountLimitTotal should not have been incremented")
+	}
+}
+
+func TestMakeArchivalRecordDuplicateAttr(t *testing.T) {
+	id := inetdiag.LinuxSockID{
+		IDiagSrc: [16]byte{10, 0, 0, 1},
+		IDiagDst: [16]byte{10, 0, 0, 2},
+	}
+	data := inet2bytes(&inetdiag.InetDiagMsg{ID: id})
+	// Two INET_DIAG_MARK attributes, each with a 4 byte value.
+	data = append(data, 8, 0, byte(inetdiag.INET_DIAG_MARK), 0, 1, 0, 0, 0)
+	data = append(data, 8, 0, byte(inetdiag.INET_DIAG_MARK), 0, 2, 0, 0, 0)
+	msg := &NetlinkMessage{Header: NlMsghdr{Type: 20}, Data: data}
+
+	before := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(ErrDuplicateAttr.Error()))
+	ar, err := MakeArchivalRecord(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last value wins.
+	if ar.Attributes[inetdiag.INET_DIAG_MARK][0] != 2 {
+		t.Error("Wrong attribute value", ar.Attributes[inetdiag.INET_DIAG_MARK])
+	}
+	after := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(ErrDuplicateAttr.Error()))
+	if after != before+1 {
+		t.Errorf("ParseErrorCount = %v, want %v", after, before+1)
+	}
+}
+
+func TestMakeArchivalRecordLargeType(t *testing.T) {
+	data := inet2bytes(&inetdiag.InetDiagMsg{})
+	// An attribute just within the limit, and one just beyond it.
+	large := MaxAttributeType + 1
+	data = append(data, 8, 0, byte(MaxAttributeType), byte(MaxAttributeType>>8), 1, 0, 0, 0)
+	data = append(data, 8, 0, byte(large), byte(large>>8), 2, 0, 0, 0)
+	msg := &NetlinkMessage{Header: NlMsghdr{Type: 20}, Data: data}
+
+	label := strconv.Itoa(int(large))
+	before := testutil.ToFloat64(metrics.AttributeTypeClampedCount.WithLabelValues(label))
+	ar, err := MakeArchivalRecord(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ar.Attributes) != int(MaxAttributeType)+1 {
+		t.Errorf("len(Attributes) = %d, want %d", len(ar.Attributes), MaxAttributeType+1)
+	}
+	if a := ar.Attributes[MaxAttributeType]; len(a) != 4 || a[0] != 1 {
+		t.Error("Wrong attribute value", a)
+	}
+	after := testutil.ToFloat64(metrics.AttributeTypeClampedCount.WithLabelValues(label))
+	if after != before+1 {
+		t.Errorf("AttributeTypeClampedCount = %v, want %v", after, before+1)
+	}
+}
+
+func TestSliceReader(t *testing.T) {
+	records := []*ArchivalRecord{
+		{Metadata: &Metadata{UUID: "foo"}},
+		{RawIDM: inet2bytes(&inetdiag.InetDiagMsg{})},
+	}
+	rdr := NewSliceReader(records)
+	for i := range records {
+		got, err := rdr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != records[i] {
+			t.Errorf("Next() = %v, want %v", got, records[i])
+		}
+	}
+	for i := 0; i < 2; i++ {
+		got, err := rdr.Next()
+		if got != nil || err != io.EOF {
+			t.Errorf("Next() = %v, %v, want nil, EOF", got, err)
+		}
+	}
+	// The caller's slice is not modified.
+	if len(records) != 2 || records[0].Metadata == nil {
+		t.Error("NewSliceReader modified the records", records)
+	}
+}
+
+func TestArchiveReaderSince(t *testing.T) {
+	cutoff := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	records := []*ArchivalRecord{
+		{Metadata: &Metadata{UUID: "foo"}},
+		{Timestamp: cutoff.Add(-time.Second)},
+		{Timestamp: cutoff},
+		{Timestamp: cutoff.Add(-time.Millisecond)},
+		{Timestamp: cutoff.Add(time.Second)},
+	}
+	rdr := NewArchiveReaderSince(NewSliceReader(records), cutoff)
+	for _, want := range []*ArchivalRecord{records[0], records[2], records[4]} {
+		got, err := rdr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Next() = %+v, want %+v", got, want)
+		}
+	}
+	if got, err := rdr.Next(); got != nil || err != io.EOF {
+		t.Errorf("Next() = %v, %v, want nil, EOF", got, err)
+	}
+}
+
+func TestCompareRandomAttributes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	raw := inet2bytes(&inetdiag.InetDiagMsg{})
+	randomRecord := func() *ArchivalRecord {
+		ar := &ArchivalRecord{RawIDM: raw, slim: rnd.Intn(10) == 0}
+		n := rnd.Intn(MaxAttributeCount + 1)
+		if n > 0 {
+			ar.Attributes = make([][]byte, n)
+		}
+		for i := range ar.Attributes {
+			if rnd.Intn(3) == 0 {
+				continue // Leave the attribute nil.
+			}
+			// Include lengths on both sides of each of the offsets used by Compare.
+			ar.Attributes[i] = make([]byte, rnd.Intn(int(bytesSentOffset)+16))
+			if rnd.Intn(2) == 0 && len(ar.Attributes[i]) > 0 {
+				ar.Attributes[i][rnd.Intn(len(ar.Attributes[i]))] = byte(rnd.Intn(256))
+			}
+		}
+		return ar
+	}
+	for i := 0; i < 10000; i++ {
+		prev, curr := randomRecord(), randomRecord()
+		if rnd.Intn(4) == 0 {
+			// Make the records similar, to exercise the later comparisons.
+			curr.Attributes = append([][]byte(nil), prev.Attributes...)
+		}
+		change, err := curr.Compare(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change < NoMajorChange || change > BBRChange {
+			t.Fatalf("Compare() returned an unknown ChangeType %d", change)
+		}
+		if (len(prev.Attributes) <= inetdiag.INET_DIAG_INFO || len(curr.Attributes) <= inetdiag.INET_DIAG_INFO) && change != NoTCPInfo {
+			t.Errorf("Compare() = %d, want NoTCPInfo for records without TCPInfo", change)
+		}
+		// A record is never different from itself.
+		if change, _ := prev.Compare(prev); change != NoMajorChange && change != NoTCPInfo {
+			t.Errorf("Compare() of a record with itself = %d", change)
+		}
+	}
+}
+
+func TestCompareBBR(t *testing.T) {
+	raw := inet2bytes(&inetdiag.InetDiagMsg{})
+	record := func(bw uint64, pacingGain, cwndGain uint32) *ArchivalRecord {
+		ar := &ArchivalRecord{RawIDM: raw, Attributes: make([][]byte, inetdiag.INET_DIAG_BBRINFO+1)}
+		ar.Attributes[inetdiag.INET_DIAG_INFO] = make([]byte, bytesSentOffset+8)
+		bbr := make([]byte, bbrInfoSize)
+		binary.LittleEndian.PutUint64(bbr[0:], bw)
+		binary.LittleEndian.PutUint32(bbr[8:], 20000)
+		binary.LittleEndian.PutUint32(bbr[12:], pacingGain)
+		binary.LittleEndian.PutUint32(bbr[16:], cwndGain)
+		ar.Attributes[inetdiag.INET_DIAG_BBRINFO] = bbr
+		return ar
+	}
+	startup := record(1000000, 739, 739)
+	drain := record(1000000, 88, 739)
+	faster := record(2000000, 739, 739)
+
+	info, ok := drain.BBRInfo()
+	if !ok || *info != (inetdiag.BBRInfo{BW: 1000000, MinRTT: 20000, PacingGain: 88, CwndGain: 739}) {
+		t.Errorf("BBRInfo() = %+v, %v", info, ok)
+	}
+	if _, ok := (&ArchivalRecord{RawIDM: raw}).BBRInfo(); ok {
+		t.Error("BBRInfo() should fail without INET_DIAG_BBRINFO")
+	}
+
+	tests := []struct {
+		name       string
+		bbrChanges bool
+		prev, curr *ArchivalRecord
+		want       ChangeType
+	}{
+		{"disabled", false, startup, drain, Other},
+		{"gain", true, startup, drain, BBRChange},
+		{"bandwidth only", true, startup, faster, Other},
+		{"same", true, startup, startup, NoMajorChange},
+	}
+	for _, tt := range tests {
+		opts := CompareOptions{BBR: tt.bbrChanges}
+		change, err := tt.curr.CompareWith(tt.prev, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change != tt.want {
+			t.Errorf("%s: Compare() = %d, want %d", tt.name, change, tt.want)
+		}
+		// A slim previous record keeps BBRINFO only if opts.BBR is set.
+		want := tt.want
+		if want == Other {
+			want = NoMajorChange
+		}
+		change, err = tt.curr.CompareWith(tt.prev.Slim(opts), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change != want {
+			t.Errorf("%s: Compare() with a slim record = %d, want %d", tt.name, change, want)
+		}
+	}
+	if attrs := startup.Slim(CompareOptions{}).Attributes; len(attrs) > inetdiag.INET_DIAG_BBRINFO {
+		t.Error("Slim() should drop BBRINFO unless opts.BBR is set")
+	}
+}
+
+func TestCheckCounters(t *testing.T) {
+	record := func(sent, received uint64) *ArchivalRecord {
+		ar := &ArchivalRecord{Attributes: make([][]byte, inetdiag.INET_DIAG_INFO+1)}
+		ar.Attributes[inetdiag.INET_DIAG_INFO] = make([]byte, bytesSentOffset+8)
+		ar.SetBytesSent(sent)
+		ar.SetBytesReceived(received)
+		return ar
+	}
+	tests := []struct {
+		name                   string
+		prev, cur              *ArchivalRecord
+		wantErr                bool
+		wantSent, wantReceived float64
+	}{
+		{name: "increasing", prev: record(100, 200), cur: record(150, 250)},
+		{name: "unchanged", prev: record(100, 200), cur: record(100, 200)},
+		{name: "sent-decreased", prev: record(100, 200), cur: record(99, 250), wantErr: true, wantSent: 1},
+		{name: "received-decreased", prev: record(100, 200), cur: record(100, 1), wantErr: true, wantReceived: 1},
+		{name: "both-decreased", prev: record(100, 200), cur: record(0, 0), wantErr: true, wantSent: 1, wantReceived: 1},
+		{name: "no-prev", cur: record(0, 0)},
+		{name: "no-tcpinfo", prev: record(100, 200), cur: &ArchivalRecord{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesSent"))
+			received := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesReceived"))
+			err := tt.cur.CheckCounters(tt.prev)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckCounters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && err != ErrCounterRegression {
+				t.Errorf("CheckCounters() error = %v, want %v", err, ErrCounterRegression)
+			}
+			if got := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesSent")) - sent; got != tt.wantSent {
+				t.Errorf("CounterRegressionCount{BytesSent} increased by %v, want %v", got, tt.wantSent)
+			}
+			if got := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesReceived")) - received; got != tt.wantReceived {
+				t.Errorf("CounterRegressionCount{BytesReceived} increased by %v, want %v", got, tt.wantReceived)
+			}
+		})
+	}
+}
+
+func TestExcludeConfig_LocalCIDRs(t *testing.T) {
+	message := func(src, dst [16]byte) *NetlinkMessage {
+		id := inetdiag.LinuxSockID{IDiagSrc: src, IDiagDst: dst}
+		return &NetlinkMessage{
+			Header: NlMsghdr{Type: 20},
+			Data:   inet2bytes(&inetdiag.InetDiagMsg{ID: id}),
+		}
+	}
+	public := [16]byte{8, 8, 8, 8}
+	private := [16]byte{10, 1, 2, 3}
+	loopback := [16]byte{127, 0, 0, 1}
+	linkLocal := [16]byte{169, 254, 1, 1}
+
+	withPrivate := &ExcludeConfig{Local: true}
+	if err := withPrivate.AddLocalCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := withPrivate.AddLocalCIDR("not-a-cidr"); err == nil {
+		t.Error("AddLocalCIDR() should reject invalid CIDRs")
+	}
+	_, loopbackNet, _ := net.ParseCIDR("127.0.0.0/8")
+	keepLinkLocal := &ExcludeConfig{Local: true, LocalCIDRs: []*net.IPNet{loopbackNet}}
+
+	tests := []struct {
+		name     string
+		exclude  *ExcludeConfig
+		src, dst [16]byte
+		excluded bool
+	}{
+		{name: "default-private", exclude: &ExcludeConfig{Local: true}, src: public, dst: private},
+		{name: "default-link-local", exclude: &ExcludeConfig{Local: true}, src: linkLocal, dst: public, excluded: true},
+		{name: "exclude-private", exclude: withPrivate, src: public, dst: private, excluded: true},
+		{name: "exclude-private-keeps-defaults", exclude: withPrivate, src: loopback, dst: public, excluded: true},
+		{name: "exclude-private-public", exclude: withPrivate, src: public, dst: public},
+		{name: "keep-link-local", exclude: keepLinkLocal, src: linkLocal, dst: public},
+		{name: "keep-link-local-loopback", exclude: keepLinkLocal, src: loopback, dst: public, excluded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MakeArchivalRecord(message(tt.src, tt.dst), tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != tt.excluded {
+				t.Errorf("MakeArchivalRecord() = %v, want excluded %v", got, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestDefaultLocalCIDRs(t *testing.T) {
+	ex := &ExcludeConfig{LocalCIDRs: DefaultLocalCIDRs()}
+	for _, addr := range []string{
+		"127.0.0.1", "127.255.0.1", "::1", "169.254.3.4", "fe80::1", "224.0.0.1",
+		"ff02::1", "0.0.0.0", "::", "8.8.8.8", "10.0.0.1", "2001:db8::1", "::ffff:127.0.0.1",
+	} {
+		ip := net.ParseIP(addr)
+		if ex.isLocal(ip) != isLocal(ip) {
+			t.Errorf("DefaultLocalCIDRs() disagrees with isLocal for %s", addr)
+		}
+	}
+}
+
+func TestLoadAllArchivalRecordsLenient(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 3; i++ {
+		b, err := json.Marshal(&ArchivalRecord{Timestamp: time.Unix(int64(i), 0).UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(b)
+		buf.WriteString("\n")
+		if i == 1 {
+			buf.WriteString(`{"Timestamp":"2019-` + "\n")
+		}
+	}
+	data := buf.Bytes()
+
+	// The strict loader stops at the corrupt line.
+	records, err := LoadAllArchivalRecords(bytes.NewReader(data))
+	if err == nil || len(records) != 2 {
+		t.Errorf("LoadAllArchivalRecords() = %d records, %v, want 2 records and an error", len(records), err)
+	}
+
+	records, err = LoadAllArchivalRecordsLenient(bytes.NewReader(data))
+	if len(records) != 3 {
+		t.Fatal("Wrong number of records:", len(records))
+	}
+	for i, r := range records {
+		if r.Timestamp.Unix() != int64(i) {
+			t.Errorf("records[%d].Timestamp = %v", i, r.Timestamp)
+		}
+	}
+	var skipped *SkippedRecordsError
+	if !errors.As(err, &skipped) {
+		t.Fatal("Expected SkippedRecordsError, got", err)
+	}
+	if skipped.Count != 1 || skipped.First == nil {
+		t.Errorf("SkippedRecordsError = %+v", skipped)
+	}
+
+	_, err = LoadAllArchivalRecordsLenient(bytes.NewReader(nil))
+	if err != nil {
+		t.Error("Unexpected error for empty input:", err)
+	}
+}
+
+func TestArchiveReaderLargeRecord(t *testing.T) {
+	// A record with a 100KB attribute, larger than the default bufio.Scanner limit.
+	large := &ArchivalRecord{Attributes: [][]byte{nil, bytes.Repeat([]byte{7}, 100000)}}
+	b, err := json.Marshal(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(b, '\n')
+	b, err = json.Marshal(&ArchivalRecord{Metadata: &Metadata{UUID: "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, append(b, '\n')...)
+
+	records, err := LoadAllArchivalRecords(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !bytes.Equal(records[0].Attributes[1], large.Attributes[1]) || records[1].Metadata.UUID != "foo" {
+		t.Errorf("LoadAllArchivalRecords() returned %d records, want 2 intact records", len(records))
+	}
+
+	// A smaller buffer is an error, rather than a silent EOF.
+	rdr := NewArchiveReaderWithBuffer(bytes.NewReader(data), 64*1024)
+	if _, err := rdr.Next(); err != bufio.ErrTooLong {
+		t.Errorf("Next() error = %v, want %v", err, bufio.ErrTooLong)
+	}
+	if _, err := rdr.Next(); err != io.EOF {
+		t.Errorf("Next() error = %v, want EOF", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	idm := func(family uint8) inetdiag.RawInetDiagMsg {
+		return inet2bytes(&inetdiag.InetDiagMsg{IDiagFamily: family})
+	}
+	withInfo := func(n int) [][]byte {
+		attrs := make([][]byte, inetdiag.INET_DIAG_INFO+1)
+		attrs[inetdiag.INET_DIAG_INFO] = make([]byte, n)
+		return attrs
+	}
+	tests := []struct {
+		name   string
+		record ArchivalRecord
+		want   error
+	}{
+		{"metadata", ArchivalRecord{Metadata: &Metadata{UUID: "foo"}}, nil},
+		{"ipv4", ArchivalRecord{RawIDM: idm(inetdiag.AF_INET), Attributes: withInfo(232)}, nil},
+		{"ipv6 without info", ArchivalRecord{RawIDM: idm(inetdiag.AF_INET6)}, nil},
+		{"oldest info", ArchivalRecord{RawIDM: idm(inetdiag.AF_INET), Attributes: withInfo(104)}, nil},
+		{"no idm", ArchivalRecord{}, ErrShortInetDiagMsg},
+		{"short idm", ArchivalRecord{RawIDM: idm(inetdiag.AF_INET)[:20]}, ErrShortInetDiagMsg},
+		{"unknown family", ArchivalRecord{RawIDM: idm(0)}, inetdiag.ErrUnknownAF},
+		{"short info", ArchivalRecord{RawIDM: idm(inetdiag.AF_INET), Attributes: withInfo(103)}, ErrShortTCPInfo},
+	}
+	for _, tt := range tests {
+		if err := tt.record.Validate(); err != tt.want {
+			t.Errorf("%s: Validate() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHasAttribute(t *testing.T) {
+	ar := &ArchivalRecord{Attributes: make([][]byte, inetdiag.INET_DIAG_CONG+1)}
+	ar.Attributes[inetdiag.INET_DIAG_CONG] = []byte("cubic")
+	for _, tt := range []struct {
+		t    int
+		want bool
+	}{
+		{-1, false},
+		{inetdiag.INET_DIAG_MEMINFO, false},
+		{inetdiag.INET_DIAG_INFO, false},
+		{inetdiag.INET_DIAG_CONG, true},
+		{inetdiag.INET_DIAG_CONG + 1, false},
+		{1000, false},
+	} {
+		if got := ar.HasAttribute(tt.t); got != tt.want {
+			t.Errorf("HasAttribute(%d) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+	// The slice is long enough to hold INET_DIAG_INFO, but there is none.
+	if ar.HasDiagInfo() {
+		t.Error("HasDiagInfo() should be false")
+	}
+	if _, ok := ar.CAState(); ok {
+		t.Error("CAState() should not be found")
+	}
+	if s, r := ar.GetStats(); s != 0 || r != 0 {
+		t.Error("GetStats() should be zero", s, r)
+	}
+	if ar.Slim(CompareOptions{}).Attributes != nil {
+		t.Error("Slim() should have no attributes")
+	}
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = make([]byte, 232)
+	if !ar.HasDiagInfo() {
+		t.Error("HasDiagInfo() should be true")
+	}
+}
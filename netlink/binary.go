@@ -0,0 +1,194 @@
+package netlink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrBadBinaryRecord is returned when a binary encoded ArchivalRecord is malformed.
+var ErrBadBinaryRecord = errors.New("malformed binary ArchivalRecord")
+
+// maxBinaryRecordSize bounds the allocation for a single record, since netlink
+// messages are never anywhere near this large.
+const maxBinaryRecordSize = 1 << 20
+
+// The binary encoding of an ArchivalRecord is a uvarint length prefix, followed by:
+//   - the Timestamp, as varint seconds and uvarint nanoseconds since the Unix epoch
+//   - the RawIDM, as a byte slice
+//   - the number of Attributes, as a uvarint, followed by each attribute as a byte slice
+//   - the JSON encoded Metadata, as a byte slice
+//
+// Each byte slice is encoded as a uvarint of its length plus one, followed by its
+// contents, so that a nil slice (encoded as zero) can be distinguished from an empty one.
+
+// MarshalBinary encodes the ArchivalRecord in a compact, length prefixed, binary
+// form.  Records encoded this way may simply be concatenated in a file, and read
+// back with NewBinaryReader.
+func (pm *ArchivalRecord) MarshalBinary() ([]byte, error) {
+	size := 2*binary.MaxVarintLen64 + len(pm.RawIDM) + binary.MaxVarintLen64
+	for _, a := range pm.Attributes {
+		size += len(a) + binary.MaxVarintLen64
+	}
+	body := make([]byte, 0, size)
+	body = binary.AppendVarint(body, pm.Timestamp.Unix())
+	body = binary.AppendUvarint(body, uint64(pm.Timestamp.Nanosecond()))
+	body = appendBytes(body, pm.RawIDM)
+	body = binary.AppendUvarint(body, uint64(len(pm.Attributes)))
+	for _, a := range pm.Attributes {
+		body = appendBytes(body, a)
+	}
+	var meta []byte
+	if pm.Metadata != nil {
+		var err error
+		meta, err = json.Marshal(pm.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	body = appendBytes(body, meta)
+
+	out := make([]byte, 0, len(body)+binary.MaxVarintLen64)
+	out = binary.AppendUvarint(out, uint64(len(body)))
+	return append(out, body...), nil
+}
+
+// UnmarshalBinary decodes a single record produced by MarshalBinary.
+func (pm *ArchivalRecord) UnmarshalBinary(data []byte) error {
+	n, k := binary.Uvarint(data)
+	if k <= 0 || uint64(len(data)-k) != n {
+		return ErrBadBinaryRecord
+	}
+	return pm.decodeBinaryBody(data[k:])
+}
+
+func (pm *ArchivalRecord) decodeBinaryBody(body []byte) error {
+	d := binaryDecoder{buf: body}
+	sec := d.varint()
+	nsec := d.uvarint()
+	raw := d.bytes()
+	count := d.uvarint()
+	if d.err == nil && count > uint64(len(d.buf)) {
+		// Each attribute takes at least one byte.
+		d.err = ErrBadBinaryRecord
+	}
+	var attrs [][]byte
+	if d.err == nil && count > 0 {
+		attrs = make([][]byte, count)
+		for i := range attrs {
+			attrs[i] = d.bytes()
+		}
+	}
+	meta := d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) != 0 || nsec >= uint64(time.Second) {
+		return ErrBadBinaryRecord
+	}
+
+	record := ArchivalRecord{
+		Timestamp:  time.Unix(sec, int64(nsec)).UTC(),
+		RawIDM:     raw,
+		Attributes: attrs,
+	}
+	if meta != nil {
+		record.Metadata = &Metadata{}
+		if err := json.Unmarshal(meta, record.Metadata); err != nil {
+			return err
+		}
+	}
+	*pm = record
+	return nil
+}
+
+func appendBytes(b []byte, value []byte) []byte {
+	if value == nil {
+		return binary.AppendUvarint(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(len(value))+1)
+	return append(b, value...)
+}
+
+// binaryDecoder consumes values from buf, recording the first error encountered.
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, k := binary.Uvarint(d.buf)
+	if k <= 0 {
+		d.err = ErrBadBinaryRecord
+		return 0
+	}
+	d.buf = d.buf[k:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, k := binary.Varint(d.buf)
+	if k <= 0 {
+		d.err = ErrBadBinaryRecord
+		return 0
+	}
+	d.buf = d.buf[k:]
+	return v
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	n--
+	if n > uint64(len(d.buf)) {
+		d.err = ErrBadBinaryRecord
+		return nil
+	}
+	v := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+type binaryReader struct {
+	rdr *bufio.Reader
+}
+
+// NewBinaryReader wraps a source of binary encoded ArchivalRecords, as produced by
+// ArchivalRecord.MarshalBinary, to create an ArchiveReader.
+func NewBinaryReader(rdr io.Reader) ArchiveReader {
+	return &binaryReader{rdr: bufio.NewReader(rdr)}
+}
+
+// Next decodes and returns the next ArchivalRecord.
+func (br *binaryReader) Next() (*ArchivalRecord, error) {
+	n, err := binary.ReadUvarint(br.rdr)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrBadBinaryRecord
+	}
+	if n > maxBinaryRecordSize {
+		return nil, ErrBadBinaryRecord
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br.rdr, body); err != nil {
+		return nil, ErrBadBinaryRecord
+	}
+	record := ArchivalRecord{}
+	if err := record.decodeBinaryBody(body); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
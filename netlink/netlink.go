@@ -7,6 +7,6 @@ type MessageBlock struct {
 	V4Time     time.Time         // Time at which netlink message block was received.
 	V4Messages []*NetlinkMessage // Array of raw messages.
 
-	V6Time     time.Time
+	V6Time     time.Time // Equal to V4Time if the collector unifies the timestamps of each cycle.
 	V6Messages []*NetlinkMessage
 }
@@ -49,8 +49,11 @@ const (
 
 // Error types.
 var (
-	ErrNotType20   = errors.New("NetlinkMessage wrong type")
-	ErrParseFailed = errors.New("Unable to parse InetDiagMsg")
+	ErrNotType20        = errors.New("NetlinkMessage wrong type")
+	ErrParseFailed      = errors.New("Unable to parse InetDiagMsg")
+	ErrShortInetDiagMsg = errors.New("InetDiagMsg too short")
+	ErrBadRouteAttr     = errors.New("malformed route attribute")
+	ErrDuplicateAttr    = errors.New("attribute appears more than once")
 )
 
 /*********************************************************************************************
@@ -1,7 +1,10 @@
 package netlink_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
@@ -13,7 +16,10 @@ import (
 
 	"github.com/go-test/deep"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
@@ -72,8 +78,8 @@ func TestParseGarbage(t *testing.T) {
 	badNm := nm
 	badNm.Data = badNm.Data[:1]
 	_, err = netlink.MakeArchivalRecord(&badNm, &netlink.ExcludeConfig{Local: true})
-	if err == nil {
-		t.Error("The parse should have failed")
+	if err != netlink.ErrShortInetDiagMsg {
+		t.Error("The parse should have failed with ErrShortInetDiagMsg, not", err)
 	}
 
 	// Replace the header type with one that we don't support.
@@ -91,17 +97,22 @@ func TestParseGarbage(t *testing.T) {
 		nm.Data[i] = byte(i)
 	}
 
+	before := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(netlink.ErrBadRouteAttr.Error()))
 	_, err = netlink.MakeArchivalRecord(&nm, nil)
-	if err == nil || err.Error() != "invalid argument" {
+	if err != netlink.ErrBadRouteAttr {
 		t.Error(err)
 	}
 
 	// Replace length with garbage so that data is incomplete.
 	nm.Header.Len = 400
 	_, err = netlink.MakeArchivalRecord(&nm, nil)
-	if err == nil || err.Error() != "invalid argument" {
+	if err != netlink.ErrBadRouteAttr {
 		t.Error(err)
 	}
+	after := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(netlink.ErrBadRouteAttr.Error()))
+	if after != before+2 {
+		t.Errorf("ParseErrorCount = %v, want %v", after, before+2)
+	}
 }
 func TestReader(t *testing.T) {
 	// Cache info new 140  err 0 same 277 local 789 diff 3 total 1209
@@ -125,6 +136,28 @@ func TestReader(t *testing.T) {
 	}
 }
 
+func TestLoadRawNetlinkMessageBadLen(t *testing.T) {
+	for _, badLen := range []uint32{0, netlink.SizeofNlMsghdr - 1, netlink.MaxRawMessageSize + 1, 0xFFFFFFFF} {
+		var buf bytes.Buffer
+		rtx.Must(binary.Write(&buf, binary.LittleEndian, netlink.NlMsghdr{Len: badLen}), "Could not write header")
+		buf.Write(make([]byte, 100))
+
+		before := testutil.ToFloat64(metrics.BadHeaderLenCount)
+		_, err := netlink.LoadRawNetlinkMessage(&buf)
+		var lenErr *netlink.HeaderLenError
+		if !errors.As(err, &lenErr) {
+			t.Fatalf("Len %d: expected a HeaderLenError, got %v", badLen, err)
+		}
+		if lenErr.Len != badLen {
+			t.Errorf("Len %d: error has Len %d", badLen, lenErr.Len)
+		}
+		after := testutil.ToFloat64(metrics.BadHeaderLenCount)
+		if after != before+1 {
+			t.Errorf("Len %d: BadHeaderLenCount went from %v to %v", badLen, before, after)
+		}
+	}
+}
+
 func TestCompare(t *testing.T) {
 	var json1 = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
 	nm := netlink.NetlinkMessage{}
@@ -178,6 +211,23 @@ func TestCompare(t *testing.T) {
 		t.Error("Late field change not detected:", deep.Equal(mp1.Attributes[inetdiag.INET_DIAG_INFO],
 			mp2.Attributes[inetdiag.INET_DIAG_INFO]))
 	}
+
+	// CAState transitions take precedence over other changes.
+	caStateOffset := unsafe.Offsetof(tcp.LinuxTCPInfo{}.CAState)
+	mp2.Attributes[inetdiag.INET_DIAG_INFO][caStateOffset] = byte(tcp.TCP_CA_Recovery)
+	diff, err = mp1.Compare(mp2)
+	rtx.Must(err, "")
+	if diff != netlink.CAStateChange {
+		t.Error("CAState change not detected:", diff)
+	}
+	from, ok := mp1.CAState()
+	if !ok || from.String() != "Open" {
+		t.Error("Wrong previous CAState", from, ok)
+	}
+	to, ok := mp2.CAState()
+	if !ok || to.String() != "Recovery" {
+		t.Error("Wrong new CAState", to, ok)
+	}
 }
 
 func TestNLMsgSerialize(t *testing.T) {
@@ -322,6 +372,79 @@ func BenchmarkNLMsgSerialize(b *testing.B) {
 	}
 }
 
+// The binary encoding is much faster than JSON for the same records.
+func BenchmarkNLMsgSerializeBinary(b *testing.B) {
+	b.StopTimer()
+	source := "testdata/testdata.zst"
+	rdr := zstd.NewReader(source)
+	msgs := make([]*netlink.ArchivalRecord, 0, 200)
+
+	for {
+		msg, err := netlink.LoadRawNetlinkMessage(rdr)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			b.Fatal(err)
+		}
+		pm, err := netlink.MakeArchivalRecord(msg, nil)
+		rtx.Must(err, "Could not parse test data")
+		msgs = append(msgs, pm)
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for _, m := range msgs {
+			_, err := m.MarshalBinary()
+			rtx.Must(err, "Could not serialize %v", m)
+			i++
+			if i >= b.N {
+				break
+			}
+		}
+	}
+}
+
+func loadBenchmarkRecords(b *testing.B) []*netlink.ArchivalRecord {
+	rdr := zstd.NewReader("testdata/testdata.zst")
+	defer rdr.Close()
+	msgs := make([]*netlink.ArchivalRecord, 0, 200)
+	for {
+		msg, err := netlink.LoadRawNetlinkMessage(rdr)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			b.Fatal(err)
+		}
+		pm, err := netlink.MakeArchivalRecord(msg, nil)
+		rtx.Must(err, "Could not parse test data")
+		msgs = append(msgs, pm)
+	}
+	return msgs
+}
+
+// RawIDM.Parse is only a length check and a cast, so there is no need to cache
+// its result, even though the saver parses each record several times.
+func BenchmarkRawIDMParse(b *testing.B) {
+	msgs := loadBenchmarkRecords(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := msgs[i%len(msgs)].RawIDM.Parse()
+		rtx.Must(err, "Could not parse RawIDM")
+	}
+}
+
+// BenchmarkCompare measures the change detection done for every record.
+func BenchmarkCompare(b *testing.B) {
+	msgs := loadBenchmarkRecords(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := msgs[(i+1)%len(msgs)].Compare(msgs[i%len(msgs)])
+		rtx.Must(err, "Could not compare records")
+	}
+}
+
 // This takes about 8 usec per record.  zstd process seems to take about 1/3 as much CPU as
 // go process.  Not clear where the bottleneck is.  Wall time may not be same as CPU time.
 func BenchmarkNLMsgParseSerializeCompress(b *testing.B) {
@@ -409,6 +532,91 @@ func Test_archiveReader_Next(t *testing.T) {
 	}
 }
 
+func TestBinaryRoundTrip(t *testing.T) {
+	source := "testdata/archiveRecords.jsonl.zst"
+	rdr := zstd.NewReader(source)
+	defer rdr.Close()
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not load test data")
+	// Also include a metadata record, which the test data lacks.
+	msgs = append(msgs, &netlink.ArchivalRecord{
+		Metadata: &netlink.Metadata{UUID: "foo", Sequence: 3, StartTime: time.Date(2019, time.June, 5, 0, 0, 0, 0, time.UTC)},
+	})
+
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		b, err := m.MarshalBinary()
+		rtx.Must(err, "Could not marshal %v", m)
+		single := netlink.ArchivalRecord{}
+		rtx.Must(single.UnmarshalBinary(b), "Could not unmarshal %v", m)
+		if diff := deep.Equal(&single, m); diff != nil {
+			t.Fatal(diff)
+		}
+		buf.Write(b)
+	}
+
+	br := netlink.NewBinaryReader(&buf)
+	for i := range msgs {
+		got, err := br.Next()
+		rtx.Must(err, "Could not read record %d", i)
+		if diff := deep.Equal(got, msgs[i]); diff != nil {
+			t.Fatal(i, diff)
+		}
+	}
+	if _, err := br.Next(); err != io.EOF {
+		t.Error("Expected EOF, got", err)
+	}
+}
+
+func TestToNetlinkMessage(t *testing.T) {
+	source := "testdata/archiveRecords.jsonl.zst"
+	rdr := zstd.NewReader(source)
+	defer rdr.Close()
+	msgs, err := netlink.LoadAllArchivalRecords(rdr)
+	rtx.Must(err, "Could not load test data")
+
+	for i, m := range msgs {
+		nm, err := m.ToNetlinkMessage()
+		if len(m.RawIDM) == 0 {
+			if err != netlink.ErrShortInetDiagMsg {
+				t.Error("Expected ErrShortInetDiagMsg, got", err)
+			}
+			continue
+		}
+		rtx.Must(err, "Could not convert record %d", i)
+		if int(nm.Header.Len) != netlink.SizeofNlMsghdr+len(nm.Data) || len(nm.Data)%netlink.RTA_ALIGNTO != 0 {
+			t.Error("Bad message length", nm.Header.Len, len(nm.Data))
+		}
+		got, err := netlink.MakeArchivalRecord(nm, nil)
+		rtx.Must(err, "Could not parse reassembled record %d", i)
+		got.Timestamp = m.Timestamp
+		if diff := deep.Equal(got, m); diff != nil {
+			t.Fatal(i, diff)
+		}
+	}
+
+	if _, err := (&netlink.ArchivalRecord{Metadata: &netlink.Metadata{}}).ToNetlinkMessage(); err != netlink.ErrShortInetDiagMsg {
+		t.Error("Expected ErrShortInetDiagMsg for metadata record, got", err)
+	}
+}
+
+func TestBinaryGarbage(t *testing.T) {
+	b, err := (&netlink.ArchivalRecord{RawIDM: []byte{1, 2, 3}}).MarshalBinary()
+	rtx.Must(err, "Could not marshal")
+	ar := netlink.ArchivalRecord{}
+	if err := ar.UnmarshalBinary(b[:len(b)-1]); err != netlink.ErrBadBinaryRecord {
+		t.Error("Expected ErrBadBinaryRecord for truncated record, got", err)
+	}
+	// Corrupt the RawIDM length so that it runs past the end of the record.
+	b[len(b)-6] = 100
+	if err := ar.UnmarshalBinary(b); err != netlink.ErrBadBinaryRecord {
+		t.Error("Expected ErrBadBinaryRecord for bad length, got", err)
+	}
+	if _, err := netlink.NewBinaryReader(bytes.NewReader(b[:len(b)-1])).Next(); err != netlink.ErrBadBinaryRecord {
+		t.Error("Expected ErrBadBinaryRecord from reader, got", err)
+	}
+}
+
 func TestGetStats(t *testing.T) {
 	source := "testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst"
 	rdr := zstd.NewReader(source)
@@ -0,0 +1,113 @@
+package saver
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupFilter selects connections by the cgroup of the process that owns
+// their socket, e.g. to save only the connections of a single container.
+// Socket owners are found by scanning the fd directories of every process in
+// /proc, which is expensive, so the Saver only consults it for new connections,
+// and it scans at most once per MessageBlock.
+type CgroupFilter struct {
+	Root  string // The proc filesystem, usually "/proc".
+	Match string // Connections are saved if any of their owner's cgroup paths contain Match.
+
+	cgroups map[uint32][]string // The owner's cgroup paths, by socket inode, from the last scan.
+	stale   bool                // Whether a new MessageBlock has started since the last scan.
+}
+
+// NewCgroupFilter returns a CgroupFilter that matches sockets owned by
+// processes, listed in root, whose cgroup paths contain match.
+func NewCgroupFilter(root, match string) *CgroupFilter {
+	return &CgroupFilter{Root: root, Match: match, stale: true}
+}
+
+// newCycle makes the next call to Matches scan again, so that it finds the
+// sockets created since the last scan.
+func (f *CgroupFilter) newCycle() {
+	f.stale = true
+}
+
+// Matches returns true if the socket with the given inode is owned by a process
+// with a matching cgroup.  Sockets without an inode, e.g. in TIME_WAIT, have no
+// owner, and never match.
+func (f *CgroupFilter) Matches(inode uint32) bool {
+	if inode == 0 {
+		return false
+	}
+	if f.stale {
+		f.scan()
+	}
+	for _, path := range f.cgroups[inode] {
+		if strings.Contains(path, f.Match) {
+			return true
+		}
+	}
+	return false
+}
+
+// scan finds the owner of every socket in Root, and its cgroup paths.
+// Processes may exit at any time, so errors are ignored.
+func (f *CgroupFilter) scan() {
+	f.cgroups = make(map[uint32][]string)
+	f.stale = false
+	procs, err := os.ReadDir(f.Root)
+	if err != nil {
+		return
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue // Not a process.
+		}
+		dir := filepath.Join(f.Root, proc.Name())
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var paths []string
+		for _, fd := range fds {
+			inode, ok := socketInode(filepath.Join(dir, "fd", fd.Name()))
+			if !ok {
+				continue
+			}
+			if paths == nil {
+				paths = cgroupPaths(filepath.Join(dir, "cgroup"))
+			}
+			f.cgroups[inode] = paths
+		}
+	}
+}
+
+// socketInode returns the inode of the socket that the fd link points to, if
+// it is a socket.
+func socketInode(fd string) (uint32, bool) {
+	target, err := os.Readlink(fd)
+	if err != nil || !strings.HasPrefix(target, "socket:[") || !strings.HasSuffix(target, "]") {
+		return 0, false
+	}
+	inode, err := strconv.ParseUint(target[len("socket:["):len(target)-1], 10, 32)
+	return uint32(inode), err == nil
+}
+
+// cgroupPaths returns the paths in a /proc/<pid>/cgroup file, whose lines are
+// of the form "hierarchy-ID:controller-list:cgroup-path".
+func cgroupPaths(file string) []string {
+	paths := []string{}
+	fh, err := os.Open(file)
+	if err != nil {
+		return paths
+	}
+	defer fh.Close()
+	s := bufio.NewScanner(fh)
+	for s.Scan() {
+		if fields := strings.SplitN(s.Text(), ":", 3); len(fields) == 3 {
+			paths = append(paths, fields[2])
+		}
+	}
+	return paths
+}
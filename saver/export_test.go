@@ -0,0 +1,19 @@
+package saver
+
+import "github.com/m-lab/tcp-info/netlink"
+
+var ThroughputDelta = throughputDelta
+
+var ReconcileTotal = reconcileTotal
+
+var ClassifyClose = classifyClose
+
+func (f *CgroupFilter) NewCycle() { f.newCycle() }
+
+// SetMarshalBinary replaces the function used to encode binary records, and
+// returns a function that restores the original.
+func SetMarshalBinary(f func(*netlink.ArchivalRecord) ([]byte, error)) func() {
+	orig := marshalBinary
+	marshalBinary = f
+	return func() { marshalBinary = orig }
+}
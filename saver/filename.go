@@ -0,0 +1,81 @@
+package saver
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultFileNameTemplate names connection files by date directory, UUID and
+// sequence, e.g. "2006/01/02/<uuid>.00003.jsonl.zst".  ResumeSequences and
+// Prune only find files named this way.
+const DefaultFileNameTemplate = `{{.Date}}/{{.UUID}}.{{printf "%05d" .Sequence}}.{{.Ext}}.zst`
+
+// FileName holds the fields available to a file name template.
+type FileName struct {
+	Date      string    // The date directory, e.g. "2006/01/02", of the StartTime for the first file, and of the current time for later files.
+	UUID      string    // The connection's UUID.
+	Sequence  int       // The file's sequence number for the connection, starting at zero.
+	StartTime time.Time // Time the connection was initiated.
+	Host      string    // The Saver's Host.
+	Pod       string    // The Saver's Pod.
+	Ext       string    // "jsonl" or "bin", for the encoding of the file.
+}
+
+var defaultFileName = template.Must(ParseFileNameTemplate(DefaultFileNameTemplate))
+
+// ParseFileNameTemplate parses a text/template for the names of connection
+// files, relative to the output directory, and validates it by rendering sample
+// FileNames.  The template must produce non-empty relative paths, without ".."
+// elements, that differ by UUID and Sequence, since a file with the same name
+// as an earlier one would replace it.
+func ParseFileNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("filename").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := FileName{
+		Date:      "2006/01/02",
+		UUID:      "host_1234567890_0000000000000001",
+		StartTime: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		Host:      "host",
+		Pod:       "pod",
+		Ext:       "jsonl",
+	}
+	otherUUID, otherSequence := sample, sample
+	otherUUID.UUID = "host_1234567890_0000000000000002"
+	otherSequence.Sequence = 1
+	names := make(map[string]bool)
+	for _, fn := range []FileName{sample, otherUUID, otherSequence} {
+		name, err := renderFileName(tmpl, &fn)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(name) == "" {
+			return nil, errors.New("file name template produces an empty name")
+		}
+		if filepath.IsAbs(name) {
+			return nil, errors.New("file name template produces an absolute path: " + name)
+		}
+		for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+			if elem == ".." {
+				return nil, errors.New("file name template produces a path with a \"..\" element: " + name)
+			}
+		}
+		names[name] = true
+	}
+	if len(names) != 3 {
+		return nil, errors.New("file name template must produce different names for each UUID and Sequence")
+	}
+	return tmpl, nil
+}
+
+func renderFileName(tmpl *template.Template, fn *FileName) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fn); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
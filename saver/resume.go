@@ -0,0 +1,61 @@
+package saver
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseConnectionFile returns the UUID and sequence number of a file written
+// by Connection.Rotate, e.g. "<uuid>.00003.jsonl.zst".
+func parseConnectionFile(name string) (string, int, bool) {
+	if !isConnectionFile(name) {
+		return "", 0, false
+	}
+	base := strings.TrimSuffix(name, ".zst")
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".jsonl"), ".bin")
+	i := strings.LastIndex(base, ".")
+	if i < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(base[i+1:])
+	if err != nil || seq < 0 {
+		return "", 0, false
+	}
+	return base[:i], seq, true
+}
+
+// ResumeSequences scans the date directories under root for yesterday and
+// today, according to the Saver's Clock, for connection files written before a
+// restart.  Connections in the first MessageBlock that already have files there
+// continue their sequence numbering, after the highest sequence found, instead
+// of starting again at zero.  Later connections are not affected.  Only local
+// files can be found, and the UUIDs of anonymized connections change on
+// restart, so they are never resumed.  It must be called before
+// MessageSaverLoop, and returns the number of connections that may be resumed.
+func (svr *Saver) ResumeSequences(root string) (int, error) {
+	now := svr.now().UTC()
+	resume := make(map[string]int)
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		entries, err := os.ReadDir(filepath.Join(root, day.Format("2006/01/02")))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			id, seq, ok := parseConnectionFile(e.Name())
+			if !ok || !e.Type().IsRegular() {
+				continue
+			}
+			if prev, found := resume[id]; !found || seq > prev {
+				resume[id] = seq
+			}
+		}
+	}
+	svr.resume = resume
+	return len(resume), nil
+}
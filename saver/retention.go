@@ -0,0 +1,93 @@
+package saver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/m-lab/tcp-info/metrics"
+)
+
+// RetentionCheckInterval is how often RetentionLoop looks for expired files.
+const RetentionCheckInterval = time.Hour
+
+// isConnectionFile returns true if name is a file written by Connection.Rotate.
+func isConnectionFile(name string) bool {
+	return strings.HasSuffix(name, ".jsonl.zst") || strings.HasSuffix(name, ".bin.zst")
+}
+
+// Prune removes connection files from the 2006/01/02 date directories under
+// root, if both the day and the file's modification time are before cutoff.
+// Date directories, and their month and year directories, are then removed if
+// they are empty.  Nothing else is removed, so other files keep their
+// directories.  It returns the number of files and bytes removed, which are
+// also counted in metrics.RetentionFilesRemoved and RetentionBytesRemoved.
+func Prune(root string, cutoff time.Time) (int, int64, error) {
+	root = filepath.Clean(root)
+	days, err := filepath.Glob(filepath.Join(root, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	if err != nil {
+		return 0, 0, err
+	}
+	files := 0
+	var size int64
+	for _, dir := range days {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return files, size, err
+		}
+		day, err := time.Parse("2006/01/02", filepath.ToSlash(rel))
+		if err != nil || !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue // Not a date, or not expired.
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return files, size, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !isConnectionFile(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue // Removed already, or still being written.
+			}
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return files, size, err
+			}
+			files++
+			size += info.Size()
+			metrics.RetentionFilesRemoved.Inc()
+			metrics.RetentionBytesRemoved.Add(float64(info.Size()))
+		}
+		// Remove fails, harmlessly, on directories that are not empty.
+		for d := dir; d != root; d = filepath.Dir(d) {
+			if os.Remove(d) != nil {
+				break
+			}
+		}
+	}
+	return files, size, nil
+}
+
+// RetentionLoop calls Prune for root immediately, and then every
+// RetentionCheckInterval, with a cutoff of retention before the current time,
+// until ctx is canceled.
+func (svr *Saver) RetentionLoop(ctx context.Context, root string, retention time.Duration) {
+	ticker := time.NewTicker(RetentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		files, size, err := Prune(root, svr.now().Add(-retention))
+		if err != nil {
+			svr.logger().Warn("Could not prune old files:", err)
+		} else if files > 0 {
+			svr.logger().Info("Pruned", files, "old files,", size, "bytes")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -9,26 +9,34 @@
 package saver
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/logx"
 
 	"github.com/m-lab/tcp-info/cache"
 	"github.com/m-lab/tcp-info/eventsocket"
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/logging"
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
 	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
 	"github.com/m-lab/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // This is the maximum switch/network if speed in bits/sec.  It is used to check for illogical bit rate observations.
@@ -45,6 +53,8 @@ const maxSwitchSpeed = 1e10
 // Errors generated by saver functions.
 var (
 	ErrNoMarshallers = errors.New("Saver has zero Marshallers")
+
+	errExceedsCapacity = errors.New("increase exceeds network capacity")
 )
 
 // Task represents a single marshalling task, specifying the message and the writer.
@@ -52,6 +62,10 @@ type Task struct {
 	// nil message means close the writer.
 	Message *netlink.ArchivalRecord
 	Writer  io.WriteCloser
+	// Binary selects ArchivalRecord.MarshalBinary instead of JSONL.
+	Binary bool
+	// SockIDAnon, if non-nil, anonymizes the cookie and ports of the message.
+	SockIDAnon *inetdiag.SockIDAnonymizer
 }
 
 // CacheLogger is any object with a LogCacheStats method.
@@ -62,7 +76,14 @@ type CacheLogger interface {
 // MarshalChan is a channel of marshalling tasks.
 type MarshalChan chan<- Task
 
-func runMarshaller(taskChan <-chan Task, wg *sync.WaitGroup, anon anonymize.IPAnonymizer) {
+// marshalBinary encodes the records of binary files.  It is a variable so that
+// tests can simulate encoding errors.
+var marshalBinary = (*netlink.ArchivalRecord).MarshalBinary
+
+// runMarshaller writes each task's record until taskChan is closed.  It logs
+// with logger, which is called for each message, since the Saver's Logger may
+// be set after its marshallers are started.
+func runMarshaller(taskChan <-chan Task, wg *sync.WaitGroup, anon anonymize.IPAnonymizer, logger func() logging.Logger) {
 	for task := range taskChan {
 		if task.Message == nil {
 			task.Writer.Close()
@@ -71,23 +92,49 @@ func runMarshaller(taskChan <-chan Task, wg *sync.WaitGroup, anon anonymize.IPAn
 		if task.Writer == nil {
 			log.Fatal("Nil writer")
 		}
+		// Anonymization rewrites the InetDiagMsg in place, but the saver still
+		// holds the record, e.g. in the cache, so only a copy may be modified.
+		msg := *task.Message
+		msg.RawIDM = append(inetdiag.RawInetDiagMsg(nil), msg.RawIDM...)
+		task.Message = &msg
 		err := task.Message.RawIDM.Anonymize(anon)
 		if err != nil {
-			log.Println("Failed to anonymize message:", err)
+			logger().Error("Failed to anonymize message:", err)
+			continue
+		}
+		if task.SockIDAnon != nil {
+			if err := task.SockIDAnon.Anonymize(task.Message.RawIDM); err != nil {
+				logger().Error("Failed to anonymize socket ID:", err)
+				continue
+			}
+		}
+		if task.Binary {
+			b, err := marshalBinary(task.Message)
+			if err != nil {
+				// A bad length prefix would make the rest of the file unreadable.
+				logger().Error("Failed to encode record:", err)
+				metrics.ErrorCount.WithLabelValues("binary encode").Inc()
+				continue
+			}
+			start := time.Now()
+			task.Writer.Write(b)
+			metrics.WriteLatencyHistogram.Observe(time.Since(start).Seconds())
 			continue
 		}
 		b, _ := json.Marshal(task.Message) // FIXME: don't ignore error
+		start := time.Now()
 		task.Writer.Write(b)
 		task.Writer.Write([]byte("\n"))
+		metrics.WriteLatencyHistogram.Observe(time.Since(start).Seconds())
 	}
-	log.Println("Marshaller Done")
+	logger().Info("Marshaller Done")
 	wg.Done()
 }
 
-func newMarshaller(wg *sync.WaitGroup, anon anonymize.IPAnonymizer) MarshalChan {
-	marshChan := make(chan Task, 100)
+func newMarshaller(wg *sync.WaitGroup, anon anonymize.IPAnonymizer, bufferSize int, logger func() logging.Logger) MarshalChan {
+	marshChan := make(chan Task, bufferSize)
 	wg.Add(1)
-	go runMarshaller(marshChan, wg, anon)
+	go runMarshaller(marshChan, wg, anon, logger)
 	return marshChan
 }
 
@@ -100,15 +147,115 @@ type Connection struct {
 	StartTime  time.Time // Time the connection was initiated.
 	Sequence   int       // Typically zero, but increments for long running connections.
 	Expiration time.Time // Time we will swap files and increment Sequence.
+	LastWrite  time.Time // Timestamp of the most recently queued snapshot.
+	LastActive time.Time // Clock time of the most recently queued snapshot, for Saver.IdleTimeout.
 	Writer     io.WriteCloser
+	Binary     bool // Write binary encoded records, instead of JSONL.
+	AttrNames  bool // Include the map of attribute names in file headers.
+	SockIDAnon *inetdiag.SockIDAnonymizer
+	Labels     netlink.Labels
+	Factory    WriterFactory // Creates the connection's files.  If nil, LocalWriterFactory is used.
+	MaxBytes   int64         // If non-zero, start a new file after about this many uncompressed bytes.
+	Clock      Clock         // Used for file expiration and naming.  If nil, time.Now is used.
+
+	// Logger receives the connection's log messages.  If nil, logging.Default is used.
+	Logger logging.Logger
+
+	// FileName names the connection's files.  If nil, DefaultFileNameTemplate is used.
+	FileName *template.Template
+
+	counter *countingWriter // Counts the bytes written to Writer.
+}
+
+// countingWriter counts the bytes written through it.  Writes come from the
+// marshaller, while the count is read by the saver, so it is accessed atomically.
+type countingWriter struct {
+	io.WriteCloser
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.WriteCloser.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+// Close observes the size of the file in OutputFileBytesHistogram, and closes it.
+func (cw *countingWriter) Close() error {
+	metrics.OutputFileBytesHistogram.Observe(float64(atomic.LoadInt64(&cw.n)))
+	return cw.WriteCloser.Close()
+}
+
+// full returns true if the current file has reached MaxBytes.  Since snapshots
+// are written asynchronously, files may exceed MaxBytes by the snapshots still
+// queued for the marshaller.
+func (conn *Connection) full() bool {
+	return conn.MaxBytes > 0 && conn.counter != nil && atomic.LoadInt64(&conn.counter.n) >= conn.MaxBytes
+}
+
+// uuid returns the connection's UUID, based on the anonymized cookie if the
+// connection's records are anonymized, so that it matches their content.
+func (conn *Connection) uuid() string {
+	cookie := conn.ID.CookieUint64()
+	if conn.SockIDAnon != nil {
+		cookie = conn.SockIDAnon.Cookie(cookie)
+	}
+	return uuid.FromCookie(cookie)
 }
 
-func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time) *Connection {
+// WriterFactory creates the writers for connection files, so that deployments
+// can store them somewhere other than the local filesystem, e.g. in object
+// storage.  Each path is relative, e.g. "2006/01/02/<uuid>.00000.jsonl.zst", and
+// the writer is responsible for the zstd compression implied by its extension.
+type WriterFactory interface {
+	NewWriter(path string) (io.WriteCloser, error)
+}
+
+// LocalWriterFactory is the default WriterFactory.  It writes zstd compressed
+// files relative to the working directory, creating directories as needed.
+type LocalWriterFactory struct {
+	// Sync makes closing a file, e.g. on rotation, also fsync it, so that the
+	// files that have been closed survive a crash.
+	Sync bool
+}
+
+// NewWriter creates the directory for path, and a zstd writer for the file.
+func (f LocalWriterFactory) NewWriter(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	if f.Sync {
+		return zstd.NewSyncWriter(path)
+	}
+	return zstd.NewWriter(path)
+}
+
+func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time, clock Clock) *Connection {
 	conn := Connection{Inode: info.IDiagInode, ID: info.ID.GetSockID(), UID: info.IDiagUID, Slice: "", StartTime: timestamp, Sequence: 0,
-		Expiration: time.Now()}
+		Clock: clock}
+	conn.Expiration = conn.now()
 	return &conn
 }
 
+// Clock provides the current time, so that tests can control file rotation.
+type Clock interface {
+	Now() time.Time
+}
+
+func (conn *Connection) logger() logging.Logger {
+	if conn.Logger != nil {
+		return conn.Logger
+	}
+	return logging.Default
+}
+
+func (conn *Connection) now() time.Time {
+	if conn.Clock == nil {
+		return time.Now()
+	}
+	return conn.Clock.Now()
+}
+
 // Rotate opens the next writer for a connection.
 // Note that long running connections will have data in multiple directories,
 // because, for all segments after the first one, we choose the directory
@@ -117,26 +264,51 @@ func newConnection(info *inetdiag.InetDiagMsg, timestamp time.Time) *Connection
 // therefore likely have data in multiple date directories.
 // (This behavior is new as of April 2020. Prior to then, all files were
 // placed in the directory corresponding to the StartTime.)
+// Each file is kept open for FileAgeLimit before the next one is started.
 func (conn *Connection) Rotate(Host string, Pod string, FileAgeLimit time.Duration) error {
 	datePath := conn.StartTime.Format("2006/01/02")
 	// For first block, date directory is based on the connection start time.
 	// For all other blocks, (sequence > 0) it is based on the current time.
 	if conn.Sequence > 0 {
-		now := time.Now().UTC()
+		now := conn.now().UTC()
 		datePath = now.Format("2006/01/02")
 	}
-	err := os.MkdirAll(datePath, 0777)
+	ext := "jsonl"
+	if conn.Binary {
+		ext = "bin"
+	}
+	tmpl := conn.FileName
+	if tmpl == nil {
+		tmpl = defaultFileName
+	}
+	name, err := renderFileName(tmpl, &FileName{
+		Date:      datePath,
+		UUID:      conn.uuid(),
+		Sequence:  conn.Sequence,
+		StartTime: conn.StartTime,
+		Host:      Host,
+		Pod:       Pod,
+		Ext:       ext,
+	})
 	if err != nil {
 		return err
 	}
-	id := uuid.FromCookie(conn.ID.CookieUint64())
-	conn.Writer, err = zstd.NewWriter(fmt.Sprintf("%s/%s.%05d.jsonl.zst", datePath, id, conn.Sequence))
+	factory := conn.Factory
+	if factory == nil {
+		factory = LocalWriterFactory{}
+	}
+	w, err := factory.NewWriter(name)
 	if err != nil {
 		return err
 	}
+	conn.counter = &countingWriter{WriteCloser: w}
+	conn.Writer = conn.counter
 	conn.writeHeader()
 	metrics.NewFileCount.Inc()
-	conn.Expiration = conn.Expiration.Add(10 * time.Minute)
+	// Files started early because they reached MaxBytes don't extend the time limit.
+	if !conn.Expiration.After(conn.now()) {
+		conn.Expiration = conn.Expiration.Add(FileAgeLimit)
+	}
 	conn.Sequence++
 	return nil
 }
@@ -144,17 +316,36 @@ func (conn *Connection) Rotate(Host string, Pod string, FileAgeLimit time.Durati
 func (conn *Connection) writeHeader() {
 	msg := netlink.ArchivalRecord{
 		Metadata: &netlink.Metadata{
-			UUID:      uuid.FromCookie(conn.ID.CookieUint64()),
-			Sequence:  conn.Sequence,
-			StartTime: conn.StartTime,
+			UUID:          conn.uuid(),
+			Sequence:      conn.Sequence,
+			StartTime:     conn.StartTime,
+			SchemaVersion: netlink.SchemaVersion,
+			Labels:        conn.Labels,
 		},
 	}
+	if conn.AttrNames {
+		msg.Metadata.AttributeNames = netlink.AttributeNames()
+	}
+	if conn.Binary {
+		bytes, err := marshalBinary(&msg)
+		if err != nil {
+			// A bad length prefix would make the rest of the file unreadable, so
+			// the file is written without its header.
+			conn.logger().Error("Failed to encode file header:", err)
+			metrics.ErrorCount.WithLabelValues("binary encode").Inc()
+			return
+		}
+		conn.Writer.Write(bytes)
+		return
+	}
 	// FIXME: Error handling
 	bytes, _ := json.Marshal(msg)
 	conn.Writer.Write(bytes)
 	conn.Writer.Write([]byte("\n"))
 }
 
+// stats are updated by MessageSaverLoop, but read by LogCacheStats, which is
+// called from the collector's goroutine, so they are only accessed atomically.
 type stats struct {
 	TotalCount   int64
 	NewCount     int64
@@ -196,26 +387,118 @@ type TcpStats struct {
 // Saver provides functionality for saving tcpinfo diffs to connection files.
 // It handles arbitrary connections, and only writes to file when the
 // significant fields change.  (TODO - what does "significant fields" mean).
+// Connections, ClosingStats, ClosingTotals and the cache are owned by the
+// MessageSaverLoop goroutine, and must not be accessed while it is running.
+// LogCacheStats is safe to call at any time.
 // TODO - just export an interface, instead of the implementation.
 type Saver struct {
-	Host          string // mlabN
-	Pod           string // 3 alpha + 2 decimal
+	Host          string // mlabN.  Recorded in file headers, unless Labels.Host is set.
+	Pod           string // 3 alpha + 2 decimal.  Recorded in file headers, unless Labels.Pod is set.
 	FileAgeLimit  time.Duration
+	BinaryOutput  bool // Write new files with the binary ArchivalRecord encoding, instead of JSONL.
+	SlimCache     bool // Cache only the fields needed for diffing.  Must be set before MessageSaverLoop.
+	BBRChanges    bool // Report BBR gain changes as BBRChange, and count BBR mode transitions.  Must be set before MessageSaverLoop.
+	AttrNames     bool // Include the map of attribute names in the header of new files.
 	MarshalChans  []MarshalChan
 	Done          *sync.WaitGroup // All marshallers will call Done on this.
 	Connections   map[uint64]*Connection
 	ClosingStats  map[uint64]TcpStats // BytesReceived and BytesSent for connections that are closing.
 	ClosingTotals TcpStats
+	MinInterval   time.Duration // If non-zero, save at most one snapshot per connection per interval, unless the state changes.
+	StateEvents   bool          // Send a StateChange flow event whenever a connection changes TCP state.
+	DropOnFull    bool          // Drop snapshots, instead of blocking, when their marshaller queue is full.
+	WriterFactory WriterFactory // Creates connection files.  If nil, they are written locally, with LocalWriterFactory.
+	Clock         Clock         // Used for file rotation and flow events.  If nil, time.Now is used.
+	MaxFileBytes  int64         // If non-zero, start a new connection file after about this many uncompressed bytes.
+	SlowBlock     time.Duration // MessageBlocks that take longer than this to process are logged and counted.
+	Handshakes    bool          // Save every snapshot that differs at all, regardless of Compare and MinInterval, during the handshake.
+	DeliveryRates bool          // Observe the DeliveryRate of each saved snapshot that is not app-limited in DeliveryRateHistogram.
+	IdleTimeout   time.Duration // If non-zero, close the files of connections with no snapshot queued for this long.  The next snapshot starts a new file.
+	Cgroups       *CgroupFilter // If non-nil, only connections owned by a process in a matching cgroup are saved.
+
+	// FileName names connection files, by executing it with a FileName.  If
+	// nil, DefaultFileNameTemplate is used.  See ParseFileNameTemplate.
+	FileName *template.Template
+
+	// SockIDAnon, if non-nil, anonymizes the cookies and ports of saved records,
+	// and the UUIDs in their file names and headers.  Flow events are not affected.
+	SockIDAnon *inetdiag.SockIDAnonymizer
+
+	// Labels are included in the header of new files, to identify where they
+	// were collected.  An empty Host or Pod defaults to the Saver's.
+	Labels netlink.Labels
+
+	// Logger receives the Saver's log messages.  If nil, logging.Default is used.
+	Logger logging.Logger
 
 	cache       *cache.Cache
+	lastInfo    map[uint64]*netlink.ArchivalRecord // The last record with DiagInfo, for connections that are closing.
+	resume      map[string]int                     // The last sequence of each UUID found by ResumeSequences, until the first MessageBlock is handled.
+	unmatched   map[uint64]struct{}                // The connections that were not saved, because their cgroup did not match.
 	stats       stats
 	eventServer eventsocket.Server
 	exclude     *netlink.ExcludeConfig
+	invalidLog  logx.Logger // Logs invalid records, at most once a second.
+}
+
+// now returns the current time, according to the Saver's Clock.
+func (svr *Saver) now() time.Time {
+	if svr.Clock == nil {
+		return time.Now()
+	}
+	return svr.Clock.Now()
 }
 
+// compareOptions returns the options for comparing successive snapshots.
+func (svr *Saver) compareOptions() netlink.CompareOptions {
+	return netlink.CompareOptions{BBR: svr.BBRChanges}
+}
+
+// logger returns the Logger used by the Saver.
+func (svr *Saver) logger() logging.Logger {
+	if svr.Logger != nil {
+		return svr.Logger
+	}
+	return logging.Default
+}
+
+// warnWriter writes each line of a log.Logger's output as a warning to the
+// Logger it returns.
+type warnWriter func() logging.Logger
+
+func (w warnWriter) Write(p []byte) (int, error) {
+	w().Warn(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// DefaultFileAgeLimit is the default for Saver.FileAgeLimit.
+const DefaultFileAgeLimit = 10 * time.Minute
+
+// DefaultSlowBlock is the default for Saver.SlowBlock.  It is the collector's
+// polling interval, since a saver that takes longer than this to process each
+// MessageBlock cannot keep up with the collector.
+const DefaultSlowBlock = 10 * time.Millisecond
+
+// DefaultMarshalBufferSize is the number of tasks each marshaller queue holds
+// when created by NewSaver.
+const DefaultMarshalBufferSize = 100
+
 // NewSaver creates a new Saver for the given host and pod.  numMarshaller controls
 // how many marshalling goroutines are used to distribute the marshalling workload.
+// A Saver without marshallers cannot save anything, so NewSaver panics with
+// ErrNoMarshallers if numMarshaller is less than 1.
 func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server, anon anonymize.IPAnonymizer, ex *netlink.ExcludeConfig) *Saver {
+	return NewSaverWithBuffer(host, pod, numMarshaller, DefaultMarshalBufferSize, srv, anon, ex)
+}
+
+// NewSaverWithBuffer is like NewSaver, but each marshaller's queue holds up to
+// bufferSize tasks.  Each queued task keeps a snapshot's netlink message (a few
+// KB) in memory, so larger buffers absorb longer bursts of changes at the cost
+// of memory.
+func NewSaverWithBuffer(host string, pod string, numMarshaller int, bufferSize int, srv eventsocket.Server, anon anonymize.IPAnonymizer, ex *netlink.ExcludeConfig) *Saver {
+	if numMarshaller < 1 {
+		panic(ErrNoMarshallers)
+	}
 	m := make([]MarshalChan, 0, numMarshaller)
 	c := cache.NewCache()
 	// We start with capacity of 500.  This will be reallocated as needed, but this
@@ -223,24 +506,28 @@ func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server
 	conn := make(map[uint64]*Connection, 500)
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	ageLim := 10 * time.Minute
-
-	for i := 0; i < numMarshaller; i++ {
-		m = append(m, newMarshaller(wg, anon))
-	}
+	ageLim := DefaultFileAgeLimit
 
-	return &Saver{
+	svr := &Saver{
 		Host:         host,
 		Pod:          pod,
 		FileAgeLimit: ageLim,
-		MarshalChans: m,
+		SlowBlock:    DefaultSlowBlock,
 		Done:         wg,
 		Connections:  conn,
 		ClosingStats: make(map[uint64]TcpStats, 100),
 		cache:        c,
+		lastInfo:     make(map[uint64]*netlink.ArchivalRecord, 100),
+		unmatched:    make(map[uint64]struct{}),
 		eventServer:  srv,
 		exclude:      ex,
 	}
+	for i := 0; i < numMarshaller; i++ {
+		m = append(m, newMarshaller(wg, anon, bufferSize, svr.logger))
+	}
+	svr.MarshalChans = m
+	svr.invalidLog = logx.NewLogEvery(log.New(warnWriter(svr.logger), "", 0), time.Second)
+	return svr
 }
 
 // queue queues a single ArchivalRecord to the appropriate marshalling queue, based on the
@@ -248,11 +535,12 @@ func NewSaver(host string, pod string, numMarshaller int, srv eventsocket.Server
 func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
 	idm, err := msg.RawIDM.Parse()
 	if err != nil {
-		log.Println(err)
-		// TODO error metric
+		metrics.ParseErrorCount.WithLabelValues(netlink.ErrShortInetDiagMsg.Error()).Inc()
+		return err
 	}
 	cookie := idm.ID.Cookie()
 	if cookie == 0 {
+		metrics.ErrorCount.WithLabelValues("cookie = 0").Inc()
 		return errors.New("Cookie = 0")
 	}
 	if len(svr.MarshalChans) < 1 {
@@ -260,21 +548,50 @@ func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
 	}
 	q := svr.MarshalChans[int(cookie%uint64(len(svr.MarshalChans)))]
 	conn, ok := svr.Connections[cookie]
+	sequence := 0
+	if ok && !sameEndpoints(&conn.ID, idm.ID.GetSockID()) {
+		// The cookie has been reused by a different connection, e.g. after a reboot.
+		// Close out the stale connection, and start a new one in its place.  The new
+		// connection continues the sequence numbering, so that it does not overwrite
+		// the files written for the stale connection.
+		svr.logger().Warn("Cookie collision:", cookie, conn.ID, idm.ID.GetSockID())
+		metrics.CookieCollisionCount.Inc()
+		if conn.Writer != nil {
+			q <- Task{Writer: conn.Writer}
+		}
+		svr.eventServer.FlowDeleted(msg.Timestamp, uuid.FromCookie(cookie), &conn.ID)
+		delete(svr.Connections, cookie)
+		sequence = conn.Sequence
+		ok = false
+	}
 	if !ok {
 		// Create a new connection for first time cookies.  For late connections already
 		// terminating, log some info for debugging purposes.
 		if idm.IDiagState >= uint8(tcp.FIN_WAIT1) {
 			s, r := msg.GetStats()
-			log.Println("Starting:", msg.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), TcpStats{s, r})
+			svr.logger().Info("Starting:", msg.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), TcpStats{s, r})
+		}
+		conn = newConnection(idm, msg.Timestamp, svr.Clock)
+		conn.Sequence = sequence
+		conn.Binary = svr.BinaryOutput
+		conn.AttrNames = svr.AttrNames
+		conn.Labels = svr.labels()
+		conn.SockIDAnon = svr.SockIDAnon
+		conn.Factory = svr.WriterFactory
+		conn.MaxBytes = svr.MaxFileBytes
+		conn.FileName = svr.FileName
+		conn.Logger = svr.Logger
+		if last, found := svr.resume[conn.uuid()]; found && last >= conn.Sequence {
+			svr.logger().Info("Resuming:", cookie, "after sequence", last)
+			conn.Sequence = last + 1
 		}
-		conn = newConnection(idm, msg.Timestamp)
 		svr.eventServer.FlowCreated(msg.Timestamp, uuid.FromCookie(cookie), idm.ID.GetSockID())
 		svr.Connections[cookie] = conn
 	} else {
 		//log.Println("Diff inode:", inode)
 	}
-	if time.Now().After(conn.Expiration) && conn.Writer != nil {
-		q <- Task{nil, conn.Writer} // Close the previous file.
+	if conn.Writer != nil && (conn.now().After(conn.Expiration) || conn.full()) {
+		q <- Task{Writer: conn.Writer} // Close the previous file.
 		conn.Writer = nil
 	}
 	if conn.Writer == nil {
@@ -283,18 +600,82 @@ func (svr *Saver) queue(msg *netlink.ArchivalRecord) error {
 			return err
 		}
 	}
-	q <- Task{msg, conn.Writer}
+	task := Task{msg, conn.Writer, conn.Binary, conn.SockIDAnon}
+	if svr.DropOnFull {
+		// Don't let a stalled marshaller (e.g. on a slow disk) back up the
+		// collector.  Closing writers, above, still blocks, so files are never
+		// left open.
+		select {
+		case q <- task:
+		default:
+			metrics.MarshallerOverflowCount.Inc()
+			return nil
+		}
+	} else {
+		q <- task
+	}
+	conn.LastWrite = msg.Timestamp
+	conn.LastActive = conn.now()
 	return nil
 }
 
+// closeIdle closes the files of connections that have had no snapshot queued for
+// IdleTimeout.  The connections are kept, so that their next snapshot starts a
+// new file, in the same way as when FileAgeLimit expires.
+func (svr *Saver) closeIdle() {
+	now := svr.now()
+	for cookie, conn := range svr.Connections {
+		if conn.Writer == nil || now.Sub(conn.LastActive) < svr.IdleTimeout {
+			continue
+		}
+		q := svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
+		q <- Task{Writer: conn.Writer}
+		conn.Writer = nil
+		metrics.IdleFileCloseCount.Inc()
+	}
+}
+
+// observeQueues records the occupancy of the saver input queue, and of the
+// fullest marshaller queue.
+func (svr *Saver) observeQueues(saverQueue int) {
+	metrics.QueueOccupancy.WithLabelValues("saver").Set(float64(saverQueue))
+	fullest := 0
+	for _, q := range svr.MarshalChans {
+		if len(q) > fullest {
+			fullest = len(q)
+		}
+	}
+	metrics.QueueOccupancy.WithLabelValues("marshaller").Set(float64(fullest))
+}
+
+// rateLimited returns true if a snapshot of the connection was queued less than
+// MinInterval before timestamp.
+func (svr *Saver) rateLimited(cookie uint64, timestamp time.Time) bool {
+	if svr.MinInterval <= 0 {
+		return false
+	}
+	conn, ok := svr.Connections[cookie]
+	return ok && timestamp.Sub(conn.LastWrite) < svr.MinInterval
+}
+
+// sameEndpoints returns true if the two SockIDs have the same addresses and ports.
+func sameEndpoints(a *inetdiag.SockID, b inetdiag.SockID) bool {
+	return a.SrcIP == b.SrcIP && a.SPort == b.SPort && a.DstIP == b.DstIP && a.DPort == b.DPort
+}
+
 func (svr *Saver) endConn(cookie uint64) {
-	svr.eventServer.FlowDeleted(time.Now(), uuid.FromCookie(cookie))
-	q := svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
 	conn, ok := svr.Connections[cookie]
+	var id *inetdiag.SockID
+	if ok {
+		id = &conn.ID
+	}
+	svr.eventServer.FlowDeleted(svr.now(), uuid.FromCookie(cookie), id)
+	q := svr.MarshalChans[cookie%uint64(len(svr.MarshalChans))]
 	if ok && conn.Writer != nil {
-		q <- Task{nil, conn.Writer}
-		delete(svr.Connections, cookie)
+		q <- Task{Writer: conn.Writer}
 	}
+	// Idle connections are kept without a Writer, and must also be removed.
+	delete(svr.Connections, cookie)
 }
 
 // Handle a bundle of messages.
@@ -305,17 +686,23 @@ func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint6
 		// In swap and queue, we want to track the total speed of all connections
 		// every second.
 		if msg == nil {
-			log.Println("Nil message")
+			svr.logger().Warn("Nil message")
 			continue
 		}
 		ar, err := netlink.MakeArchivalRecord(msg, svr.exclude)
 		if ar == nil {
 			if err != nil {
-				log.Println(err)
+				svr.logger().Warn(err)
 			}
 			continue
 		}
 		ar.Timestamp = t
+		if err := ar.Validate(); err != nil {
+			metrics.ParseErrorCount.WithLabelValues(err.Error()).Inc()
+			// A misbehaving kernel may produce many invalid records, so limit the log rate.
+			svr.invalidLog.Println("Invalid record:", err)
+			continue
+		}
 
 		// Note: If GetStats shows up in profiling, might want to move to once/second code.
 		s, r := ar.GetStats()
@@ -329,13 +716,32 @@ func (svr *Saver) handleType(t time.Time, msgs []*netlink.NetlinkMessage) (uint6
 
 // MessageSaverLoop runs a loop to receive batches of ArchivalRecords.  Local connections
 func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
-	log.Println("Starting Saver")
+	svr.logger().Info("Starting Saver")
+	svr.cache.Slim = svr.SlimCache
+	svr.cache.CompareOptions = svr.compareOptions()
 
 	var reported, closed TcpStats
 	lastReportTime := time.Time{}.Unix()
 	closeLogCount := 10000
+	var lastSlowLog, lastIdleCheck time.Time
 
 	for msgs := range readerChannel {
+		// Block timing is always measured in wall time, even with a fake Clock.
+		start := time.Now()
+		svr.observeQueues(len(readerChannel))
+		if svr.Cgroups != nil {
+			svr.Cgroups.newCycle()
+		}
+
+		// Track the gap between the v6 and v4 dumps, which indicates collection latency.
+		// Equal times are unified by the collector, which observes the gap itself.
+		if !msgs.V4Time.IsZero() && !msgs.V6Time.IsZero() && !msgs.V4Time.Equal(msgs.V6Time) {
+			skew := msgs.V6Time.Sub(msgs.V4Time)
+			if skew < 0 {
+				skew = -skew
+			}
+			metrics.CollectionSkewHistogram.Observe(skew.Seconds())
+		}
 
 		// Handle v4 and v6 messages, and return the total bytes sent and received.
 		// TODO - we only need to collect these stats if this is a reporting cycle.
@@ -347,14 +753,26 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 		// Note that the connections that have closed may have had traffic that
 		// we never see, and therefore can't account for in metrics.
 		residual := svr.cache.EndCycle()
+		// Only connections that were open before a restart are resumed.
+		svr.resume = nil
 
 		// Remove all missing connections from the cache.
 		// Also keep a metric of the total cumulative send and receive bytes.
 		for cookie := range residual {
 			ar := residual[cookie]
+			if idm, err := ar.RawIDM.Parse(); err == nil && svr.timeWaitOnly(idm) {
+				continue // Nothing was saved, so there is nothing to close.
+			}
+			if _, ok := svr.unmatched[cookie]; ok {
+				delete(svr.unmatched, cookie)
+				continue // Likewise.
+			}
 			var stats TcpStats
 			var ok bool
+			info := ar
 			if !ar.HasDiagInfo() {
+				info = svr.lastInfo[cookie]
+				delete(svr.lastInfo, cookie)
 				stats, ok = svr.ClosingStats[cookie]
 				if ok {
 					// Remove the stats from closing.
@@ -362,20 +780,23 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 					svr.ClosingTotals.Received -= stats.Received
 					delete(svr.ClosingStats, cookie)
 				} else {
-					log.Println("Missing stats for", cookie)
+					svr.logger().Warn("Missing stats for", cookie)
 				}
 			} else {
 				stats.Sent, stats.Received = ar.GetStats()
+				observeLimited(ar)
 			}
 			closed.Sent += stats.Sent
 			closed.Received += stats.Received
+			kind := classifyClose(ar, info)
+			metrics.ConnectionCloseCount.WithLabelValues(kind).Inc()
 
 			if closeLogCount > 0 {
 				idm, err := ar.RawIDM.Parse()
 				if err != nil {
-					log.Println("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, "idm parse error", stats)
+					svr.logger().Info("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, "idm parse error", stats)
 				} else {
-					log.Println("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), stats)
+					svr.logger().Info("Closed:", ar.Timestamp.Format("15:04:05.000"), cookie, tcp.State(idm.IDiagState), kind, stats)
 				}
 				closeLogCount--
 			}
@@ -384,6 +805,12 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 			svr.stats.IncExpiredCount()
 		}
 
+		// Checking every connection is expensive, so only check about once a second.
+		if svr.IdleTimeout > 0 && svr.now().Sub(lastIdleCheck) >= time.Second {
+			svr.closeIdle()
+			lastIdleCheck = svr.now()
+		}
+
 		// Every second, update the total throughput for the past second.
 		if msgs.V4Time.Unix() > lastReportTime {
 			// This is the total bytes since program start.
@@ -391,64 +818,175 @@ func (svr *Saver) MessageSaverLoop(readerChannel <-chan netlink.MessageBlock) {
 			totalReceived := closed.Received + svr.ClosingTotals.Received + r4 + r6
 
 			// NOTE: We are seeing occasions when total < reported.  This messes up prometheus, so
-			// we detect that and skip reporting.
+			// reconcileTotal detects that, and the report is skipped.
 			// This seems to be persistent, not just a momentary glitch.  The total may drop by 500KB,
 			// and only recover after many seconds of gradual increases (on idle workstation).
 			// This workaround seems to also cure the 2<<67 reports.
-			// We also check for increments larger than 10x the maxSwitchSpeed.
+			// Decreases in individual connections' counters are counted in tcpinfo_counter_regression_total.
 			// TODO: This can all be discarded when we are confident the bug has been fixed.
-			if totalSent > 10*maxSwitchSpeed/8+reported.Sent || totalSent < reported.Sent {
-				// Some bug in the accounting!!
-				log.Println("Skipping BytesSent report due to bad accounting", totalSent, reported.Sent, closed.Sent, svr.ClosingTotals.Sent, s4, s6)
-				if totalSent < reported.Sent {
-					metrics.ErrorCount.WithLabelValues("totalSent < reportedSent").Inc()
-				} else {
-					metrics.ErrorCount.WithLabelValues("totalSent-reportedSent exceeds network capacity").Inc()
+			for _, dir := range []struct {
+				name                          string
+				total                         uint64
+				reported                      *uint64 // the total bytes reported to prometheus.
+				closed, closing, live4, live6 uint64
+				rate                          prometheus.Histogram
+			}{
+				{"Sent", totalSent, &reported.Sent, closed.Sent, svr.ClosingTotals.Sent, s4, s6, metrics.SendRateHistogram},
+				{"Received", totalReceived, &reported.Received, closed.Received, svr.ClosingTotals.Received, r4, r6, metrics.ReceiveRateHistogram},
+			} {
+				delta, ok, reason := reconcileTotal(dir.name, dir.total, *dir.reported)
+				if !ok {
+					svr.logger().Warn("Skipping Bytes"+dir.name+" report due to bad accounting:", reason, dir.total, *dir.reported, dir.closed, dir.closing, dir.live4, dir.live6)
+					metrics.ErrorCount.WithLabelValues(reason).Inc()
+					continue
 				}
-			} else {
-				metrics.SendRateHistogram.Observe(8 * float64(totalSent-reported.Sent))
-				reported.Sent = totalSent // the total bytes reported to prometheus.
-			}
-
-			if totalReceived > 10*maxSwitchSpeed/8+reported.Received || totalReceived < reported.Received {
-				// Some bug in the accounting!!
-				log.Println("Skipping BytesReceived report due to bad accounting", totalReceived, reported.Received, closed.Received, svr.ClosingTotals.Received, r4, r6)
-				if totalReceived < reported.Received {
-					metrics.ErrorCount.WithLabelValues("totalReceived < reportedReceived").Inc()
-				} else {
-					metrics.ErrorCount.WithLabelValues("totalReceived-reportedReceived exceeds network capacity").Inc()
-				}
-			} else {
-				metrics.ReceiveRateHistogram.Observe(8 * float64(totalReceived-reported.Received))
-				reported.Received = totalReceived // the total bytes reported to prometheus.
+				dir.rate.Observe(8 * float64(delta))
+				*dir.reported = dir.total
 			}
 
 			lastReportTime = msgs.V4Time.Unix()
 		}
+
+		elapsed := time.Since(start)
+		metrics.SaverBlockHistogram.Observe(elapsed.Seconds())
+		if svr.SlowBlock > 0 && elapsed > svr.SlowBlock {
+			metrics.SlowSaverBlockCount.Inc()
+			// Log at most once a second, since a slow saver usually stays slow.
+			if time.Since(lastSlowLog) >= time.Second {
+				svr.logger().Warn("Saver took", elapsed, "to process a block, with", len(readerChannel), "blocks waiting")
+				lastSlowLog = time.Now()
+			}
+		}
 	}
 	svr.Close()
 }
 
+// reconcileTotal checks the total bytes Sent or Received, as named by dir,
+// against the total that was last reported.  If the rate can be reported, it
+// returns the bytes transferred since then, and true.  Otherwise, it returns
+// false, and the reason, which is also the ErrorCount label, e.g.
+// "totalSent < reportedSent".
+func reconcileTotal(dir string, total, reported uint64) (uint64, bool, string) {
+	delta, err := throughputDelta(total, reported)
+	switch {
+	case err == nil:
+		return delta, true, ""
+	case err == netlink.ErrCounterRegression:
+		return 0, false, "total" + dir + " < reported" + dir
+	default:
+		return 0, false, "total" + dir + "-reported" + dir + " exceeds network capacity"
+	}
+}
+
+// throughputDelta returns the bytes transferred since the previously reported
+// total.  It returns netlink.ErrCounterRegression if the total has decreased, and
+// errExceedsCapacity if the increase is more than 10x what maxSwitchSpeed allows in
+// a second.
+func throughputDelta(total, reported uint64) (uint64, error) {
+	if total < reported {
+		return 0, netlink.ErrCounterRegression
+	}
+	if total > 10*maxSwitchSpeed/8+reported {
+		return 0, errExceedsCapacity
+	}
+	return total - reported, nil
+}
+
+// closeRetransmits is the number of consecutive retransmission timeouts after
+// which a connection that disappears is assumed to have timed out.
+const closeRetransmits = 3
+
+// classifyClose returns the kind of close, for tcpinfo_connection_close_total, of
+// a connection whose last snapshot was final.  info is the last snapshot with
+// TCPInfo, which may be final itself, or nil if there was none.  Connections
+// that were last seen in a FIN or TIME_WAIT state closed normally.  Others were
+// aborted, either by a timeout, if they were retransmitting, or by a reset.
+func classifyClose(final, info *netlink.ArchivalRecord) string {
+	idm, err := final.RawIDM.Parse()
+	if err != nil {
+		return "unknown"
+	}
+	switch tcp.State(idm.IDiagState) {
+	case tcp.FIN_WAIT1, tcp.FIN_WAIT2, tcp.TIME_WAIT, tcp.CLOSE_WAIT, tcp.LAST_ACK, tcp.CLOSING:
+		return "normal"
+	}
+	if info != nil {
+		if n, ok := info.Retransmits(); ok && n >= closeRetransmits {
+			return "timeout"
+		}
+		if ca, ok := info.CAState(); ok && ca == tcp.TCP_CA_Loss {
+			return "timeout"
+		}
+	}
+	return "reset"
+}
+
+// observeLimited records the fraction of busy time that a connection spent receive
+// window or send buffer limited.  It should be called with the final record that
+// contains TCPInfo for each connection.
+func observeLimited(ar *netlink.ArchivalRecord) {
+	_, snap, err := snapshot.Decode(ar)
+	if err != nil || snap == nil {
+		return
+	}
+	if f, ok := snap.RWndLimitedFraction(); ok {
+		metrics.RWndLimitedHistogram.Observe(f)
+	}
+	if f, ok := snap.SndBufLimitedFraction(); ok {
+		metrics.SndBufLimitedHistogram.Observe(f)
+	}
+}
+
+// observeDeliveryRate records the DeliveryRate of a saved snapshot, if enabled,
+// and unless it was app-limited, and so understates the path's capacity.
+func (svr *Saver) observeDeliveryRate(pm *netlink.ArchivalRecord) {
+	if !svr.DeliveryRates {
+		return
+	}
+	rate, appLimited, ok := pm.DeliveryRate()
+	if ok && !appLimited {
+		metrics.DeliveryRateHistogram.Observe(8 * float64(rate))
+	}
+}
+
 func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
-	svr.stats.IncTotalCount() // TODO fix race
+	svr.stats.IncTotalCount()
 	old, err := svr.cache.Update(pm)
 	if err != nil {
 		// TODO metric
-		log.Println(err)
+		svr.logger().Error(err)
 		return
 	}
 	if old == nil {
 		svr.stats.IncNewCount()
+		if idm, err := pm.RawIDM.Parse(); err == nil {
+			if svr.timeWaitOnly(idm) {
+				metrics.TimeWaitOnlyCount.Inc()
+				return
+			}
+			if svr.Cgroups != nil && !svr.Cgroups.Matches(idm.IDiagInode) {
+				svr.unmatched[idm.ID.Cookie()] = struct{}{}
+				metrics.CgroupUnmatchedCount.Inc()
+				return
+			}
+		}
 		metrics.SnapshotCount.Inc()
+		svr.observeDeliveryRate(pm)
 		err := svr.queue(pm)
 		if err != nil {
-			log.Println(err, "Connections", len(svr.Connections))
+			svr.logger().Error(err, "Connections", len(svr.Connections))
 		}
 	} else {
 		pmIDM, err := pm.RawIDM.Parse()
 		if err != nil {
 			// TODO metric
-			log.Println(err)
+			svr.logger().Error(err)
+			return
+		}
+		if svr.timeWaitOnly(pmIDM) {
+			return // Already counted, when first seen.
+		}
+		if _, ok := svr.unmatched[pmIDM.ID.Cookie()]; ok {
 			return
 		}
 		if !pm.HasDiagInfo() {
@@ -457,50 +995,124 @@ func (svr *Saver) swapAndQueue(pm *netlink.ArchivalRecord) {
 			if old.HasDiagInfo() {
 				sOld, rOld := old.GetStats()
 				svr.ClosingStats[pmIDM.ID.Cookie()] = TcpStats{Sent: sOld, Received: rOld}
+				svr.lastInfo[pmIDM.ID.Cookie()] = old
+				observeLimited(old)
 				svr.ClosingTotals.Sent += sOld
 				svr.ClosingTotals.Received += rOld
-				log.Println("Closing:", pm.Timestamp.Format("15:04:05.000"), pmIDM.ID.Cookie(), tcp.State(pmIDM.IDiagState), TcpStats{sOld, rOld})
+				svr.logger().Info("Closing:", pm.Timestamp.Format("15:04:05.000"), pmIDM.ID.Cookie(), tcp.State(pmIDM.IDiagState), TcpStats{sOld, rOld})
 			}
 		}
 
-		change, err := pm.Compare(old)
+		change, err := pm.CompareWith(old, svr.compareOptions())
 		if err != nil {
 			// TODO metric
-			log.Println(err)
+			svr.logger().Error(err)
 			return
 		}
-		if change > netlink.NoMajorChange {
+		// Regressions are counted and logged by CheckCounters.  The snapshot is
+		// still saved, since it is what the kernel reported.
+		pm.CheckCounters(old)
+		if change == netlink.IDiagStateChange && svr.StateEvents {
+			if oldIDM, err := old.RawIDM.Parse(); err == nil {
+				svr.eventServer.FlowStateChanged(pm.Timestamp, uuid.FromCookie(pmIDM.ID.Cookie()),
+					tcp.State(oldIDM.IDiagState), tcp.State(pmIDM.IDiagState))
+			}
+		}
+		if change == netlink.CAStateChange {
+			from, _ := old.CAState()
+			to, _ := pm.CAState()
+			metrics.CAStateTransitionCount.WithLabelValues(from.String(), to.String()).Inc()
+		}
+		if change == netlink.BBRChange {
+			from, fromOK := old.BBRInfo()
+			to, toOK := pm.BBRInfo()
+			if fromOK && toOK && from.Phase() != to.Phase() {
+				metrics.BBRPhaseTransitionCount.WithLabelValues(from.Phase(), to.Phase()).Inc()
+			}
+		}
+		// Handshake timing, e.g. in RTT, is only visible in the first few snapshots,
+		// so every change is saved if Handshakes is set.
+		handshake := svr.Handshakes && handshakeChange(pmIDM, pm, old)
+		if change > netlink.NoMajorChange && change != netlink.IDiagStateChange && !handshake && svr.rateLimited(pmIDM.ID.Cookie(), pm.Timestamp) {
+			// Put back the last saved record, so that this change is still detected,
+			// and saved, once the interval has passed.
+			metrics.SuppressedSnapshotCount.Inc()
+			svr.cache.Update(old)
+			return
+		}
+		if change > netlink.NoMajorChange || handshake {
 			svr.stats.IncDiffCount()
 			metrics.SnapshotCount.Inc()
+			svr.observeDeliveryRate(pm)
 			err := svr.queue(pm)
 			if err != nil {
 				// TODO metric
-				log.Println(err)
+				svr.logger().Error(err)
 			}
 		}
 	}
 }
 
+// labels returns the Labels for the headers of new files, with the Saver's Host
+// and Pod in place of any that are not set.
+func (svr *Saver) labels() netlink.Labels {
+	labels := svr.Labels
+	if labels.Host == "" {
+		labels.Host = svr.Host
+	}
+	if labels.Pod == "" {
+		labels.Pod = svr.Pod
+	}
+	return labels
+}
+
+// timeWaitOnly returns true if idm is of a TIME_WAIT socket that has no
+// Connection, i.e. one that has only been seen in TIME_WAIT.  These are only
+// collected if the collector's States include TIME_WAIT, and are numerous and
+// short lived, so they are counted in TimeWaitOnlyCount, but not saved.
+func (svr *Saver) timeWaitOnly(idm *inetdiag.InetDiagMsg) bool {
+	if tcp.State(idm.IDiagState) != tcp.TIME_WAIT {
+		return false
+	}
+	_, ok := svr.Connections[idm.ID.Cookie()]
+	return !ok
+}
+
+// handshakeChange returns true if pm is a snapshot of a connection in SYN_SENT or
+// SYN_RECV, and its InetDiagMsg or TCPInfo differs at all from old.
+func handshakeChange(pmIDM *inetdiag.InetDiagMsg, pm, old *netlink.ArchivalRecord) bool {
+	switch tcp.State(pmIDM.IDiagState) {
+	case tcp.SYN_SENT, tcp.SYN_RECV:
+	default:
+		return false
+	}
+	if !bytes.Equal(pm.RawIDM, old.RawIDM) || pm.HasDiagInfo() != old.HasDiagInfo() {
+		return true
+	}
+	return pm.HasDiagInfo() && !bytes.Equal(pm.Attributes[inetdiag.INET_DIAG_INFO], old.Attributes[inetdiag.INET_DIAG_INFO])
+}
+
 // Close shuts down all the marshallers, and waits for all files to be closed.
 func (svr *Saver) Close() {
-	log.Println("Terminating Saver")
-	log.Println("Total of", len(svr.Connections), "connections active.")
+	svr.logger().Info("Terminating Saver")
+	svr.logger().Info("Total of", len(svr.Connections), "connections active.")
 	for i := range svr.Connections {
 		svr.endConn(i)
 	}
-	log.Println("Closing Marshallers")
+	svr.logger().Info("Closing Marshallers")
 	for i := range svr.MarshalChans {
 		close(svr.MarshalChans[i])
 	}
 	svr.Done.Done()
 }
 
-// LogCacheStats prints out some basic cache stats.
+// LogCacheStats prints out some basic cache stats.  It may be called
+// concurrently with MessageSaverLoop.
 // TODO(https://github.com/m-lab/tcp-info/issues/32) - should also export all of these as Prometheus metrics.
 func (svr *Saver) LogCacheStats(localCount, errCount int) {
 	stats := svr.stats.Copy() // Get a copy
-	log.Printf("Cache info total %d  local %d same %d diff %d new %d err %d\n",
+	svr.logger().Info(fmt.Sprintf("Cache info total %d  local %d same %d diff %d new %d err %d",
 		stats.TotalCount+(int64)(localCount), localCount,
 		stats.TotalCount-((int64)(errCount)+stats.NewCount+stats.DiffCount+(int64)(localCount)),
-		stats.DiffCount, stats.NewCount, errCount)
+		stats.DiffCount, stats.NewCount, errCount))
 }
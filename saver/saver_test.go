@@ -1,9 +1,13 @@
 package saver_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -11,8 +15,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/m-lab/go/anonymize"
 
@@ -23,16 +29,18 @@ import (
 	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/saver"
+	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
+	"github.com/m-lab/uuid"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 )
 
 // TODO Tests:
 //   File closing.
 //   Marshaller selection.
-//   Rotation  (use 1 second rotation time)
 
 func init() {
 	// Always prepend the filename and line number.
@@ -93,6 +101,32 @@ func (msg *TestMsg) setDPort(dport uint16) *TestMsg {
 	return msg
 }
 
+func (msg *TestMsg) setState(state tcp.State) *TestMsg {
+	raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+	if raw == nil {
+		panic("setState failed")
+	}
+	idm, err := raw.Parse()
+	if err != nil {
+		panic("setState failed")
+	}
+	idm.IDiagState = uint8(state)
+	return msg
+}
+
+func (msg *TestMsg) setInode(inode uint32) *TestMsg {
+	raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+	if raw == nil {
+		panic("setInode failed")
+	}
+	idm, err := raw.Parse()
+	if err != nil {
+		panic("setInode failed")
+	}
+	idm.IDiagInode = inode
+	return msg
+}
+
 func (msg *TestMsg) mustAR() *netlink.ArchivalRecord {
 	ar, err := netlink.MakeArchivalRecord(&msg.NetlinkMessage, nil)
 	if err != nil {
@@ -133,6 +167,37 @@ func msg(t *testing.T, cookie uint64, dport uint16) *TestMsg {
 	return msg
 }
 
+// withoutDiagInfo returns a copy of msg with only the InetDiagMsg, like those
+// the kernel reports for some closing sockets.
+func (msg *TestMsg) withoutDiagInfo() *TestMsg {
+	raw, _ := inetdiag.SplitInetDiagMsg(msg.Data)
+	if raw == nil {
+		panic("withoutDiagInfo failed")
+	}
+	out := TestMsg{}
+	out.Header = msg.Header
+	out.Data = append([]byte(nil), raw...)
+	out.Header.Len = uint32(netlink.SizeofNlMsghdr + len(out.Data))
+	return &out
+}
+
+// withBBR returns a copy of msg with an INET_DIAG_BBRINFO attribute appended,
+// holding the given gains.
+func (msg *TestMsg) withBBR(pacingGain, cwndGain uint32) *TestMsg {
+	attr := make([]byte, 24) // The 4 byte rtattr header, and the 20 byte tcp_bbr_info.
+	binary.LittleEndian.PutUint16(attr[0:], uint16(len(attr)))
+	binary.LittleEndian.PutUint16(attr[2:], inetdiag.INET_DIAG_BBRINFO)
+	binary.LittleEndian.PutUint64(attr[4:], 1000000)
+	binary.LittleEndian.PutUint32(attr[12:], 20000)
+	binary.LittleEndian.PutUint32(attr[16:], pacingGain)
+	binary.LittleEndian.PutUint32(attr[20:], cwndGain)
+	out := TestMsg{}
+	out.Header = msg.Header
+	out.Data = append(append([]byte(nil), msg.Data...), attr...)
+	out.Header.Len = uint32(netlink.SizeofNlMsghdr + len(out.Data))
+	return &out
+}
+
 func (msg *TestMsg) setBytesSent(value uint64) *TestMsg {
 	ar := msg.mustAR()
 	ar.SetBytesSent(value)
@@ -197,26 +262,30 @@ func counterValue(m prometheus.Metric) float64 {
 	return *ctr.Value
 }
 
+// chdirTemp switches to a new temporary directory for the rest of the test, so
+// that the files written by a Saver are removed afterwards, and returns it.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldDir, err := os.Getwd()
+	rtx.Must(err, "Could not get working directory")
+	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
+	t.Cleanup(func() { rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir) })
+	return dir
+}
+
 type countingEventSocket struct {
 	opens, closes int
 }
 
-func (*countingEventSocket) Listen() error                                              { return nil }
-func (*countingEventSocket) Serve(context.Context) error                                { return nil }
-func (c *countingEventSocket) FlowCreated(t time.Time, uuid string, id inetdiag.SockID) { c.opens++ }
-func (c *countingEventSocket) FlowDeleted(t time.Time, uuid string)                     { c.closes++ }
+func (*countingEventSocket) Listen() error                                               { return nil }
+func (*countingEventSocket) Serve(context.Context) error                                 { return nil }
+func (c *countingEventSocket) FlowCreated(t time.Time, uuid string, id inetdiag.SockID)  { c.opens++ }
+func (c *countingEventSocket) FlowDeleted(t time.Time, uuid string, id *inetdiag.SockID) { c.closes++ }
+func (c *countingEventSocket) FlowStateChanged(t time.Time, u string, o, n tcp.State)    {}
 
 func TestHistograms(t *testing.T) {
-	dir, err := ioutil.TempDir("", "tcp-info_saver_TestBasic")
-	rtx.Must(err, "Could not create tempdir")
-	fmt.Println("Directory is:", dir)
-	oldDir, err := os.Getwd()
-	rtx.Must(err, "Could not get working directory")
-	rtx.Must(os.Chdir(dir), "Could not switch to temp dir %s", dir)
-	defer func() {
-		os.RemoveAll(dir)
-		rtx.Must(os.Chdir(oldDir), "Could not switch back to %s", oldDir)
-	}()
+	chdirTemp(t)
 	eventCounts := &countingEventSocket{}
 	anon := anonymize.New(anonymize.None)
 	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anon, nil)
@@ -328,9 +397,282 @@ func TestHistograms(t *testing.T) {
 	verifySizeBetween(t, 350, 450, "2018/02/06/*_00000000000000EB.00000.jsonl.zst")
 }
 
-// TODO - this file contains connection data from a connection with FIN_WAIT2 and no DiagInfo.
-// Need to create fake NetlinkMessage stream, and send to saver, and test behavior.
-func TestFinWait2NotImplemented(t *testing.T) {
+// fakeClock is a saver.Clock that only changes when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRotation(t *testing.T) {
+	chdirTemp(t)
+	// Rotation happens shortly before midnight, so later files go in the next day's directory.
+	clock := &fakeClock{now: time.Date(2018, 02, 06, 23, 59, 0, 0, time.UTC)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.FileAgeLimit = time.Minute
+	svr.Clock = clock
+	// Rotated files are fsynced, which must not lose any of their records.
+	svr.WriterFactory = saver.LocalWriterFactory{Sync: true}
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+	send := func(m *TestMsg) {
+		mb.V4Messages = []*netlink.NetlinkMessage{&m.NetlinkMessage}
+		mb.V4Time = mb.V4Time.Add(time.Second)
+		svrChan <- mb
+		// Once the loop accepts the unchanged snapshot, the change has been
+		// handled, so the clock can safely be advanced.
+		svrChan <- mb
+	}
+
+	send(msg(t, 11234, 1))
+	// Within the file age, so the change goes to the same file.
+	clock.Advance(30 * time.Second)
+	send(msg(t, 11234, 1).setByte(20, 127))
+	// Past the file age, so the change starts a new file.
+	clock.Advance(31 * time.Second)
+	send(msg(t, 11234, 1).setByte(20, 100))
+
+	close(svrChan)
+	svr.Done.Wait()
+
+	for _, tt := range []struct {
+		pattern string
+		records int
+	}{
+		{"2018/02/06/*_0000000000002BE2.00000.jsonl.zst", 3},
+		{"2018/02/07/*_0000000000002BE2.00001.jsonl.zst", 2},
+	} {
+		names, err := filepath.Glob(tt.pattern)
+		rtx.Must(err, "Could not Glob pattern %s", tt.pattern)
+		if len(names) != 1 {
+			t.Errorf("Expected one file matching %s, found %v", tt.pattern, names)
+			continue
+		}
+		rdr := zstd.NewReader(names[0])
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		rtx.Must(err, "Could not read %s", names[0])
+		// The header, and the snapshots.
+		if len(records) != tt.records {
+			t.Errorf("%s has %d records, want %d", names[0], len(records), tt.records)
+		}
+	}
+	if names, _ := filepath.Glob("*/*/*/*"); len(names) != 2 {
+		t.Error("Expected two files, found", names)
+	}
+}
+
+func TestCollectionSkew(t *testing.T) {
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	var before dto.Metric
+	rtx.Must(metrics.CollectionSkewHistogram.Write(&before), "Could not read histogram")
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{V4Time: date.Add(5 * time.Millisecond), V6Time: date}
+	// Blocks without timestamps, or with unified timestamps, should not be observed.
+	svrChan <- netlink.MessageBlock{}
+	svrChan <- netlink.MessageBlock{V4Time: date.Add(time.Second), V6Time: date.Add(time.Second)}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var after dto.Metric
+	rtx.Must(metrics.CollectionSkewHistogram.Write(&after), "Could not read histogram")
+	if count := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); count != 1 {
+		t.Error("Expected 1 observation, got", count)
+	}
+	if sum := after.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); math.Abs(sum-0.005) > 1e-9 {
+		t.Error("Expected observation of 0.005 seconds, got", sum)
+	}
+}
+
+func TestCookieCollision(t *testing.T) {
+	chdirTemp(t)
+	events := eventsocket.NewRecordingServer()
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, events, anon, nil)
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	c := make(chan prometheus.Metric, 1)
+	metrics.CookieCollisionCount.Collect(c)
+	before := counterValue(<-c)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+
+	// Two different connections, with the same cookie.  The saver only queues
+	// snapshots with changed TCPInfo, so the second one also has a different SndMSS.
+	m1 := msg(t, 1234, 1)
+	mb.V4Messages = []*netlink.NetlinkMessage{&m1.NetlinkMessage}
+	svrChan <- mb
+	m2 := msg(t, 1234, 2).setByte(20, 127)
+	mb.V4Messages = []*netlink.NetlinkMessage{&m2.NetlinkMessage}
+	mb.V4Time = mb.V4Time.Add(time.Second)
+	svrChan <- mb
+
+	close(svrChan)
+	svr.Done.Wait()
+
+	metrics.CookieCollisionCount.Collect(c)
+	if after := counterValue(<-c); after != before+1 {
+		t.Errorf("CookieCollisionCount = %v, want %v", after, before+1)
+	}
+	// The stale connection must be closed before the new one is opened.
+	got := events.Events()
+	want := []eventsocket.TCPEvent{eventsocket.Open, eventsocket.Close, eventsocket.Open, eventsocket.Close}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Event != want[i] {
+			t.Errorf("Event %d = %v, want %v", i, got[i].Event, want[i])
+		}
+	}
+	if got[0].ID.DPort == got[2].ID.DPort {
+		t.Errorf("Open events should be for different connections: %+v, %+v", got[0].ID, got[2].ID)
+	}
+	// Each Close event identifies the connection that was opened.
+	for _, i := range []int{1, 3} {
+		if got[i].ID == nil || *got[i].ID != *got[i-1].ID {
+			t.Errorf("Close event %d has ID %+v, want %+v", i, got[i].ID, got[i-1].ID)
+		}
+	}
+	// The new connection must not overwrite the stale connection's file.
+	for _, pattern := range []string{
+		"2018/02/06/*_00000000000004D2.00000.jsonl.zst",
+		"*/*/*/*_00000000000004D2.00001.jsonl.zst",
+	} {
+		names, err := filepath.Glob(pattern)
+		rtx.Must(err, "Could not Glob pattern %s", pattern)
+		if len(names) != 1 {
+			t.Errorf("Expected one file matching %s, found %v", pattern, names)
+		}
+	}
+}
+
+func TestBinaryOutput(t *testing.T) {
+	chdirTemp(t)
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.BinaryOutput = true
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m1 := msg(t, 11234, 1)
+	svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m1.NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	names, err := filepath.Glob("2018/02/06/*_0000000000002BE2.00000.bin.zst")
+	rtx.Must(err, "Could not Glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one binary file, found", names)
+	}
+	rdr := zstd.NewReader(names[0])
+	defer rdr.Close()
+	br := netlink.NewBinaryReader(rdr)
+	header, err := br.Next()
+	rtx.Must(err, "Could not read header")
+	if header.Metadata == nil || header.Metadata.StartTime != date {
+		t.Errorf("Bad header %+v", header)
+	}
+	record, err := br.Next()
+	rtx.Must(err, "Could not read record")
+	if record.Timestamp != date || !record.HasDiagInfo() {
+		t.Errorf("Bad record %+v", record)
+	}
+}
+
+func TestBinaryEncodeErrors(t *testing.T) {
+	errEncode := errors.New("encode failed")
+	for _, tt := range []struct {
+		name       string
+		failHeader bool
+	}{
+		{"header", true},
+		{"record", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := saver.SetMarshalBinary(func(ar *netlink.ArchivalRecord) ([]byte, error) {
+				if (ar.Metadata != nil) == tt.failHeader {
+					return nil, errEncode
+				}
+				return ar.MarshalBinary()
+			})
+			defer restore()
+			before := testutil.ToFloat64(metrics.ErrorCount.WithLabelValues("binary encode"))
+
+			factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+			anon := anonymize.New(anonymize.None)
+			svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+			svr.WriterFactory = factory
+			svr.BinaryOutput = true
+			rl := &recordingLogger{}
+			svr.Logger = rl
+			svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+			go svr.MessageSaverLoop(svrChan)
+
+			date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+			m := msg(t, 11234, 1)
+			svrChan <- netlink.MessageBlock{V4Time: date, V6Time: date, V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+			close(svrChan)
+			svr.Done.Wait()
+
+			if got := testutil.ToFloat64(metrics.ErrorCount.WithLabelValues("binary encode")) - before; got != 1 {
+				t.Errorf("ErrorCount increased by %v, want 1", got)
+			}
+			rl.Lock()
+			logged := strings.Join(rl.lines, "\n")
+			rl.Unlock()
+			if !strings.Contains(logged, "ERROR Failed to encode") {
+				t.Errorf("Missing encode error in %q", logged)
+			}
+			// The rest of the file is still readable.
+			if len(factory.files) != 1 {
+				t.Fatal("Expected one file, got", len(factory.files))
+			}
+			for _, f := range factory.files {
+				var records []*netlink.ArchivalRecord
+				br := netlink.NewBinaryReader(&f.Buffer)
+				for {
+					ar, err := br.Next()
+					if err == io.EOF {
+						break
+					}
+					rtx.Must(err, "Could not read binary file")
+					records = append(records, ar)
+				}
+				if len(records) != 1 || (records[0].Metadata != nil) == tt.failHeader {
+					t.Errorf("Read %d records, want only the one that was encoded: %+v", len(records), records)
+				}
+			}
+		})
+	}
+}
+
+// This file contains connection data from a connection with FIN_WAIT2 and no DiagInfo.
+// The records are replayed through the saver, to check the behavior for closing connections.
+func TestFinWait2Replay(t *testing.T) {
 	source := "testdata/finwait2-sample_1554836592_unsafe_000000000135A272.00000.jsonl.zst"
 	rdr := zstd.NewReader(source)
 	defer rdr.Close()
@@ -339,27 +681,1396 @@ func TestFinWait2NotImplemented(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	chdirTemp(t)
+
+	eventCounts := &countingEventSocket{}
 	anon := anonymize.New(anonymize.None)
-	svr := saver.NewSaver("hostname", "fakePod", 1, eventsocket.NullServer(), anon, nil)
+	svr := saver.NewSaver("hostname", "fakePod", 1, eventCounts, anon, nil)
+	svr.AttrNames = true
 	blockChan := make(chan netlink.MessageBlock, 0)
 	go svr.MessageSaverLoop(blockChan)
+	replayed := 0
+	var last time.Time
 	for i := range msgs {
 		ar := msgs[i]
-		s, r := ar.GetStats()
-		// TODO Fill in when we have a way to create NetlinkMessage from ArchiveRecord
-		mb := netlink.MessageBlock{}
-		blockChan <- mb
-
-		log.Println(s, r, ar.HasDiagInfo())
+		if ar.Metadata != nil {
+			continue
+		}
+		nm, err := ar.ToNetlinkMessage()
+		rtx.Must(err, "Could not convert record %d", i)
+		last = ar.Timestamp
+		blockChan <- netlink.MessageBlock{V4Time: last, V4Messages: []*netlink.NetlinkMessage{nm}}
+		replayed++
 	}
+	// The connection disappears in the next cycle.
+	blockChan <- netlink.MessageBlock{V4Time: last.Add(time.Second)}
 
 	close(blockChan)
 	svr.Done.Wait()
 	svr.LogCacheStats(1, 0)
-	t.Log("Test not implemented")
+
+	if replayed == 0 {
+		t.Fatal("No records replayed")
+	}
+	if eventCounts.opens != 1 || eventCounts.closes != 1 {
+		t.Errorf("Should have {opens:1, closes:1} not %+v", *eventCounts)
+	}
+	names, err := filepath.Glob("*/*/*/*_000000000135A272.00000.jsonl.zst")
+	rtx.Must(err, "Could not Glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one output file, found", names)
+	}
+	out := zstd.NewReader(names[0])
+	defer out.Close()
+	saved, err := netlink.LoadAllArchivalRecords(out)
+	rtx.Must(err, "Could not read output")
+	// The header, plus at least the first snapshot.
+	if len(saved) < 2 || saved[0].Metadata == nil {
+		t.Fatal("Bad output", len(saved))
+	}
+	meta := saved[0].Metadata
+	if meta.SchemaVersion != netlink.SchemaVersion || meta.AttributeNames[inetdiag.INET_DIAG_INFO] != "TCPInfo" {
+		t.Errorf("Header should have schema version and attribute names: %+v", meta)
+	}
+	// The final FIN_WAIT2 snapshot, without DiagInfo, should have been saved.
+	if saved[len(saved)-1].HasDiagInfo() {
+		t.Error("Last saved snapshot should not have DiagInfo")
+	}
 }
 
-// If this compiles, the "test" passes
-func assertSaverIsACacheLogger(s *saver.Saver) {
-	func(csl saver.CacheLogger) {}(s)
+func TestMinInterval(t *testing.T) {
+	chdirTemp(t)
+
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.MinInterval = 100 * time.Millisecond
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+	before := testutil.ToFloat64(metrics.SuppressedSnapshotCount)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	send := func(offset time.Duration, m *TestMsg) {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(offset),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	send(0, msg(t, 1234, 1))                                                             // Saved, new connection.
+	send(10*time.Millisecond, msg(t, 1234, 1).setByte(20, 127))                          // Suppressed.
+	send(20*time.Millisecond, msg(t, 1234, 1).setByte(20, 127).setState(tcp.FIN_WAIT1))  // Saved, state change.
+	send(30*time.Millisecond, msg(t, 1234, 1).setByte(20, 100).setState(tcp.FIN_WAIT1))  // Suppressed.
+	send(200*time.Millisecond, msg(t, 1234, 1).setByte(20, 100).setState(tcp.FIN_WAIT1)) // Saved, delayed change.
+	close(svrChan)
+	svr.Done.Wait()
+
+	if suppressed := testutil.ToFloat64(metrics.SuppressedSnapshotCount) - before; suppressed != 2 {
+		t.Errorf("Suppressed %v snapshots, want 2", suppressed)
+	}
+	names, err := filepath.Glob("*/*/*/*_00000000000004D2.00000.jsonl.zst")
+	rtx.Must(err, "Could not Glob")
+	if len(names) != 1 {
+		t.Fatal("Expected one output file, found", names)
+	}
+	out := zstd.NewReader(names[0])
+	defer out.Close()
+	saved, err := netlink.LoadAllArchivalRecords(out)
+	rtx.Must(err, "Could not read output")
+	// The header, and three snapshots.
+	if len(saved) != 4 {
+		t.Fatal("Expected 4 records, got", len(saved))
+	}
+	for i, offset := range []time.Duration{0, 20 * time.Millisecond, 200 * time.Millisecond} {
+		if !saved[i+1].Timestamp.Equal(date.Add(offset)) {
+			t.Errorf("Snapshot %d has timestamp %v, want %v", i, saved[i+1].Timestamp, date.Add(offset))
+		}
+	}
+}
+
+func TestStateEvents(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		events := eventsocket.NewRecordingServer()
+		anon := anonymize.New(anonymize.None)
+		svr := saver.NewSaver("foo", "bar", 1, events, anon, nil)
+		svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+		svr.StateEvents = enabled
+		svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+		go svr.MessageSaverLoop(svrChan)
+
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		for i, m := range []*TestMsg{
+			msg(t, 1234, 1),
+			msg(t, 1234, 1).setByte(20, 127), // Not a state change.
+			msg(t, 1234, 1).setByte(20, 127).setState(tcp.FIN_WAIT1),
+			msg(t, 1234, 1).setByte(20, 127).setState(tcp.FIN_WAIT1),
+		} {
+			svrChan <- netlink.MessageBlock{
+				V4Time:     date.Add(time.Duration(i) * time.Second),
+				V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+			}
+		}
+		close(svrChan)
+		svr.Done.Wait()
+
+		var changes []eventsocket.FlowEvent
+		for _, e := range events.Events() {
+			if e.Event == eventsocket.StateChange {
+				changes = append(changes, e)
+			}
+		}
+		if !enabled {
+			if len(changes) != 0 {
+				t.Error("StateChange events should not be sent unless enabled:", changes)
+			}
+			continue
+		}
+		if len(changes) != 1 {
+			t.Fatal("Expected one StateChange event, got", changes)
+		}
+		e := changes[0]
+		if *e.OldState != tcp.ESTABLISHED || *e.State != tcp.FIN_WAIT1 || !e.Timestamp.Equal(date.Add(2*time.Second)) {
+			t.Errorf("StateChange event %+v, want ESTABLISHED -> FIN_WAIT1 at %v", e, date.Add(2*time.Second))
+		}
+	}
+}
+
+func TestTimeWaitOnly(t *testing.T) {
+	before := testutil.ToFloat64(metrics.TimeWaitOnlyCount)
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// Cookie 1234 is only ever seen in TIME_WAIT, and 5678 enters TIME_WAIT
+	// after it has been saved.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, ms := range [][]*TestMsg{
+		{msg(t, 1234, 1).setState(tcp.TIME_WAIT), msg(t, 5678, 2)},
+		{msg(t, 1234, 1).setState(tcp.TIME_WAIT), msg(t, 5678, 2).setState(tcp.TIME_WAIT)},
+		{msg(t, 1234, 1).setState(tcp.TIME_WAIT).setByte(20, 127)},
+		{},
+	} {
+		block := netlink.MessageBlock{V4Time: date.Add(time.Duration(i) * time.Second)}
+		for _, m := range ms {
+			block.V4Messages = append(block.V4Messages, &m.NetlinkMessage)
+		}
+		svrChan <- block
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for path, f := range factory.files {
+		if !strings.HasSuffix(path, "_000000000000162E.00000.jsonl.zst") {
+			t.Error("Unexpected path:", path)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		// The header, and both snapshots, including the one in TIME_WAIT.
+		if len(records) != 3 {
+			t.Errorf("Wrong records: %+v", records)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.TimeWaitOnlyCount) - before; got != 1 {
+		t.Error("Expected one TIME_WAIT only socket, got", got)
+	}
+}
+
+func TestDropOnFull(t *testing.T) {
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaverWithBuffer("foo", "bar", 1, 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr.DropOnFull = true
+	// Stall the marshaller, by interposing a queue that is not read until released.
+	orig := svr.MarshalChans[0]
+	stalled := make(chan saver.Task, 1)
+	svr.MarshalChans = []saver.MarshalChan{stalled}
+	release := make(chan struct{})
+	go func() {
+		<-release
+		for task := range stalled {
+			orig <- task
+		}
+		close(orig)
+	}()
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+	before := testutil.ToFloat64(metrics.MarshallerOverflowCount)
+
+	// Each cycle adds a new connection, which needs a snapshot saved.  Only the
+	// first fits in the queue.
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{}
+	for i := 1; i <= 5; i++ {
+		mb.V4Time = date.Add(time.Duration(i) * time.Second)
+		mb.V4Messages = append(mb.V4Messages, &msg(t, uint64(i), uint16(i)).NetlinkMessage)
+		select {
+		case svrChan <- mb:
+		case <-time.After(5 * time.Second):
+			t.Fatal("MessageSaverLoop is blocked on the stalled marshaller")
+		}
+	}
+	// Once the loop accepts an unchanged cycle, the last one has been handled, so
+	// the marshaller can be released without affecting the count.
+	svrChan <- mb
+	close(release)
+	close(svrChan)
+	svr.Done.Wait()
+
+	if dropped := testutil.ToFloat64(metrics.MarshallerOverflowCount) - before; dropped != 4 {
+		t.Errorf("Dropped %v snapshots, want 4", dropped)
+	}
+}
+
+// memoryFile is an in-memory connection file.
+type memoryFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memoryFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+// memoryWriterFactory is a saver.WriterFactory that keeps uncompressed files in
+// memory, as an example of writing somewhere other than the local filesystem.
+type memoryWriterFactory struct {
+	mu    sync.Mutex
+	files map[string]*memoryFile
+}
+
+func (m *memoryWriterFactory) NewWriter(path string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := &memoryFile{}
+	m.files[path] = f
+	return f, nil
+}
+
+func TestWriterFactory(t *testing.T) {
+	chdirTemp(t)
+
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, m := range []*TestMsg{msg(t, 1234, 1), msg(t, 1234, 1).setByte(20, 127)} {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for path, f := range factory.files {
+		if !strings.HasPrefix(path, "2018/02/06/") || !strings.HasSuffix(path, "_00000000000004D2.00000.jsonl.zst") {
+			t.Error("Unexpected path:", path)
+		}
+		if !f.closed {
+			t.Error("File was not closed:", path)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		// The header, and two snapshots.
+		if len(records) != 3 || records[0].Metadata == nil {
+			t.Errorf("Wrong records: %+v", records)
+		}
+	}
+	// Nothing should be written locally.
+	if names, _ := filepath.Glob("*"); len(names) != 0 {
+		t.Error("Unexpected local files:", names)
+	}
+}
+
+func TestFileNameTemplate(t *testing.T) {
+	for _, bad := range []string{
+		"{{.UUID", "{{.NoSuchField}}", "", "  ", "/{{.UUID}}.zst",
+		"{{.Date}}/{{.Host}}.jsonl.zst", "{{.UUID}}.zst", "{{.Sequence}}.zst", "../{{.UUID}}.{{.Sequence}}.zst",
+		"{{.Date}}/../../{{.UUID}}.{{.Sequence}}.zst",
+	} {
+		if _, err := saver.ParseFileNameTemplate(bad); err == nil {
+			t.Errorf("ParseFileNameTemplate(%q) should fail", bad)
+		}
+	}
+
+	tmpl, err := saver.ParseFileNameTemplate(`{{.Host}}/{{.Pod}}/{{.StartTime.Format "2006-01-02"}}/{{.UUID}}-{{.Sequence}}.{{.Ext}}.zst`)
+	rtx.Must(err, "Could not parse template")
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	svr.FileName = tmpl
+	// Start a new file for every snapshot.
+	svr.MaxFileBytes = 1
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, m := range []*TestMsg{msg(t, 1234, 1), msg(t, 1234, 1).setByte(20, 127)} {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 2 {
+		t.Fatal("Expected two files, got", len(factory.files))
+	}
+	for _, suffix := range []string{"_00000000000004D2-0.jsonl.zst", "_00000000000004D2-1.jsonl.zst"} {
+		found := false
+		for path := range factory.files {
+			if strings.HasPrefix(path, "foo/bar/2018-02-06/") && strings.HasSuffix(path, suffix) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No file ending in %s in %v", suffix, factory.files)
+		}
+	}
+}
+
+func TestHandshakes(t *testing.T) {
+	// Offset of LastDataSent in LinuxTCPInfo, which Compare ignores.
+	const lastDataSent = 44
+	msgs := []*TestMsg{
+		msg(t, 1234, 1).setState(tcp.SYN_SENT),
+		msg(t, 1234, 1).setState(tcp.SYN_SENT).setByte(lastDataSent, 1), // Saved only with Handshakes.
+		msg(t, 1234, 1).setState(tcp.SYN_RECV).setByte(lastDataSent, 1),
+		msg(t, 1234, 1).setState(tcp.ESTABLISHED).setByte(lastDataSent, 1),
+		msg(t, 1234, 1).setState(tcp.ESTABLISHED).setByte(lastDataSent, 2), // Never saved.
+	}
+	for _, tt := range []struct {
+		handshakes bool
+		want       []tcp.State
+	}{
+		{false, []tcp.State{tcp.SYN_SENT, tcp.SYN_RECV, tcp.ESTABLISHED}},
+		{true, []tcp.State{tcp.SYN_SENT, tcp.SYN_SENT, tcp.SYN_RECV, tcp.ESTABLISHED}},
+	} {
+		factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+		anon := anonymize.New(anonymize.None)
+		svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+		svr.WriterFactory = factory
+		svr.Handshakes = tt.handshakes
+		// Handshake changes are not rate limited.
+		svr.MinInterval = time.Hour
+		svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+		go svr.MessageSaverLoop(svrChan)
+
+		date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+		for i, m := range msgs {
+			svrChan <- netlink.MessageBlock{
+				V4Time:     date.Add(time.Duration(i) * time.Millisecond),
+				V4Messages: []*netlink.NetlinkMessage{&m.copy().NetlinkMessage},
+			}
+		}
+		close(svrChan)
+		svr.Done.Wait()
+
+		if len(factory.files) != 1 {
+			t.Fatal("Expected one file, got", len(factory.files))
+		}
+		var states []tcp.State
+		for _, f := range factory.files {
+			records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+			rtx.Must(err, "Could not read records")
+			for _, r := range records[1:] {
+				idm, err := r.RawIDM.Parse()
+				rtx.Must(err, "Could not parse record")
+				states = append(states, tcp.State(idm.IDiagState))
+			}
+		}
+		if fmt.Sprint(states) != fmt.Sprint(tt.want) {
+			t.Errorf("Handshakes=%v saved %v, want %v", tt.handshakes, states, tt.want)
+		}
+	}
+}
+
+func TestMaxFileBytes(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	// The header alone exceeds this, so every snapshot starts a new file.
+	svr.MaxFileBytes = 1
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := msg(t, 1234, 1).setByte(20, byte(100+i))
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	// All within the default FileAgeLimit.
+	if len(factory.files) != 5 {
+		t.Fatal("Expected five files, got", len(factory.files))
+	}
+	byName := make(map[string]*memoryFile)
+	for path, f := range factory.files {
+		// Later files are placed in the directory for the current date.
+		byName[filepath.Base(path)] = f
+	}
+	for i := 0; i < 5; i++ {
+		path := fmt.Sprintf("%s.%05d.jsonl.zst", uuid.FromCookie(1234), i)
+		f, ok := byName[path]
+		if !ok {
+			t.Errorf("Missing file %s in %v", path, factory.files)
+			continue
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		if len(records) != 2 || records[0].Metadata == nil || records[0].Metadata.Sequence != i {
+			t.Errorf("Wrong records in %s: %+v", path, records)
+		}
+	}
+}
+
+func TestCounterRegression(t *testing.T) {
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+	before := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesSent"))
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, sent := range []uint64{1000, 2000, 1500, 3000} {
+		m := msg(t, 1234, 1).setBytesSent(sent)
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if got := testutil.ToFloat64(metrics.CounterRegressionCount.WithLabelValues("BytesSent")) - before; got != 1 {
+		t.Errorf("CounterRegressionCount{BytesSent} increased by %v, want 1", got)
+	}
+}
+
+func TestThroughputDelta(t *testing.T) {
+	tests := []struct {
+		total, reported uint64
+		want            uint64
+		wantErr         bool
+	}{
+		{total: 1500, reported: 1000, want: 500},
+		{total: 1000, reported: 1000, want: 0},
+		{total: 999, reported: 1000, wantErr: true},
+		{total: 1 << 62, reported: 1000, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := saver.ThroughputDelta(tt.total, tt.reported)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ThroughputDelta(%d, %d) = %d, %v, want %d, wantErr %v", tt.total, tt.reported, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := saver.ThroughputDelta(999, 1000); err != netlink.ErrCounterRegression {
+		t.Errorf("ThroughputDelta() error = %v, want %v", err, netlink.ErrCounterRegression)
+	}
+}
+
+func TestReconcileTotal(t *testing.T) {
+	tests := []struct {
+		name            string
+		dir             string
+		total, reported uint64
+		want            uint64
+		wantOK          bool
+		wantReason      string
+	}{
+		{name: "increase", dir: "Sent", total: 1500, reported: 1000, want: 500, wantOK: true},
+		{name: "unchanged", dir: "Received", total: 1000, reported: 1000, want: 0, wantOK: true},
+		{name: "decrease", dir: "Sent", total: 999, reported: 1000, wantReason: "totalSent < reportedSent"},
+		{name: "decrease", dir: "Received", total: 999, reported: 1000, wantReason: "totalReceived < reportedReceived"},
+		{name: "over capacity", dir: "Sent", total: 1 << 62, reported: 1000, wantReason: "totalSent-reportedSent exceeds network capacity"},
+		{name: "over capacity", dir: "Received", total: 1 << 62, reported: 1000, wantReason: "totalReceived-reportedReceived exceeds network capacity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.dir, func(t *testing.T) {
+			got, ok, reason := saver.ReconcileTotal(tt.dir, tt.total, tt.reported)
+			if got != tt.want || ok != tt.wantOK || reason != tt.wantReason {
+				t.Errorf("ReconcileTotal(%q, %d, %d) = %d, %v, %q, want %d, %v, %q",
+					tt.dir, tt.total, tt.reported, got, ok, reason, tt.want, tt.wantOK, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewSaverWithBuffer(t *testing.T) {
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaverWithBuffer("foo", "bar", 2, 7, eventsocket.NullServer(), anon, nil)
+	for i, q := range svr.MarshalChans {
+		if cap(q) != 7 {
+			t.Errorf("Marshaller %d has capacity %d, want 7", i, cap(q))
+		}
+	}
+	svr = saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	if cap(svr.MarshalChans[0]) != saver.DefaultMarshalBufferSize {
+		t.Errorf("NewSaver marshaller has capacity %d, want %d", cap(svr.MarshalChans[0]), saver.DefaultMarshalBufferSize)
+	}
+
+	// The occupancy of the saver's input queue is sampled every cycle.
+	metrics.QueueOccupancy.WithLabelValues("saver").Set(-1)
+	svrChan := make(chan netlink.MessageBlock, 3)
+	svrChan <- netlink.MessageBlock{}
+	svrChan <- netlink.MessageBlock{}
+	close(svrChan)
+	svr.MessageSaverLoop(svrChan)
+	// The last sample was taken after both blocks were removed.
+	if got := testutil.ToFloat64(metrics.QueueOccupancy.WithLabelValues("saver")); got != 0 {
+		t.Error("Saver queue occupancy should be 0, not", got)
+	}
+}
+
+func histCount(m prometheus.Metric) uint64 {
+	var mm dto.Metric
+	m.Write(&mm)
+	return mm.GetHistogram().GetSampleCount()
+}
+
+func TestOutputFileMetrics(t *testing.T) {
+	var before, after dto.Metric
+	metrics.OutputFileBytesHistogram.Write(&before)
+	writes := histCount(metrics.WriteLatencyHistogram)
+
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = factory
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, m := range []*TestMsg{msg(t, 1234, 1), msg(t, 1234, 1).setByte(20, 127)} {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	var size int
+	for _, f := range factory.files {
+		size = f.Len()
+	}
+	metrics.OutputFileBytesHistogram.Write(&after)
+	if count := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); count != 1 {
+		t.Error("Expected one file size observation, got", count)
+	}
+	if sum := after.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); sum != float64(size) {
+		t.Errorf("Observed a file size of %v, want %d", sum, size)
+	}
+	// The header is written by the saver, and the two snapshots by the marshaller.
+	if count := histCount(metrics.WriteLatencyHistogram) - writes; count != 2 {
+		t.Error("Expected two write latency observations, got", count)
+	}
+}
+
+func TestSaverBlockMetrics(t *testing.T) {
+	before := histCount(metrics.SaverBlockHistogram)
+	slow := testutil.ToFloat64(metrics.SlowSaverBlockCount)
+
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	if svr.SlowBlock != saver.DefaultSlowBlock {
+		t.Errorf("SlowBlock = %v, want %v", svr.SlowBlock, saver.DefaultSlowBlock)
+	}
+	// Every block is slow.
+	svr.SlowBlock = time.Nanosecond
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// Blocks are timed in wall time, so a clock that never advances has no effect.
+	svr.Clock = &fakeClock{now: date}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	for i := 0; i < 2; i++ {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&msg(t, 1234, 1).NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if got := histCount(metrics.SaverBlockHistogram) - before; got != 2 {
+		t.Errorf("SaverBlockHistogram has %d new samples, want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.SlowSaverBlockCount) - slow; got != 2 {
+		t.Errorf("SlowSaverBlockCount increased by %v, want 2", got)
+	}
+}
+
+func TestNewSaverNoMarshallers(t *testing.T) {
+	defer func() {
+		if e := recover(); e != saver.ErrNoMarshallers {
+			t.Errorf("NewSaver should panic with ErrNoMarshallers, not %v", e)
+		}
+	}()
+	anon := anonymize.New(anonymize.None)
+	saver.NewSaver("foo", "bar", 0, eventsocket.NullServer(), anon, nil)
+}
+
+func TestSockIDAnonymization(t *testing.T) {
+	chdirTemp(t)
+
+	sockAnon := inetdiag.NewSockIDAnonymizer([]byte("test key"), false)
+	anonCookie := sockAnon.Cookie(1234)
+	for _, tt := range []struct {
+		anon   *inetdiag.SockIDAnonymizer
+		cookie uint64
+	}{
+		{nil, 1234},
+		{sockAnon, anonCookie},
+	} {
+		anon := anonymize.New(anonymize.None)
+		svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+		svr.SockIDAnon = tt.anon
+		svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+		go svr.MessageSaverLoop(svrChan)
+		m := msg(t, 1234, 1)
+		svrChan <- netlink.MessageBlock{V4Time: time.Now(), V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage}}
+		close(svrChan)
+		svr.Done.Wait()
+
+		// The file name, header, and record all use the same cookie.
+		suffix := fmt.Sprintf("_%016X", tt.cookie)
+		names, err := filepath.Glob("*/*/*/*" + suffix + ".00000.jsonl.zst")
+		rtx.Must(err, "Could not Glob")
+		if len(names) != 1 {
+			t.Fatalf("Expected one file for cookie %X, found %v", tt.cookie, names)
+		}
+		out := zstd.NewReader(names[0])
+		saved, err := netlink.LoadAllArchivalRecords(out)
+		out.Close()
+		rtx.Must(err, "Could not read output")
+		if len(saved) != 2 || saved[0].Metadata == nil {
+			t.Fatal("Bad output", len(saved))
+		}
+		if !strings.HasSuffix(saved[0].Metadata.UUID, suffix) {
+			t.Errorf("Header UUID %s should end with %s", saved[0].Metadata.UUID, suffix)
+		}
+		idm, err := saved[1].RawIDM.Parse()
+		rtx.Must(err, "Could not parse record")
+		if idm.ID.Cookie() != tt.cookie {
+			t.Errorf("Saved cookie = %X, want %X", idm.ID.Cookie(), tt.cookie)
+		}
+	}
+}
+
+// Anonymization must not modify the records held by the saver, which still
+// identifies them by their real cookies.  Run with -race.
+func TestSockIDAnonymizationWithCache(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	eventCounts := &countingEventSocket{}
+	svr := saver.NewSaver("foo", "bar", 1, eventCounts, anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = factory
+	svr.SockIDAnon = inetdiag.NewSockIDAnonymizer([]byte("test key"), false)
+	svr.MinInterval = time.Hour
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, ms := range [][]*TestMsg{
+		{msg(t, 1234, 1)},
+		{msg(t, 1234, 1).setByte(20, 1)}, // Suppressed by MinInterval.
+		{msg(t, 1234, 1).setByte(20, 2)}, // Suppressed by MinInterval.
+		{},                               // Closed.
+	} {
+		block := netlink.MessageBlock{V4Time: date.Add(time.Duration(i) * time.Second)}
+		for _, m := range ms {
+			block.V4Messages = append(block.V4Messages, &m.NetlinkMessage)
+		}
+		svrChan <- block
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if eventCounts.opens != 1 || eventCounts.closes != 1 {
+		t.Errorf("Expected 1 open and 1 close, got %d and %d", eventCounts.opens, eventCounts.closes)
+	}
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for path, f := range factory.files {
+		if !f.closed {
+			t.Error("File was not closed:", path)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		if len(records) != 2 {
+			t.Fatalf("Expected the header and one snapshot, got %d records", len(records))
+		}
+		idm, err := records[1].RawIDM.Parse()
+		rtx.Must(err, "Could not parse record")
+		if idm.ID.Cookie() != svr.SockIDAnon.Cookie(1234) {
+			t.Errorf("Saved cookie = %X, want %X", idm.ID.Cookie(), svr.SockIDAnon.Cookie(1234))
+		}
+	}
+}
+
+// If this compiles, the "test" passes
+func assertSaverIsACacheLogger(s *saver.Saver) {
+	func(csl saver.CacheLogger) {}(s)
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (rl *recordingLogger) add(level string, v []interface{}) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.lines = append(rl.lines, level+" "+strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (rl *recordingLogger) Debug(v ...interface{}) { rl.add("DEBUG", v) }
+func (rl *recordingLogger) Info(v ...interface{})  { rl.add("INFO", v) }
+func (rl *recordingLogger) Warn(v ...interface{})  { rl.add("WARN", v) }
+func (rl *recordingLogger) Error(v ...interface{}) { rl.add("ERROR", v) }
+
+func TestLogger(t *testing.T) {
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	rl := &recordingLogger{}
+	svr.Logger = rl
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	m := msg(t, 1234, 1).setState(tcp.FIN_WAIT1)
+	svrChan <- netlink.MessageBlock{
+		V4Time:     date,
+		V4Messages: []*netlink.NetlinkMessage{nil, &m.NetlinkMessage},
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	rl.Lock()
+	defer rl.Unlock()
+	want := []string{"INFO Starting Saver", "WARN Nil message", "INFO Starting: 11:12:13.000 1234 FIN_WAIT1", "INFO Marshaller Done"}
+	for _, w := range want {
+		found := false
+		for _, line := range rl.lines {
+			if strings.HasPrefix(line, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Missing log line %q in %q", w, rl.lines)
+		}
+	}
+}
+
+func TestClassifyClose(t *testing.T) {
+	// Offsets of CAState and Retransmits in LinuxTCPInfo.
+	const caState, retransmits = 1, 2
+	established := msg(t, 1234, 1).setState(tcp.ESTABLISHED)
+	tests := []struct {
+		name  string
+		final *TestMsg
+		info  *TestMsg
+		want  string
+	}{
+		{"fin_wait2", msg(t, 1234, 1).setState(tcp.FIN_WAIT2).withoutDiagInfo(), established, "normal"},
+		{"time_wait", msg(t, 1234, 1).setState(tcp.TIME_WAIT).withoutDiagInfo(), nil, "normal"},
+		{"close_wait", msg(t, 1234, 1).setState(tcp.CLOSE_WAIT), nil, "normal"},
+		{"established", established, established, "reset"},
+		{"close", msg(t, 1234, 1).setState(tcp.CLOSE).withoutDiagInfo(), established, "reset"},
+		{"no_info", msg(t, 1234, 1).setState(tcp.CLOSE).withoutDiagInfo(), nil, "reset"},
+		{"retransmitting", established.copy().setByte(retransmits, 5), nil, "timeout"},
+		{"one_retransmit", established.copy().setByte(retransmits, 1), nil, "reset"},
+		{"loss", established.copy().setByte(caState, byte(tcp.TCP_CA_Loss)), nil, "timeout"},
+	}
+	for _, tt := range tests {
+		final, err := netlink.MakeArchivalRecord(&tt.final.NetlinkMessage, nil)
+		rtx.Must(err, "Could not make final record for %s", tt.name)
+		info := final
+		if tt.info != nil {
+			info = tt.info.mustAR()
+		} else if !final.HasDiagInfo() {
+			info = nil
+		}
+		if got := saver.ClassifyClose(final, info); got != tt.want {
+			t.Errorf("%s: ClassifyClose() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := saver.ClassifyClose(&netlink.ArchivalRecord{}, nil); got != "unknown" {
+		t.Errorf("ClassifyClose() of an empty record = %q, want unknown", got)
+	}
+}
+
+func TestConnectionCloseCount(t *testing.T) {
+	count := func(kind string) float64 {
+		return testutil.ToFloat64(metrics.ConnectionCloseCount.WithLabelValues(kind))
+	}
+	normal, timeout, reset := count("normal"), count("timeout"), count("reset")
+
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	send := func(i int, msgs ...*TestMsg) {
+		block := netlink.MessageBlock{V4Time: date.Add(time.Duration(i) * time.Second)}
+		for _, m := range msgs {
+			block.V4Messages = append(block.V4Messages, &m.NetlinkMessage)
+		}
+		svrChan <- block
+	}
+	// 1 closes normally, losing its TCPInfo in FIN_WAIT2, 2 times out, and 3 is reset.
+	send(0, msg(t, 1, 1), msg(t, 2, 2), msg(t, 3, 3))
+	send(1, msg(t, 1, 1).setState(tcp.FIN_WAIT2).withoutDiagInfo(), msg(t, 2, 2).setByte(2, 6), msg(t, 3, 3))
+	send(2)
+	close(svrChan)
+	svr.Done.Wait()
+
+	if got := count("normal") - normal; got != 1 {
+		t.Errorf("normal closes increased by %v, want 1", got)
+	}
+	if got := count("timeout") - timeout; got != 1 {
+		t.Errorf("timeout closes increased by %v, want 1", got)
+	}
+	if got := count("reset") - reset; got != 1 {
+		t.Errorf("reset closes increased by %v, want 1", got)
+	}
+}
+
+func TestInvalidRecordsSkipped(t *testing.T) {
+	events := eventsocket.NewRecordingServer()
+	svr := saver.NewSaver("foo", "bar", 1, events, anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	rl := &recordingLogger{}
+	svr.Logger = rl
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	before := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(inetdiag.ErrUnknownAF.Error()))
+	var msgs []*netlink.NetlinkMessage
+	for i := 0; i < 3; i++ {
+		m := msg(t, uint64(1234+i), 1)
+		m.NetlinkMessage.Data[0] = 0 // IDiagFamily
+		msgs = append(msgs, &m.NetlinkMessage)
+	}
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{V4Time: date, V4Messages: msgs}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if after := testutil.ToFloat64(metrics.ParseErrorCount.WithLabelValues(inetdiag.ErrUnknownAF.Error())); after != before+3 {
+		t.Errorf("ParseErrorCount = %v, want %v", after, before+3)
+	}
+	if got := events.Events(); len(got) != 0 {
+		t.Error("An invalid record should not open a connection:", got)
+	}
+	// The invalid records are logged at most once a second.
+	rl.Lock()
+	defer rl.Unlock()
+	warnings := 0
+	for _, line := range rl.lines {
+		if strings.HasPrefix(line, "WARN ") {
+			warnings++
+		}
+	}
+	if warnings > 1 {
+		t.Errorf("Logged %d warnings for invalid records, want at most 1: %q", warnings, rl.lines)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp-info_saver_TestPrune")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	old := time.Date(2018, 02, 06, 0, 0, 0, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{
+		"2018/01/31/a.00000.jsonl.zst": old,
+		"2018/02/04/b.00000.jsonl.zst": old,
+		"2018/02/04/notes.txt":         old,
+		"2018/02/05/c.00000.bin.zst":   old,
+		"2018/02/05/d.00001.jsonl.zst": old.Add(2 * time.Hour), // Still being written.
+		"2018/02/06/e.00000.jsonl.zst": old,
+	} {
+		fn := filepath.Join(dir, name)
+		rtx.Must(os.MkdirAll(filepath.Dir(fn), 0755), "Could not create dir for %s", name)
+		rtx.Must(ioutil.WriteFile(fn, []byte("1234"), 0644), "Could not write %s", name)
+		rtx.Must(os.Chtimes(fn, mtime, mtime), "Could not set time of %s", name)
+	}
+
+	before := testutil.ToFloat64(metrics.RetentionBytesRemoved)
+	files, size, err := saver.Prune(dir, old.Add(time.Hour))
+	rtx.Must(err, "Could not prune")
+	if files != 3 || size != 12 {
+		t.Errorf("Prune() = %d files, %d bytes, want 3 files, 12 bytes", files, size)
+	}
+	if after := testutil.ToFloat64(metrics.RetentionBytesRemoved); after != before+12 {
+		t.Errorf("RetentionBytesRemoved = %v, want %v", after, before+12)
+	}
+	for name, want := range map[string]bool{
+		"2018/01":                      false, // Left empty, so removed.
+		"2018/02/04/b.00000.jsonl.zst": false,
+		"2018/02/04/notes.txt":         true,
+		"2018/02/05/c.00000.bin.zst":   false,
+		"2018/02/05/d.00001.jsonl.zst": true,
+		"2018/02/06/e.00000.jsonl.zst": true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+// setDeliveryRate sets the DeliveryRate, and the app-limited bit.
+func (msg *TestMsg) setDeliveryRate(rate uint64, appLimited bool) *TestMsg {
+	offset := int(unsafe.Offsetof(tcp.LinuxTCPInfo{}.DeliveryRate))
+	for i := 0; i < 8; i++ {
+		msg.setByte(offset+i, byte(rate>>(8*i)))
+	}
+	var limited byte
+	if appLimited {
+		limited = 1
+	}
+	return msg.setByte(int(unsafe.Offsetof(tcp.LinuxTCPInfo{}.AppLimited)), limited)
+}
+
+func TestDeliveryRates(t *testing.T) {
+	var before dto.Metric
+	rtx.Must(metrics.DeliveryRateHistogram.Write(&before), "Could not read histogram")
+
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr.DeliveryRates = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, m := range []*TestMsg{
+		msg(t, 1234, 1).setDeliveryRate(1000, false),
+		msg(t, 1234, 1).setDeliveryRate(2000, true).setByte(20, 1),
+		msg(t, 1234, 1).setDeliveryRate(2000, true).setByte(20, 1), // Unchanged, so not saved.
+		msg(t, 1234, 1).setDeliveryRate(3000, false).setByte(20, 2),
+	} {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	var after dto.Metric
+	rtx.Must(metrics.DeliveryRateHistogram.Write(&after), "Could not read histogram")
+	if count := after.GetHistogram().GetSampleCount() - before.GetHistogram().GetSampleCount(); count != 2 {
+		t.Error("Expected 2 observations, got", count)
+	}
+	if sum := after.GetHistogram().GetSampleSum() - before.GetHistogram().GetSampleSum(); sum != 8*(1000+3000) {
+		t.Error("Expected a sum of 32000 bits per second, got", sum)
+	}
+}
+
+func TestBBRPhaseTransitions(t *testing.T) {
+	for _, slim := range []bool{false, true} {
+		testBBRPhaseTransitions(t, slim)
+	}
+}
+
+func testBBRPhaseTransitions(t *testing.T, slim bool) {
+	startupToDrain := metrics.BBRPhaseTransitionCount.WithLabelValues("STARTUP", "DRAIN")
+	drainToProbeBW := metrics.BBRPhaseTransitionCount.WithLabelValues("DRAIN", "PROBE_BW")
+	beforeDrain, beforeProbeBW := testutil.ToFloat64(startupToDrain), testutil.ToFloat64(drainToProbeBW)
+
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = factory
+	svr.SlimCache = slim
+	svr.BBRChanges = true
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	// The records differ only in their BBRInfo.
+	for i, m := range []*TestMsg{
+		msg(t, 1234, 1).withBBR(739, 739),
+		msg(t, 1234, 1).withBBR(88, 739),
+		msg(t, 1234, 1).withBBR(320, 512),
+		msg(t, 1234, 1).withBBR(192, 512), // Still PROBE_BW.
+	} {
+		svrChan <- netlink.MessageBlock{
+			V4Time:     date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{&m.NetlinkMessage},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if got := testutil.ToFloat64(startupToDrain) - beforeDrain; got != 1 {
+		t.Errorf("Slim %v: expected 1 STARTUP to DRAIN transition, got %v", slim, got)
+	}
+	if got := testutil.ToFloat64(drainToProbeBW) - beforeProbeBW; got != 1 {
+		t.Errorf("Slim %v: expected 1 DRAIN to PROBE_BW transition, got %v", slim, got)
+	}
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for _, f := range factory.files {
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		// The header, and all four snapshots.
+		if len(records) != 5 {
+			t.Errorf("Slim %v: expected 5 records, got %d", slim, len(records))
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = factory
+	svr.Labels = netlink.Labels{Host: "mlab1", Site: "lga03", Experiment: "ndt"}
+	want := netlink.Labels{Host: "mlab1", Pod: "bar", Site: "lga03", Experiment: "ndt"}
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{V4Time: date, V4Messages: []*netlink.NetlinkMessage{&msg(t, 1234, 1).NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for _, f := range factory.files {
+		header, _, _ := bytes.Cut(f.Bytes(), []byte("\n"))
+		// The Labels override the Saver's Host, and the Saver's Pod fills in for
+		// the unset Pod label.
+		if !bytes.Contains(header, []byte(`"Host":"mlab1","Pod":"bar","Site":"lga03","Experiment":"ndt"}`)) {
+			t.Error("Header does not contain the labels:", string(header))
+		}
+		records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+		rtx.Must(err, "Could not read records")
+		if meta := records[0].Metadata; meta == nil || meta.Labels != want {
+			t.Errorf("Metadata = %+v, want labels %+v", meta, want)
+		}
+	}
+}
+
+func TestHostAndPod(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr := saver.NewSaver("mlab1", "ndt-abc12", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	if svr.Host != "mlab1" || svr.Pod != "ndt-abc12" {
+		t.Errorf("Host = %q, Pod = %q, want mlab1 and ndt-abc12", svr.Host, svr.Pod)
+	}
+	svr.WriterFactory = factory
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	svrChan <- netlink.MessageBlock{V4Time: date, V4Messages: []*netlink.NetlinkMessage{&msg(t, 1234, 1).NetlinkMessage}}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for _, f := range factory.files {
+		records, err := netlink.LoadAllArchivalRecords(bytes.NewReader(f.Bytes()))
+		rtx.Must(err, "Could not read records")
+		want := netlink.Labels{Host: "mlab1", Pod: "ndt-abc12"}
+		if meta := records[0].Metadata; meta == nil || meta.Labels != want {
+			t.Errorf("Metadata = %+v, want labels %+v", meta, want)
+		}
+	}
+}
+
+// fakeProc creates a process in a fake /proc under root, with the given cgroup
+// path, and an fd for each of the socket inodes.
+func fakeProc(root string, pid int, cgroup string, inodes ...uint32) {
+	dir := fmt.Sprintf("%s/%d", root, pid)
+	rtx.Must(os.MkdirAll(dir+"/fd", 0777), "Could not create %s", dir)
+	rtx.Must(ioutil.WriteFile(dir+"/cgroup", []byte("0::"+cgroup+"\n"), 0666), "Could not write cgroup")
+	// Processes also have fds that are not sockets.
+	rtx.Must(os.Symlink("/dev/null", dir+"/fd/0"), "Could not create fd")
+	for i, inode := range inodes {
+		rtx.Must(os.Symlink(fmt.Sprintf("socket:[%d]", inode), fmt.Sprintf("%s/fd/%d", dir, i+3)), "Could not create fd")
+	}
+}
+
+func TestCgroupFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestCgroupFilter")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(root)
+	fakeProc(root, 100, "/kubepods/pod1/abc123", 1111, 1112)
+	fakeProc(root, 200, "/system.slice/sshd.service", 2222)
+	rtx.Must(os.MkdirAll(root+"/sys", 0777), "Could not create a non-process directory")
+
+	f := saver.NewCgroupFilter(root, "abc123")
+	for _, tt := range []struct {
+		inode uint32
+		want  bool
+	}{
+		{1111, true},
+		{1112, true},
+		{2222, false},
+		{3333, false}, // No owner.
+		{0, false},
+	} {
+		if got := f.Matches(tt.inode); got != tt.want {
+			t.Errorf("Matches(%d) = %v, want %v", tt.inode, got, tt.want)
+		}
+	}
+
+	// /proc is only scanned again in the next cycle.
+	fakeProc(root, 300, "/kubepods/pod1/abc123", 3333)
+	if f.Matches(3333) {
+		t.Error("Matches(3333) should use the scan from this cycle")
+	}
+	f.NewCycle()
+	if !f.Matches(3333) {
+		t.Error("Matches(3333) should find the new process in the next cycle")
+	}
+}
+
+func TestSaverCgroups(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestSaverCgroups")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(root)
+	fakeProc(root, 100, "/kubepods/pod1/abc123", 1111)
+	fakeProc(root, 200, "/system.slice/sshd.service", 2222)
+
+	before := testutil.ToFloat64(metrics.CgroupUnmatchedCount)
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anonymize.New(anonymize.None), nil)
+	svr.WriterFactory = factory
+	svr.Cgroups = saver.NewCgroupFilter(root, "abc123")
+	svrChan := make(chan netlink.MessageBlock, 0)
+	go svr.MessageSaverLoop(svrChan)
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i, ms := range [][]*TestMsg{
+		{msg(t, 1234, 1).setInode(1111), msg(t, 5678, 2).setInode(2222)},
+		{msg(t, 1234, 1).setInode(1111).setByte(20, 127), msg(t, 5678, 2).setInode(2222).setByte(20, 127)},
+		{},
+	} {
+		block := netlink.MessageBlock{V4Time: date.Add(time.Duration(i) * time.Second)}
+		for _, m := range ms {
+			block.V4Messages = append(block.V4Messages, &m.NetlinkMessage)
+		}
+		svrChan <- block
+	}
+	close(svrChan)
+	svr.Done.Wait()
+
+	if len(factory.files) != 1 {
+		t.Fatal("Expected one file, got", len(factory.files))
+	}
+	for path, f := range factory.files {
+		if !strings.HasSuffix(path, "_00000000000004D2.00000.jsonl.zst") {
+			t.Error("Unexpected path:", path)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		if len(records) != 3 {
+			t.Errorf("Wrong records: %+v", records)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.CgroupUnmatchedCount) - before; got != 1 {
+		t.Error("Expected one unmatched connection, got", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	clock := &fakeClock{now: time.Date(2018, 02, 06, 11, 0, 0, 0, time.UTC)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	svr.Clock = clock
+	svr.FileAgeLimit = time.Hour
+	svr.IdleTimeout = 5 * time.Minute
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	before := testutil.ToFloat64(metrics.IdleFileCloseCount)
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+	send := func(m *TestMsg) {
+		mb.V4Messages = []*netlink.NetlinkMessage{&m.NetlinkMessage}
+		mb.V4Time = mb.V4Time.Add(time.Second)
+		svrChan <- mb
+		// Once the loop accepts the same block again, the first has been
+		// handled, so the clock can safely be advanced.
+		svrChan <- mb
+	}
+
+	send(msg(t, 1234, 1))
+	// Unchanged snapshots don't keep the connection active.
+	clock.Advance(4 * time.Minute)
+	send(msg(t, 1234, 1))
+	clock.Advance(2 * time.Minute)
+	send(msg(t, 1234, 1))
+	// Once the idle file is closed, the next change starts a new file.
+	send(msg(t, 1234, 1).setByte(20, 127))
+	close(svrChan)
+	svr.Done.Wait()
+
+	if closed := testutil.ToFloat64(metrics.IdleFileCloseCount) - before; closed != 1 {
+		t.Errorf("Closed %v idle files, want 1", closed)
+	}
+	if len(factory.files) != 2 {
+		t.Fatal("Expected two files, got", len(factory.files))
+	}
+	for _, suffix := range []string{".00000.jsonl.zst", ".00001.jsonl.zst"} {
+		var f *memoryFile
+		for path := range factory.files {
+			if strings.HasSuffix(path, suffix) {
+				f = factory.files[path]
+			}
+		}
+		if f == nil {
+			t.Error("Missing file with suffix", suffix)
+			continue
+		}
+		if !f.closed {
+			t.Error("File was not closed:", suffix)
+		}
+		records, err := netlink.LoadAllArchivalRecords(&f.Buffer)
+		rtx.Must(err, "Could not read records")
+		// The header, and one snapshot.
+		if len(records) != 2 || records[0].Metadata == nil {
+			t.Errorf("Wrong records in %s: %+v", suffix, records)
+		}
+	}
+}
+
+func TestLogCacheStatsConcurrently(t *testing.T) {
+	factory := &memoryWriterFactory{files: make(map[string]*memoryFile)}
+	anon := anonymize.New(anonymize.None)
+	svr := saver.NewSaver("foo", "bar", 2, eventsocket.NullServer(), anon, nil)
+	svr.WriterFactory = factory
+	rl := &recordingLogger{}
+	svr.Logger = rl
+	svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+	go svr.MessageSaverLoop(svrChan)
+
+	// The collector logs cache stats from its own goroutine, while the saver
+	// is running.  Run with -race to check this.
+	done := make(chan struct{})
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				svr.LogCacheStats(0, 0)
+			}
+		}
+	}()
+
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		svrChan <- netlink.MessageBlock{
+			V4Time: date.Add(time.Duration(i) * time.Second),
+			V4Messages: []*netlink.NetlinkMessage{
+				&msg(t, 1234, 1).setByte(20, byte(i)).NetlinkMessage,
+				&msg(t, 5678, 2).NetlinkMessage,
+			},
+		}
+	}
+	close(svrChan)
+	svr.Done.Wait()
+	close(done)
+	<-logged
+
+	rl.lines = nil
+	svr.LogCacheStats(0, 0)
+	// 20 snapshots, of 2 new connections, one of which changed 9 times.
+	want := "INFO Cache info total 20  local 0 same 9 diff 9 new 2 err 0"
+	if len(rl.lines) != 1 || rl.lines[0] != want {
+		t.Errorf("LogCacheStats() logged %q, want %q", rl.lines, want)
+	}
+}
+
+func TestResumeSequences(t *testing.T) {
+	chdirTemp(t)
+
+	clock := &fakeClock{now: time.Date(2018, 02, 06, 12, 0, 0, 0, time.UTC)}
+	date := time.Date(2018, 02, 06, 11, 12, 13, 0, time.UTC)
+	run := func(resume bool, blocks ...[]*TestMsg) {
+		anon := anonymize.New(anonymize.None)
+		svr := saver.NewSaver("foo", "bar", 1, eventsocket.NullServer(), anon, nil)
+		svr.Clock = clock
+		if resume {
+			n, err := svr.ResumeSequences(".")
+			rtx.Must(err, "Could not scan for files")
+			if n != 1 {
+				t.Errorf("ResumeSequences() found %d connections, want 1", n)
+			}
+		}
+		svrChan := make(chan netlink.MessageBlock, 0) // no buffering
+		go svr.MessageSaverLoop(svrChan)
+		for _, msgs := range blocks {
+			date = date.Add(time.Second)
+			mb := netlink.MessageBlock{V4Time: date, V6Time: date}
+			for _, m := range msgs {
+				mb.V4Messages = append(mb.V4Messages, &m.NetlinkMessage)
+			}
+			svrChan <- mb
+		}
+		close(svrChan)
+		svr.Done.Wait()
+	}
+
+	// Write a .00000 file, and then restart while the connection is still open.
+	run(false, []*TestMsg{msg(t, 1234, 1)})
+	run(true, []*TestMsg{msg(t, 1234, 1).setByte(20, 127)}, []*TestMsg{msg(t, 5678, 2)})
+
+	for _, tt := range []struct {
+		name    string
+		records int
+	}{
+		{fmt.Sprintf("2018/02/06/%s.00000.jsonl.zst", uuid.FromCookie(1234)), 2},
+		{fmt.Sprintf("2018/02/06/%s.00001.jsonl.zst", uuid.FromCookie(1234)), 2},
+		// Connections that start after the first block are not resumed.
+		{fmt.Sprintf("2018/02/06/%s.00000.jsonl.zst", uuid.FromCookie(5678)), 2},
+	} {
+		rdr := zstd.NewReader(tt.name)
+		records, err := netlink.LoadAllArchivalRecords(rdr)
+		rdr.Close()
+		if err != nil {
+			t.Errorf("Could not read %s: %v", tt.name, err)
+			continue
+		}
+		// The header, and the snapshot.
+		if len(records) != tt.records {
+			t.Errorf("%s has %d records, want %d", tt.name, len(records), tt.records)
+		}
+	}
+	if names, _ := filepath.Glob("*/*/*/*"); len(names) != 3 {
+		t.Error("Expected three files, found", names)
+	}
 }
@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldChange describes a single field that differs between two Snapshots.
+type FieldChange struct {
+	Name string // The CSV column name, e.g. TCP.SndCwnd.
+	Old  string // Empty if the field was absent from the previous Snapshot.
+	New  string // Empty if the field is absent from the current Snapshot.
+}
+
+func (fc FieldChange) String() string {
+	return fmt.Sprintf("%s %s -> %s", fc.Name, fc.Old, fc.New)
+}
+
+// Diff returns the InetDiagMsg and TCPInfo fields that differ between two
+// snapshots of the same connection, in CSV column order.  If the InetDiagMsg
+// or TCPInfo is missing from only one of the snapshots, all of its fields are
+// reported, with an empty value for the missing side.
+func Diff(prev, cur *Snapshot) []FieldChange {
+	var changes []FieldChange
+	changes = diffFields(changes, reflect.ValueOf(prev.InetDiagMsg), reflect.ValueOf(cur.InetDiagMsg))
+	changes = diffFields(changes, reflect.ValueOf(prev.TCPInfo), reflect.ValueOf(cur.TCPInfo))
+	return changes
+}
+
+// DiffString formats the result of Diff on a single line, e.g.
+// "TCP.RTT 30000 -> 28000, TCP.SndCwnd 10 -> 12".
+func DiffString(changes []FieldChange) string {
+	s := make([]string, len(changes))
+	for i := range changes {
+		s[i] = changes[i].String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// diffFields appends a FieldChange for each leaf field that differs between two
+// pointers to the same struct type, either of which may be nil.
+func diffFields(changes []FieldChange, prev, cur reflect.Value) []FieldChange {
+	names, before := leafStrings(prev)
+	_, after := leafStrings(cur)
+	for i := range names {
+		if before[i] != after[i] {
+			changes = append(changes, FieldChange{Name: names[i], Old: before[i], New: after[i]})
+		}
+	}
+	return changes
+}
+
+// leafStrings returns the names and string values of the leaf fields of the
+// struct that v points to.  If v is nil, the values are all empty.
+func leafStrings(v reflect.Value) (names, values []string) {
+	absent := v.IsNil()
+	if absent {
+		v = reflect.New(v.Type().Elem())
+	}
+	visitFields(v, func(name string, field reflect.Value) {
+		names = append(names, name)
+		if absent {
+			values = append(values, "")
+		} else {
+			values = append(values, fieldString(field))
+		}
+	})
+	return names, values
+}
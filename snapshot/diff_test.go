@@ -0,0 +1,48 @@
+package snapshot_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestDiff(t *testing.T) {
+	prev := &snapshot.Snapshot{
+		InetDiagMsg: &inetdiag.InetDiagMsg{IDiagState: uint8(tcp.ESTABLISHED)},
+		TCPInfo:     &tcp.LinuxTCPInfo{RTT: 30000, SndCwnd: 10, BytesAcked: 100},
+	}
+	cur := &snapshot.Snapshot{
+		InetDiagMsg: &inetdiag.InetDiagMsg{IDiagState: uint8(tcp.ESTABLISHED)},
+		TCPInfo:     &tcp.LinuxTCPInfo{RTT: 28000, SndCwnd: 12, BytesAcked: 100},
+	}
+	want := []snapshot.FieldChange{
+		{Name: "TCP.RTT", Old: "30000", New: "28000"},
+		{Name: "TCP.SndCwnd", Old: "10", New: "12"},
+	}
+	got := snapshot.Diff(prev, cur)
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+	if s := snapshot.DiffString(got); s != "TCP.RTT 30000 -> 28000, TCP.SndCwnd 10 -> 12" {
+		t.Errorf("DiffString() = %q", s)
+	}
+
+	if got := snapshot.Diff(cur, cur); len(got) != 0 {
+		t.Error("Snapshot should not differ from itself:", got)
+	}
+
+	// A missing TCPInfo reports every field, including unchanged zeros.
+	cur.TCPInfo = nil
+	got = snapshot.Diff(prev, cur)
+	if len(got) < 50 {
+		t.Fatal("Expected every TCPInfo field to be reported, got", len(got))
+	}
+	for _, fc := range got {
+		if fc.New != "" || fc.Old == "" {
+			t.Errorf("Unexpected change %v", fc)
+		}
+	}
+}
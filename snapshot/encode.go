@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+)
+
+// structBytes returns a copy of the size bytes of the struct at p.  If raw, the
+// value it was decoded from, was shorter, e.g. from an older kernel, the copy is
+// truncated to the same length, unless fields beyond it have been set.
+func structBytes(p unsafe.Pointer, size uintptr, raw []byte) []byte {
+	b := append([]byte(nil), unsafe.Slice((*byte)(p), size)...)
+	if raw != nil && len(raw) < len(b) && len(bytes.TrimRight(b[len(raw):], "\x00")) == 0 {
+		b = b[:len(raw)]
+	}
+	return b
+}
+
+// encodeAttribute returns the value of the attribute of type t, encoded from the
+// Snapshot's fields, or nil if it is not modeled by the Snapshot.  The raw value
+// is used only for its length.
+func (s *Snapshot) encodeAttribute(t int, raw []byte) []byte {
+	switch t {
+	case inetdiag.INET_DIAG_MEMINFO:
+		if s.MemInfo != nil {
+			return structBytes(unsafe.Pointer(s.MemInfo), unsafe.Sizeof(*s.MemInfo), raw)
+		}
+	case inetdiag.INET_DIAG_INFO:
+		if s.TCPInfo != nil {
+			return structBytes(unsafe.Pointer(s.TCPInfo), unsafe.Sizeof(*s.TCPInfo), raw)
+		}
+	case inetdiag.INET_DIAG_VEGASINFO:
+		if s.VegasInfo != nil {
+			return structBytes(unsafe.Pointer(s.VegasInfo), unsafe.Sizeof(*s.VegasInfo), raw)
+		}
+	case inetdiag.INET_DIAG_CONG:
+		return append([]byte(s.CongestionAlgorithm), 0)
+	case inetdiag.INET_DIAG_TOS:
+		return []byte{s.TOS}
+	case inetdiag.INET_DIAG_TCLASS:
+		return []byte{s.TClass}
+	case inetdiag.INET_DIAG_SKMEMINFO:
+		if s.SocketMem != nil {
+			return structBytes(unsafe.Pointer(s.SocketMem), unsafe.Sizeof(*s.SocketMem), raw)
+		}
+	case inetdiag.INET_DIAG_SHUTDOWN:
+		return []byte{s.Shutdown}
+	case inetdiag.INET_DIAG_DCTCPINFO:
+		if s.DCTCPInfo != nil {
+			return structBytes(unsafe.Pointer(s.DCTCPInfo), unsafe.Sizeof(*s.DCTCPInfo), raw)
+		}
+	case inetdiag.INET_DIAG_PROTOCOL:
+		return []byte{uint8(s.Protocol)}
+	case inetdiag.INET_DIAG_SKV6ONLY:
+		if s.SKV6Only != nil {
+			if *s.SKV6Only {
+				return []byte{1}
+			}
+			return []byte{0}
+		}
+	case inetdiag.INET_DIAG_MARK:
+		if s.HasMark() {
+			mark := s.Mark
+			return structBytes(unsafe.Pointer(&mark), unsafe.Sizeof(mark), nil)
+		}
+	case inetdiag.INET_DIAG_BBRINFO:
+		if s.BBRInfo != nil {
+			return structBytes(unsafe.Pointer(s.BBRInfo), unsafe.Sizeof(*s.BBRInfo), raw)
+		}
+	case inetdiag.INET_DIAG_CLASS_ID:
+		return []byte{s.ClassID}
+	}
+	return nil
+}
+
+// ToArchivalRecord encodes the Snapshot as an ArchivalRecord, reversing Decode,
+// so that snapshots can be transformed and saved again.  The InetDiagMsg, and
+// each attribute in Observed that the Snapshot models, are encoded from the
+// Snapshot's fields, so changes to them are kept.  Other attributes, e.g. those
+// Decode doesn't parse, or those in NotFullyParsed, are copied unchanged from
+// the record the Snapshot was decoded from.  Derived fields, e.g. StateName and
+// DSCP, are not encoded, since Decode recomputes them.  The result has no
+// Metadata, so a Snapshot without an InetDiagMsg returns ErrEmptyRecord.
+func ToArchivalRecord(s *Snapshot) (*netlink.ArchivalRecord, error) {
+	if s.InetDiagMsg == nil {
+		return nil, ErrEmptyRecord
+	}
+	ar := &netlink.ArchivalRecord{
+		Timestamp: s.Timestamp,
+		RawIDM:    structBytes(unsafe.Pointer(s.InetDiagMsg), unsafe.Sizeof(*s.InetDiagMsg), nil),
+	}
+	// Observed covers types 1 to 32, but there may be raw attributes beyond them.
+	n := len(s.attributes)
+	for t := n; t <= 32; t++ {
+		if s.Has(t) {
+			n = t + 1
+		}
+	}
+	if n == 0 {
+		return ar, nil
+	}
+	ar.Attributes = make([][]byte, n)
+	for t := range ar.Attributes {
+		var raw []byte
+		if t < len(s.attributes) {
+			raw = s.attributes[t]
+		}
+		if s.Has(t) && s.NotFullyParsed&(1<<uint(t-1)) == 0 {
+			if v := s.encodeAttribute(t, raw); v != nil {
+				ar.Attributes[t] = v
+				continue
+			}
+		}
+		if raw == nil && s.Has(t) {
+			return nil, fmt.Errorf("attribute %d can't be encoded, since it was not decoded from a record", t)
+		}
+		if raw != nil {
+			ar.Attributes[t] = append([]byte{}, raw...)
+		}
+	}
+	return ar, nil
+}
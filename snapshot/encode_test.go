@@ -0,0 +1,98 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"unsafe"
+
+	"github.com/go-test/deep"
+	"github.com/m-lab/go/rtx"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+// attribute returns the attribute of type t, or nil if there is none.
+func attribute(ar *netlink.ArchivalRecord, t int) []byte {
+	if t >= len(ar.Attributes) {
+		return nil
+	}
+	return ar.Attributes[t]
+}
+
+func TestToArchivalRecordRoundTrip(t *testing.T) {
+	for _, source := range []string{"testdata/archiveRecords.zst", "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"} {
+		rdr := zstd.NewReader(source)
+		arReader := netlink.NewArchiveReader(rdr)
+		count := 0
+		for {
+			ar, err := arReader.Next()
+			if err == io.EOF {
+				break
+			}
+			rtx.Must(err, "Could not read record")
+			if ar.RawIDM == nil {
+				continue // Metadata only.
+			}
+			_, snap, err := snapshot.Decode(ar)
+			rtx.Must(err, "Could not decode record")
+			got, err := snapshot.ToArchivalRecord(snap)
+			rtx.Must(err, "Could not encode snapshot")
+			if !got.Timestamp.Equal(ar.Timestamp) || !bytes.Equal(got.RawIDM, ar.RawIDM) {
+				t.Fatalf("%s record %d: wrong Timestamp or RawIDM", source, count)
+			}
+			for i := 0; i < len(got.Attributes) || i < len(ar.Attributes); i++ {
+				if !bytes.Equal(attribute(got, i), attribute(ar, i)) {
+					t.Fatalf("%s record %d: attribute %d is %v, want %v", source, count, i, attribute(got, i), attribute(ar, i))
+				}
+			}
+			_, again, err := snapshot.Decode(got)
+			rtx.Must(err, "Could not decode encoded snapshot")
+			if diff := deep.Equal(again, snap); diff != nil {
+				t.Fatalf("%s record %d: round trip changed the snapshot: %v", source, count, diff)
+			}
+			count++
+		}
+		rdr.Close()
+		if count == 0 {
+			t.Error("No records in", source)
+		}
+	}
+}
+
+func TestToArchivalRecordChanges(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_MARK+1),
+	}
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = make([]byte, unsafe.Sizeof(tcp.LinuxTCPInfo{}))
+	ar.Attributes[inetdiag.INET_DIAG_TOS] = []byte{0}
+	ar.Attributes[inetdiag.INET_DIAG_CONG] = []byte("cubic\x00")
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{1, 0, 0, 0}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+
+	// Changes to modeled fields are encoded.
+	snap.InetDiagMsg.IDiagState = uint8(tcp.FIN_WAIT1)
+	snap.TCPInfo.RTT = 12345
+	snap.TOS = 0x12
+	snap.CongestionAlgorithm = "bbr"
+	snap.Mark = 7
+	got, err := snapshot.ToArchivalRecord(snap)
+	rtx.Must(err, "Could not encode snapshot")
+	_, again, err := snapshot.Decode(got)
+	rtx.Must(err, "Could not decode encoded snapshot")
+	if again.StateName != tcp.NamedState(tcp.FIN_WAIT1) || again.TCPInfo.RTT != 12345 || again.TOS != 0x12 ||
+		again.CongestionAlgorithm != "bbr" || again.Mark != 7 || again.Observed != snap.Observed {
+		t.Errorf("Changes were not encoded: %+v", again)
+	}
+
+	// Snapshots of metadata can't be encoded.
+	if _, err := snapshot.ToArchivalRecord(&snapshot.Snapshot{}); err != snapshot.ErrEmptyRecord {
+		t.Error("Expected ErrEmptyRecord, got", err)
+	}
+}
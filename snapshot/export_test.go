@@ -0,0 +1,5 @@
+package snapshot
+
+import "sync"
+
+func ResetLargeTCPInfoLog() { largeTCPInfoLog = sync.Once{} }
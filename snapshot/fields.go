@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// csvMarshaler is implemented by the LinuxSockID field types, which marshal
+// themselves for CSV output.
+type csvMarshaler interface {
+	MarshalCSV() (string, error)
+}
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	csvMarshalerType = reflect.TypeOf((*csvMarshaler)(nil)).Elem()
+)
+
+// visitFields walks the struct v in the same order, and with the same names, as
+// the columns that gocsv produces.  Nested structs are flattened, and nil struct
+// pointers (e.g. absent attributes) are skipped.  The visit function is called
+// with the column name and value of every leaf field.
+func visitFields(v reflect.Value, visit func(name string, field reflect.Value)) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		field := v.Field(i)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if isLeaf(ft) {
+			name := strings.Split(sf.Tag.Get("csv"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			visit(name, field)
+			continue
+		}
+		// gocsv ignores the "-" tag on struct fields, and flattens them.
+		visitFields(field, visit)
+	}
+}
+
+// isLeaf returns true if values of type t are written as a single CSV column.
+func isLeaf(t reflect.Type) bool {
+	return t.Kind() != reflect.Struct || t == timeType || reflect.PtrTo(t).Implements(csvMarshalerType)
+}
+
+// fieldString returns the CSV representation of a leaf field.
+func fieldString(field reflect.Value) string {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return ""
+		}
+		field = field.Elem()
+	}
+	if field.CanAddr() {
+		if m, ok := field.Addr().Interface().(csvMarshaler); ok {
+			s, _ := m.MarshalCSV()
+			return s
+		}
+	}
+	if t, ok := field.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(field.Interface())
+}
@@ -0,0 +1,49 @@
+package snapshot
+
+import (
+	"reflect"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// flatAttributes maps the top level columns that are zero when absent to the
+// attribute they are decoded from.
+var flatAttributes = map[string]int{
+	"CongestionAlgorithm": inetdiag.INET_DIAG_CONG,
+	"TOS":                 inetdiag.INET_DIAG_TOS,
+	"TClass":              inetdiag.INET_DIAG_TCLASS,
+	"ClassID":             inetdiag.INET_DIAG_CLASS_ID,
+	"Shutdown":            inetdiag.INET_DIAG_SHUTDOWN,
+	"Protocol":            inetdiag.INET_DIAG_PROTOCOL,
+	"Mark":                inetdiag.INET_DIAG_MARK,
+}
+
+// Flatten returns the Snapshot as a flat map, keyed by the CSV column names,
+// e.g. TCP.RTT, IDM.State and MemInfo.Rmem, so that it can be marshaled to JSON
+// without the nesting of the Snapshot structs.  Columns from absent attributes,
+// according to Observed, are omitted.  Numbers and booleans keep their types,
+// and the socket ID fields and StateName have their CSV representations.
+func (s *Snapshot) Flatten() map[string]interface{} {
+	flat := map[string]interface{}{}
+	dsPresent := s.Has(inetdiag.INET_DIAG_TOS) || s.Has(inetdiag.INET_DIAG_TCLASS)
+	visitFields(reflect.ValueOf(s), func(name string, field reflect.Value) {
+		if attr, ok := flatAttributes[name]; ok && !s.Has(attr) {
+			return
+		}
+		if (name == "DSCP" || name == "ECN") && !dsPresent {
+			return
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				return
+			}
+			field = field.Elem()
+		}
+		if field.CanAddr() && field.Addr().Type().Implements(csvMarshalerType) {
+			flat[name] = fieldString(field)
+			return
+		}
+		flat[name] = field.Interface()
+	})
+	return flat
+}
@@ -0,0 +1,71 @@
+package snapshot_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gocarina/gocsv"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func TestSnapshot_Flatten(t *testing.T) {
+	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
+	rdr := zstd.NewReader(src)
+	defer rdr.Close()
+	_, all, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+	rtx.Must(err, "Could not load snapshots")
+	snap := all[1]
+
+	s, err := gocsv.MarshalString([]*snapshot.Snapshot{snap})
+	rtx.Must(err, "Could not marshal CSV")
+	rows, err := csv.NewReader(strings.NewReader(s)).ReadAll()
+	rtx.Must(err, "Could not read CSV")
+	columns := map[string]string{}
+	for i, name := range rows[0] {
+		columns[name] = rows[1][i]
+	}
+
+	if want := snap.TCPInfo.CongestionAvoidanceState().String(); columns["TCP.CAStateName"] != want {
+		t.Errorf("CSV TCP.CAStateName = %q, want %q", columns["TCP.CAStateName"], want)
+	}
+
+	flat := snap.Flatten()
+	for _, key := range []string{"IDM.SockID.Src", "IDM.SockID.DPort", "IDM.SockID.Cookie", "IDM.State", "IDM.StateName", "TCP.RTT", "TCP.State", "TCP.CAStateName", "MemInfo.Rmem", "CongestionAlgorithm"} {
+		v, ok := flat[key]
+		if !ok {
+			t.Errorf("Flatten() missing %q", key)
+			continue
+		}
+		if got := fmt.Sprint(v); got != columns[key] {
+			t.Errorf("Flatten()[%q] = %q, CSV has %q", key, got, columns[key])
+		}
+	}
+	if _, ok := flat["TCP.RTT"].(uint32); !ok {
+		t.Errorf("TCP.RTT should be a number, got %T", flat["TCP.RTT"])
+	}
+
+	// Columns of absent attributes are omitted.
+	for _, key := range []string{"BBR.BW", "Mark", "Protocol", "SKV6Only"} {
+		if _, ok := flat[key]; ok {
+			t.Errorf("Flatten() should omit %q", key)
+		}
+	}
+	if snap.Has(inetdiag.INET_DIAG_TOS) != (flat["TOS"] != nil) {
+		t.Error("TOS presence does not match Observed", flat["TOS"])
+	}
+
+	b, err := json.Marshal(flat)
+	rtx.Must(err, "Could not marshal flat snapshot")
+	var m map[string]interface{}
+	rtx.Must(json.Unmarshal(b, &m), "Could not unmarshal flat snapshot")
+	if m["IDM.SockID.Dst"] != "192.168.14.129" {
+		t.Errorf("JSON IDM.SockID.Dst = %v: %s", m["IDM.SockID.Dst"], b)
+	}
+}
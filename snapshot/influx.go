@@ -0,0 +1,71 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// LineProtocolMeasurement is the InfluxDB measurement written by WriteLineProtocol.
+const LineProtocolMeasurement = "tcp_info"
+
+// lineProtocolTags are the columns written as InfluxDB tags, which identify the
+// connection and its state.  They are sorted, as InfluxDB recommends.
+var lineProtocolTags = []string{
+	"IDM.SockID.Cookie", "IDM.SockID.DPort", "IDM.SockID.Dst", "IDM.SockID.SPort", "IDM.SockID.Src", "IDM.StateName",
+}
+
+// lineProtocolFields are the columns written as InfluxDB fields, sorted.
+var lineProtocolFields = []string{
+	"TCP.BytesAcked", "TCP.BytesReceived", "TCP.BytesRetrans", "TCP.BytesSent", "TCP.DeliveryRate", "TCP.MinRTT",
+	"TCP.RTT", "TCP.RTTVar", "TCP.SndCwnd", "TCP.TotalRetrans",
+}
+
+// Escapers for the special characters of each part of a line.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// WriteLineProtocol writes the Snapshot to w as a line of InfluxDB line
+// protocol, in the tcp_info measurement, with the Snapshot's Timestamp in
+// nanoseconds.  The endpoints, cookie and state are tags, and the RTTs,
+// congestion window, byte counts, retransmissions and delivery rate are integer
+// fields, all named as their CSV columns, e.g. TCP.RTT.  Nothing is written for
+// snapshots without TCPInfo, since a line needs at least one field.
+func (s *Snapshot) WriteLineProtocol(w io.Writer) error {
+	if s.TCPInfo == nil {
+		return nil
+	}
+	flat := s.Flatten()
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(LineProtocolMeasurement))
+	for _, name := range lineProtocolTags {
+		value, ok := flat[name].(string)
+		if !ok || value == "" {
+			continue // Empty tag values are not allowed.
+		}
+		fmt.Fprintf(&b, ",%s=%s", tagEscaper.Replace(name), tagEscaper.Replace(value))
+	}
+	sep := " "
+	for _, name := range lineProtocolFields {
+		v, ok := flat[name]
+		if !ok {
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fmt.Fprintf(&b, "%s%s=%di", sep, tagEscaper.Replace(name), rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fmt.Fprintf(&b, "%s%s=%di", sep, tagEscaper.Replace(name), rv.Uint())
+		default:
+			continue
+		}
+		sep = ","
+	}
+	fmt.Fprintf(&b, " %d\n", s.Timestamp.UnixNano())
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,35 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func TestSnapshot_WriteLineProtocol(t *testing.T) {
+	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
+	rdr := zstd.NewReader(src)
+	defer rdr.Close()
+	_, all, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+	rtx.Must(err, "Could not load snapshots")
+
+	var buf bytes.Buffer
+	rtx.Must(all[1].WriteLineProtocol(&buf), "Could not write line protocol")
+	want := "tcp_info,IDM.SockID.Cookie=3E8,IDM.SockID.DPort=43508,IDM.SockID.Dst=192.168.14.129,IDM.SockID.SPort=9091,IDM.SockID.Src=192.168.14.134,IDM.StateName=ESTABLISHED " +
+		"TCP.BytesAcked=4954605i,TCP.BytesReceived=372051i,TCP.BytesRetrans=6695i,TCP.BytesSent=4961300i,TCP.DeliveryRate=21681i," +
+		"TCP.MinRTT=125640i,TCP.RTT=125762i,TCP.RTTVar=86i,TCP.SndCwnd=3i,TCP.TotalRetrans=5i 1554215557511000000\n"
+	if buf.String() != want {
+		t.Errorf("WriteLineProtocol() =\n%q, want\n%q", buf.String(), want)
+	}
+
+	// The header has no TCPInfo, and so no fields, so nothing is written.
+	buf.Reset()
+	rtx.Must(all[0].WriteLineProtocol(&buf), "Could not write line protocol")
+	if buf.Len() != 0 {
+		t.Error("Nothing should be written for a snapshot without TCPInfo:", buf.String())
+	}
+}
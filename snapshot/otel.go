@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// OpenTelemetry severity number for INFO level log records.
+const otelSeverityInfo = 9
+
+// OTelLogRecord is the OpenTelemetry log data model representation of a
+// Snapshot, using the OTLP/JSON field names, so that snapshots can be fed
+// directly to OpenTelemetry collectors.
+type OTelLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"` // OTLP/JSON encodes 64 bit integers as strings.
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           OTelAnyValue   `json:"body"`
+	Attributes     []OTelKeyValue `json:"attributes"`
+}
+
+// OTelKeyValue is a single OpenTelemetry attribute.
+type OTelKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTelAnyValue `json:"value"`
+}
+
+// OTelAnyValue holds either a string or an integer attribute value.
+type OTelAnyValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+// OTelLogRecord maps the Snapshot onto an OpenTelemetry log record.  The
+// attributes use the same names as the CSV columns, e.g. IDM.SockID.Src, and
+// absent netlink attributes are omitted.
+func (s *Snapshot) OTelLogRecord() *OTelLogRecord {
+	rec := &OTelLogRecord{
+		TimeUnixNano:   strconv.FormatInt(s.Timestamp.UnixNano(), 10),
+		SeverityNumber: otelSeverityInfo,
+		SeverityText:   "INFO",
+		Body:           OTelAnyValue{StringValue: "tcpinfo snapshot"},
+	}
+	visitFields(reflect.ValueOf(s), func(name string, field reflect.Value) {
+		if field.Type() == timeType {
+			return // Already in TimeUnixNano.
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				return
+			}
+			field = field.Elem()
+		}
+		var value OTelAnyValue
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			value.IntValue = strconv.FormatInt(field.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value.IntValue = strconv.FormatUint(field.Uint(), 10)
+		default:
+			value.StringValue = fieldString(field)
+			if value.StringValue == "" {
+				return
+			}
+		}
+		rec.Attributes = append(rec.Attributes, OTelKeyValue{Key: name, Value: value})
+	})
+	return rec
+}
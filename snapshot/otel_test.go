@@ -0,0 +1,62 @@
+package snapshot_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/tcp-info/netlink"
+	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/zstd"
+)
+
+func TestSnapshot_OTelLogRecord(t *testing.T) {
+	src := "testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst"
+	rdr := zstd.NewReader(src)
+	defer rdr.Close()
+	_, all, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+	rtx.Must(err, "Could not load snapshots")
+
+	b, err := json.Marshal(all[1].OTelLogRecord())
+	rtx.Must(err, "Could not marshal log record")
+
+	var rec map[string]interface{}
+	rtx.Must(json.Unmarshal(b, &rec), "Could not unmarshal log record")
+	for _, f := range []string{"timeUnixNano", "severityNumber", "severityText", "body", "attributes"} {
+		if _, ok := rec[f]; !ok {
+			t.Errorf("OTelLogRecord() missing required field %q: %s", f, b)
+		}
+	}
+	if rec["timeUnixNano"] != "1554215557511000000" {
+		t.Error("Wrong timeUnixNano", rec["timeUnixNano"])
+	}
+
+	attrs := map[string]map[string]interface{}{}
+	for _, a := range rec["attributes"].([]interface{}) {
+		kv := a.(map[string]interface{})
+		attrs[kv["key"].(string)] = kv["value"].(map[string]interface{})
+	}
+	tests := []struct {
+		key, kind, want string
+	}{
+		{"IDM.SockID.Src", "stringValue", "192.168.14.134"},
+		{"IDM.SockID.SPort", "stringValue", "9091"},
+		{"IDM.SockID.Dst", "stringValue", "192.168.14.129"},
+		{"IDM.SockID.DPort", "stringValue", "43508"},
+		{"IDM.SockID.Cookie", "stringValue", "3E8"},
+		{"TCP.State", "intValue", "1"},
+	}
+	for _, tt := range tests {
+		v, ok := attrs[tt.key]
+		if !ok {
+			t.Errorf("Missing attribute %q", tt.key)
+			continue
+		}
+		if v[tt.kind] != tt.want {
+			t.Errorf("Attribute %q = %v, want {%s: %s}", tt.key, v, tt.kind, tt.want)
+		}
+	}
+	if _, ok := attrs["Timestamp"]; ok {
+		t.Error("Timestamp should not be repeated in the attributes")
+	}
+}
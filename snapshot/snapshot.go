@@ -3,10 +3,14 @@
 package snapshot
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -25,9 +29,28 @@ var missingDecodeLog = logx.NewLogEvery(nil, time.Second)
 // Decode decodes a netlink.ArchivalRecord into a single Snapshot
 // Initial ArchivalRecord may have just a Snapshot, just Metadata, or both.
 func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
+	return DecodeWith(ar, DecodeOptions{})
+}
+
+// DecodeOptions selects the optional fields filled in by DecodeWith.
+type DecodeOptions struct {
+	// RecordAttributeLengths records the payload length of every attribute in
+	// Snapshot.AttributeLengths, e.g. to diagnose attributes that have grown in
+	// newer kernels.  It costs an allocation per snapshot.
+	RecordAttributeLengths bool
+
+	// RetainTCPInfoTail keeps the bytes of INET_DIAG_INFO beyond the end of
+	// LinuxTCPInfo in Snapshot.TCPInfoTail, so that the fields added by newer
+	// kernels are not lost before LinuxTCPInfo is updated.
+	RetainTCPInfoTail bool
+}
+
+// DecodeWith is like Decode, but also fills in the fields selected by opts.
+func DecodeWith(ar *netlink.ArchivalRecord, opts DecodeOptions) (*netlink.Metadata, *Snapshot, error) {
 	var err error
 	result := Snapshot{}
 	result.Timestamp = ar.Timestamp
+	result.attributes = ar.Attributes
 	if ar.Metadata == nil && ar.RawIDM == nil {
 		return nil, nil, ErrEmptyRecord
 	}
@@ -37,57 +60,29 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 			log.Println("Error decoding RawIDM:", err)
 			return nil, nil, err
 		}
+		result.StateName = tcp.NamedState(result.InetDiagMsg.IDiagState)
 	}
 	for t, raw := range ar.Attributes {
 		if raw == nil {
 			continue
 		}
-		rta := RouteAttrValue(raw)
+		if opts.RecordAttributeLengths {
+			if result.AttributeLengths == nil {
+				result.AttributeLengths = make(map[int]int)
+			}
+			result.AttributeLengths[t] = len(raw)
+		}
 		ok := false
-		switch t {
-		case inetdiag.INET_DIAG_MEMINFO:
-			result.MemInfo, ok = rta.toMemInfo()
-		case inetdiag.INET_DIAG_INFO:
-			result.TCPInfo, ok = rta.toLinuxTCPInfo()
-		case inetdiag.INET_DIAG_VEGASINFO:
-			result.VegasInfo, ok = rta.toVegasInfo()
-		case inetdiag.INET_DIAG_CONG:
-			result.CongestionAlgorithm, ok = rta.CongestionAlgorithm()
-		case inetdiag.INET_DIAG_TOS:
-			result.TOS, ok = rta.toTOS()
-		case inetdiag.INET_DIAG_TCLASS:
-			result.TClass, ok = rta.toTCLASS()
-		case inetdiag.INET_DIAG_SKMEMINFO:
-			result.SocketMem, ok = rta.toSockMemInfo()
-		case inetdiag.INET_DIAG_SHUTDOWN:
-			result.Shutdown, ok = rta.toShutdown()
-		case inetdiag.INET_DIAG_DCTCPINFO:
-			result.DCTCPInfo, ok = rta.toDCTCPInfo()
-		case inetdiag.INET_DIAG_PROTOCOL:
-			result.Protocol, ok = rta.toProtocol()
-		case inetdiag.INET_DIAG_SKV6ONLY:
-			metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_SKV6ONLY").Inc()
-			missingDecodeLog.Println("SKV6ONLY not handled", len(rta))
-		case inetdiag.INET_DIAG_LOCALS:
-			metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_LOCALS").Inc()
-			missingDecodeLog.Println("LOCAL not handled", len(rta))
-		case inetdiag.INET_DIAG_PEERS:
-			metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_PEERS").Inc()
-			missingDecodeLog.Println("PEERS not handled", len(rta))
-		case inetdiag.INET_DIAG_PAD:
-			metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_PAD").Inc()
-			missingDecodeLog.Println("PAD not handled", len(rta))
-		case inetdiag.INET_DIAG_MARK:
-			result.Mark, ok = rta.toMark()
-		case inetdiag.INET_DIAG_BBRINFO:
-			result.BBRInfo, ok = rta.toBBRInfo()
-		case inetdiag.INET_DIAG_CLASS_ID:
-			result.ClassID, ok = rta.toClassID()
-		case inetdiag.INET_DIAG_MD5SIG:
-			missingDecodeLog.Println("MD5SIGnot handled", len(rta))
-		default:
-			metrics.NetlinkNotDecoded.WithLabelValues(fmt.Sprint(t)).Inc()
-			missingDecodeLog.Println("unhandled attribute type:", t)
+		if decode, found := decoders[t]; found {
+			ok = decode(&result, RouteAttrValue(raw), opts)
+		} else {
+			// Known types are labeled by their constant name, e.g. INET_DIAG_LOCALS.
+			name := fmt.Sprint(t)
+			if n, known := inetdiag.InetDiagType[int32(t)]; known {
+				name = "INET_DIAG_" + strings.ToUpper(n)
+			}
+			metrics.NetlinkNotDecoded.WithLabelValues(name).Inc()
+			missingDecodeLog.Println(name, "not handled", len(raw))
 		}
 		bit := uint32(1) << uint8(t-1)
 		result.Observed |= bit
@@ -95,9 +90,159 @@ func Decode(ar *netlink.ArchivalRecord) (*netlink.Metadata, *Snapshot, error) {
 			result.NotFullyParsed |= bit
 		}
 	}
+	ds := result.TOS
+	if result.Has(inetdiag.INET_DIAG_TCLASS) {
+		ds = result.TClass
+	}
+	result.DSCP, result.ECN = DSCP(ds), ECN(ds)
+	result.MarkPresent = result.HasMark()
+	if result.TCPInfo != nil {
+		ca := tcp.NamedCAState(result.TCPInfo.CongestionAvoidanceState())
+		result.CAStateName = &ca
+		result.TCPOptions = newTCPOptions(result.TCPInfo)
+	}
 	return ar.Metadata, &result, nil
 }
 
+// DecodeLine decodes a single line of a JSONL connection file, e.g. for
+// consumers tailing a file that is still being written.  For the header line,
+// it returns just the Metadata, and a nil Snapshot.  A trailing newline is
+// allowed.
+func DecodeLine(line []byte) (*netlink.Metadata, *Snapshot, error) {
+	ar := netlink.ArchivalRecord{}
+	if err := json.Unmarshal(line, &ar); err != nil {
+		return nil, nil, err
+	}
+	if ar.RawIDM == nil && ar.Metadata != nil {
+		return ar.Metadata, nil, nil
+	}
+	return Decode(&ar)
+}
+
+// attributeDecoder decodes a single attribute into the Snapshot, and returns
+// whether it was fully parsed.
+type attributeDecoder func(s *Snapshot, rta RouteAttrValue, opts DecodeOptions) bool
+
+// decoders has the decoder for each attribute type that Decode parses.  Decode
+// skips any other attribute, and marks it in NotFullyParsed.
+var decoders = map[int]attributeDecoder{
+	inetdiag.INET_DIAG_MEMINFO: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.MemInfo, ok = rta.toMemInfo()
+		return ok
+	},
+	inetdiag.INET_DIAG_INFO: decodeTCPInfo,
+	inetdiag.INET_DIAG_VEGASINFO: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.VegasInfo, ok = rta.toVegasInfo()
+		return ok
+	},
+	inetdiag.INET_DIAG_CONG: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.CongestionAlgorithm, ok = rta.CongestionAlgorithm()
+		return ok
+	},
+	inetdiag.INET_DIAG_TOS: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.TOS, ok = rta.toTOS()
+		return ok
+	},
+	inetdiag.INET_DIAG_TCLASS: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.TClass, ok = rta.toTCLASS()
+		return ok
+	},
+	inetdiag.INET_DIAG_SKMEMINFO: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.SocketMem, ok = rta.toSockMemInfo()
+		return ok
+	},
+	inetdiag.INET_DIAG_SHUTDOWN: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.Shutdown, ok = rta.toShutdown()
+		return ok
+	},
+	inetdiag.INET_DIAG_DCTCPINFO: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.DCTCPInfo, ok = rta.toDCTCPInfo()
+		return ok
+	},
+	inetdiag.INET_DIAG_PROTOCOL: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.Protocol, ok = rta.toProtocol()
+		return ok
+	},
+	inetdiag.INET_DIAG_SKV6ONLY: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) bool {
+		// A malformed attribute is left absent, rather than reported as false.
+		v6only, ok := rta.toSKV6Only()
+		if ok {
+			s.SKV6Only = &v6only
+		}
+		return ok
+	},
+	inetdiag.INET_DIAG_PAD: func(*Snapshot, RouteAttrValue, DecodeOptions) bool {
+		// Just alignment padding, so there is nothing to decode.
+		return true
+	},
+	inetdiag.INET_DIAG_MARK: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.Mark, ok = rta.toMark()
+		return ok
+	},
+	inetdiag.INET_DIAG_BBRINFO: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.BBRInfo, ok = rta.toBBRInfo()
+		return ok
+	},
+	inetdiag.INET_DIAG_CLASS_ID: func(s *Snapshot, rta RouteAttrValue, _ DecodeOptions) (ok bool) {
+		s.ClassID, ok = rta.toClassID()
+		return ok
+	},
+}
+
+// decodeTCPInfo decodes INET_DIAG_INFO, which is only a tcp_info for TCP sockets.
+func decodeTCPInfo(s *Snapshot, rta RouteAttrValue, opts DecodeOptions) bool {
+	if p, nonTCP := nonTCPProtocol(s.attributes); nonTCP {
+		// Not a tcp_info, so it is only kept raw, and marked NotFullyParsed.
+		name, known := inetdiag.ProtocolName[int32(p)]
+		if !known {
+			name = fmt.Sprint(p)
+		}
+		metrics.NonTCPInfoCount.WithLabelValues(name).Inc()
+		return false
+	}
+	var ok bool
+	s.TCPInfo, ok = rta.toLinuxTCPInfo()
+	if size := int(unsafe.Sizeof(tcp.LinuxTCPInfo{})); len(rta) > size {
+		extra := "ignored"
+		if opts.RetainTCPInfoTail {
+			s.TCPInfoTail = append([]byte(nil), rta[size:]...)
+			extra = "kept in TCPInfoTail"
+		}
+		// The kernel is the same for every snapshot, so once is enough.
+		largeTCPInfoLog.Do(func() {
+			log.Printf("WARNING: tcp_info is %d bytes larger than LinuxTCPInfo, and the extra fields are %s",
+				len(rta)-size, extra)
+		})
+	}
+	return ok
+}
+
+var largeTCPInfoLog sync.Once
+
+// SupportedAttributes returns every INET_DIAG attribute type below
+// INET_DIAG_MAX, mapped to true if Decode parses it into the Snapshot, or false
+// if Decode skips it, and marks it in NotFullyParsed.  Skipped attributes are
+// also counted in the NetlinkNotDecoded metric.
+func SupportedAttributes() map[int]bool {
+	attrs := make(map[int]bool, inetdiag.INET_DIAG_MAX)
+	for t := inetdiag.INET_DIAG_MEMINFO; t < inetdiag.INET_DIAG_MAX; t++ {
+		_, attrs[t] = decoders[t]
+	}
+	return attrs
+}
+
+// FromNetlinkMessage converts a raw NetlinkMessage, such as those returned by
+// collector.OneType, directly into a Snapshot.  It returns nil, nil if the
+// message is excluded by the ExcludeConfig.
+func FromNetlinkMessage(msg *netlink.NetlinkMessage, exclude *netlink.ExcludeConfig) (*Snapshot, error) {
+	ar, err := netlink.MakeArchivalRecord(msg, exclude)
+	if ar == nil || err != nil {
+		return nil, err
+	}
+	_, snap, err := Decode(ar)
+	return snap, err
+}
+
 /*********************************************************************************************/
 /*          Conversions from RouteAttr.Value to various tcp and inetdiag structs             */
 /*********************************************************************************************/
@@ -138,9 +283,6 @@ func (raw RouteAttrValue) toMemInfo() (*inetdiag.MemInfo, bool) {
 func (raw RouteAttrValue) toLinuxTCPInfo() (*tcp.LinuxTCPInfo, bool) {
 	structSize := (int)(unsafe.Sizeof(tcp.LinuxTCPInfo{}))
 	data, ok := maybeCopy(raw, structSize, "TCPInfo")
-	if !ok {
-		oneSecondLog.Println("tcpinfo data is larger than struct")
-	}
 	return (*tcp.LinuxTCPInfo)(data), ok
 }
 
@@ -166,6 +308,18 @@ func (raw RouteAttrValue) toUint8() (uint8, bool) {
 	return uint8(raw[0]), true
 }
 
+// DSCP returns the Differentiated Services Code Point, the upper six bits of a
+// TOS or TClass octet.  See https://tools.ietf.org/html/rfc2474
+func DSCP(octet uint8) uint8 {
+	return octet >> 2
+}
+
+// ECN returns the Explicit Congestion Notification field, the lower two bits of
+// a TOS or TClass octet.  See https://tools.ietf.org/html/rfc3168
+func ECN(octet uint8) uint8 {
+	return octet & 0x3
+}
+
 // toTOS marshals the TCP Type Of Service field.  See https://tools.ietf.org/html/rfc3168
 func (raw RouteAttrValue) toTOS() (uint8, bool) {
 	return raw.toUint8()
@@ -206,6 +360,23 @@ func (raw RouteAttrValue) toProtocol() (inetdiag.Protocol, bool) {
 	return inetdiag.Protocol(p), ok
 }
 
+// nonTCPProtocol returns the protocol from the INET_DIAG_PROTOCOL attribute,
+// and whether it is present and names a protocol other than TCP, e.g. UDP or
+// DCCP, whose INET_DIAG_INFO is not a tcp_info.
+func nonTCPProtocol(attrs [][]byte) (inetdiag.Protocol, bool) {
+	if len(attrs) <= inetdiag.INET_DIAG_PROTOCOL || attrs[inetdiag.INET_DIAG_PROTOCOL] == nil {
+		return inetdiag.Protocol_IPPROTO_UNUSED, false
+	}
+	p, ok := RouteAttrValue(attrs[inetdiag.INET_DIAG_PROTOCOL]).toProtocol()
+	return p, ok && p != inetdiag.Protocol_IPPROTO_TCP && p != inetdiag.Protocol_IPPROTO_UNUSED
+}
+
+// toSKV6Only returns the IPV6_V6ONLY socket option flag.
+func (raw RouteAttrValue) toSKV6Only() (bool, bool) {
+	v, ok := raw.toUint8()
+	return v != 0, ok && len(raw) == 1
+}
+
 func (raw RouteAttrValue) toMark() (uint32, bool) {
 	if raw == nil || len(raw) != 4 {
 		return 0, false
@@ -240,18 +411,22 @@ type Snapshot struct {
 	CongestionAlgorithm string `csv:",omitempty"`
 
 	// See https://tools.ietf.org/html/rfc3168
-	// TODO Do we need to record whether these are present and zero, vs absent?
+	// These are zero when absent.  Use TOSValue, TClassValue and ClassIDValue
+	// to distinguish present and zero from absent.
 	TOS     uint8 `csv:",omitempty"`
 	TClass  uint8 `csv:",omitempty"`
 	ClassID uint8 `csv:",omitempty"`
 
-	// TODO Do we need to record present and zero, vs absent?
+	// Zero when absent.  Use ShutdownValue to distinguish present and zero.
 	Shutdown uint8 `csv:",omitempty"`
 
-	// From INET_DIAG_PROTOCOL message.
-	// TODO Do we need to record present and zero, vs absent?
+	// From INET_DIAG_PROTOCOL message.  Use ProtocolValue to distinguish
+	// present and zero from absent.
 	Protocol inetdiag.Protocol `csv:",omitempty"`
 
+	// From INET_DIAG_MARK, which the kernel only sends to CAP_NET_ADMIN callers.
+	// Zero when absent.  MarkPresent, or HasMark, distinguishes present and zero,
+	// including in CSV output, where a zero Mark is empty.
 	Mark uint32 `csv:",omitempty"`
 
 	// TCPInfo contains data from struct tcp_info.
@@ -266,6 +441,206 @@ type Snapshot struct {
 	VegasInfo *inetdiag.VegasInfo `csv:"-"`
 	DCTCPInfo *inetdiag.DCTCPInfo `csv:"-"`
 	BBRInfo   *inetdiag.BBRInfo   `csv:"-"`
+
+	// The bytes of INET_DIAG_INFO beyond the end of TCPInfo, from a kernel with
+	// a larger tcp_info.  Nil unless DecodeOptions.RetainTCPInfoTail is set.
+	TCPInfoTail []byte `csv:"-" json:",omitempty"`
+
+	// The payload length of each attribute, by type, for debugging.  Nil unless
+	// DecodeOptions.RecordAttributeLengths is set.
+	AttributeLengths map[int]int `csv:"-" json:",omitempty"`
+
+	// Fields below were added after the original CSV columns.  New columns go
+	// at the end, so that existing columns keep their positions.
+
+	// The name of InetDiagMsg.IDiagState, for readable output.
+	StateName tcp.NamedState `csv:"IDM.StateName"`
+
+	// The DSCP and ECN fields of TClass for IPv6 sockets, or of TOS otherwise.
+	DSCP uint8 `csv:",omitempty"`
+	ECN  uint8 `csv:",omitempty"`
+
+	// Whether INET_DIAG_MARK was present, so that a zero Mark can be told apart
+	// from an absent one.
+	MarkPresent bool
+
+	// From INET_DIAG_SKV6ONLY message.  Nil if the attribute is absent or malformed.
+	SKV6Only *bool `csv:",omitempty"`
+
+	// The options in TCPInfo.Options.  Nil if there is no TCPInfo.
+	TCPOptions *TCPOptions `csv:"-"`
+
+	// The name of TCPInfo.CAState, for readable output.  Nil if there is no TCPInfo.
+	CAStateName *tcp.NamedCAState `csv:"TCP.CAStateName"`
+
+	// The raw attribute values, shared with the decoded ArchivalRecord.
+	attributes [][]byte
+}
+
+// TCPOptions are the TCP options negotiated for a connection, decoded from the
+// TCPI_OPT_* bits of LinuxTCPInfo.Options.
+type TCPOptions struct {
+	Timestamps bool `csv:"TCP.Options.Timestamps"`
+	SACK       bool `csv:"TCP.Options.SACK"`
+	WScale     bool `csv:"TCP.Options.WScale"`
+	ECN        bool `csv:"TCP.Options.ECN"`
+	ECNSeen    bool `csv:"TCP.Options.ECNSeen"`
+	FastOpen   bool `csv:"TCP.Options.FastOpen"`
+}
+
+func newTCPOptions(info *tcp.LinuxTCPInfo) *TCPOptions {
+	return &TCPOptions{
+		Timestamps: info.TimestampsEnabled(),
+		SACK:       info.SACKEnabled(),
+		WScale:     info.WScaleEnabled(),
+		ECN:        info.ECNEnabled(),
+		ECNSeen:    info.ECNSeen(),
+		FastOpen:   info.FastOpenEnabled(),
+	}
+}
+
+// Attribute returns the raw value of the attribute of type t, e.g. one that
+// Decode does not yet parse, and whether it was present.  The value shares
+// memory with the ArchivalRecord it was decoded from, so it should not be
+// modified.
+func (s *Snapshot) Attribute(t int) ([]byte, bool) {
+	if t < 0 || t >= len(s.attributes) || s.attributes[t] == nil {
+		return nil, false
+	}
+	return s.attributes[t], true
+}
+
+// Has returns true if the attribute of type attr, e.g. inetdiag.INET_DIAG_TOS,
+// was present in the message, according to Observed.
+func (s *Snapshot) Has(attr int) bool {
+	if attr < 1 || attr > 32 {
+		return false
+	}
+	return s.Observed&(uint32(1)<<uint(attr-1)) != 0
+}
+
+// TOSValue returns the TOS, and whether the INET_DIAG_TOS attribute was present.
+func (s *Snapshot) TOSValue() (uint8, bool) {
+	return s.TOS, s.Has(inetdiag.INET_DIAG_TOS)
+}
+
+// TClassValue returns the TClass, and whether the INET_DIAG_TCLASS attribute was present.
+func (s *Snapshot) TClassValue() (uint8, bool) {
+	return s.TClass, s.Has(inetdiag.INET_DIAG_TCLASS)
+}
+
+// ClassIDValue returns the ClassID, and whether the INET_DIAG_CLASS_ID attribute was present.
+func (s *Snapshot) ClassIDValue() (uint8, bool) {
+	return s.ClassID, s.Has(inetdiag.INET_DIAG_CLASS_ID)
+}
+
+// ShutdownValue returns the Shutdown, and whether the INET_DIAG_SHUTDOWN attribute was present.
+func (s *Snapshot) ShutdownValue() (uint8, bool) {
+	return s.Shutdown, s.Has(inetdiag.INET_DIAG_SHUTDOWN)
+}
+
+// ProtocolValue returns the Protocol, and whether the INET_DIAG_PROTOCOL attribute was present.
+func (s *Snapshot) ProtocolValue() (inetdiag.Protocol, bool) {
+	return s.Protocol, s.Has(inetdiag.INET_DIAG_PROTOCOL)
+}
+
+// HasMark returns true if the INET_DIAG_MARK attribute was present and decoded.
+func (s *Snapshot) HasMark() bool {
+	bit := uint32(1) << (inetdiag.INET_DIAG_MARK - 1)
+	return s.Has(inetdiag.INET_DIAG_MARK) && s.NotFullyParsed&bit == 0
+}
+
+// MarkValue returns the Mark, and whether the INET_DIAG_MARK attribute was present.
+func (s *Snapshot) MarkValue() (uint32, bool) {
+	return s.Mark, s.HasMark()
+}
+
+// RWndLimitedFraction returns the fraction of BusyTime during which the connection
+// was limited by the peer's receive window.  It returns false if there is no TCPInfo,
+// or the connection has not been busy.
+func (s *Snapshot) RWndLimitedFraction() (float64, bool) {
+	if s.TCPInfo == nil {
+		return 0, false
+	}
+	return busyFraction(s.TCPInfo.RWndLimited, s.TCPInfo.BusyTime)
+}
+
+// SndBufLimitedFraction returns the fraction of BusyTime during which the connection
+// was limited by the local send buffer.  It returns false if there is no TCPInfo, or
+// the connection has not been busy.
+func (s *Snapshot) SndBufLimitedFraction() (float64, bool) {
+	if s.TCPInfo == nil {
+		return 0, false
+	}
+	return busyFraction(s.TCPInfo.SndBufLimited, s.TCPInfo.BusyTime)
+}
+
+func busyFraction(limited, busy int64) (float64, bool) {
+	if busy <= 0 {
+		return 0, false
+	}
+	return float64(limited) / float64(busy), true
+}
+
+// ActivityGaps is the time since the connection last sent data, received data,
+// and received an ACK, as of a snapshot.  The kernel does not track the time the
+// last ACK was sent, so LastAckSent is not used.
+type ActivityGaps struct {
+	DataSent time.Duration
+	DataRecv time.Duration
+	AckRecv  time.Duration
+}
+
+// ActivityGaps returns the elapsed times reported by the kernel in the
+// LastDataSent, LastDataRecv and LastAckRecv fields, which are in milliseconds.
+// It returns false if there is no TCPInfo.
+func (s *Snapshot) ActivityGaps() (ActivityGaps, bool) {
+	if s.TCPInfo == nil {
+		return ActivityGaps{}, false
+	}
+	return ActivityGaps{
+		DataSent: time.Duration(s.TCPInfo.LastDataSent) * time.Millisecond,
+		DataRecv: time.Duration(s.TCPInfo.LastDataRecv) * time.Millisecond,
+		AckRecv:  time.Duration(s.TCPInfo.LastAckRecv) * time.Millisecond,
+	}, true
+}
+
+// SamplingInterval estimates the time that elapsed between prev and s from the
+// kernel's elapsed time fields, which, unlike Timestamp, are not affected by
+// polling jitter.  If there was no activity of a given kind between the two
+// snapshots, its field grows by exactly the elapsed time.  If there was, the field
+// restarts from zero, and usually shrinks, so it is ignored.  Activity that shows
+// up as a smaller increase only makes the estimate smaller, so the largest increase
+// is a lower bound on the interval.  It returns false if either snapshot has no
+// TCPInfo, or if every kind of activity happened between them.
+//
+// The fields are 32 bit millisecond counters, so they wrap after about 49.7 days
+// of inactivity.  A field that wraps between the snapshots looks like new activity,
+// and is ignored.
+func (s *Snapshot) SamplingInterval(prev *Snapshot) (time.Duration, bool) {
+	gaps, ok := s.ActivityGaps()
+	if !ok {
+		return 0, false
+	}
+	prevGaps, ok := prev.ActivityGaps()
+	if !ok {
+		return 0, false
+	}
+	var interval time.Duration
+	found := false
+	for _, g := range [][2]time.Duration{
+		{gaps.DataSent, prevGaps.DataSent},
+		{gaps.DataRecv, prevGaps.DataRecv},
+		{gaps.AckRecv, prevGaps.AckRecv},
+	} {
+		if g[0] >= g[1] {
+			found = true
+			if g[0]-g[1] > interval {
+				interval = g[0] - g[1]
+			}
+		}
+	}
+	return interval, found
 }
 
 // ConnectionLog contains a Metadata and slice of Snapshots.
@@ -274,9 +649,141 @@ type ConnectionLog struct {
 	Snapshots []Snapshot
 }
 
+// GroupByCookie groups snapshots by the cookie of their connection, preserving
+// their order.  Snapshots without an InetDiagMsg, e.g. from metadata only
+// records, are omitted.
+func GroupByCookie(snaps []*Snapshot) map[uint64][]*Snapshot {
+	groups := make(map[uint64][]*Snapshot)
+	for _, snap := range snaps {
+		if snap == nil || snap.InetDiagMsg == nil {
+			continue
+		}
+		cookie := snap.InetDiagMsg.ID.Cookie()
+		groups[cookie] = append(groups[cookie], snap)
+	}
+	return groups
+}
+
+// ConnectionLogs splits snapshots, e.g. from LoadAll, into a ConnectionLog for
+// each connection, ordered by cookie, with each connection's snapshots sorted by
+// Timestamp.  The metadata, which may be nil, is copied into every log, but since
+// it only describes a single connection, each log's UUID is rewritten to use the
+// log's own cookie.
+func ConnectionLogs(meta *netlink.Metadata, snaps []*Snapshot) []ConnectionLog {
+	groups := GroupByCookie(snaps)
+	cookies := make([]uint64, 0, len(groups))
+	for cookie := range groups {
+		cookies = append(cookies, cookie)
+	}
+	sort.Slice(cookies, func(i, j int) bool { return cookies[i] < cookies[j] })
+
+	logs := make([]ConnectionLog, 0, len(cookies))
+	for _, cookie := range cookies {
+		cl := ConnectionLog{Snapshots: make([]Snapshot, 0, len(groups[cookie]))}
+		if meta != nil {
+			cl.Metadata = *meta
+			if i := strings.LastIndex(meta.UUID, "_"); i >= 0 {
+				cl.Metadata.UUID = fmt.Sprintf("%s_%016X", meta.UUID[:i], cookie)
+			}
+		}
+		for _, snap := range groups[cookie] {
+			cl.Snapshots = append(cl.Snapshots, *snap)
+		}
+		sort.SliceStable(cl.Snapshots, func(i, j int) bool {
+			return cl.Snapshots[i].Timestamp.Before(cl.Snapshots[j].Timestamp)
+		})
+		logs = append(logs, cl)
+	}
+	return logs
+}
+
+// LossRatePoint is the loss rate over the interval ending at Timestamp.
+type LossRatePoint struct {
+	Timestamp time.Time
+	LossRate  float64
+}
+
+// LossRateSeries computes the fraction of segments retransmitted in each
+// interval between successive snapshots, from the TotalRetrans and SegsOut
+// counters.  Each point is aligned to the snapshot that ends the interval.  The
+// first interval runs from the start of the connection, when both counters are
+// zero.  Snapshots without TCPInfo are skipped, and intervals in which no
+// segments were sent have a loss rate of zero.
+func (cl *ConnectionLog) LossRateSeries() []LossRatePoint {
+	series := make([]LossRatePoint, 0, len(cl.Snapshots))
+	var prevRetrans uint32
+	var prevSegs int32
+	for i := range cl.Snapshots {
+		info := cl.Snapshots[i].TCPInfo
+		if info == nil {
+			continue
+		}
+		point := LossRatePoint{Timestamp: cl.Snapshots[i].Timestamp}
+		segs := info.SegsOut - prevSegs
+		if segs > 0 && info.TotalRetrans > prevRetrans {
+			point.LossRate = float64(info.TotalRetrans-prevRetrans) / float64(segs)
+		}
+		series = append(series, point)
+		prevRetrans, prevSegs = info.TotalRetrans, info.SegsOut
+	}
+	return series
+}
+
+// RateSample is the average throughput over the Interval ending at Timestamp.
+type RateSample struct {
+	Timestamp      time.Time
+	Interval       time.Duration
+	SendBitsPerSec float64
+	RecvBitsPerSec float64
+}
+
+// Throughput computes the send and receive rates between consecutive snapshots of
+// a single connection, sorted by Timestamp, from the BytesSent and BytesReceived
+// counters.  Each sample is aligned to the snapshot that ends the interval.
+// Snapshots without TCPInfo, or with the same Timestamp as the previous one, are
+// skipped.  Like the saver's throughput metrics, if either counter decreases, which
+// should be impossible, the sample is skipped, and the next is measured from the
+// last good snapshot.
+func Throughput(snaps []*Snapshot) []RateSample {
+	series := make([]RateSample, 0, len(snaps))
+	var prev *Snapshot
+	for _, snap := range snaps {
+		if snap == nil || snap.TCPInfo == nil {
+			continue
+		}
+		if prev == nil {
+			prev = snap
+			continue
+		}
+		interval := snap.Timestamp.Sub(prev.Timestamp)
+		if interval <= 0 {
+			continue
+		}
+		// The kernel counters are uint64, though LinuxTCPInfo uses int64.
+		sent := uint64(snap.TCPInfo.BytesSent)
+		prevSent := uint64(prev.TCPInfo.BytesSent)
+		received := uint64(snap.TCPInfo.BytesReceived)
+		prevReceived := uint64(prev.TCPInfo.BytesReceived)
+		if sent < prevSent || received < prevReceived {
+			continue
+		}
+		series = append(series, RateSample{
+			Timestamp:      snap.Timestamp,
+			Interval:       interval,
+			SendBitsPerSec: 8 * float64(sent-prevSent) / interval.Seconds(),
+			RecvBitsPerSec: 8 * float64(received-prevReceived) / interval.Seconds(),
+		})
+		prev = snap
+	}
+	return series
+}
+
 // Reader wraps an ArchiveReader to provide a Snapshot reader.
 type Reader struct {
 	archiveReader netlink.ArchiveReader
+
+	// Options are passed to DecodeWith for every record.
+	Options DecodeOptions
 }
 
 // NewReader wraps an ArchiveReader and provides Next()
@@ -299,13 +806,19 @@ func (rdr Reader) Next() (*netlink.Metadata, *Snapshot, error) {
 		ar.Timestamp = time.Date(2009, time.May, 29, 23, 59, 59, 0, time.UTC)
 	}
 
-	return Decode(ar)
+	return DecodeWith(ar, rdr.Options)
 }
 
 // LoadAll loads all snapshots from an ArchiveReader, and returns the
 // metadata and slice of snapshots.  Metadata may be nil, or the last non-nil metadata record.
 func LoadAll(ar netlink.ArchiveReader) (*netlink.Metadata, []*Snapshot, error) {
+	return LoadAllWith(ar, DecodeOptions{})
+}
+
+// LoadAllWith is like LoadAll, but decodes the snapshots with opts.
+func LoadAllWith(ar netlink.ArchiveReader, opts DecodeOptions) (*netlink.Metadata, []*Snapshot, error) {
 	snapReader := NewReader(ar)
+	snapReader.Options = opts
 
 	// Read all the ParsedMessage and convert to Wrappers.
 	var metadata *netlink.Metadata
@@ -327,3 +840,36 @@ func LoadAll(ar netlink.ArchiveReader) (*netlink.Metadata, []*Snapshot, error) {
 
 	return metadata, snapshots, nil
 }
+
+// LoadAllLenient is like LoadAll, but skips records that cannot be read or
+// decoded instead of aborting.  It returns the metadata and good snapshots,
+// and a *netlink.SkippedRecordsError if any records were skipped.  The
+// ArchiveReader must make progress past bad records, as the JSONL reader does.
+func LoadAllLenient(ar netlink.ArchiveReader) (*netlink.Metadata, []*Snapshot, error) {
+	snapReader := NewReader(ar)
+
+	var metadata *netlink.Metadata
+	var skipped *netlink.SkippedRecordsError
+	snapshots := make([]*Snapshot, 0, 3000)
+	for {
+		meta, snap, err := snapReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if skipped == nil {
+				skipped = &netlink.SkippedRecordsError{First: err}
+			}
+			skipped.Count++
+			continue
+		}
+		if meta != nil {
+			metadata = meta
+		}
+		snapshots = append(snapshots, snap)
+	}
+	if skipped != nil {
+		return metadata, snapshots, skipped
+	}
+	return metadata, snapshots, nil
+}
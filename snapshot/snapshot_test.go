@@ -1,14 +1,26 @@
 package snapshot_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
 	"log"
+	"math"
+	"os"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/go-test/deep"
 	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/metrics"
 	"github.com/m-lab/tcp-info/netlink"
 	"github.com/m-lab/tcp-info/snapshot"
+	"github.com/m-lab/tcp-info/tcp"
 	"github.com/m-lab/tcp-info/zstd"
 )
 
@@ -149,3 +161,714 @@ func TestLoadAll(t *testing.T) {
 	}
 
 }
+
+func TestDecodeSKV6Only(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name        string
+		value       []byte
+		want        *bool
+		wantProblem bool
+	}{
+		{name: "v6only", value: []byte{1}, want: &yes},
+		{name: "dual-stack", value: []byte{0}, want: &no},
+		{name: "wrong-length", value: []byte{1, 0}, wantProblem: true},
+		{name: "empty", value: []byte{}, wantProblem: true},
+	}
+	bit := uint32(1) << (inetdiag.INET_DIAG_SKV6ONLY - 1)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ar := &netlink.ArchivalRecord{
+				RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+				Attributes: make([][]byte, inetdiag.INET_DIAG_SKV6ONLY+1),
+			}
+			ar.Attributes[inetdiag.INET_DIAG_SKV6ONLY] = tt.value
+			_, snap, err := snapshot.Decode(ar)
+			rtx.Must(err, "Could not decode record")
+			if (snap.SKV6Only == nil) != (tt.want == nil) || (tt.want != nil && *snap.SKV6Only != *tt.want) {
+				t.Errorf("SKV6Only = %v, want %v", snap.SKV6Only, tt.want)
+			}
+			if snap.Observed&bit == 0 {
+				t.Error("SKV6ONLY should be observed")
+			}
+			if (snap.NotFullyParsed&bit != 0) != tt.wantProblem {
+				t.Errorf("NotFullyParsed = %X, wantProblem %v", snap.NotFullyParsed, tt.wantProblem)
+			}
+		})
+	}
+
+	// Absent attribute should leave the field nil.
+	ar := &netlink.ArchivalRecord{RawIDM: make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{}))}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.SKV6Only != nil {
+		t.Error("SKV6Only should be nil when absent")
+	}
+}
+
+func TestFromNetlinkMessage(t *testing.T) {
+	var json1 = `{"Header":{"Len":356,"Type":20,"Flags":2,"Seq":1,"Pid":148940},"Data":"CgEAAOpWE6cmIAAAEAMEFbM+nWqBv4ehJgf4sEANDAoAAAAAAAAAgQAAAAAdWwAAAAAAAAAAAAAAAAAAAAAAAAAAAAC13zIBBQAIAAAAAAAFAAUAIAAAAAUABgAgAAAAFAABAAAAAAAAAAAAAAAAAAAAAAAoAAcAAAAAAICiBQAAAAAAALQAAAAAAAAAAAAAAAAAAAAAAAAAAAAArAACAAEAAAAAB3gBQIoDAECcAABEBQAAuAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAUCEAAAAAAAAgIQAAQCEAANwFAACsywIAJW8AAIRKAAD///9/CgAAAJQFAAADAAAALMkAAIBwAAAAAAAALnUOAAAAAAD///////////ayBAAAAAAASfQPAAAAAADMEQAANRMAAAAAAABiNQAAxAsAAGMIAABX5AUAAAAAAAoABABjdWJpYwAAAA=="}`
+	nm := netlink.NetlinkMessage{}
+	rtx.Must(json.Unmarshal([]byte(json1), &nm), "Could not unmarshal message")
+
+	snap, err := snapshot.FromNetlinkMessage(&nm, &netlink.ExcludeConfig{Local: true})
+	rtx.Must(err, "Could not convert message")
+	if snap == nil || snap.InetDiagMsg == nil || snap.TCPInfo == nil {
+		t.Fatalf("FromNetlinkMessage() = %+v, want InetDiagMsg and TCPInfo", snap)
+	}
+	if snap.InetDiagMsg.IDiagFamily != inetdiag.AF_INET6 {
+		t.Error("IDiagFamily should be IPv6:", snap.InetDiagMsg.IDiagFamily)
+	}
+	if snap.CongestionAlgorithm != "cubic" {
+		t.Errorf("CongestionAlgorithm = %q, want cubic", snap.CongestionAlgorithm)
+	}
+
+	// The result should match the two step path.
+	ar, err := netlink.MakeArchivalRecord(&nm, nil)
+	rtx.Must(err, "Could not make record")
+	_, want, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if diff := deep.Equal(snap, want); diff != nil {
+		t.Error(diff)
+	}
+
+	// Excluded messages produce neither a snapshot nor an error.
+	ex := &netlink.ExcludeConfig{SrcPorts: map[uint16]bool{snap.InetDiagMsg.ID.SPort(): true}}
+	snap, err = snapshot.FromNetlinkMessage(&nm, ex)
+	if snap != nil || err != nil {
+		t.Errorf("FromNetlinkMessage() = %v, %v, want nil, nil", snap, err)
+	}
+}
+
+func TestDecodeClassID(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_CLASS_ID+1),
+	}
+	ar.Attributes[inetdiag.INET_DIAG_CLASS_ID] = []byte{7, 0, 0, 0}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.ClassID != 7 {
+		t.Errorf("ClassID = %d, want 7", snap.ClassID)
+	}
+	bit := uint32(1) << (inetdiag.INET_DIAG_CLASS_ID - 1)
+	if snap.Observed&bit == 0 || snap.NotFullyParsed&bit != 0 {
+		t.Errorf("Observed = %X, NotFullyParsed = %X", snap.Observed, snap.NotFullyParsed)
+	}
+}
+
+func TestPresenceAccessors(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_CLASS_ID+1),
+	}
+	// TOS and Shutdown are present, but zero.
+	ar.Attributes[inetdiag.INET_DIAG_TOS] = []byte{0, 0, 0, 0}
+	ar.Attributes[inetdiag.INET_DIAG_SHUTDOWN] = []byte{0, 0, 0, 0}
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{5, 0, 0, 0}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+
+	if v, ok := snap.TOSValue(); v != 0 || !ok {
+		t.Errorf("TOSValue() = %d, %v, want 0, true", v, ok)
+	}
+	if v, ok := snap.ShutdownValue(); v != 0 || !ok {
+		t.Errorf("ShutdownValue() = %d, %v, want 0, true", v, ok)
+	}
+	if v, ok := snap.MarkValue(); v != 5 || !ok {
+		t.Errorf("MarkValue() = %d, %v, want 5, true", v, ok)
+	}
+	if _, ok := snap.TClassValue(); ok {
+		t.Error("TClassValue() should be absent")
+	}
+	if _, ok := snap.ClassIDValue(); ok {
+		t.Error("ClassIDValue() should be absent")
+	}
+	if _, ok := snap.ProtocolValue(); ok {
+		t.Error("ProtocolValue() should be absent")
+	}
+	if snap.Has(0) || snap.Has(33) || !snap.Has(inetdiag.INET_DIAG_TOS) {
+		t.Error("Wrong result from Has")
+	}
+}
+
+func TestZeroMark(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_MARK+1),
+	}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.HasMark() || snap.MarkPresent {
+		t.Error("Mark should be absent")
+	}
+
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{0, 0, 0, 0}
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if v, ok := snap.MarkValue(); v != 0 || !ok || !snap.HasMark() || !snap.MarkPresent {
+		t.Errorf("MarkValue() = %d, %v, MarkPresent = %v, want 0, true, true", v, ok, snap.MarkPresent)
+	}
+
+	// A malformed mark is observed, but not present.
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{1, 0}
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.HasMark() || snap.MarkPresent || !snap.Has(inetdiag.INET_DIAG_MARK) {
+		t.Error("A malformed mark should not be present")
+	}
+}
+
+func TestAttribute(t *testing.T) {
+	// An attribute type beyond any that Decode knows about.
+	unknown := inetdiag.INET_DIAG_MAX + 2
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, unknown+1),
+	}
+	ar.Attributes[inetdiag.INET_DIAG_MARK] = []byte{5, 0, 0, 0}
+	ar.Attributes[unknown] = []byte{1, 2, 3}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+
+	if v, ok := snap.Attribute(unknown); !ok || !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Errorf("Attribute(%d) = %v, %v, want [1 2 3], true", unknown, v, ok)
+	}
+	if v, ok := snap.Attribute(inetdiag.INET_DIAG_MARK); !ok || !bytes.Equal(v, []byte{5, 0, 0, 0}) {
+		t.Errorf("Attribute(INET_DIAG_MARK) = %v, %v", v, ok)
+	}
+	for _, typ := range []int{-1, inetdiag.INET_DIAG_TOS, unknown + 1} {
+		if _, ok := snap.Attribute(typ); ok {
+			t.Errorf("Attribute(%d) should be absent", typ)
+		}
+	}
+}
+
+func TestDSCPAndECN(t *testing.T) {
+	tests := []struct {
+		octet uint8
+		dscp  uint8
+		ecn   uint8
+	}{
+		{octet: 0x00, dscp: 0, ecn: 0},
+		{octet: 0xB8, dscp: 46, ecn: 0}, // EF
+		{octet: 0xB9, dscp: 46, ecn: 1}, // EF, ECT(1)
+		{octet: 0x2A, dscp: 10, ecn: 2}, // AF11, ECT(0)
+		{octet: 0x03, dscp: 0, ecn: 3},  // CE
+		{octet: 0xFF, dscp: 63, ecn: 3},
+	}
+	for _, tt := range tests {
+		if got := snapshot.DSCP(tt.octet); got != tt.dscp {
+			t.Errorf("DSCP(%#x) = %d, want %d", tt.octet, got, tt.dscp)
+		}
+		if got := snapshot.ECN(tt.octet); got != tt.ecn {
+			t.Errorf("ECN(%#x) = %d, want %d", tt.octet, got, tt.ecn)
+		}
+	}
+
+	// IPv4 sockets report only TOS.
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_TCLASS+1),
+	}
+	ar.Attributes[inetdiag.INET_DIAG_TOS] = []byte{0xB9, 0, 0, 0}
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.DSCP != 46 || snap.ECN != 1 {
+		t.Errorf("DSCP, ECN = %d, %d, want 46, 1", snap.DSCP, snap.ECN)
+	}
+
+	// IPv6 sockets also report TClass, which takes precedence.
+	ar.Attributes[inetdiag.INET_DIAG_TCLASS] = []byte{0x2A, 0, 0, 0}
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.DSCP != 10 || snap.ECN != 2 {
+		t.Errorf("DSCP, ECN = %d, %d, want 10, 2", snap.DSCP, snap.ECN)
+	}
+}
+
+func TestSupportedAttributes(t *testing.T) {
+	// A well formed value for each supported attribute type.
+	sizes := map[int]uintptr{
+		inetdiag.INET_DIAG_MEMINFO:   unsafe.Sizeof(inetdiag.MemInfo{}),
+		inetdiag.INET_DIAG_INFO:      unsafe.Sizeof(tcp.LinuxTCPInfo{}),
+		inetdiag.INET_DIAG_VEGASINFO: unsafe.Sizeof(inetdiag.VegasInfo{}),
+		inetdiag.INET_DIAG_SKMEMINFO: unsafe.Sizeof(inetdiag.SocketMemInfo{}),
+		inetdiag.INET_DIAG_DCTCPINFO: unsafe.Sizeof(inetdiag.DCTCPInfo{}),
+		inetdiag.INET_DIAG_BBRINFO:   unsafe.Sizeof(inetdiag.BBRInfo{}),
+		inetdiag.INET_DIAG_MARK:      4,
+		inetdiag.INET_DIAG_PAD:       4,
+	}
+	attrs := snapshot.SupportedAttributes()
+	if len(attrs) != inetdiag.INET_DIAG_MAX-1 {
+		t.Error("Wrong number of attributes:", len(attrs))
+	}
+	for attr, supported := range attrs {
+		size, ok := sizes[attr]
+		if !ok {
+			size = 1
+		}
+		ar := &netlink.ArchivalRecord{
+			RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+			Attributes: make([][]byte, attr+1),
+		}
+		ar.Attributes[attr] = make([]byte, size)
+		label := "INET_DIAG_" + strings.ToUpper(inetdiag.InetDiagType[int32(attr)])
+		before := testutil.ToFloat64(metrics.NetlinkNotDecoded.WithLabelValues(label))
+		_, snap, err := snapshot.Decode(ar)
+		rtx.Must(err, "Could not decode record")
+		decoded := snap.NotFullyParsed == 0
+		if decoded != supported {
+			t.Errorf("SupportedAttributes()[%s] = %v, but Decode fully parsed it: %v", inetdiag.InetDiagType[int32(attr)], supported, decoded)
+		}
+		skipped := testutil.ToFloat64(metrics.NetlinkNotDecoded.WithLabelValues(label)) == before+1
+		if skipped == supported {
+			t.Errorf("SupportedAttributes()[%s] = %v, but NetlinkNotDecoded counted it: %v", label, supported, skipped)
+		}
+	}
+}
+
+func TestDecodePad(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_PAD+1),
+	}
+	ar.Attributes[inetdiag.INET_DIAG_PAD] = []byte{0, 0, 0, 0}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	before := testutil.ToFloat64(metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_PAD"))
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.NotFullyParsed != 0 {
+		t.Errorf("NotFullyParsed = %X, want 0", snap.NotFullyParsed)
+	}
+	if testutil.ToFloat64(metrics.NetlinkNotDecoded.WithLabelValues("INET_DIAG_PAD")) != before {
+		t.Error("NetlinkNotDecoded should not count INET_DIAG_PAD")
+	}
+	if logs.Len() != 0 {
+		t.Error("Unexpected log output:", logs.String())
+	}
+}
+
+func TestDecodeNonTCPInfo(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_PROTOCOL+1),
+	}
+	info := make([]byte, unsafe.Sizeof(tcp.LinuxTCPInfo{}))
+	for i := range info {
+		info[i] = byte(i)
+	}
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = info
+
+	// Without INET_DIAG_PROTOCOL, the socket is TCP.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.TCPInfo == nil {
+		t.Fatal("TCPInfo should be decoded for a TCP socket")
+	}
+
+	ar.Attributes[inetdiag.INET_DIAG_PROTOCOL] = []byte{byte(inetdiag.Protocol_IPPROTO_UDP)}
+	before := testutil.ToFloat64(metrics.NonTCPInfoCount.WithLabelValues("IPPROTO_UDP"))
+	_, snap, err = snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.TCPInfo != nil || snap.CAStateName != nil || snap.TCPOptions != nil {
+		t.Errorf("No tcp_info should be decoded for a UDP socket: %+v", snap)
+	}
+	if snap.Protocol != inetdiag.Protocol_IPPROTO_UDP {
+		t.Error("Wrong protocol:", snap.Protocol)
+	}
+	bit := uint32(1) << (inetdiag.INET_DIAG_INFO - 1)
+	if snap.Observed&bit == 0 || snap.NotFullyParsed&bit == 0 {
+		t.Errorf("Observed = %X, NotFullyParsed = %X", snap.Observed, snap.NotFullyParsed)
+	}
+	if raw, ok := snap.Attribute(inetdiag.INET_DIAG_INFO); !ok || !bytes.Equal(raw, info) {
+		t.Error("The raw INET_DIAG_INFO should still be available")
+	}
+	if testutil.ToFloat64(metrics.NonTCPInfoCount.WithLabelValues("IPPROTO_UDP")) != before+1 {
+		t.Error("The UDP INET_DIAG_INFO should have been counted")
+	}
+}
+
+func TestTCPInfoTail(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_INFO+1),
+	}
+	// A tcp_info from a newer kernel, with 16 bytes of new fields.
+	size := int(unsafe.Sizeof(tcp.LinuxTCPInfo{}))
+	info := make([]byte, size+16)
+	info[1] = 4 // CAState
+	for i := size; i < len(info); i++ {
+		info[i] = byte(i - size + 1)
+	}
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = info
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	snapshot.ResetLargeTCPInfoLog()
+
+	// The tail is only kept if requested.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.TCPInfoTail != nil {
+		t.Error("TCPInfoTail should be nil by default:", snap.TCPInfoTail)
+	}
+
+	if !strings.Contains(logs.String(), "extra fields are ignored") {
+		t.Error("The warning should say that the extra fields are ignored:", logs.String())
+	}
+
+	_, snap, err = snapshot.DecodeWith(ar, snapshot.DecodeOptions{RetainTCPInfoTail: true})
+	rtx.Must(err, "Could not decode record")
+	if snap.TCPInfo == nil || snap.TCPInfo.CAState != 4 {
+		t.Errorf("The known fields should still be decoded: %+v", snap.TCPInfo)
+	}
+	if !bytes.Equal(snap.TCPInfoTail, info[size:]) {
+		t.Errorf("TCPInfoTail = %v, want %v", snap.TCPInfoTail, info[size:])
+	}
+	// The tail is a copy, so it survives reuse of the record.
+	info[size] = 99
+	if snap.TCPInfoTail[0] != 1 {
+		t.Error("TCPInfoTail should not share the attribute's bytes")
+	}
+
+	if n := strings.Count(logs.String(), "tcp_info is 16 bytes larger"); n != 1 {
+		t.Errorf("Expected one warning with the excess length, got %d: %s", n, logs.String())
+	}
+
+	// When the tail is retained first, the warning says so.
+	logs.Reset()
+	snapshot.ResetLargeTCPInfoLog()
+	_, _, err = snapshot.DecodeWith(ar, snapshot.DecodeOptions{RetainTCPInfoTail: true})
+	rtx.Must(err, "Could not decode record")
+	if !strings.Contains(logs.String(), "extra fields are kept in TCPInfoTail") {
+		t.Error("The warning should say that the extra fields are kept:", logs.String())
+	}
+}
+
+func TestAttributeLengths(t *testing.T) {
+	ar := &netlink.ArchivalRecord{
+		RawIDM:     make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{})),
+		Attributes: make([][]byte, inetdiag.INET_DIAG_SHUTDOWN+1),
+	}
+	// A TCPInfo from a newer kernel, with fields we don't know about.
+	ar.Attributes[inetdiag.INET_DIAG_INFO] = make([]byte, unsafe.Sizeof(tcp.LinuxTCPInfo{})+16)
+	ar.Attributes[inetdiag.INET_DIAG_SHUTDOWN] = []byte{3}
+
+	// Lengths are only recorded if requested.
+	_, snap, err := snapshot.Decode(ar)
+	rtx.Must(err, "Could not decode record")
+	if snap.AttributeLengths != nil {
+		t.Error("AttributeLengths should be nil by default:", snap.AttributeLengths)
+	}
+
+	before := testutil.ToFloat64(metrics.LargeNetlinkMsgTotal.WithLabelValues("TCPInfo"))
+	_, snap, err = snapshot.DecodeWith(ar, snapshot.DecodeOptions{RecordAttributeLengths: true})
+	rtx.Must(err, "Could not decode record")
+	if testutil.ToFloat64(metrics.LargeNetlinkMsgTotal.WithLabelValues("TCPInfo")) != before+1 {
+		t.Error("The TCPInfo should have been counted as larger than the struct")
+	}
+	want := map[int]int{
+		inetdiag.INET_DIAG_INFO:     int(unsafe.Sizeof(tcp.LinuxTCPInfo{})) + 16,
+		inetdiag.INET_DIAG_SHUTDOWN: 1,
+	}
+	if diff := deep.Equal(snap.AttributeLengths, want); diff != nil {
+		t.Error("Wrong AttributeLengths", diff)
+	}
+}
+
+func TestConnectionLogs(t *testing.T) {
+	rdr := zstd.NewReader("testdata/archiveRecords.zst")
+	defer rdr.Close()
+	_, all, err := snapshot.LoadAll(netlink.NewArchiveReader(rdr))
+	rtx.Must(err, "Could not load snapshots")
+
+	groups := snapshot.GroupByCookie(all)
+	if len(groups) != 140 {
+		t.Error("Wrong number of connections:", len(groups))
+	}
+	for cookie, snaps := range groups {
+		for _, snap := range snaps {
+			if snap.InetDiagMsg.ID.Cookie() != cookie {
+				t.Fatalf("Snapshot with cookie %d grouped under %d", snap.InetDiagMsg.ID.Cookie(), cookie)
+			}
+		}
+	}
+
+	logs := snapshot.ConnectionLogs(nil, all)
+	if len(logs) != len(groups) {
+		t.Fatalf("ConnectionLogs() returned %d logs, want %d", len(logs), len(groups))
+	}
+	total := 0
+	for i := range logs {
+		total += len(logs[i].Snapshots)
+		if i > 0 && logs[i-1].Snapshots[0].InetDiagMsg.ID.Cookie() >= logs[i].Snapshots[0].InetDiagMsg.ID.Cookie() {
+			t.Error("Logs should be ordered by cookie")
+		}
+	}
+	if total != len(all) {
+		t.Errorf("ConnectionLogs() has %d snapshots, want %d", total, len(all))
+	}
+
+	// Snapshots are sorted by time, and the UUID is specific to each connection.
+	start := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(cookie uint64, sec int) *snapshot.Snapshot {
+		idm := &inetdiag.InetDiagMsg{}
+		for i := range idm.ID.IDiagCookie {
+			idm.ID.IDiagCookie[i] = byte(cookie >> (8 * uint(i)))
+		}
+		return &snapshot.Snapshot{Timestamp: start.Add(time.Duration(sec) * time.Second), InetDiagMsg: idm}
+	}
+	meta := &netlink.Metadata{UUID: "host_1553815964_00000000000003E8", Sequence: 2}
+	logs = snapshot.ConnectionLogs(meta, []*snapshot.Snapshot{snap(7, 2), {}, snap(3, 5), snap(7, 1)})
+	if len(logs) != 2 {
+		t.Fatal("Wrong number of logs:", len(logs))
+	}
+	if logs[0].Metadata.UUID != "host_1553815964_0000000000000003" || logs[1].Metadata.UUID != "host_1553815964_0000000000000007" {
+		t.Error("Wrong UUIDs:", logs[0].Metadata.UUID, logs[1].Metadata.UUID)
+	}
+	if logs[1].Metadata.Sequence != 2 || meta.UUID != "host_1553815964_00000000000003E8" {
+		t.Error("Metadata should be copied, not modified", logs[1].Metadata, meta)
+	}
+	if !logs[1].Snapshots[0].Timestamp.Equal(start.Add(time.Second)) || !logs[1].Snapshots[1].Timestamp.Equal(start.Add(2*time.Second)) {
+		t.Error("Snapshots should be sorted by time", logs[1].Snapshots)
+	}
+}
+
+func TestConnectionLog_LossRateSeries(t *testing.T) {
+	start := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(sec int, retrans uint32, segs int32) snapshot.Snapshot {
+		return snapshot.Snapshot{
+			Timestamp: start.Add(time.Duration(sec) * time.Second),
+			TCPInfo:   &tcp.LinuxTCPInfo{TotalRetrans: retrans, SegsOut: segs},
+		}
+	}
+	cl := snapshot.ConnectionLog{
+		Snapshots: []snapshot.Snapshot{
+			snap(0, 1, 10),
+			{Timestamp: start.Add(500 * time.Millisecond)}, // No TCPInfo, so skipped.
+			snap(1, 1, 110),
+			snap(2, 11, 210),
+			snap(3, 11, 210), // Idle.
+			snap(4, 14, 240),
+		},
+	}
+	want := []snapshot.LossRatePoint{
+		{Timestamp: start, LossRate: 0.1},
+		{Timestamp: start.Add(1 * time.Second), LossRate: 0},
+		{Timestamp: start.Add(2 * time.Second), LossRate: 0.1},
+		{Timestamp: start.Add(3 * time.Second), LossRate: 0},
+		{Timestamp: start.Add(4 * time.Second), LossRate: 0.1},
+	}
+	got := cl.LossRateSeries()
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	start := time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(ms int, sent, received int64) *snapshot.Snapshot {
+		return &snapshot.Snapshot{
+			Timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+			TCPInfo:   &tcp.LinuxTCPInfo{BytesSent: sent, BytesReceived: received},
+		}
+	}
+	snaps := []*snapshot.Snapshot{
+		snap(0, 1000, 100),
+		{Timestamp: start.Add(100 * time.Millisecond)}, // No TCPInfo, so skipped.
+		snap(500, 2000, 100),
+		snap(500, 3000, 100), // Same Timestamp, so skipped.
+		snap(1500, 127000, 1100),
+		snap(2500, 126000, 2100), // BytesSent decreased, so skipped.
+		snap(3500, 377000, 3100),
+	}
+	want := []snapshot.RateSample{
+		{Timestamp: start.Add(500 * time.Millisecond), Interval: 500 * time.Millisecond, SendBitsPerSec: 16000, RecvBitsPerSec: 0},
+		{Timestamp: start.Add(1500 * time.Millisecond), Interval: time.Second, SendBitsPerSec: 1000000, RecvBitsPerSec: 8000},
+		{Timestamp: start.Add(3500 * time.Millisecond), Interval: 2 * time.Second, SendBitsPerSec: 1000000, RecvBitsPerSec: 8000},
+	}
+	got := snapshot.Throughput(snaps)
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+	if len(snapshot.Throughput(snaps[:1])) != 0 {
+		t.Error("A single snapshot should have no samples")
+	}
+}
+
+func TestLoadAllFromSlice(t *testing.T) {
+	idm := make([]byte, unsafe.Sizeof(inetdiag.InetDiagMsg{}))
+	records := []*netlink.ArchivalRecord{
+		{Metadata: &netlink.Metadata{UUID: "foo"}},
+		{Timestamp: time.Date(2019, time.April, 1, 12, 0, 0, 0, time.UTC), RawIDM: idm},
+		{Timestamp: time.Date(2019, time.April, 1, 12, 0, 1, 0, time.UTC), RawIDM: idm},
+	}
+	meta, all, err := snapshot.LoadAll(netlink.NewSliceReader(records))
+	rtx.Must(err, "Could not load snapshots")
+	if meta == nil || meta.UUID != "foo" {
+		t.Error("Wrong metadata", meta)
+	}
+	if len(all) != 3 {
+		t.Fatal("Expected 3 snapshots, got", len(all))
+	}
+	if !all[2].Timestamp.Equal(records[2].Timestamp) {
+		t.Error("Wrong timestamp", all[2].Timestamp)
+	}
+}
+
+func TestSnapshot_LimitedFractions(t *testing.T) {
+	tests := []struct {
+		name       string
+		info       *tcp.LinuxTCPInfo
+		wantRWnd   float64
+		wantSndBuf float64
+		wantOK     bool
+	}{
+		{
+			name:       "limited",
+			info:       &tcp.LinuxTCPInfo{BusyTime: 1000, RWndLimited: 250, SndBufLimited: 500},
+			wantRWnd:   0.25,
+			wantSndBuf: 0.5,
+			wantOK:     true,
+		},
+		{
+			name:   "zero-busy-time",
+			info:   &tcp.LinuxTCPInfo{RWndLimited: 250, SndBufLimited: 500},
+			wantOK: false,
+		},
+		{
+			name:   "no-tcpinfo",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &snapshot.Snapshot{TCPInfo: tt.info}
+			rwnd, ok := s.RWndLimitedFraction()
+			if rwnd != tt.wantRWnd || ok != tt.wantOK {
+				t.Errorf("RWndLimitedFraction() = %v, %v, want %v, %v", rwnd, ok, tt.wantRWnd, tt.wantOK)
+			}
+			sndbuf, ok := s.SndBufLimitedFraction()
+			if sndbuf != tt.wantSndBuf || ok != tt.wantOK {
+				t.Errorf("SndBufLimitedFraction() = %v, %v, want %v, %v", sndbuf, ok, tt.wantSndBuf, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSnapshot_SamplingInterval(t *testing.T) {
+	snap := func(dataSent, dataRecv, ackRecv uint32) *snapshot.Snapshot {
+		return &snapshot.Snapshot{TCPInfo: &tcp.LinuxTCPInfo{LastDataSent: dataSent, LastDataRecv: dataRecv, LastAckRecv: ackRecv}}
+	}
+	tests := []struct {
+		name       string
+		prev, curr *snapshot.Snapshot
+		want       time.Duration
+		wantOK     bool
+	}{
+		{"idle", snap(100, 200, 300), snap(110, 210, 310), 10 * time.Millisecond, true},
+		{"sending", snap(5, 200, 300), snap(2, 210, 1), 10 * time.Millisecond, true},
+		// Data was received part way through the interval, so it underestimates.
+		{"partial", snap(100, 200, 300), snap(110, 204, 310), 10 * time.Millisecond, true},
+		{"all-active", snap(100, 200, 300), snap(1, 2, 3), 0, false},
+		// LastDataSent wrapped around, and looks like new activity.
+		{"wrapped", snap(math.MaxUint32-5, 200, 300), snap(4, 210, 310), 10 * time.Millisecond, true},
+		{"no-prev-tcpinfo", &snapshot.Snapshot{}, snap(1, 2, 3), 0, false},
+		{"no-tcpinfo", snap(1, 2, 3), &snapshot.Snapshot{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.curr.SamplingInterval(tt.prev)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("SamplingInterval() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	gaps, ok := snap(1, 2, 3).ActivityGaps()
+	want := snapshot.ActivityGaps{DataSent: time.Millisecond, DataRecv: 2 * time.Millisecond, AckRecv: 3 * time.Millisecond}
+	if !ok || gaps != want {
+		t.Errorf("ActivityGaps() = %+v, %v, want %+v", gaps, ok, want)
+	}
+	if _, ok := (&snapshot.Snapshot{}).ActivityGaps(); ok {
+		t.Error("ActivityGaps() should fail without TCPInfo")
+	}
+}
+
+func TestLoadAllLenient(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst")
+	data, err := io.ReadAll(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+
+	// Corrupt a single line in the middle of the file.
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[10] = []byte("{\"Timestamp\": garbage}\n")
+	corrupt := bytes.Join(lines, nil)
+
+	_, _, err = snapshot.LoadAll(netlink.NewArchiveReader(bytes.NewReader(corrupt)))
+	if err == nil {
+		t.Error("LoadAll should fail on corrupt input")
+	}
+
+	meta, all, err := snapshot.LoadAllLenient(netlink.NewArchiveReader(bytes.NewReader(corrupt)))
+	if meta == nil {
+		t.Error("No metadata")
+	}
+	if len(all) != 150 {
+		t.Error("Wrong count:", len(all))
+	}
+	skipped, ok := err.(*netlink.SkippedRecordsError)
+	if !ok || skipped.Count != 1 {
+		t.Errorf("LoadAllLenient() error = %v, want 1 skipped record", err)
+	}
+
+	_, all, err = snapshot.LoadAllLenient(netlink.NewArchiveReader(bytes.NewReader(data)))
+	if err != nil || len(all) != 151 {
+		t.Errorf("LoadAllLenient() = %d, %v, want 151, nil", len(all), err)
+	}
+}
+
+func TestDecodeLine(t *testing.T) {
+	rdr := zstd.NewReader("testdata/ndt-jdczh_1553815964_00000000000003E8.00185.jsonl.zst")
+	data, err := io.ReadAll(rdr)
+	rdr.Close()
+	rtx.Must(err, "Could not read test data")
+	wantMeta, all, err := snapshot.LoadAll(netlink.NewArchiveReader(bytes.NewReader(data)))
+	rtx.Must(err, "Could not load snapshots")
+
+	lines := bytes.SplitAfter(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != len(all) {
+		t.Fatalf("Got %d lines, and %d snapshots", len(lines), len(all))
+	}
+	// The header line has only Metadata.
+	meta, snap, err := snapshot.DecodeLine(lines[0])
+	if err != nil || snap != nil {
+		t.Errorf("DecodeLine(header) = %v, %v, want a nil Snapshot", snap, err)
+	}
+	if diff := deep.Equal(meta, wantMeta); diff != nil {
+		t.Error("Wrong Metadata", diff)
+	}
+	// Data lines decode to the same Snapshots as LoadAll.
+	for i, line := range lines[1:] {
+		meta, snap, err := snapshot.DecodeLine(line)
+		if err != nil || meta != nil || snap == nil {
+			t.Fatalf("DecodeLine(line %d) = %v, %v, %v", i+1, meta, snap, err)
+		}
+		if diff := deep.Equal(snap, all[i+1]); diff != nil {
+			t.Errorf("Line %d: %v", i+1, diff)
+		}
+	}
+
+	if _, _, err := snapshot.DecodeLine([]byte(`{"Timestamp": garbage}`)); err == nil {
+		t.Error("DecodeLine should fail on invalid JSON")
+	}
+	if _, _, err := snapshot.DecodeLine([]byte(`{}`)); err != snapshot.ErrEmptyRecord {
+		t.Errorf("DecodeLine({}) error = %v, want ErrEmptyRecord", err)
+	}
+}
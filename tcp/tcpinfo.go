@@ -2,7 +2,10 @@
 // constants.
 package tcp
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // State is the enumeration of TCP states.
 // https://datatracker.ietf.org/doc/draft-ietf-tcpm-rfc793bis/
@@ -29,6 +32,10 @@ const (
 // AllFlags includes flag bits for all TCP connection states. It corresponds to TCPF_ALL in some linux code.
 const AllFlags = 0xFFF
 
+// DefaultFlags includes flag bits for the TCP states collected by default, which is
+// every state except SYN_RECV, TIME_WAIT, and CLOSE.
+const DefaultFlags = AllFlags &^ (1<<SYN_RECV | 1<<TIME_WAIT | 1<<CLOSE)
+
 var stateName = map[State]string{
 	0:  "INVALID",
 	1:  "ESTABLISHED",
@@ -52,6 +59,132 @@ func (x State) String() string {
 	return s
 }
 
+// NamedState is a State that is marshaled as its name, e.g. "ESTABLISHED", in
+// JSON, text and CSV output.  State itself is still marshaled as a number, so
+// that existing consumers are not affected.
+type NamedState State
+
+func (x NamedState) String() string {
+	return State(x).String()
+}
+
+// MarshalText marshals the state name.  It is also used for JSON.
+func (x NamedState) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+// UnmarshalText parses a state name, as produced by MarshalText.
+func (x *NamedState) UnmarshalText(text []byte) error {
+	name := string(text)
+	for state, s := range stateName {
+		if s == name {
+			*x = NamedState(state)
+			return nil
+		}
+	}
+	var n int32
+	if _, err := fmt.Sscanf(name, "UNKNOWN_STATE_%d", &n); err == nil {
+		*x = NamedState(n)
+		return nil
+	}
+	return fmt.Errorf("unknown TCP state %q", name)
+}
+
+// MarshalCSV marshals the state name to CSV.
+func (x *NamedState) MarshalCSV() (string, error) {
+	return x.String(), nil
+}
+
+// ParseStateFlags converts a comma separated list of state names, e.g.
+// "ESTABLISHED,TIME_WAIT", or "all", into the corresponding flag bits, suitable
+// for the idiag_states field of an inet_diag request.  Names are not case
+// sensitive.
+func ParseStateFlags(names string) (uint32, error) {
+	if strings.EqualFold(strings.TrimSpace(names), "all") {
+		return AllFlags, nil
+	}
+	var flags uint32
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		found := false
+		for state, s := range stateName {
+			if s == name && state != INVALID {
+				flags |= 1 << uint(state)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown TCP state %q", name)
+		}
+	}
+	return flags, nil
+}
+
+// CAState is the enumeration of TCP congestion avoidance states, from
+// enum tcp_ca_state in include/net/tcp.h.
+type CAState uint8
+
+// These names are also inherited from the linux kernel.
+const (
+	TCP_CA_Open     CAState = 0
+	TCP_CA_Disorder CAState = 1
+	TCP_CA_CWR      CAState = 2
+	TCP_CA_Recovery CAState = 3
+	TCP_CA_Loss     CAState = 4
+)
+
+var caStateName = map[CAState]string{
+	0: "Open",
+	1: "Disorder",
+	2: "CWR",
+	3: "Recovery",
+	4: "Loss",
+}
+
+func (x CAState) String() string {
+	s, ok := caStateName[x]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN_CA_STATE_%d", x)
+	}
+	return s
+}
+
+// NamedCAState is a CAState that is marshaled as its name, e.g. "Recovery", in
+// JSON, text and CSV output, like NamedState.
+type NamedCAState CAState
+
+func (x NamedCAState) String() string {
+	return CAState(x).String()
+}
+
+// MarshalText marshals the congestion avoidance state name.  It is also used for JSON.
+func (x NamedCAState) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+// UnmarshalText parses a congestion avoidance state name, as produced by MarshalText.
+func (x *NamedCAState) UnmarshalText(text []byte) error {
+	name := string(text)
+	for state, s := range caStateName {
+		if s == name {
+			*x = NamedCAState(state)
+			return nil
+		}
+	}
+	var n uint8
+	if _, err := fmt.Sscanf(name, "UNKNOWN_CA_STATE_%d", &n); err == nil {
+		*x = NamedCAState(n)
+		return nil
+	}
+	return fmt.Errorf("unknown congestion avoidance state %q", name)
+}
+
+// MarshalCSV marshals the congestion avoidance state name to CSV.
+func (x *NamedCAState) MarshalCSV() (string, error) {
+	return x.String(), nil
+}
+
 // LinuxTCPInfo is the linux defined structure returned in RouteAttr DIAG_INFO messages.
 // It corresponds to the struct tcp_info in
 // https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/uapi/linux/tcp.h
@@ -77,8 +210,8 @@ type LinuxTCPInfo struct {
 	Fackets uint32 `csv:"TCP.Fackets"`
 
 	/* Times. */
-	// These seem to be elapsed time, so they increase on almost every sample.
-	// We can probably use them to get more info about intervals between samples.
+	// These are elapsed times in milliseconds since the last event of each kind, so
+	// they increase on almost every sample.  See snapshot.Snapshot.SamplingInterval.
 	LastDataSent uint32 `csv:"TCP.LastDataSent"` // offset 44
 	LastAckSent  uint32 `csv:"TCP.LastAckSent"`  /* Not remembered, sorry. */ // offset 48
 	LastDataRecv uint32 `csv:"TCP.LastDataRecv"` // offset 52
@@ -134,3 +267,69 @@ type LinuxTCPInfo struct {
 
 	SndWnd uint32 `csv:"TCP.SndWnd"` /* peer's advertised receive window after scaling (bytes) */
 }
+
+// The bits of LinuxTCPInfo.Options, from the TCPI_OPT_* definitions in
+// include/uapi/linux/tcp.h.
+const (
+	TCPI_OPT_TIMESTAMPS uint8 = 1
+	TCPI_OPT_SACK       uint8 = 2
+	TCPI_OPT_WSCALE     uint8 = 4
+	TCPI_OPT_ECN        uint8 = 8  // ECN was negotiated at TCP session init
+	TCPI_OPT_ECN_SEEN   uint8 = 16 // we received at least one packet with ECT
+	TCPI_OPT_SYN_DATA   uint8 = 32 // SYN-ACK acked data in SYN sent or rcvd
+)
+
+// TimestampsEnabled returns true if the TCP timestamps option was negotiated.
+func (info *LinuxTCPInfo) TimestampsEnabled() bool {
+	return info.Options&TCPI_OPT_TIMESTAMPS != 0
+}
+
+// SACKEnabled returns true if selective acknowledgements were negotiated.
+func (info *LinuxTCPInfo) SACKEnabled() bool {
+	return info.Options&TCPI_OPT_SACK != 0
+}
+
+// WScaleEnabled returns true if window scaling was negotiated.  The scale
+// factors are given by SndWScale and RcvWScale.
+func (info *LinuxTCPInfo) WScaleEnabled() bool {
+	return info.Options&TCPI_OPT_WSCALE != 0
+}
+
+// ECNEnabled returns true if ECN was negotiated at connection setup.
+func (info *LinuxTCPInfo) ECNEnabled() bool {
+	return info.Options&TCPI_OPT_ECN != 0
+}
+
+// ECNSeen returns true if at least one packet with an ECN capable transport
+// codepoint has been received.
+func (info *LinuxTCPInfo) ECNSeen() bool {
+	return info.Options&TCPI_OPT_ECN_SEEN != 0
+}
+
+// FastOpenEnabled returns true if data in the SYN was acknowledged, i.e. TCP
+// Fast Open was used.
+func (info *LinuxTCPInfo) FastOpenEnabled() bool {
+	return info.Options&TCPI_OPT_SYN_DATA != 0
+}
+
+// SndWScale returns the send window scale, from the low 4 bits of WScale.
+func (info *LinuxTCPInfo) SndWScale() uint8 {
+	return info.WScale & 0x0F
+}
+
+// RcvWScale returns the receive window scale, from the high 4 bits of WScale.
+func (info *LinuxTCPInfo) RcvWScale() uint8 {
+	return info.WScale >> 4
+}
+
+// CongestionAvoidanceState returns CAState, the congestion avoidance state, as a
+// CAState.
+func (info *LinuxTCPInfo) CongestionAvoidanceState() CAState {
+	return CAState(info.CAState)
+}
+
+// IsAppLimited returns the delivery_rate_app_limited bit, which indicates that the
+// DeliveryRate was limited by the application, rather than the network.
+func (info *LinuxTCPInfo) IsAppLimited() bool {
+	return info.AppLimited&0x01 != 0
+}
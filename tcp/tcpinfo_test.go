@@ -1,6 +1,7 @@
 package tcp_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/m-lab/tcp-info/tcp"
@@ -35,3 +36,183 @@ func TestState_String(t *testing.T) {
 		})
 	}
 }
+
+func TestParseStateFlags(t *testing.T) {
+	tests := []struct {
+		names   string
+		want    uint32
+		wantErr bool
+	}{
+		{names: "all", want: tcp.AllFlags},
+		{names: "ALL", want: tcp.AllFlags},
+		{names: "ESTABLISHED", want: 1 << tcp.ESTABLISHED},
+		{names: "established, time_wait", want: 1<<tcp.ESTABLISHED | 1<<tcp.TIME_WAIT},
+		{names: "ESTABLISHED,SYN_SENT,FIN_WAIT1,FIN_WAIT2,CLOSE_WAIT,LAST_ACK,LISTEN,CLOSING", want: tcp.DefaultFlags &^ 1},
+		{names: "ESTABLISHED,BOGUS", wantErr: true},
+		{names: "INVALID", wantErr: true},
+		{names: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.names, func(t *testing.T) {
+			got, err := tcp.ParseStateFlags(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseStateFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseStateFlags() = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCAState_String(t *testing.T) {
+	tests := []struct {
+		in   tcp.CAState
+		want string
+	}{
+		{tcp.TCP_CA_Open, "Open"},
+		{tcp.TCP_CA_Disorder, "Disorder"},
+		{tcp.TCP_CA_CWR, "CWR"},
+		{tcp.TCP_CA_Recovery, "Recovery"},
+		{tcp.TCP_CA_Loss, "Loss"},
+		{tcp.CAState(99), "UNKNOWN_CA_STATE_99"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.in.String(); got != tt.want {
+				t.Errorf("CAState.String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinuxTCPInfo_BitFields(t *testing.T) {
+	tests := []struct {
+		name           string
+		info           tcp.LinuxTCPInfo
+		wantSnd        uint8
+		wantRcv        uint8
+		wantAppLimited bool
+	}{
+		{name: "zero"},
+		{name: "snd-7-rcv-9", info: tcp.LinuxTCPInfo{WScale: 0x97}, wantSnd: 7, wantRcv: 9},
+		{name: "max", info: tcp.LinuxTCPInfo{WScale: 0xFF, AppLimited: 0x01}, wantSnd: 15, wantRcv: 15, wantAppLimited: true},
+		// The other bits in the AppLimited byte hold tcpi_fastopen_client_fail.
+		{name: "fastopen-bits", info: tcp.LinuxTCPInfo{AppLimited: 0x06}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.SndWScale(); got != tt.wantSnd {
+				t.Errorf("SndWScale() = %v, want %v", got, tt.wantSnd)
+			}
+			if got := tt.info.RcvWScale(); got != tt.wantRcv {
+				t.Errorf("RcvWScale() = %v, want %v", got, tt.wantRcv)
+			}
+			if got := tt.info.IsAppLimited(); got != tt.wantAppLimited {
+				t.Errorf("IsAppLimited() = %v, want %v", got, tt.wantAppLimited)
+			}
+		})
+	}
+}
+
+func TestLinuxTCPInfo_Options(t *testing.T) {
+	// The reference values are the TCPI_OPT_* bits, as decoded by the old
+	// nl-proto convert.go into TsOpt, SackOpt, WscaleOpt, EcnOpt, EcnseenOpt
+	// and FastopenOpt.
+	tests := []struct {
+		name    string
+		options uint8
+		want    [6]bool // Timestamps, SACK, WScale, ECN, ECNSeen, FastOpen
+	}{
+		{name: "none"},
+		{name: "timestamps", options: 0x01, want: [6]bool{true, false, false, false, false, false}},
+		{name: "sack", options: 0x02, want: [6]bool{false, true, false, false, false, false}},
+		{name: "wscale", options: 0x04, want: [6]bool{false, false, true, false, false, false}},
+		{name: "ecn", options: 0x08, want: [6]bool{false, false, false, true, false, false}},
+		{name: "ecnseen", options: 0x10, want: [6]bool{false, false, false, false, true, false}},
+		{name: "fastopen", options: 0x20, want: [6]bool{false, false, false, false, false, true}},
+		{name: "typical", options: 0x07, want: [6]bool{true, true, true, false, false, false}},
+		// Newer kernels use the high bits for TCPI_OPT_USEC_TS and TCPI_OPT_TFO_CHILD.
+		{name: "all", options: 0xFF, want: [6]bool{true, true, true, true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := tcp.LinuxTCPInfo{Options: tt.options}
+			got := [6]bool{info.TimestampsEnabled(), info.SACKEnabled(), info.WScaleEnabled(),
+				info.ECNEnabled(), info.ECNSeen(), info.FastOpenEnabled()}
+			if got != tt.want {
+				t.Errorf("Options %#x decoded as %v, want %v", tt.options, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamedState(t *testing.T) {
+	type record struct {
+		State tcp.State
+		Name  tcp.NamedState
+	}
+	b, err := json.Marshal(record{tcp.FIN_WAIT2, tcp.NamedState(tcp.FIN_WAIT2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// State is unchanged, for compatibility.
+	if string(b) != `{"State":5,"Name":"FIN_WAIT2"}` {
+		t.Error("Wrong JSON:", string(b))
+	}
+
+	for _, state := range []tcp.NamedState{0, 1, 11, 42} {
+		text, err := state.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got tcp.NamedState
+		if err := got.UnmarshalText(text); err != nil || got != state {
+			t.Errorf("UnmarshalText(%q) = %v, %v, want %v", text, got, err, state)
+		}
+	}
+	var got tcp.NamedState
+	if err := json.Unmarshal([]byte(`"BOGUS"`), &got); err == nil {
+		t.Error("Unmarshaling an unknown state name should fail")
+	}
+	s := tcp.NamedState(tcp.LISTEN)
+	if csv, _ := s.MarshalCSV(); csv != "LISTEN" {
+		t.Error("Wrong CSV:", csv)
+	}
+}
+
+func TestNamedCAState(t *testing.T) {
+	tests := []struct {
+		raw  uint8
+		want string
+	}{
+		{0, "Open"},
+		{1, "Disorder"},
+		{2, "CWR"},
+		{3, "Recovery"},
+		{4, "Loss"},
+		{5, "UNKNOWN_CA_STATE_5"},
+		{255, "UNKNOWN_CA_STATE_255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			info := tcp.LinuxTCPInfo{CAState: tt.raw}
+			state := tcp.NamedCAState(info.CongestionAvoidanceState())
+			if got, _ := state.MarshalCSV(); got != tt.want {
+				t.Errorf("MarshalCSV() = %v, want %v", got, tt.want)
+			}
+			text, err := state.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got tcp.NamedCAState
+			if err := got.UnmarshalText(text); err != nil || got != state {
+				t.Errorf("UnmarshalText(%q) = %v, %v, want %v", text, got, err, state)
+			}
+		})
+	}
+	var got tcp.NamedCAState
+	if err := json.Unmarshal([]byte(`"BOGUS"`), &got); err == nil {
+		t.Error("Unmarshaling an unknown state name should fail")
+	}
+}
@@ -3,6 +3,7 @@ package zstd_test
 import (
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"testing"
 
@@ -54,3 +55,38 @@ func TestWriterReader(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamReader(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestStreamReader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	w, err := zstd.NewWriter(tmpdir + "/test.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := os.Open(tmpdir + "/test.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := zstd.NewStreamReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abcd" {
+		t.Errorf("%q != \"abcd\"", string(b))
+	}
+}
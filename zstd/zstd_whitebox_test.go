@@ -1,11 +1,15 @@
 package zstd
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/m-lab/go/rtx"
 )
 
@@ -48,3 +52,127 @@ func TestZstdFailure(t *testing.T) {
 		t.Error("Closing the pipe twice is not a failure?")
 	}
 }
+
+// withBackend runs f with the pure Go backend selected if goBackend is true.
+func withBackend(goBackend bool, f func()) {
+	orig := useGo
+	useGo = goBackend
+	defer func() { useGo = orig }()
+	f()
+}
+
+func TestGoBackendCompatibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestGoBackendCompatibility")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte((i * 37) % 256)
+	}
+	// Each backend must be able to read the output of both backends.
+	for _, writeGo := range []bool{false, true} {
+		for _, readGo := range []bool{false, true} {
+			fn := fmt.Sprintf("%s/%v-%v.zst", dir, writeGo, readGo)
+			withBackend(writeGo, func() {
+				w, err := NewWriter(fn)
+				rtx.Must(err, "Could not create writer")
+				_, err = w.Write(data)
+				rtx.Must(err, "Could not write")
+				rtx.Must(w.Close(), "Could not close writer")
+			})
+			withBackend(readGo, func() {
+				r := NewReader(fn)
+				defer r.Close()
+				read, err := ioutil.ReadAll(r)
+				rtx.Must(err, "Could not read")
+				if !bytes.Equal(read, data) {
+					t.Errorf("Data mismatch, written with go=%v and read with go=%v", writeGo, readGo)
+				}
+			})
+		}
+	}
+
+	withBackend(true, func() {
+		if _, err := NewWriter("/this/file/is/uncreateable"); err == nil {
+			t.Error("Should have had an error on an uncreateable file")
+		}
+	})
+}
+
+func TestSyncWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSyncWriter")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte((i * 37) % 256)
+	}
+	for _, goBackend := range []bool{false, true} {
+		fn := fmt.Sprintf("%s/%v.zst", dir, goBackend)
+		var f *os.File
+		withBackend(goBackend, func() {
+			w, err := NewSyncWriter(fn)
+			rtx.Must(err, "Could not create writer")
+			_, err = w.Write(data)
+			rtx.Must(err, "Could not write")
+			rtx.Must(w.Close(), "Could not close writer")
+			switch w := w.(type) {
+			case waitingWriteCloser:
+				f = w.f
+			case goWriteCloser:
+				f = w.f
+			}
+		})
+		if f == nil || !errors.Is(f.Sync(), os.ErrClosed) {
+			t.Errorf("The file should be closed, written with go=%v", goBackend)
+		}
+		// Once Close returns, the file must hold the complete compressed data.
+		compressed, err := ioutil.ReadFile(fn)
+		rtx.Must(err, "Could not read %s", fn)
+		d, err := zstd.NewReader(nil)
+		rtx.Must(err, "Could not create decoder")
+		read, err := d.DecodeAll(compressed, nil)
+		d.Close()
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("Data mismatch, written with go=%v: %v", goBackend, err)
+		}
+	}
+}
+
+// benchmarkWriter compresses the jsonl test data with the selected backend, and
+// reports the compressed size.
+func benchmarkWriter(b *testing.B, goBackend bool) {
+	src, err := os.Open("../netlink/testdata/ndt-7hhhv_1559749627_0000000000062D84.00000.jsonl.zst")
+	rtx.Must(err, "Could not open test data")
+	defer src.Close()
+	d, err := zstd.NewReader(src)
+	rtx.Must(err, "Could not decompress test data")
+	data, err := ioutil.ReadAll(d)
+	rtx.Must(err, "Could not read test data")
+	d.Close()
+
+	dir, err := ioutil.TempDir("", "BenchmarkWriter")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	fn := dir + "/bench.zst"
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	withBackend(goBackend, func() {
+		for i := 0; i < b.N; i++ {
+			w, err := NewWriter(fn)
+			rtx.Must(err, "Could not create writer")
+			w.Write(data)
+			rtx.Must(w.Close(), "Could not close writer")
+		}
+	})
+	b.StopTimer()
+	info, err := os.Stat(fn)
+	rtx.Must(err, "Could not stat output")
+	b.ReportMetric(float64(info.Size()), "compressed-B")
+}
+
+func BenchmarkWriterExec(b *testing.B) { benchmarkWriter(b, false) }
+func BenchmarkWriterGo(b *testing.B)   { benchmarkWriter(b, true) }